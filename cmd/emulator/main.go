@@ -1,18 +1,60 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io/fs"
 	"log/slog"
+	"os"
+	"os/signal"
 
+	"github.com/Keisim/go-riscv-emu/pkg/calltrace"
+	"github.com/Keisim/go-riscv-emu/pkg/coverage"
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
 	"github.com/Keisim/go-riscv-emu/pkg/loader"
+	"github.com/Keisim/go-riscv-emu/pkg/profiler"
+	"github.com/Keisim/go-riscv-emu/pkg/replay"
 	"github.com/Keisim/go-riscv-emu/pkg/system"
+
+	// Registers the virtio device types for -machine.
+	_ "github.com/Keisim/go-riscv-emu/pkg/virtio"
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run executes the emulator and returns the process exit code.
+func run() int {
 	debug := flag.Bool("debug", false, "Enable debug logging")
 	elfPath := flag.String("elf", "misc/c/empty_main.o", "Path to the ELF file to load")
-	steps := flag.Int("steps", 0, "Number of steps to execute (0 for infinite, default)")
+	steps := flag.Int("steps", 0, "Number of steps to execute on every hart (0 for infinite, default)")
 	dummyTTY := flag.Bool("dummy-tty", false, "Enable Dummy TTY device")
+	engineName := flag.String("engine", "interpreter", "Execution engine to use (interpreter or block)")
+	harts := flag.Int("harts", 1, "Number of harts sharing the bus")
+	scheduleName := flag.String("schedule", "roundrobin", "Hart scheduling mode (roundrobin or parallel)")
+	quantum := flag.Uint64("quantum", system.DefaultQuantum, "Instructions per hart before switching harts in roundrobin mode")
+	snapshotSave := flag.String("snapshot-save", "", "Path of the snapshot file to save at step -snapshot-at")
+	snapshotAt := flag.Uint64("snapshot-at", 0, "Step at which the snapshot is saved")
+	snapshotLoad := flag.String("snapshot-load", "", "Path of a snapshot file to resume from instead of loading the ELF file")
+	recordPath := flag.String("record", "", "Path of an input log recording the host input reads and interrupts of the guest")
+	replayPath := flag.String("replay", "", "Path of an input log to replay host input from")
+	profilePath := flag.String("profile", "", "Path of a pprof profile of the guest code written when the emulator exits")
+	coveragePath := flag.String("coverage", "", "Path of an lcov coverage file of the guest code written when the emulator exits")
+	coverageMerge := flag.Bool("coverage-merge", false, "Add the coverage to the existing -coverage file instead of replacing it")
+	callTracePath := flag.String("calltrace", "", "Path of a file to print the tree of guest function calls to (- for standard output)")
+	callTraceFilter := flag.String("calltrace-filter", "", "Glob pattern of the function names shown by -calltrace")
+	statsFormat := flag.String("stats", "", "Print execution statistics when the emulator exits (table or json)")
+	machinePath := flag.String("machine", "", "Path of a JSON machine configuration replacing -harts and -dummy-tty")
+	loadFDT := flag.Bool("fdt", false, "Place a device tree of the machine at the end of RAM and pass its address in a1")
+	dumpFDT := flag.String("dump-fdt", "", "Path of a file to write the device tree blob of the machine to")
+	biosPath := flag.String("bios", "", "Path of firmware to load at the start of RAM and run instead of the ELF file")
+	kernelPath := flag.String("kernel", "", "Path of a Linux kernel Image to load after the -bios firmware, or to run instead of the ELF file")
+	initrdPath := flag.String("initrd", "", "Path of an initramfs passed to the -kernel")
+	bootargs := flag.String("append", "", "Kernel command line in the device tree")
+	vncPort := flag.Int("vnc", 0, "Port on localhost to serve the framebuffer and virtio-input devices over VNC on")
+	monitorMode := flag.Bool("monitor", false, "Start the interactive monitor instead of running -steps instructions")
 	flag.Parse()
 
 	if *debug {
@@ -21,21 +63,398 @@ func main() {
 
 	slog.Info("Starting RISC-V RV32I Emulator")
 	slog.Info("Initializing system and loading ELF file", "path", *elfPath)
-	system := system.NewSystem(*dummyTTY)
-	err := loader.LoadELFToSystem(*elfPath, system)
+	schedule, err := system.ParseSchedulingMode(*scheduleName)
 	if err != nil {
-		slog.Error("Failed to load ELF file:", "error", err)
-		return
+		slog.Error("Invalid scheduling mode:", "error", err)
+		return 1
 	}
-	slog.Info("Emulator initialized with ELF file. Starting execution...")
-
-	if *steps == 0 {
-		for {
-			system.Step()
+	if *harts < 1 {
+		slog.Error("Invalid number of harts:", "harts", *harts)
+		return 1
+	}
+	config := system.DefaultMachineConfig(*dummyTTY, *harts)
+	if *machinePath != "" {
+		if flagSet("harts") || flagSet("dummy-tty") {
+			slog.Error("-machine cannot be combined with -harts and -dummy-tty")
+			return 1
+		}
+		config, err = system.LoadMachineConfig(*machinePath)
+		if err != nil {
+			slog.Error("Invalid machine configuration:", "error", err)
+			return 1
+		}
+	}
+	system, err := system.NewMachine(config)
+	if err != nil {
+		slog.Error("Failed to create machine:", "error", err)
+		return 1
+	}
+	defer system.Close()
+	system.SetScheduling(schedule, *quantum)
+	if *snapshotLoad != "" {
+		slog.Info("Resuming from snapshot", "path", *snapshotLoad)
+		err = system.LoadSnapshotFile(*snapshotLoad)
+		if err != nil {
+			slog.Error("Failed to load snapshot:", "error", err)
+			return 1
+		}
+	} else if *biosPath != "" || *kernelPath != "" {
+		if flagSet("elf") {
+			slog.Error("-elf cannot be combined with -bios and -kernel")
+			return 1
+		}
+		info, err := loader.Boot(system, loader.BootConfig{
+			Firmware: *biosPath,
+			Kernel:   *kernelPath,
+			Initrd:   *initrdPath,
+			Bootargs: *bootargs,
+		})
+		if err != nil {
+			slog.Error("Failed to boot:", "error", err)
+			return 1
 		}
+		slog.Info("Loaded boot images", "entry", info.Entry, "kernel",
+			info.Kernel, "initrd", info.Initrd, "fdt", info.DeviceTree)
 	} else {
-		for i := 0; i < *steps; i++ {
-			system.Step()
+		err = loader.LoadELFToSystem(*elfPath, system)
+		if err != nil {
+			slog.Error("Failed to load ELF file:", "error", err)
+			return 1
+		}
+		if *loadFDT {
+			address, err := system.LoadDeviceTree(*bootargs)
+			if err != nil {
+				slog.Error("Failed to load device tree:", "error", err)
+				return 1
+			}
+			slog.Info("Loaded device tree", "address", address)
+		}
+	}
+	if *dumpFDT != "" {
+		err := os.WriteFile(*dumpFDT, system.DeviceTreeBlob(*bootargs), 0o644)
+		if err != nil {
+			slog.Error("Failed to write device tree:", "error", err)
+			return 1
+		}
+	}
+	if *vncPort != 0 {
+		if err := startVNC(system, *vncPort); err != nil {
+			slog.Error("Failed to start VNC server:", "error", err)
+			return 1
+		}
+	}
+
+	engine, err := cpu.ParseEngine(*engineName)
+	if err != nil {
+		slog.Error("Invalid execution engine:", "error", err)
+		return 1
+	}
+	if *statsFormat != "" {
+		if err := checkStatsFormat(*statsFormat); err != nil {
+			slog.Error("Invalid statistics format:", "error", err)
+			return 1
+		}
+		system.EnableStats()
+		defer func() {
+			err := writeStats(os.Stderr, system.Stats(), *statsFormat)
+			if err != nil {
+				slog.Error("Failed to write statistics:", "error", err)
+			}
+		}()
+	}
+	var guestProfiler *profiler.Profiler
+	if *profilePath != "" {
+		guestProfiler = profiler.New()
+		defer writeProfile(guestProfiler, system, *profilePath)
+	}
+	var guestCoverage *coverage.Coverage
+	if *coveragePath != "" {
+		guestCoverage = coverage.New()
+		defer writeCoverage(guestCoverage, system, *coveragePath,
+			*coverageMerge)
+	}
+	var callTree *calltrace.Printer
+	if *callTracePath != "" {
+		callTree, err = startCallTrace(system, *callTracePath, *callTraceFilter)
+		if err != nil {
+			slog.Error("Failed to start call trace:", "error", err)
+			return 1
+		}
+		defer func() {
+			err := callTree.Flush()
+			if err != nil {
+				slog.Error("Failed to write call trace:", "error", err)
+			}
+		}()
+	}
+	for _, hart := range system.Harts() {
+		hart.SetEngine(engine)
+		if *debug {
+			tracer := cpu.NewLogTracer(slog.Default())
+			tracer.SetSymbolizer(system.Symbolizer())
+			hart.AddTracer(tracer)
+		}
+		if guestProfiler != nil {
+			hart.AddTracer(guestProfiler.Tracer())
+		}
+		if guestCoverage != nil {
+			hart.AddTracer(guestCoverage.Tracer())
+		}
+		if callTree != nil {
+			hart.AddTracer(callTree.Tracer())
+		}
+	}
+
+	if *recordPath != "" && *replayPath != "" {
+		slog.Error("Only one of -record and -replay can be used")
+		return 1
+	}
+	if *recordPath != "" {
+		recorder, err := startRecording(system, *recordPath)
+		if err != nil {
+			slog.Error("Failed to start recording:", "error", err)
+			return 1
+		}
+		defer func() {
+			err := recorder.Flush()
+			if err != nil {
+				slog.Error("Failed to write input log:", "error", err)
+			}
+			slog.Info("Recorded nondeterministic inputs", "events",
+				recorder.Count())
+		}()
+	}
+	if *replayPath != "" {
+		f, err := os.Open(*replayPath)
+		if err != nil {
+			slog.Error("Failed to open input log:", "error", err)
+			return 1
+		}
+		defer f.Close()
+		_, err = system.StartReplay(f)
+		if err != nil {
+			slog.Error("Failed to start replay:", "error", err)
+			return 1
 		}
 	}
+
+	if *monitorMode {
+		newMonitor(system, os.Stdout).serve(os.Stdin)
+		return 0
+	}
+
+	slog.Info("Emulator initialized with ELF file. Starting execution...",
+		"engine", engine)
+
+	if err := system.SaveResetState(); err != nil {
+		slog.Warn("Guest resets are not possible:", "error", err)
+	}
+	remaining := uint64(*steps)
+	if *snapshotSave != "" {
+		if remaining != 0 && *snapshotAt > remaining {
+			slog.Error("The snapshot step is beyond the last step:",
+				"snapshot-at", *snapshotAt, "steps", remaining)
+			return 1
+		}
+		// Run treats 0 as infinite, so a snapshot at step 0 is taken
+		// right away.
+		if *snapshotAt > 0 {
+			stop, err := runResetting(system, *snapshotAt)
+			if err != nil {
+				slog.Error("Failed to execute CPU step:", "error", err)
+				return 1
+			}
+			if stop != nil {
+				return exitCode(stop)
+			}
+		}
+		err = system.SaveSnapshotFile(*snapshotSave)
+		if err != nil {
+			slog.Error("Failed to save snapshot:", "error", err)
+			return 1
+		}
+		slog.Info("Saved snapshot", "path", *snapshotSave, "step", *snapshotAt)
+		if remaining != 0 {
+			remaining -= *snapshotAt
+			if remaining == 0 {
+				return 0
+			}
+		}
+	}
+
+	stop, interrupted, err := runInterruptible(system, remaining)
+	if err != nil {
+		slog.Error("Failed to execute CPU step:", "error", err)
+		return 1
+	}
+	if interrupted {
+		slog.Info("Interrupted")
+		return 130
+	}
+	if stop != nil {
+		return exitCode(stop)
+	}
+	return 0
+}
+
+// exitCode returns the process exit status after the guest powered the
+// machine off. Exit codes above 255 are reported as 255, as the status only
+// keeps their low 8 bits, which could make a failure look like success.
+func exitCode(stop *system.Stop) int {
+	slog.Info("Guest powered the machine off", "code", stop.ExitCode)
+	return int(min(stop.ExitCode, 255))
+}
+
+// runResetting runs the system like Run, but resets the machine to the
+// state saved by SaveResetState whenever the guest requests it and keeps
+// running until the steps have been run. It returns the stop of a power
+// off, breakpoint or watchpoint.
+func runResetting(sys *system.System, steps uint64) (*system.Stop, error) {
+	for {
+		stop, err := sys.Run(steps)
+		if err != nil || stop == nil || stop.Reason != system.StopReset {
+			return stop, err
+		}
+		if err := sys.Reset(); err != nil {
+			return nil, fmt.Errorf("failed to reset the machine: %v", err)
+		}
+		slog.Info("Guest reset the machine")
+		if steps != 0 {
+			steps -= stop.Steps
+			if steps == 0 {
+				return nil, nil
+			}
+		}
+	}
+}
+
+// flagSet reports whether the flag with the given name was set on the
+// command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// startRecording creates the input log file and starts recording into it.
+func startRecording(sys *system.System, path string) (*replay.Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	recorder, err := sys.StartRecording(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return recorder, nil
+}
+
+// startCallTrace creates the call trace file, or uses standard output for
+// "-", and returns the printer writing to it. The file is closed when the
+// process exits.
+func startCallTrace(sys *system.System, path, filter string) (*calltrace.Printer, error) {
+	out := os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	printer, err := calltrace.New(out, sys.Symbolizer(), filter)
+	if err != nil && out != os.Stdout {
+		out.Close()
+	}
+	return printer, err
+}
+
+// interruptChunk is the number of steps run between checks for Ctrl-C.
+const interruptChunk = 1 << 20
+
+// runInterruptible runs the system like runResetting, but returns early
+// with interrupted set when the emulator receives Ctrl-C, so that the input
+// log, profile, coverage and call trace are still written. Runs without a
+// step limit only end this way or when the guest powers the machine off,
+// which is returned as stop.
+func runInterruptible(sys *system.System, steps uint64) (stop *system.Stop, interrupted bool, err error) {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	for {
+		chunk := uint64(interruptChunk)
+		if steps != 0 {
+			chunk = min(chunk, steps)
+		}
+		stop, err := runResetting(sys, chunk)
+		if err != nil || stop != nil {
+			return stop, false, err
+		}
+		if steps != 0 {
+			steps -= chunk
+			if steps == 0 {
+				return nil, false, nil
+			}
+		}
+		select {
+		case <-interrupts:
+			return nil, true, nil
+		default:
+		}
+	}
+}
+
+// writeProfile writes the profile of the guest code to a file.
+func writeProfile(p *profiler.Profiler, sys *system.System, path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		slog.Error("Failed to create profile:", "error", err)
+		return
+	}
+	defer f.Close()
+	err = p.WriteProfile(f, sys.Symbolizer())
+	if err != nil {
+		slog.Error("Failed to write profile:", "error", err)
+		return
+	}
+	slog.Info("Wrote profile", "path", path, "instructions", p.Instructions())
+}
+
+// writeCoverage writes the coverage of the guest code to an lcov file. With
+// merge set, the coverage already in the file is kept and added to.
+func writeCoverage(c *coverage.Coverage, sys *system.System, path string,
+	merge bool) {
+	report := c.Report(sys.Symbolizer(), sys.ReadWord)
+	if merge {
+		f, err := os.Open(path)
+		if err == nil {
+			previous, err := coverage.ParseLCOV(f)
+			f.Close()
+			if err != nil {
+				slog.Error("Failed to read coverage:", "error", err)
+				return
+			}
+			report.Merge(previous)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Failed to open coverage:", "error", err)
+			return
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		slog.Error("Failed to create coverage:", "error", err)
+		return
+	}
+	defer f.Close()
+	err = report.WriteLCOV(f)
+	if err != nil {
+		slog.Error("Failed to write coverage:", "error", err)
+		return
+	}
+	slog.Info("Wrote coverage", "path", path, "files", len(report.Files))
 }
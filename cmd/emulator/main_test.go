@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/system"
+)
+
+// newTestMachine returns a machine with 64K of RAM and a SiFive test
+// device at 0x100000, running the program at the start of RAM.
+func newTestMachine(t *testing.T, program []uint32) *system.System {
+	t.Helper()
+	config, err := system.ParseMachineConfig(strings.NewReader(`{
+		"devices": [
+			{"type": "sifive-test", "base": "0x100000"},
+			{"type": "ram", "base": "0x80000000", "size": "64K"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("ParseMachineConfig failed: %v", err)
+	}
+	sys, err := system.NewMachine(config)
+	if err != nil {
+		t.Fatalf("NewMachine failed: %v", err)
+	}
+	for i, instruction := range program {
+		for j := range uint32(4) {
+			address := system.RAMOffset + uint32(4*i) + j
+			if err := sys.Bus().Write(address, byte(instruction>>(8*j))); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+	}
+	sys.Core().SetPc(system.RAMOffset)
+	return sys
+}
+
+// writeFinisher returns a program writing value to the SiFive test device
+// byte by byte, then spinning.
+func writeFinisher(value uint32) []uint32 {
+	program := []uint32{0x100<<12 | 5<<7 | 0b0110111} // LUI x5, 0x100
+	for i := range uint32(4) {
+		b := value >> (8 * i) & 0xFF
+		program = append(program,
+			b<<20|6<<7|0b0010011,       // ADDI x6, x0, b
+			i<<7|6<<20|5<<15|0b0100011) // SB x6, i(x5)
+	}
+	return append(program, 0b1101111) // JAL x0, 0
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		value uint32
+		code  int
+	}{
+		{0x5555, 0},
+		{3<<16 | 0x3333, 3},
+		{0x3333, 1},
+		{256<<16 | 0x3333, 255},
+		{0xFFFF<<16 | 0x3333, 255},
+	}
+	for _, test := range tests {
+		sys := newTestMachine(t, writeFinisher(test.value))
+		stop, err := runResetting(sys, 1000)
+		if err != nil || stop == nil || stop.Reason != system.StopPowerOff {
+			t.Fatalf("Expected a power off for %X, got %v, %v", test.value, stop, err)
+		}
+		if code := exitCode(stop); code != test.code {
+			t.Errorf("Expected exit status %d for %X, got %d", test.code,
+				test.value, code)
+		}
+	}
+}
+
+func TestRunResetting(t *testing.T) {
+	sys := newTestMachine(t, writeFinisher(0x7777))
+	if err := sys.SaveResetState(); err != nil {
+		t.Fatalf("SaveResetState failed: %v", err)
+	}
+	// The program resets the machine with its ninth instruction.
+	stop, err := runResetting(sys, 9)
+	if err != nil || stop != nil {
+		t.Fatalf("Expected the reset to be carried out, got %v, %v", stop, err)
+	}
+	if pc := sys.Core().GetPc(); pc != system.RAMOffset {
+		t.Errorf("Expected the hart reset to %X, got %X", system.RAMOffset, pc)
+	}
+	// 21 steps reset the machine twice and run 3 more instructions.
+	if _, err := runResetting(sys, 21); err != nil {
+		t.Fatalf("runResetting failed: %v", err)
+	}
+	if pc := sys.Core().GetPc(); pc != system.RAMOffset+12 {
+		t.Errorf("Expected the hart at %X after two resets, got %X",
+			system.RAMOffset+12, pc)
+	}
+
+	unsaved := newTestMachine(t, writeFinisher(0x7777))
+	if _, err := runResetting(unsaved, 1000); err == nil {
+		t.Error("Expected an error without a reset state")
+	}
+}
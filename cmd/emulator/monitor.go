@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+	"github.com/Keisim/go-riscv-emu/pkg/loader"
+	"github.com/Keisim/go-riscv-emu/pkg/system"
+)
+
+// monitorChunk is the number of instructions per hart executed by continue
+// between checks for an interrupt.
+const monitorChunk = 1 << 20
+
+// maxDumpLength is the largest number of bytes dumped or instructions
+// disassembled by a single command.
+const maxDumpLength = 1 << 16
+
+// monitor is an interactive console controlling a live System, similar to
+// the QEMU monitor.
+type monitor struct {
+	sys         *system.System
+	out         io.Writer
+	hart        int            // Hart selected for registers and disassembly
+	breakpoints map[int]string // Descriptions of breakpoints and watchpoints
+	interrupted atomic.Bool
+}
+
+// monitorCommand is a command of the monitor.
+type monitorCommand struct {
+	args string
+	help string
+	run  func(m *monitor, args []string) error
+}
+
+// monitorCommands holds the monitor commands by name.
+var monitorCommands map[string]monitorCommand
+
+// monitorAliases maps short command names to their commands.
+var monitorAliases = map[string]string{
+	"s": "step",
+	"c": "continue",
+	"r": "regs",
+	"b": "break",
+	"q": "quit",
+}
+
+func init() {
+	monitorCommands = map[string]monitorCommand{
+		"help":       {"", "show this help", (*monitor).help},
+		"step":       {"[n]", "execute n instructions on every hart (default 1)", (*monitor).step},
+		"continue":   {"", "run until a breakpoint, watchpoint, power off, error or Ctrl-C", (*monitor).continueRun},
+		"hart":       {"[id]", "show or select the hart used by regs, set and dis", (*monitor).selectHart},
+		"regs":       {"", "show the registers of the selected hart", (*monitor).regs},
+		"set":        {"<reg|pc> <value>", "write a register of the selected hart", (*monitor).set},
+		"x":          {"<addr> [len]", "dump memory as hex (default 64 bytes)", (*monitor).dump},
+		"dis":        {"[addr] [count]", "disassemble memory (default at pc, 10 instructions)", (*monitor).disassemble},
+		"write":      {"<addr> <byte>...", "write bytes to memory", (*monitor).write},
+		"break":      {"<addr>", "add a breakpoint", (*monitor).addBreakpoint},
+		"watch":      {"<addr> [len] [r|w|rw]", "add a watchpoint (default 1 byte, w)", (*monitor).addWatchpoint},
+		"delete":     {"<id>", "remove a breakpoint or watchpoint", (*monitor).delete},
+		"info":       {"", "list breakpoints and watchpoints", (*monitor).info},
+		"devices":    {"", "list the devices on the bus", (*monitor).devices},
+		"load":       {"<path>", "load an ELF file and jump to its entry point", (*monitor).load},
+		"bt":         {"", "show a backtrace of the selected hart", (*monitor).backtrace},
+		"screenshot": {"<path>", "write the frame of the first framebuffer to a PNG file", (*monitor).screenshot},
+		"quit":       {"", "exit the emulator", nil},
+	}
+}
+
+// newMonitor creates a monitor for the system writing to out.
+func newMonitor(sys *system.System, out io.Writer) *monitor {
+	return &monitor{
+		sys:         sys,
+		out:         out,
+		breakpoints: map[int]string{},
+	}
+}
+
+// serve reads commands from in until quit or the end of the input. Ctrl-C
+// interrupts continue instead of ending the emulator.
+func (m *monitor) serve(in io.Reader) {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-interrupts:
+				m.interrupted.Store(true)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(in)
+	fmt.Fprint(m.out, "(rvemu) ")
+	for scanner.Scan() {
+		if !m.execute(scanner.Text()) {
+			return
+		}
+		fmt.Fprint(m.out, "(rvemu) ")
+	}
+	fmt.Fprintln(m.out)
+}
+
+// execute runs a single command line. It returns false once the monitor
+// should exit.
+func (m *monitor) execute(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true
+	}
+	name := fields[0]
+	if alias, ok := monitorAliases[name]; ok {
+		name = alias
+	}
+	if name == "quit" {
+		return false
+	}
+	command, ok := monitorCommands[name]
+	if !ok {
+		fmt.Fprintf(m.out, "unknown command %q, try help\n", fields[0])
+		return true
+	}
+	if err := command.run(m, fields[1:]); err != nil {
+		fmt.Fprintf(m.out, "error: %v\n", err)
+	}
+	return true
+}
+
+func (m *monitor) help(args []string) error {
+	names := make([]string, 0, len(monitorCommands))
+	for name := range monitorCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		command := monitorCommands[name]
+		fmt.Fprintf(m.out, "  %-30s %s\n", name+" "+command.args, command.help)
+	}
+	return nil
+}
+
+// core returns the selected hart.
+func (m *monitor) core() *cpu.Core {
+	return m.sys.Harts()[m.hart]
+}
+
+// parseValue parses a number, the value of a register of the selected hart
+// given by name, e.g. "sp" or "pc", or the address of a symbol with an
+// optional offset, e.g. "main+0x10".
+func (m *monitor) parseValue(s string) (uint32, error) {
+	if s == "pc" {
+		return m.core().GetPc(), nil
+	}
+	if index, err := cpu.ParseRegister(s); err == nil {
+		return m.core().GetRegister(index), nil
+	}
+	name, offset, hasOffset := strings.Cut(s, "+")
+	if address, ok := m.sys.Symbolizer().LookupSymbol(name); ok {
+		if !hasOffset {
+			return address, nil
+		}
+		value, err := strconv.ParseUint(offset, 0, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid offset %q", offset)
+		}
+		return address + uint32(value), nil
+	}
+	value, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return uint32(value), nil
+}
+
+// report prints why execution stopped and where every hart is.
+func (m *monitor) report(stop *system.Stop, err error) {
+	if err != nil {
+		fmt.Fprintf(m.out, "error: %v\n", err)
+	}
+	if stop != nil {
+		fmt.Fprintln(m.out, stop)
+	}
+	for _, hart := range m.sys.Harts() {
+		pc := hart.GetPc()
+		fmt.Fprintf(m.out, "hart %d: %s: %s\n", hart.GetHartID(),
+			m.sys.Symbolizer().Describe(pc), m.disassembleAt(pc))
+	}
+}
+
+func (m *monitor) step(args []string) error {
+	steps := uint32(1)
+	if len(args) > 0 {
+		var err error
+		steps, err = m.parseValue(args[0])
+		if err != nil {
+			return err
+		}
+		if steps == 0 {
+			return fmt.Errorf("step count must be positive")
+		}
+	}
+	m.report(runResetting(m.sys, uint64(steps)))
+	return nil
+}
+
+func (m *monitor) continueRun(args []string) error {
+	m.interrupted.Store(false)
+	for !m.interrupted.Load() {
+		stop, err := runResetting(m.sys, monitorChunk)
+		if stop != nil || err != nil {
+			m.report(stop, err)
+			return nil
+		}
+	}
+	fmt.Fprintln(m.out, "interrupted")
+	m.report(nil, nil)
+	return nil
+}
+
+func (m *monitor) selectHart(args []string) error {
+	if len(args) > 0 {
+		id, err := strconv.Atoi(args[0])
+		if err != nil || id < 0 || id >= len(m.sys.Harts()) {
+			return fmt.Errorf("invalid hart %q", args[0])
+		}
+		m.hart = id
+	}
+	fmt.Fprintf(m.out, "hart %d\n", m.hart)
+	return nil
+}
+
+func (m *monitor) regs(args []string) error {
+	core := m.core()
+	fmt.Fprintf(m.out, "hart %d  pc %08x  instret %d\n", core.GetHartID(),
+		core.GetPc(), core.GetInstret())
+	for i := uint32(0); i < 32; i++ {
+		fmt.Fprintf(m.out, "%-4s %08x", cpu.RegisterName(i), core.GetRegister(i))
+		if i%4 == 3 {
+			fmt.Fprintln(m.out)
+		} else {
+			fmt.Fprint(m.out, "  ")
+		}
+	}
+	return nil
+}
+
+func (m *monitor) set(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: set <reg|pc> <value>")
+	}
+	value, err := m.parseValue(args[1])
+	if err != nil {
+		return err
+	}
+	if args[0] == "pc" {
+		m.core().SetPc(value)
+		return nil
+	}
+	index, err := cpu.ParseRegister(args[0])
+	if err != nil {
+		return err
+	}
+	m.core().SetRegister(index, value)
+	return nil
+}
+
+// readMemory reads bytes from the bus without triggering watchpoints or
+// consuming host input.
+func (m *monitor) readMemory(address uint32, length uint32) ([]byte, error) {
+	data := make([]byte, length)
+	for i := range data {
+		value, err := m.sys.Bus().Peek(address + uint32(i))
+		if err != nil {
+			return data[:i], err
+		}
+		data[i] = value
+	}
+	return data, nil
+}
+
+func (m *monitor) dump(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: x <addr> [len]")
+	}
+	address, err := m.parseValue(args[0])
+	if err != nil {
+		return err
+	}
+	length := uint32(64)
+	if len(args) > 1 {
+		if length, err = m.parseValue(args[1]); err != nil {
+			return err
+		}
+		if length > maxDumpLength {
+			return fmt.Errorf("length %d exceeds the maximum of %d bytes",
+				length, maxDumpLength)
+		}
+	}
+
+	data, err := m.readMemory(address, length)
+	for offset := 0; offset < len(data); offset += 16 {
+		line := data[offset:min(offset+16, len(data))]
+		var ascii strings.Builder
+		fmt.Fprintf(m.out, "%08x: ", address+uint32(offset))
+		for i := 0; i < 16; i++ {
+			if i < len(line) {
+				fmt.Fprintf(m.out, "%02x ", line[i])
+				if line[i] >= 0x20 && line[i] < 0x7F {
+					ascii.WriteByte(line[i])
+				} else {
+					ascii.WriteByte('.')
+				}
+			} else {
+				fmt.Fprint(m.out, "   ")
+			}
+		}
+		fmt.Fprintf(m.out, " %s\n", ascii.String())
+	}
+	return err
+}
+
+// disassembleAt disassembles the instruction at the given address.
+func (m *monitor) disassembleAt(address uint32) string {
+	data, err := m.readMemory(address, 4)
+	if err != nil {
+		return "<unmapped>"
+	}
+	instruction := uint32(data[0]) | uint32(data[1])<<8 |
+		uint32(data[2])<<16 | uint32(data[3])<<24
+	return cpu.Disassemble(instruction, address)
+}
+
+func (m *monitor) disassemble(args []string) error {
+	address := m.core().GetPc()
+	count := uint32(10)
+	var err error
+	if len(args) > 0 {
+		if address, err = m.parseValue(args[0]); err != nil {
+			return err
+		}
+	}
+	if len(args) > 1 {
+		if count, err = m.parseValue(args[1]); err != nil {
+			return err
+		}
+		if count > maxDumpLength {
+			return fmt.Errorf("count %d exceeds the maximum of %d instructions",
+				count, maxDumpLength)
+		}
+	}
+
+	for i := uint32(0); i < count; i++ {
+		pc := address + 4*i
+		if location := m.sys.Symbolizer().Lookup(pc); location.Offset == 0 &&
+			location.Function != "" {
+			fmt.Fprintf(m.out, "%s:\n", location.Function)
+		}
+		marker := "  "
+		if pc == m.core().GetPc() {
+			marker = "=>"
+		}
+		fmt.Fprintf(m.out, "%s %08x: %s\n", marker, pc, m.disassembleAt(pc))
+	}
+	return nil
+}
+
+func (m *monitor) write(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: write <addr> <byte>...")
+	}
+	address, err := m.parseValue(args[0])
+	if err != nil {
+		return err
+	}
+	for i, arg := range args[1:] {
+		value, err := strconv.ParseUint(arg, 0, 8)
+		if err != nil {
+			return fmt.Errorf("invalid byte %q", arg)
+		}
+		if err := m.sys.Bus().Poke(address+uint32(i), byte(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *monitor) addBreakpoint(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: break <addr>")
+	}
+	address, err := m.parseValue(args[0])
+	if err != nil {
+		return err
+	}
+	id := m.sys.AddBreakpoint(address)
+	m.breakpoints[id] = fmt.Sprintf("breakpoint at %08x", address)
+	fmt.Fprintf(m.out, "breakpoint %d at %08x\n", id, address)
+	return nil
+}
+
+func (m *monitor) addWatchpoint(args []string) error {
+	if len(args) < 1 || len(args) > 3 {
+		return fmt.Errorf("usage: watch <addr> [len] [r|w|rw]")
+	}
+	address, err := m.parseValue(args[0])
+	if err != nil {
+		return err
+	}
+	length := uint32(1)
+	if len(args) > 1 {
+		if length, err = m.parseValue(args[1]); err != nil {
+			return err
+		}
+	}
+	kind := system.WatchWrite
+	if len(args) > 2 {
+		switch args[2] {
+		case "r":
+			kind = system.WatchRead
+		case "w":
+			kind = system.WatchWrite
+		case "rw":
+			kind = system.WatchAccess
+		default:
+			return fmt.Errorf("invalid watch kind %q", args[2])
+		}
+	}
+
+	id := m.sys.AddWatchpoint(address, length, kind)
+	m.breakpoints[id] = fmt.Sprintf("%s watchpoint at %08x, %d bytes", kind,
+		address, length)
+	fmt.Fprintf(m.out, "watchpoint %d at %08x\n", id, address)
+	return nil
+}
+
+func (m *monitor) delete(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: delete <id>")
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid id %q", args[0])
+	}
+	if !m.sys.RemoveBreakpoint(id) && !m.sys.RemoveWatchpoint(id) {
+		return fmt.Errorf("no breakpoint or watchpoint %d", id)
+	}
+	delete(m.breakpoints, id)
+	return nil
+}
+
+func (m *monitor) info(args []string) error {
+	ids := make([]int, 0, len(m.breakpoints))
+	for id := range m.breakpoints {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		fmt.Fprintf(m.out, "%3d  %s\n", id, m.breakpoints[id])
+	}
+	return nil
+}
+
+func (m *monitor) devices(args []string) error {
+	for _, device := range m.sys.Bus().Devices() {
+		fmt.Fprintf(m.out, "%08x-%08x  %T\n", device.BaseAddress(),
+			device.BaseAddress()+device.Size()-1, device)
+	}
+	return nil
+}
+
+func (m *monitor) backtrace(args []string) error {
+	for i, pc := range m.sys.Backtrace(m.core()) {
+		fmt.Fprintf(m.out, "#%-2d %s\n", i, m.sys.Symbolizer().Describe(pc))
+	}
+	return nil
+}
+
+func (m *monitor) screenshot(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: screenshot <path>")
+	}
+	for _, device := range m.sys.Bus().Devices() {
+		if fb, ok := device.(*devices.FramebufferDevice); ok {
+			f, err := os.Create(args[0])
+			if err != nil {
+				return err
+			}
+			if err := fb.WritePNG(f); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		}
+	}
+	return fmt.Errorf("no framebuffer on the bus")
+}
+
+func (m *monitor) load(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: load <path>")
+	}
+	if err := loader.LoadELFToSystem(args[0], m.sys); err != nil {
+		return err
+	}
+	fmt.Fprintf(m.out, "loaded %s, entry point %08x\n", args[0],
+		m.core().GetPc())
+	return nil
+}
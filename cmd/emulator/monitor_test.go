@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/system"
+)
+
+// countingProgram increments x1 four times, then spins.
+var countingProgram = []uint32{
+	0x00108093, // ADDI x1, x1, 1
+	0x00108093,
+	0x00108093,
+	0x00108093,
+	0b1101111, // JAL x0, 0
+}
+
+// newTestMonitor returns a monitor of a machine running countingProgram.
+func newTestMonitor(t *testing.T) (*monitor, *bytes.Buffer) {
+	t.Helper()
+	var out bytes.Buffer
+	return newMonitor(newTestMachine(t, countingProgram), &out), &out
+}
+
+func TestMonitor_Execute(t *testing.T) {
+	tests := []struct {
+		line   string
+		output string
+		more   bool
+	}{
+		{"", "", true},
+		{"bogus", `unknown command "bogus", try help`, true},
+		{"quit", "", false},
+		{"q", "", false},
+		{"help", "continue", true},
+		{"hart", "hart 0", true},
+		{"hart 1", `invalid hart "1"`, true},
+		{"step 0", "step count must be positive", true},
+		{"s nothing", `invalid value "nothing"`, true},
+		{"x", "usage: x <addr> [len]", true},
+		{"x 0x80000000 0x10001", "length 65537 exceeds the maximum", true},
+		{"x 0x80000000 4", "80000000: 93 80 10 00", true},
+		{"x 0x1000 1", "error: device not found", true},
+		{"dis pc 0x10001", "count 65537 exceeds the maximum", true},
+		{"dis pc 1", "=> 80000000: addi ra, ra, 1", true},
+		{"write 0x80000000", "usage: write <addr> <byte>...", true},
+		{"write 0x80000000 0x100", `invalid byte "0x100"`, true},
+		{"b", "usage: break <addr>", true},
+		{"b pc+4", `invalid value "pc+4"`, true},
+		{"delete 7", "", true},
+	}
+	for _, test := range tests {
+		m, out := newTestMonitor(t)
+		if result := m.execute(test.line); result != test.more {
+			t.Errorf("Expected %q to return %v, got %v", test.line,
+				test.more, result)
+		}
+		if !strings.Contains(out.String(), test.output) {
+			t.Errorf("Expected %q to print %q, got %q", test.line, test.output,
+				out.String())
+		}
+	}
+}
+
+func TestMonitor_Step(t *testing.T) {
+	m, out := newTestMonitor(t)
+	m.execute("s 3")
+	if pc := m.core().GetPc(); pc != system.RAMOffset+12 {
+		t.Errorf("Expected pc %X after 3 steps, got %X", system.RAMOffset+12, pc)
+	}
+	if x1 := m.core().GetRegister(1); x1 != 3 {
+		t.Errorf("Expected x1 = 3, got %d", x1)
+	}
+	if !strings.Contains(out.String(), "hart 0: ") {
+		t.Errorf("Expected the harts to be reported, got %q", out.String())
+	}
+
+	m.execute("set x1 0x10")
+	m.execute("step")
+	if x1 := m.core().GetRegister(1); x1 != 0x11 {
+		t.Errorf("Expected x1 = 0x11, got %X", x1)
+	}
+}
+
+func TestMonitor_Breakpoint(t *testing.T) {
+	m, out := newTestMonitor(t)
+	m.execute("break 0x80000008")
+	m.execute("c")
+	if pc := m.core().GetPc(); pc != system.RAMOffset+8 {
+		t.Fatalf("Expected to stop at %X, got %X", system.RAMOffset+8, pc)
+	}
+	if !strings.Contains(out.String(), "breakpoint 1 at 80000008") ||
+		!strings.Contains(out.String(), "at pc 80000008") {
+		t.Errorf("Expected the breakpoint to be reported, got %q", out.String())
+	}
+
+	out.Reset()
+	m.execute("info")
+	if !strings.Contains(out.String(), "breakpoint at 80000008") {
+		t.Errorf("Expected the breakpoint to be listed, got %q", out.String())
+	}
+	m.execute("delete 1")
+	m.execute("s 8")
+	if pc := m.core().GetPc(); pc != system.RAMOffset+16 {
+		t.Errorf("Expected to spin at %X, got %X", system.RAMOffset+16, pc)
+	}
+}
+
+func TestMonitor_Write(t *testing.T) {
+	m, out := newTestMonitor(t)
+	m.execute("write 0x80000100 0x41 0x42 0")
+	for i, expected := range []byte{0x41, 0x42, 0} {
+		value, err := m.sys.Bus().Read(system.RAMOffset + 0x100 + uint32(i))
+		if err != nil || value != expected {
+			t.Errorf("Expected %02X at offset %d, got %02X, %v", expected, i,
+				value, err)
+		}
+	}
+	m.execute("x 0x80000100 3")
+	if !strings.Contains(out.String(), "80000100: 41 42 00") ||
+		!strings.Contains(out.String(), " AB.") {
+		t.Errorf("Expected the written bytes to be dumped, got %q", out.String())
+	}
+
+	// Patching the first instruction into ADDI x1, x1, 2 changes the step.
+	m.execute("write 0x80000000 0x93 0x80 0x20 0x00")
+	m.execute("step")
+	if x1 := m.core().GetRegister(1); x1 != 2 {
+		t.Errorf("Expected x1 = 2 after the patched instruction, got %d", x1)
+	}
+}
+
+func TestMonitor_Reset(t *testing.T) {
+	var out bytes.Buffer
+	sys := newTestMachine(t, writeFinisher(0x7777))
+	if err := sys.SaveResetState(); err != nil {
+		t.Fatalf("SaveResetState failed: %v", err)
+	}
+	m := newMonitor(sys, &out)
+
+	// The ninth step resets the machine, the tenth runs after the reset.
+	m.execute("s 10")
+	if pc := m.core().GetPc(); pc != system.RAMOffset+4 {
+		t.Errorf("Expected pc %X after the reset, got %X", system.RAMOffset+4, pc)
+	}
+	if strings.Contains(out.String(), "reset requested") {
+		t.Errorf("Expected the reset to be carried out, got %q", out.String())
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/Keisim/go-riscv-emu/pkg/system"
+)
+
+// checkStatsFormat returns an error for unknown -stats formats.
+func checkStatsFormat(format string) error {
+	switch format {
+	case "table", "json":
+		return nil
+	default:
+		return fmt.Errorf("unknown stats format %q", format)
+	}
+}
+
+// writeStats writes the statistics as a table or as JSON.
+func writeStats(w io.Writer, stats system.Stats, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Instructions retired\t%d\n", stats.Instructions)
+	fmt.Fprintf(tw, "Wall time\t%v\n", stats.WallTime)
+	fmt.Fprintf(tw, "MIPS\t%.2f\n", stats.MIPS)
+	fmt.Fprintf(tw, "Conditional branches\t%d\n", stats.Branches)
+	fmt.Fprintf(tw, "Taken\t%d (%.1f%%)\n", stats.BranchesTaken,
+		100*stats.BranchTakenRatio)
+
+	if len(stats.Traps) > 0 {
+		fmt.Fprintf(tw, "\nTrap\tCount\n")
+		for _, cause := range slices.Sorted(maps.Keys(stats.Traps)) {
+			fmt.Fprintf(tw, "%s\t%d\n", cause, stats.Traps[cause])
+		}
+	}
+	if len(stats.Devices) > 0 {
+		fmt.Fprintf(tw, "\nDevice\tLoads\tStores\n")
+		for _, d := range stats.Devices {
+			fmt.Fprintf(tw, "%s@%08x\t%d\t%d\n", d.Name, d.BaseAddress,
+				d.Loads, d.Stores)
+		}
+	}
+	if len(stats.Mnemonics) > 0 {
+		fmt.Fprintf(tw, "\nMnemonic\tCount\t%%\n")
+		mnemonics := slices.SortedFunc(maps.Keys(stats.Mnemonics),
+			func(a, b string) int {
+				return cmp.Or(
+					cmp.Compare(stats.Mnemonics[b], stats.Mnemonics[a]),
+					cmp.Compare(a, b))
+			})
+		for _, mnemonic := range mnemonics {
+			count := stats.Mnemonics[mnemonic]
+			fmt.Fprintf(tw, "%s\t%d\t%.1f\n", mnemonic, count,
+				100*float64(count)/float64(stats.Instructions))
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+	"github.com/Keisim/go-riscv-emu/pkg/system"
+	"github.com/Keisim/go-riscv-emu/pkg/virtio"
+	"github.com/Keisim/go-riscv-emu/pkg/vnc"
+)
+
+// startVNC serves the first framebuffer of the system over VNC on a port of
+// localhost, with events going to the first virtio-input keyboard and
+// tablet.
+func startVNC(sys *system.System, port int) error {
+	var fb *devices.FramebufferDevice
+	var keyboard vnc.Keyboard
+	var pointer vnc.Pointer
+	for _, device := range sys.Bus().Devices() {
+		switch device := device.(type) {
+		case *devices.FramebufferDevice:
+			if fb == nil {
+				fb = device
+			}
+		case *virtio.Transport:
+			if input, ok := device.Device().(*virtio.Input); ok {
+				if input.IsTablet() && pointer == nil {
+					pointer = input
+				} else if !input.IsTablet() && keyboard == nil {
+					keyboard = input
+				}
+			}
+		}
+	}
+	if fb == nil {
+		return fmt.Errorf("no framebuffer on the bus")
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return err
+	}
+	server := vnc.NewServer("go-riscv-emu", fb.Image(), keyboard, pointer)
+	fb.OnFrame(server.SetFrame)
+	slog.Info("Serving VNC", "address", listener.Addr())
+	go server.Serve(listener)
+	return nil
+}
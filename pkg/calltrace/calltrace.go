@@ -0,0 +1,208 @@
+// Package calltrace prints the calls and returns of guest functions as an
+// indented tree, like the function graph tracer of Linux.
+package calltrace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+	"github.com/Keisim/go-riscv-emu/pkg/symbols"
+)
+
+// maxDepth bounds the tracked call depth, e.g. for runaway recursion.
+const maxDepth = 1024
+
+// Argument registers a0 to a7.
+const (
+	registerA0 = 10
+	arguments  = 8
+)
+
+// Printer writes the call tree of the harts it traces. Every line starts
+// with the hart ID. Calls are shown with their arguments a0 to a7, e.g.
+// "main(0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0) {", and returns with the
+// value of a0 and the number of instructions retired by the call, including
+// its callees, e.g. "} = 0x0 /* main, 12 instructions */". Calls returning
+// without calling other shown functions take a single line.
+type Printer struct {
+	mu         sync.Mutex
+	out        *bufio.Writer
+	symbolizer *symbols.Symbolizer
+	filter     string
+	harts      []*hartTracer
+}
+
+// New returns a Printer writing to w. The symbolizer names the called
+// functions. A non-empty filter is a glob pattern as in path.Match, and only
+// functions whose names match it are shown, indented by the number of
+// shown functions they were called from.
+func New(w io.Writer, symbolizer *symbols.Symbolizer, filter string) (*Printer, error) {
+	if _, err := path.Match(filter, ""); err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %v", filter, err)
+	}
+	return &Printer{
+		out:        bufio.NewWriter(w),
+		symbolizer: symbolizer,
+		filter:     filter,
+	}, nil
+}
+
+// Tracer returns a new tracer to install on a single hart.
+func (p *Printer) Tracer() cpu.Tracer {
+	tracer := &hartTracer{p: p}
+	p.mu.Lock()
+	p.harts = append(p.harts, tracer)
+	p.mu.Unlock()
+	return tracer
+}
+
+// Flush writes the calls that have not returned yet and any buffered
+// output. It is meant to be called once the harts stopped.
+func (p *Printer) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, hart := range p.harts {
+		hart.flushEntry()
+	}
+	return p.out.Flush()
+}
+
+// shown reports whether calls to the function are printed.
+func (p *Printer) shown(name string) bool {
+	if p.filter == "" {
+		return true
+	}
+	matched, _ := path.Match(p.filter, name)
+	return matched
+}
+
+// frame is a function call that has not returned yet.
+type frame struct {
+	name          string
+	returnAddress uint32
+	entry         uint64 // Instructions retired by the hart at the call
+	shown         bool
+}
+
+// hartTracer tracks the call stack of a single hart.
+type hartTracer struct {
+	p        *Printer
+	hart     uint32
+	stack    []frame
+	depth    int // Number of shown frames on the stack
+	overflow int // Calls beyond maxDepth that were not tracked
+
+	// The entry of the innermost shown call is printed when it either
+	// returns or calls another shown function.
+	pending string
+}
+
+// TraceInstruction follows calls and returns.
+func (t *hartTracer) TraceInstruction(core *cpu.Core, event cpu.TraceEvent) {
+	if event.IsCall() {
+		t.call(core, event)
+	} else if event.IsReturn() {
+		t.ret(core, event.NextPc)
+	}
+}
+
+// call enters the function called by the event.
+func (t *hartTracer) call(core *cpu.Core, event cpu.TraceEvent) {
+	if len(t.stack) >= maxDepth {
+		t.overflow++
+		return
+	}
+	name := t.p.symbolizer.Lookup(event.NextPc).Function
+	if name == "" {
+		name = fmt.Sprintf("%08x", event.NextPc)
+	}
+	f := frame{
+		name:          name,
+		returnAddress: event.Pc + 4,
+		entry:         core.GetInstret(),
+		shown:         t.p.shown(name),
+	}
+	t.stack = append(t.stack, f)
+	if !f.shown {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s(", name)
+	for i := range uint32(arguments) {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%#x", core.GetRegister(registerA0+i))
+	}
+	b.WriteString(")")
+
+	t.p.mu.Lock()
+	t.hart = core.GetHartID()
+	t.flushEntry()
+	t.pending = b.String()
+	t.depth++
+	t.p.mu.Unlock()
+}
+
+// ret leaves the functions up to the one returning to the address. Returns
+// that match no tracked call, e.g. after a longjmp, are ignored.
+func (t *hartTracer) ret(core *cpu.Core, address uint32) {
+	if t.overflow > 0 {
+		t.overflow--
+		return
+	}
+	i := len(t.stack) - 1
+	for i >= 0 && t.stack[i].returnAddress != address {
+		i--
+	}
+	if i < 0 {
+		return
+	}
+
+	t.p.mu.Lock()
+	defer t.p.mu.Unlock()
+	t.hart = core.GetHartID()
+	result := core.GetRegister(registerA0)
+	for len(t.stack) > i {
+		f := t.stack[len(t.stack)-1]
+		t.stack = t.stack[:len(t.stack)-1]
+		if !f.shown {
+			continue
+		}
+		t.depth--
+		count := core.GetInstret() - f.entry
+		if t.pending != "" {
+			t.line(fmt.Sprintf("%s = %#x /* %d instructions */", t.pending,
+				result, count))
+			t.pending = ""
+		} else {
+			t.line(fmt.Sprintf("} = %#x /* %s, %d instructions */", result,
+				f.name, count))
+		}
+	}
+}
+
+// flushEntry prints the entry of the innermost shown call if it has not
+// been printed yet. The caller must hold the lock of the Printer.
+func (t *hartTracer) flushEntry() {
+	if t.pending == "" {
+		return
+	}
+	t.depth--
+	t.line(t.pending + " {")
+	t.depth++
+	t.pending = ""
+}
+
+// line prints a line of the tree at the current depth. The caller must
+// hold the lock of the Printer.
+func (t *hartTracer) line(text string) {
+	fmt.Fprintf(t.p.out, "%2d) %s%s\n", t.hart, strings.Repeat("  ", t.depth),
+		text)
+}
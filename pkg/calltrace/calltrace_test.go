@@ -0,0 +1,130 @@
+package calltrace
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+	"github.com/Keisim/go-riscv-emu/pkg/symbols"
+)
+
+// encodeI encodes an I-type instruction.
+func encodeI(opcode, funct3, rd, rs1 uint32, imm int32) uint32 {
+	return uint32(imm)<<20 | rs1<<15 | funct3<<12 | rd<<7 | opcode
+}
+
+// encodeJal encodes a JAL instruction.
+func encodeJal(rd uint32, offset int32) uint32 {
+	imm := uint32(offset)
+	return (imm>>20&1)<<31 | (imm>>1&0x3FF)<<21 | (imm>>11&1)<<20 |
+		(imm>>12&0xFF)<<12 | rd<<7 | 0b1101111
+}
+
+func addi(rd, rs1 uint32, imm int32) uint32 {
+	return encodeI(0b0010011, 0, rd, rs1, imm)
+}
+
+// callProgram calls f with a0 = 5, which calls g through t0. f adds 1 and g
+// adds 2 to a0.
+var callProgram = map[uint32]uint32{
+	0x1000: addi(10, 0, 5),                 // addi a0, zero, 5
+	0x1004: encodeJal(1, 0xC),              // jal ra, f
+	0x1008: addi(11, 10, 0),                // addi a1, a0, 0
+	0x100C: encodeJal(0, 0),                // j .
+	0x1010: addi(10, 10, 1),                // f: addi a0, a0, 1
+	0x1014: encodeJal(5, 0xC),              // jal t0, g
+	0x1018: encodeI(0b1100111, 0, 0, 1, 0), // jalr zero, 0(ra)
+	0x1020: addi(10, 10, 2),                // g: addi a0, a0, 2
+	0x1024: encodeI(0b1100111, 0, 0, 5, 0), // jalr zero, 0(t0)
+}
+
+// runCallProgram runs callProgram with the printer tracing the core.
+func runCallProgram(t *testing.T, p *Printer) {
+	t.Helper()
+	bus := &devices.Bus{}
+	ram := &devices.RAMDevice{}
+	ram.Initialize(0x1000, 0x1000)
+	bus.AddDevice(ram)
+	for address, instruction := range callProgram {
+		for i := uint32(0); i < 4; i++ {
+			if err := bus.Write(address+i, byte(instruction>>(8*i))); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+	}
+	core := cpu.NewCore(bus)
+	core.SetPc(0x1000)
+	core.SetTracer(p.Tracer())
+	if _, err := cpu.Run(core, 9); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+}
+
+func newSymbolizer() *symbols.Symbolizer {
+	symbolizer := symbols.New()
+	symbolizer.AddSymbol(symbols.Symbol{Name: "main", Address: 0x1000, Size: 0x10})
+	symbolizer.AddSymbol(symbols.Symbol{Name: "f", Address: 0x1010, Size: 0x10})
+	symbolizer.AddSymbol(symbols.Symbol{Name: "g", Address: 0x1020, Size: 0x8})
+	return symbolizer
+}
+
+func TestPrinter(t *testing.T) {
+	var buffer bytes.Buffer
+	p, err := New(&buffer, newSymbolizer(), "")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	runCallProgram(t, p)
+
+	expected := ` 0) f(0x5, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0) {
+ 0)   g(0x6, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0) = 0x8 /* 2 instructions */
+ 0) } = 0x8 /* f, 5 instructions */
+`
+	if buffer.String() != expected {
+		t.Errorf("Unexpected call tree:\n%s", buffer.String())
+	}
+}
+
+func TestPrinter_Filter(t *testing.T) {
+	var buffer bytes.Buffer
+	p, err := New(&buffer, newSymbolizer(), "[g]")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	runCallProgram(t, p)
+
+	expected := " 0) g(0x6, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0) = 0x8 /* 2 instructions */\n"
+	if buffer.String() != expected {
+		t.Errorf("Unexpected call tree:\n%s", buffer.String())
+	}
+}
+
+func TestPrinter_Unreturned(t *testing.T) {
+	var buffer bytes.Buffer
+	p, err := New(&buffer, nil, "")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	tracer := p.Tracer()
+	core := cpu.NewCore(&devices.Bus{})
+	tracer.TraceInstruction(core, cpu.TraceEvent{Pc: 0x1000, NextPc: 0x2000,
+		Mnemonic: "jal", Rd: 1})
+	if err := p.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	expected := " 0) 00002000(0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0) {\n"
+	if buffer.String() != expected {
+		t.Errorf("Unexpected call tree:\n%s", buffer.String())
+	}
+}
+
+func TestNew_InvalidFilter(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, nil, "[a"); err == nil {
+		t.Error("Expected an error for an invalid filter")
+	}
+}
@@ -0,0 +1,110 @@
+// Package coverage records the instructions and branch outcomes of guest
+// code and maps them to source lines for lcov coverage reports.
+package coverage
+
+import (
+	"sync"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+	"github.com/Keisim/go-riscv-emu/pkg/symbols"
+)
+
+// Coverage counts the instructions retired and the branches taken by the
+// harts it traces. Each hart needs its own tracer from Tracer, so harts
+// running in parallel do not share state.
+type Coverage struct {
+	mu    sync.Mutex
+	harts []*hartTracer
+}
+
+// New returns a Coverage without any tracers.
+func New() *Coverage {
+	return &Coverage{}
+}
+
+// Tracer returns a new tracer to install on a single hart.
+func (c *Coverage) Tracer() cpu.Tracer {
+	tracer := &hartTracer{
+		executed: make(map[uint32]uint64),
+		branches: make(map[uint32]*[2]uint64),
+	}
+	c.mu.Lock()
+	c.harts = append(c.harts, tracer)
+	c.mu.Unlock()
+	return tracer
+}
+
+// hartTracer records the coverage of a single hart.
+type hartTracer struct {
+	executed map[uint32]uint64     // Instructions retired by PC
+	branches map[uint32]*[2]uint64 // Taken and not taken by branch PC
+}
+
+// TraceInstruction counts the instruction and, for conditional branches,
+// whether it was taken.
+func (t *hartTracer) TraceInstruction(core *cpu.Core, event cpu.TraceEvent) {
+	t.executed[event.Pc]++
+	if !cpu.IsConditionalBranch(event.Instruction) {
+		return
+	}
+	outcomes, ok := t.branches[event.Pc]
+	if !ok {
+		outcomes = &[2]uint64{}
+		t.branches[event.Pc] = outcomes
+	}
+	if event.NextPc == event.Pc+4 {
+		outcomes[1]++
+	} else {
+		outcomes[0]++
+	}
+}
+
+// Report maps the recorded coverage to the source lines known to the
+// symbolizer. Every line in the line tables is reported, with the number of
+// times its most executed instruction was retired. readWord reads the guest
+// code to find the conditional branches of each line, which are reported
+// with the number of times they were taken and not taken.
+func (c *Coverage) Report(symbolizer *symbols.Symbolizer,
+	readWord func(address uint32) (uint32, error)) *Report {
+	executed := map[uint32]uint64{}
+	branches := map[uint32][2]uint64{}
+	c.mu.Lock()
+	for _, hart := range c.harts {
+		for pc, count := range hart.executed {
+			executed[pc] += count
+		}
+		for pc, outcomes := range hart.branches {
+			sum := branches[pc]
+			sum[0] += outcomes[0]
+			sum[1] += outcomes[1]
+			branches[pc] = sum
+		}
+	}
+	c.mu.Unlock()
+
+	report := NewReport()
+	blocks := map[symbols.LineRange]int{} // Next block number by line
+	for _, r := range symbolizer.Lines() {
+		file := report.file(r.File)
+		for pc := r.Address; pc < r.End; pc += 4 {
+			count := executed[pc]
+			file.Lines[r.Line] = max(file.Lines[r.Line], count)
+
+			instruction, err := readWord(pc)
+			if err != nil || !cpu.IsConditionalBranch(instruction) {
+				continue
+			}
+			line := symbols.LineRange{File: r.File, Line: r.Line}
+			block := blocks[line]
+			blocks[line]++
+			taken, notTaken := int64(NotExecuted), int64(NotExecuted)
+			if count > 0 {
+				outcomes := branches[pc]
+				taken, notTaken = int64(outcomes[0]), int64(outcomes[1])
+			}
+			file.Branches[Branch{r.Line, block, 0}] = taken
+			file.Branches[Branch{r.Line, block, 1}] = notTaken
+		}
+	}
+	return report
+}
@@ -0,0 +1,158 @@
+package coverage
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+	"github.com/Keisim/go-riscv-emu/pkg/symbols"
+)
+
+const (
+	addi = 0x00108093 // addi ra, ra, 1
+	bne  = 0xFE009EE3 // bne ra, zero, -4
+)
+
+// program is the code of loopTrace, one instruction per line of main.c.
+var program = map[uint32]uint32{
+	0x1000: addi,
+	0x1004: bne,
+	0x1008: addi,
+	0x100C: bne,
+}
+
+// loopTrace loops over the first two instructions three times, leaving the
+// branch on line 4 unexecuted.
+var loopTrace = []cpu.TraceEvent{
+	{Pc: 0x1000, NextPc: 0x1004, Instruction: addi},
+	{Pc: 0x1004, NextPc: 0x1000, Instruction: bne},
+	{Pc: 0x1000, NextPc: 0x1004, Instruction: addi},
+	{Pc: 0x1004, NextPc: 0x1000, Instruction: bne},
+	{Pc: 0x1000, NextPc: 0x1004, Instruction: addi},
+	{Pc: 0x1004, NextPc: 0x1008, Instruction: bne},
+	{Pc: 0x1008, NextPc: 0x100C, Instruction: addi},
+}
+
+const loopLCOV = `TN:
+SF:/src/main.c
+BRDA:2,0,0,2
+BRDA:2,0,1,1
+BRDA:4,0,0,-
+BRDA:4,0,1,-
+BRF:4
+BRH:2
+DA:1,3
+DA:2,3
+DA:3,1
+DA:4,0
+LF:4
+LH:3
+end_of_record
+`
+
+func readWord(address uint32) (uint32, error) {
+	instruction, ok := program[address]
+	if !ok {
+		return 0, fmt.Errorf("no code at %X", address)
+	}
+	return instruction, nil
+}
+
+func newSymbolizer() *symbols.Symbolizer {
+	symbolizer := symbols.New()
+	for line := range 4 {
+		address := 0x1000 + uint32(4*line)
+		symbolizer.AddLine(symbols.LineRange{Address: address,
+			End: address + 4, File: "/src/main.c", Line: line + 1})
+	}
+	return symbolizer
+}
+
+func TestCoverage_LCOV(t *testing.T) {
+	c := New()
+	// Split the trace over two harts.
+	first, second := c.Tracer(), c.Tracer()
+	for i, event := range loopTrace {
+		if i < 3 {
+			first.TraceInstruction(nil, event)
+		} else {
+			second.TraceInstruction(nil, event)
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := c.Report(newSymbolizer(), readWord).WriteLCOV(&buffer); err != nil {
+		t.Fatalf("WriteLCOV failed: %v", err)
+	}
+	if buffer.String() != loopLCOV {
+		t.Errorf("Unexpected lcov output:\n%s", buffer.String())
+	}
+}
+
+func TestParseLCOV_Merge(t *testing.T) {
+	report, err := ParseLCOV(strings.NewReader(loopLCOV))
+	if err != nil {
+		t.Fatalf("ParseLCOV failed: %v", err)
+	}
+	other, err := ParseLCOV(strings.NewReader(`SF:/src/main.c
+DA:4,1,checksum
+BRDA:4,0,0,0
+BRDA:4,0,1,1
+end_of_record
+SF:/src/other.c
+DA:7,0
+end_of_record
+`))
+	if err != nil {
+		t.Fatalf("ParseLCOV failed: %v", err)
+	}
+	report.Merge(other)
+
+	var buffer bytes.Buffer
+	if err := report.WriteLCOV(&buffer); err != nil {
+		t.Fatalf("WriteLCOV failed: %v", err)
+	}
+	expected := `TN:
+SF:/src/main.c
+BRDA:2,0,0,2
+BRDA:2,0,1,1
+BRDA:4,0,0,0
+BRDA:4,0,1,1
+BRF:4
+BRH:3
+DA:1,3
+DA:2,3
+DA:3,1
+DA:4,1
+LF:4
+LH:4
+end_of_record
+TN:
+SF:/src/other.c
+BRF:0
+BRH:0
+DA:7,0
+LF:1
+LH:0
+end_of_record
+`
+	if buffer.String() != expected {
+		t.Errorf("Unexpected merged output:\n%s", buffer.String())
+	}
+}
+
+func TestParseLCOV_Invalid(t *testing.T) {
+	tests := []string{
+		"DA:1,1\n",
+		"SF:a.c\nDA:x,1\n",
+		"SF:a.c\nBRDA:1,0,0\n",
+		"SF:a.c\nBRDA:1,0,0,x\n",
+	}
+	for _, input := range tests {
+		if _, err := ParseLCOV(strings.NewReader(input)); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
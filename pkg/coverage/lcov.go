@@ -0,0 +1,200 @@
+package coverage
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// NotExecuted is the count of the outcomes of a branch whose instruction
+// was never executed, written as "-" in lcov files.
+const NotExecuted = -1
+
+// Branch identifies an outcome of a conditional branch: block numbers the
+// branch instructions of a line in address order, branch is 0 for taken
+// and 1 for not taken.
+type Branch struct {
+	Line   int
+	Block  int
+	Branch int
+}
+
+// FileCoverage is the coverage of a source file.
+type FileCoverage struct {
+	Lines    map[int]uint64   // Execution counts by line
+	Branches map[Branch]int64 // Counts of branch outcomes, or NotExecuted
+}
+
+// Report is the coverage of a set of source files, as stored in lcov
+// tracefiles.
+type Report struct {
+	Files map[string]*FileCoverage // By path
+}
+
+// NewReport returns an empty Report.
+func NewReport() *Report {
+	return &Report{Files: make(map[string]*FileCoverage)}
+}
+
+// file returns the coverage of the file with the given path, adding it if
+// needed.
+func (r *Report) file(path string) *FileCoverage {
+	file, ok := r.Files[path]
+	if !ok {
+		file = &FileCoverage{
+			Lines:    make(map[int]uint64),
+			Branches: make(map[Branch]int64),
+		}
+		r.Files[path] = file
+	}
+	return file
+}
+
+// Merge adds the counts of another report, e.g. of a different run of the
+// same firmware.
+func (r *Report) Merge(other *Report) {
+	for path, otherFile := range other.Files {
+		file := r.file(path)
+		for line, count := range otherFile.Lines {
+			file.Lines[line] += count
+		}
+		for branch, count := range otherFile.Branches {
+			file.addBranch(branch, count)
+		}
+	}
+}
+
+// addBranch adds the count of a branch outcome. Counts of executed
+// branches replace NotExecuted.
+func (f *FileCoverage) addBranch(branch Branch, count int64) {
+	existing, ok := f.Branches[branch]
+	if !ok || existing == NotExecuted {
+		f.Branches[branch] = count
+	} else if count != NotExecuted {
+		f.Branches[branch] = existing + count
+	}
+}
+
+// WriteLCOV writes the report in the lcov tracefile format read by genhtml.
+func (r *Report) WriteLCOV(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	for _, path := range slices.Sorted(maps.Keys(r.Files)) {
+		file := r.Files[path]
+		fmt.Fprintf(out, "TN:\nSF:%s\n", path)
+
+		branches := slices.SortedFunc(maps.Keys(file.Branches),
+			func(a, b Branch) int {
+				return cmp.Or(cmp.Compare(a.Line, b.Line),
+					cmp.Compare(a.Block, b.Block),
+					cmp.Compare(a.Branch, b.Branch))
+			})
+		hit := 0
+		for _, branch := range branches {
+			count := file.Branches[branch]
+			taken := "-"
+			if count != NotExecuted {
+				taken = strconv.FormatInt(count, 10)
+			}
+			if count > 0 {
+				hit++
+			}
+			fmt.Fprintf(out, "BRDA:%d,%d,%d,%s\n", branch.Line, branch.Block,
+				branch.Branch, taken)
+		}
+		fmt.Fprintf(out, "BRF:%d\nBRH:%d\n", len(branches), hit)
+
+		lines := slices.Sorted(maps.Keys(file.Lines))
+		hit = 0
+		for _, line := range lines {
+			count := file.Lines[line]
+			if count > 0 {
+				hit++
+			}
+			fmt.Fprintf(out, "DA:%d,%d\n", line, count)
+		}
+		fmt.Fprintf(out, "LF:%d\nLH:%d\nend_of_record\n", len(lines), hit)
+	}
+	return out.Flush()
+}
+
+// ParseLCOV reads the line and branch coverage of an lcov tracefile.
+// Function records and summaries are ignored.
+func ParseLCOV(r io.Reader) (*Report, error) {
+	report := NewReport()
+	var file *FileCoverage
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		record, value, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		var err error
+		switch record {
+		case "SF":
+			file = report.file(value)
+		case "end_of_record":
+			file = nil
+		case "DA", "BRDA":
+			if file == nil {
+				err = fmt.Errorf("%s outside of a file record", record)
+			} else if record == "DA" {
+				err = parseLine(file, value)
+			} else {
+				err = parseBranch(file, value)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", number, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// parseLine parses a "DA:<line>,<count>[,<checksum>]" record.
+func parseLine(file *FileCoverage, value string) error {
+	fields := strings.Split(value, ",")
+	if len(fields) < 2 {
+		return fmt.Errorf("invalid DA record %q", value)
+	}
+	line, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return fmt.Errorf("invalid line number %q", fields[0])
+	}
+	count, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid execution count %q", fields[1])
+	}
+	file.Lines[line] += count
+	return nil
+}
+
+// parseBranch parses a "BRDA:<line>,<block>,<branch>,<taken>" record.
+func parseBranch(file *FileCoverage, value string) error {
+	fields := strings.Split(value, ",")
+	if len(fields) != 4 {
+		return fmt.Errorf("invalid BRDA record %q", value)
+	}
+	var numbers [3]int
+	for i := range numbers {
+		number, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return fmt.Errorf("invalid BRDA record %q", value)
+		}
+		numbers[i] = number
+	}
+	count := int64(NotExecuted)
+	if fields[3] != "-" {
+		taken, err := strconv.ParseUint(fields[3], 10, 63)
+		if err != nil {
+			return fmt.Errorf("invalid branch count %q", fields[3])
+		}
+		count = int64(taken)
+	}
+	file.addBranch(Branch{numbers[0], numbers[1], numbers[2]}, count)
+	return nil
+}
@@ -0,0 +1,290 @@
+package cpu
+
+import "fmt"
+
+// Engine selects how a Core executes guest code.
+type Engine int
+
+const (
+	// EngineInterpreter executes one decoded instruction at a time.
+	EngineInterpreter Engine = iota
+	// EngineBlock translates straight-line basic blocks into threaded code
+	// and executes them as a unit, chaining blocks on direct branches.
+	EngineBlock
+)
+
+// maxBlockLength limits the number of instructions in a translated block.
+const maxBlockLength = 64
+
+// String returns the name of the engine as accepted by ParseEngine.
+func (e Engine) String() string {
+	switch e {
+	case EngineInterpreter:
+		return "interpreter"
+	case EngineBlock:
+		return "block"
+	default:
+		return fmt.Sprintf("Engine(%d)", int(e))
+	}
+}
+
+// ParseEngine returns the Engine with the given name.
+func ParseEngine(name string) (Engine, error) {
+	switch name {
+	case "interpreter":
+		return EngineInterpreter, nil
+	case "block":
+		return EngineBlock, nil
+	default:
+		return 0, fmt.Errorf("unknown execution engine %q", name)
+	}
+}
+
+// translatedBlock is a guest basic block translated into an array of
+// decoded instructions. A block never crosses a code page boundary, so that
+// a write into a page only has to invalidate the blocks of that page.
+type translatedBlock struct {
+	start uint32
+	ops   []decodedInstruction
+	valid bool
+
+	// direct is set when the block ends with a direct branch or falls
+	// through, so its successors are known at translation time.
+	direct bool
+
+	// Successor blocks of direct branches, linked lazily on first use.
+	next   [2]*translatedBlock
+	nextPc [2]uint32
+}
+
+// blockCache keeps translated blocks keyed by their start address.
+type blockCache struct {
+	blocks     map[uint32]*translatedBlock
+	pages      map[uint32][]*translatedBlock
+	generation uint64
+}
+
+// newBlockCache returns an empty block cache.
+func newBlockCache() blockCache {
+	return blockCache{
+		blocks: map[uint32]*translatedBlock{},
+		pages:  map[uint32][]*translatedBlock{},
+	}
+}
+
+// endsBlock reports whether the decoded instruction transfers control or
+// otherwise has to be the last instruction of a block.
+func endsBlock(instruction uint32) bool {
+	if instruction == mretInstruction {
+		return true
+	}
+	switch instruction & 0x7F {
+	case opcodeJal, opcodeJalr, opcodeBne, opcodeFenceI:
+		return true
+	}
+	return false
+}
+
+// translate decodes the basic block starting at the current PC of the core.
+func (c *blockCache) translate(core *Core) (*translatedBlock, error) {
+	start := core.pc
+	block := &translatedBlock{start: start, valid: true}
+	pc := start
+
+	for len(block.ops) < maxBlockLength {
+		instruction := core.fetchAt(pc)
+		decoded, err := core.decode(instruction)
+		if err != nil {
+			if len(block.ops) == 0 {
+				return nil, err
+			}
+			// The block starting at the failing instruction reports the
+			// error once it is reached.
+			break
+		}
+		block.ops = append(block.ops, decoded)
+		block.direct = instruction&0x7F != opcodeJalr
+		pc += 4
+		if endsBlock(instruction) || pc>>cachePageShift != start>>cachePageShift {
+			break
+		}
+	}
+
+	c.blocks[start] = block
+	tag := start >> cachePageShift
+	c.pages[tag] = append(c.pages[tag], block)
+	return block, nil
+}
+
+// lookup returns the block starting at the current PC of the core,
+// translating it on a miss.
+func (c *blockCache) lookup(core *Core) (*translatedBlock, error) {
+	if c.generation != core.bus.Generation() {
+		c.flush()
+		c.generation = core.bus.Generation()
+	}
+	block := c.blocks[core.pc]
+	if block != nil {
+		return block, nil
+	}
+	return c.translate(core)
+}
+
+// invalidate drops every block translated from the written page.
+func (c *blockCache) invalidate(address uint32) {
+	if len(c.pages) == 0 {
+		return
+	}
+	tag := address >> cachePageShift
+	blocks, ok := c.pages[tag]
+	if !ok {
+		return
+	}
+	for _, block := range blocks {
+		block.valid = false
+		delete(c.blocks, block.start)
+	}
+	delete(c.pages, tag)
+}
+
+// flush invalidates every translated block.
+func (c *blockCache) flush() {
+	for _, block := range c.blocks {
+		block.valid = false
+	}
+	clear(c.blocks)
+	clear(c.pages)
+}
+
+// runBlocks executes up to steps instructions on the core using translated
+// blocks and returns the number of instructions executed.
+func runBlocks(core *Core, steps uint64) (uint64, error) {
+	var executed, ticked uint64
+	var block *translatedBlock
+
+	for executed < steps {
+		core.syncCaches()
+		core.tickTimer(executed - ticked)
+		ticked = executed
+		taken, err := core.interrupt()
+		if err != nil {
+			return executed, err
+		}
+		if taken || block != nil && !block.valid {
+			block = nil
+		}
+		if core.breakpoints != nil && core.atBreakpoint() {
+			return executed, ErrStopped
+		}
+		if block == nil {
+			block, err = core.blocks.lookup(core)
+			if err != nil {
+				if core.takeException(err) {
+					executed++
+					continue
+				}
+				return executed, err
+			}
+		}
+
+		completed := true
+		for i := range block.ops {
+			if i > 0 && core.breakpoints != nil && core.atBreakpoint() {
+				return executed, ErrStopped
+			}
+			err := core.retire(&block.ops[i])
+			if err != nil {
+				if core.takeException(err) {
+					// Trapping counts as a step, so that a faulting
+					// handler cannot run forever.
+					executed++
+					completed = false
+					break
+				}
+				return executed, err
+			}
+			executed++
+			if core.stop {
+				core.stop = false
+				return executed, ErrStopped
+			}
+			core.syncCaches()
+			if executed == steps || !block.valid {
+				// Out of budget, or the block has just modified its own
+				// code; the PC already points at the next instruction.
+				completed = false
+				break
+			}
+		}
+
+		if completed {
+			block = block.chain(core)
+		} else {
+			block = nil
+		}
+	}
+
+	return executed, nil
+}
+
+// chain returns the successor of the block for the current PC of the core,
+// following and recording direct branch links.
+func (b *translatedBlock) chain(core *Core) *translatedBlock {
+	if !b.direct {
+		next, _ := core.blocks.lookup(core)
+		return next
+	}
+
+	for i, next := range b.next {
+		if next != nil && b.nextPc[i] == core.pc {
+			if next.valid {
+				return next
+			}
+			b.next[i] = nil
+		}
+	}
+
+	next, err := core.blocks.lookup(core)
+	if err != nil {
+		// Leave the error to be reported by the next lookup.
+		return nil
+	}
+	for i := range b.next {
+		if b.next[i] == nil {
+			b.next[i] = next
+			b.nextPc[i] = core.pc
+			break
+		}
+	}
+	return next
+}
+
+// Run executes up to steps instructions on the given core using its
+// selected engine and returns the number of instructions executed. It
+// returns ErrStopped before executing an instruction at a breakpoint and
+// after a stop request.
+func Run(core *Core, steps uint64) (uint64, error) {
+	core.stop = false
+	if core.engine == EngineBlock {
+		return runBlocks(core, steps)
+	}
+
+	for executed := uint64(0); executed < steps; executed++ {
+		core.tickTimer(1)
+		if _, err := core.interrupt(); err != nil {
+			return executed, err
+		}
+		if core.breakpoints != nil && core.atBreakpoint() {
+			return executed, ErrStopped
+		}
+		err := step(core)
+		if err != nil && !core.takeException(err) {
+			return executed, err
+		}
+		if core.stop {
+			core.stop = false
+			return executed + 1, ErrStopped
+		}
+	}
+	return steps, nil
+}
@@ -0,0 +1,202 @@
+package cpu
+
+import (
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+// encodeJType assembles a J-type instruction word.
+func encodeJType(opcode, rd uint32, imm int32) uint32 {
+	u := uint32(imm)
+	return (u>>20&1)<<31 | (u>>1&0x3FF)<<21 | (u>>11&1)<<20 |
+		(u>>12&0xFF)<<12 | rd<<7 | opcode
+}
+
+// encodeUType assembles a U-type instruction word.
+func encodeUType(opcode, rd uint32, imm int32) uint32 {
+	return uint32(imm)<<12 | rd<<7 | opcode
+}
+
+// callProgram calls a subroutine that counts down a register, storing
+// progress bytes into RAM, and loops forever afterwards:
+//
+//	0x1000: LUI  x4, 0x1
+//	0x1004: ADDI x2, x0, 5
+//	0x1008: JAL  x1, sub
+//	0x100C: ADDI x3, x3, 1
+//	0x1010: JAL  x0, 0x100C
+//	sub:    SB   x2, 0x100(x4)
+//	        ADDI x4, x4, 1
+//	        ADDI x2, x2, -1
+//	        BNE  x2, x0, sub
+//	        JALR x0, 0(x1)
+var callProgram = []uint32{
+	encodeUType(opcodeLui, 4, 1),
+	encodeIType(opcodeAddi, iTypeFunc3Addi, 2, 0, 5),
+	encodeJType(opcodeJal, 1, 12),
+	encodeIType(opcodeAddi, iTypeFunc3Addi, 3, 3, 1),
+	encodeJType(opcodeJal, 0, -4),
+	encodeSType(opcodeSb, sTypeFunc3Sb, 4, 2, 0x100),
+	encodeIType(opcodeAddi, iTypeFunc3Addi, 4, 4, 1),
+	encodeIType(opcodeAddi, iTypeFunc3Addi, 2, 2, -1),
+	encodeBType(opcodeBne, bTypeFunc3Bne, 2, 0, -12),
+	encodeIType(opcodeJalr, iTypeFunc3Jalr, 0, 1, 0),
+}
+
+// selfModifyingProgram patches the destination register of an instruction
+// in the middle of its own basic block and then executes it:
+//
+//	0x1000: LUI  x5, 0x1
+//	0x1004: ADDI x6, x0, 0x13   (low byte of ADDI x6, x0, 9)
+//	0x1008: SB   x6, 0x10(x5)
+//	0x100C: ADDI x8, x8, 1
+//	0x1010: ADDI x7, x0, 9      (patched into ADDI x6, x0, 9)
+//	0x1014: JAL  x0, 0x1000
+var selfModifyingProgram = []uint32{
+	encodeUType(opcodeLui, 5, 1),
+	encodeIType(opcodeAddi, iTypeFunc3Addi, 6, 0,
+		int32(encodeIType(opcodeAddi, iTypeFunc3Addi, 6, 0, 9)&0xFF)),
+	encodeSType(opcodeSb, sTypeFunc3Sb, 5, 6, 0x10),
+	encodeIType(opcodeAddi, iTypeFunc3Addi, 8, 8, 1),
+	encodeIType(opcodeAddi, iTypeFunc3Addi, 7, 0, 9),
+	encodeJType(opcodeJal, 0, -20),
+}
+
+// runEngine executes the program for the given number of steps on a fresh
+// core using the given engine.
+func runEngine(t *testing.T, engine Engine, program []uint32,
+	steps uint64) (*Core, *devices.Bus) {
+	t.Helper()
+	core, bus := setupProgram(t, program...)
+	core.SetEngine(engine)
+
+	executed, err := Run(core, steps)
+	if err != nil {
+		t.Fatalf("Run with %v engine failed: %v", engine, err)
+	}
+	if executed != steps {
+		t.Fatalf("Expected %d steps with %v engine, got %d", steps, engine,
+			executed)
+	}
+	return core, bus
+}
+
+// compareEngines runs the program on both engines for every step count up
+// to maxSteps and checks that the architectural state matches.
+func compareEngines(t *testing.T, program []uint32, maxSteps uint64) {
+	t.Helper()
+	for steps := uint64(0); steps <= maxSteps; steps++ {
+		interpreted, interpretedBus := runEngine(t, EngineInterpreter,
+			program, steps)
+		translated, translatedBus := runEngine(t, EngineBlock, program, steps)
+
+		if interpreted.pc != translated.pc {
+			t.Fatalf("After %d steps: expected PC %X, got %X", steps,
+				interpreted.pc, translated.pc)
+		}
+		if interpreted.x != translated.x {
+			t.Fatalf("After %d steps: expected registers %v, got %v", steps,
+				interpreted.x, translated.x)
+		}
+		for address := uint32(0x1000); address < 0x2000; address++ {
+			expected, _ := interpretedBus.Read(address)
+			actual, _ := translatedBus.Read(address)
+			if expected != actual {
+				t.Fatalf("After %d steps: expected memory at %X to be %X, got %X",
+					steps, address, expected, actual)
+			}
+		}
+	}
+}
+
+func TestRun_DifferentialComputeLoop(t *testing.T) {
+	compareEngines(t, computeLoop, 50)
+}
+
+func TestRun_DifferentialCalls(t *testing.T) {
+	compareEngines(t, callProgram, 60)
+}
+
+func TestRun_DifferentialSelfModifyingCode(t *testing.T) {
+	compareEngines(t, selfModifyingProgram, 20)
+
+	core, _ := runEngine(t, EngineBlock, selfModifyingProgram, 5)
+	if core.x[6] != 9 || core.x[7] != 0 {
+		t.Errorf("Expected the patched instruction to set x6, got x6 = %d, x7 = %d",
+			core.x[6], core.x[7])
+	}
+}
+
+func TestRun_BlockChaining(t *testing.T) {
+	core, _ := runEngine(t, EngineBlock, computeLoop, 30)
+
+	block := core.blocks.blocks[0x1000]
+	if block == nil {
+		t.Fatal("Expected a block translated at 1000")
+	}
+	if len(block.ops) != 3 {
+		t.Errorf("Expected block of 3 instructions, got %d", len(block.ops))
+	}
+	if block.next[0] != block {
+		t.Error("Expected the loop block to be chained to itself")
+	}
+}
+
+func TestRun_BlockUnsupportedInstruction(t *testing.T) {
+	core, _ := setupProgram(t,
+		encodeIType(opcodeAddi, iTypeFunc3Addi, 1, 0, 1),
+		0xFFFFFFFF,
+	)
+	core.SetEngine(EngineBlock)
+
+	executed, err := Run(core, 10)
+	if err == nil {
+		t.Fatal("Expected error for unsupported instruction, got nil")
+	}
+	if executed != 1 {
+		t.Errorf("Expected 1 executed instruction, got %d", executed)
+	}
+	if core.pc != 0x1004 {
+		t.Errorf("Expected PC to stop at 1004, got %X", core.pc)
+	}
+}
+
+func TestParseEngine(t *testing.T) {
+	for _, engine := range []Engine{EngineInterpreter, EngineBlock} {
+		parsed, err := ParseEngine(engine.String())
+		if err != nil {
+			t.Fatalf("ParseEngine(%q) failed: %v", engine, err)
+		}
+		if parsed != engine {
+			t.Errorf("Expected %v, got %v", engine, parsed)
+		}
+	}
+
+	_, err := ParseEngine("jit")
+	if err == nil {
+		t.Error("Expected error for unknown engine, got nil")
+	}
+}
+
+func benchmarkRunComputeLoop(b *testing.B, engine Engine) {
+	const chunk = 1024
+	core, _ := setupProgram(b, computeLoop...)
+	core.SetEngine(engine)
+
+	for b.Loop() {
+		if _, err := Run(core, chunk); err != nil {
+			b.Fatalf("Run failed: %v", err)
+		}
+	}
+
+	b.ReportMetric(float64(b.N)*chunk/b.Elapsed().Seconds()/1e6, "MIPS")
+}
+
+func BenchmarkRun_ComputeLoopInterpreter(b *testing.B) {
+	benchmarkRunComputeLoop(b, EngineInterpreter)
+}
+
+func BenchmarkRun_ComputeLoopBlock(b *testing.B) {
+	benchmarkRunComputeLoop(b, EngineBlock)
+}
@@ -0,0 +1,51 @@
+package cpu
+
+import "errors"
+
+// ErrStopped is returned by Run when it stops early because a breakpoint
+// was reached or RequestStop was called.
+var ErrStopped = errors.New("execution stopped")
+
+// SetBreakpoints replaces the breakpoints of the core. Run stops with
+// ErrStopped before executing an instruction at one of the addresses,
+// including the first one and the first one of a trap handler. The next Run
+// executes the instruction it stopped at instead of stopping again.
+func (c *Core) SetBreakpoints(pcs []uint32) {
+	if len(pcs) == 0 {
+		c.breakpoints = nil
+		return
+	}
+	c.breakpoints = make(map[uint32]struct{}, len(pcs))
+	for _, pc := range pcs {
+		c.breakpoints[pc] = struct{}{}
+	}
+}
+
+// RequestStop makes a running Run return ErrStopped once the current
+// instruction has completed. It has to be called from the goroutine
+// executing the core, e.g. by a bus device or tracer.
+func (c *Core) RequestStop() {
+	c.stop = true
+}
+
+// resumePoint is where Run last stopped at a breakpoint: the PC and the
+// number of retired instructions.
+type resumePoint struct {
+	pc      uint32
+	instret uint64
+	valid   bool
+}
+
+// atBreakpoint reports whether the core is about to execute an instruction
+// at a breakpoint it did not stop at yet.
+func (c *Core) atBreakpoint() bool {
+	if _, ok := c.breakpoints[c.pc]; !ok {
+		return false
+	}
+	resume := resumePoint{pc: c.pc, instret: c.instret, valid: true}
+	if c.resume == resume {
+		return false
+	}
+	c.resume = resume
+	return true
+}
@@ -0,0 +1,101 @@
+package cpu
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+func TestRun_Breakpoints(t *testing.T) {
+	for _, engine := range []Engine{EngineInterpreter, EngineBlock} {
+		t.Run(engine.String(), func(t *testing.T) {
+			core, _ := setupProgram(t, computeLoop...)
+			core.SetEngine(engine)
+			core.SetBreakpoints([]uint32{0x1008}) // BNE
+
+			executed, err := Run(core, 100)
+			if !errors.Is(err, ErrStopped) {
+				t.Fatalf("Expected ErrStopped, got %v", err)
+			}
+			if executed != 2 || core.GetPc() != 0x1008 {
+				t.Errorf("Expected stop at 1008 after 2 instructions, got %X after %d",
+					core.GetPc(), executed)
+			}
+
+			// Continuing does not stop at the breakpoint it starts from.
+			executed, err = Run(core, 100)
+			if !errors.Is(err, ErrStopped) || executed != 3 {
+				t.Errorf("Expected ErrStopped after 3 instructions, got %v after %d",
+					err, executed)
+			}
+
+			core.SetBreakpoints(nil)
+			executed, err = Run(core, 100)
+			if err != nil || executed != 100 {
+				t.Errorf("Expected 100 instructions, got %d: %v", executed, err)
+			}
+		})
+	}
+}
+
+func TestRun_BreakpointEntry(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(core *Core)
+		pc    uint32
+		steps uint64
+	}{
+		{"start", func(*Core) {}, 0x1000, 0},
+		{"exception", func(*Core) {}, 0x1100, 2},
+		{"interrupt", func(core *Core) {
+			core.SetCSR(CsrMie, 1<<devices.InterruptMachineSoftware)
+			core.SetCSR(CsrMstatus, mstatusMIE)
+			core.InterruptLine(devices.InterruptMachineSoftware).SetLevel(true)
+		}, 0x1100, 0},
+	}
+	for _, test := range tests {
+		for _, engine := range []Engine{EngineInterpreter, EngineBlock} {
+			core, bus := setupProgram(t, nop, 0xFFFFFFFF)
+			writeWord(t, bus, 0x1100, nop)
+			core.SetEngine(engine)
+			core.SetCSR(CsrMtvec, 0x1100)
+			test.setup(core)
+			core.SetBreakpoints([]uint32{test.pc})
+
+			executed, err := Run(core, 10)
+			if !errors.Is(err, ErrStopped) || core.pc != test.pc || executed != test.steps {
+				t.Errorf("%s on %v: expected a stop at %X after %d steps, got pc %X after %d, %v",
+					test.name, engine, test.pc, test.steps, core.pc, executed, err)
+			}
+			// Continuing executes the instruction at the breakpoint.
+			if _, err := Run(core, 1); err != nil || core.pc != test.pc+4 {
+				t.Errorf("%s on %v: expected to continue to %X, got %X, %v",
+					test.name, engine, test.pc+4, core.pc, err)
+			}
+		}
+	}
+}
+
+// stoppingTracer requests a stop after the given number of instructions.
+type stoppingTracer struct {
+	remaining int
+}
+
+func (s *stoppingTracer) TraceInstruction(core *Core, event TraceEvent) {
+	s.remaining--
+	if s.remaining == 0 {
+		core.RequestStop()
+	}
+}
+
+func TestRun_RequestStop(t *testing.T) {
+	core, _ := setupProgram(t, computeLoop...)
+	core.SetTracer(&stoppingTracer{remaining: 5})
+
+	executed, err := Run(core, 100)
+	if !errors.Is(err, ErrStopped) || executed != 5 {
+		t.Errorf("Expected ErrStopped after 5 instructions, got %v after %d",
+			err, executed)
+	}
+}
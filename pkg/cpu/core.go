@@ -1,31 +1,107 @@
 package cpu
 
 import (
-	"fmt"
-	"log/slog"
-
 	"github.com/Keisim/go-riscv-emu/pkg/devices"
 )
 
 // Core represents the CPU core with its registers and program counter.
 type Core struct {
-	pc  uint32
-	x   [32]uint32
-	bus *devices.Bus
+	pc     uint32
+	x      [32]uint32
+	bus    *devices.Bus
+	cache  decodeCache
+	blocks blockCache
+	engine Engine
+	tracer Tracer
+
+	hartID      uint32
+	extensions  Extensions
+	instret     uint64
+	csr         csrFile
+	reservation reservation
+	writes      writeQueue
+
+	timer          func() // See SetTimer
+	timerCountdown uint64 // Instructions until the next timer check
+
+	interrupts InterruptInterceptor // See SetInterruptInterceptor
+	seen       seenInterrupts       // Interrupts returned by interrupts
+
+	breakpoints map[uint32]struct{}
+	resume      resumePoint // The breakpoint Run stopped at
+	stop        bool        // Run returns after the current instruction
+
+	// scratch holds instructions decoded outside of the caches.
+	scratch decodedInstruction
 }
 
 // NewCore creates and initializes a new CPU core with the given bus.
 func NewCore(bus *devices.Bus) *Core {
-	return &Core{
-		pc:  0,
-		bus: bus,
-		x:   [32]uint32{},
+	core := &Core{
+		pc:         0,
+		bus:        bus,
+		x:          [32]uint32{},
+		cache:      newDecodeCache(),
+		blocks:     newBlockCache(),
+		engine:     EngineInterpreter,
+		extensions: AllExtensions,
+	}
+	bus.AddWriteObserver(&core.writes)
+	bus.AddWriteObserver(&core.reservation)
+	return core
+}
+
+// SetHartID sets the hardware thread ID reported by the mhartid CSR.
+func (c *Core) SetHartID(id uint32) {
+	c.hartID = id
+}
+
+// GetHartID returns the hardware thread ID of the core.
+func (c *Core) GetHartID() uint32 {
+	return c.hartID
+}
+
+// GetInstret returns the number of instructions retired by the core.
+func (c *Core) GetInstret() uint64 {
+	return c.instret
+}
+
+// SetRegister sets the general-purpose register with the given index.
+// Writes to x0 are ignored.
+func (c *Core) SetRegister(index uint32, value uint32) {
+	if index != 0 {
+		c.x[index] = value
 	}
 }
 
+// GetRegister returns the value of the general-purpose register with the
+// given index.
+func (c *Core) GetRegister(index uint32) uint32 {
+	return c.x[index]
+}
+
+// SetDecodeCache enables or disables the cache of decoded instructions.
+// Disabling the cache drops all of its entries.
+func (c *Core) SetDecodeCache(enabled bool) {
+	c.cache.flush()
+	c.cache.enabled = enabled
+}
+
+// SetEngine selects the engine used by Run to execute guest code.
+func (c *Core) SetEngine(engine Engine) {
+	c.blocks.flush()
+	c.engine = engine
+}
+
+// GetEngine returns the engine used by Run to execute guest code.
+func (c *Core) GetEngine() Engine {
+	return c.engine
+}
+
 // SetPc sets the program counter to the specified value.
 func (c *Core) SetPc(value uint32) {
 	c.pc = value
+	c.resume.valid = false
 }
 
 // GetPc returns the current value of the program counter.
@@ -35,12 +111,15 @@ func (c *Core) GetPc() uint32 {
 
 // Fetch retrieves the next instruction from memory at the current PC.
 func (c *Core) Fetch() uint32 {
-	slog.Debug(fmt.Sprintf("Fetching instruction at PC: %X", c.pc))
+	return c.fetchAt(c.pc)
+}
 
-	byte1, _ := c.bus.Read(c.pc)
-	byte2, _ := c.bus.Read(c.pc + 1)
-	byte3, _ := c.bus.Read(c.pc + 2)
-	byte4, _ := c.bus.Read(c.pc + 3)
+// fetchAt reads the instruction word at the given address.
+func (c *Core) fetchAt(address uint32) uint32 {
+	byte1, _ := c.bus.Fetch(address)
+	byte2, _ := c.bus.Fetch(address + 1)
+	byte3, _ := c.bus.Fetch(address + 2)
+	byte4, _ := c.bus.Fetch(address + 3)
 
 	instruction := uint32(byte1) | (uint32(byte2) << 8) |
 		(uint32(byte3) << 16) | (uint32(byte4) << 24)
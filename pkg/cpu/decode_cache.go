@@ -0,0 +1,156 @@
+package cpu
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// cachePageShift selects the size of a decode cache page (4 KiB).
+	cachePageShift = 12
+	// cachePageSlots is the number of instruction slots in a single page.
+	cachePageSlots = (1 << cachePageShift) / 4
+)
+
+// decodedPage holds the decoded instructions of a single code page. A slot
+// with a nil handler has not been decoded yet.
+type decodedPage struct {
+	slots [cachePageSlots]decodedInstruction
+}
+
+// decodeCache keeps pre-decoded instructions keyed by their physical
+// address. Entries are dropped when the bus reports a write into the cached
+// word, when the memory map of the bus changes and on FENCE.I.
+type decodeCache struct {
+	enabled    bool
+	pages      map[uint32]*decodedPage
+	lastTag    uint32
+	lastPage   *decodedPage
+	generation uint64
+}
+
+// newDecodeCache returns an empty, enabled decode cache.
+func newDecodeCache() decodeCache {
+	return decodeCache{
+		enabled: true,
+		pages:   map[uint32]*decodedPage{},
+	}
+}
+
+// page returns the cache page for the given tag, or nil if the page holds no
+// decoded instructions.
+func (c *decodeCache) page(tag uint32) *decodedPage {
+	if c.lastPage != nil && c.lastTag == tag {
+		return c.lastPage
+	}
+	page := c.pages[tag]
+	if page != nil {
+		c.lastTag = tag
+		c.lastPage = page
+	}
+	return page
+}
+
+// lookup returns the decoded instruction at the current PC of the core,
+// fetching and decoding it on a miss.
+func (c *decodeCache) lookup(core *Core) (*decodedInstruction, error) {
+	if c.generation != core.bus.Generation() {
+		c.flush()
+		c.generation = core.bus.Generation()
+	}
+
+	tag := core.pc >> cachePageShift
+	slot := (core.pc & (1<<cachePageShift - 1)) >> 2
+	page := c.page(tag)
+	if page != nil && page.slots[slot].handler != nil && core.pc&3 == 0 {
+		return &page.slots[slot], nil
+	}
+
+	decoded, err := core.decode(core.Fetch())
+	if err != nil {
+		return nil, err
+	}
+	if core.pc&3 != 0 {
+		// Misaligned fetches are rare enough not to be worth caching.
+		return &decoded, nil
+	}
+	if page == nil {
+		page = &decodedPage{}
+		c.pages[tag] = page
+		c.lastTag = tag
+		c.lastPage = page
+	}
+	page.slots[slot] = decoded
+	return &page.slots[slot], nil
+}
+
+// invalidate drops the cached instruction covering the written address.
+func (c *decodeCache) invalidate(address uint32) {
+	if len(c.pages) == 0 {
+		return
+	}
+	page := c.page(address >> cachePageShift)
+	if page == nil {
+		return
+	}
+	page.slots[(address&(1<<cachePageShift-1))>>2] = decodedInstruction{}
+}
+
+// flush drops every cached instruction.
+func (c *decodeCache) flush() {
+	if len(c.pages) == 0 {
+		return
+	}
+	clear(c.pages)
+	c.lastPage = nil
+}
+
+// maxPendingWrites is the number of queued writes after which the caches
+// are flushed completely instead of invalidating single addresses.
+const maxPendingWrites = 256
+
+// writeQueue collects the addresses written on the bus until the owning core
+// applies them to its caches. When harts run in parallel, writes are
+// observed on the goroutines of other harts, so the caches themselves are
+// only ever touched by the owner.
+type writeQueue struct {
+	dirty     atomic.Bool
+	mu        sync.Mutex
+	addresses []uint32
+	overflow  bool
+}
+
+// ObserveWrite queues the written address.
+func (q *writeQueue) ObserveWrite(address uint32) {
+	q.mu.Lock()
+	if len(q.addresses) < maxPendingWrites {
+		q.addresses = append(q.addresses, address)
+	} else {
+		q.overflow = true
+	}
+	q.mu.Unlock()
+	q.dirty.Store(true)
+}
+
+// syncCaches applies the writes observed on the bus to the caches of the
+// core.
+func (c *Core) syncCaches() {
+	if !c.writes.dirty.Load() {
+		return
+	}
+
+	c.writes.mu.Lock()
+	c.writes.dirty.Store(false)
+	if c.writes.overflow {
+		c.cache.flush()
+		c.blocks.flush()
+	} else {
+		for _, address := range c.writes.addresses {
+			c.cache.invalidate(address)
+			c.blocks.invalidate(address)
+		}
+	}
+	c.writes.addresses = c.writes.addresses[:0]
+	c.writes.overflow = false
+	c.writes.mu.Unlock()
+}
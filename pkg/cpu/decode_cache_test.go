@@ -0,0 +1,227 @@
+package cpu
+
+import (
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+// encodeIType assembles an I-type instruction word.
+func encodeIType(opcode, func3, rd, rs1 uint32, imm int32) uint32 {
+	return uint32(imm)<<20 | rs1<<15 | func3<<12 | rd<<7 | opcode
+}
+
+// encodeBType assembles a B-type instruction word.
+func encodeBType(opcode, func3, rs1, rs2 uint32, imm int32) uint32 {
+	u := uint32(imm)
+	return (u>>12&1)<<31 | (u>>5&0x3F)<<25 | rs2<<20 | rs1<<15 |
+		func3<<12 | (u>>1&0xF)<<8 | (u>>11&1)<<7 | opcode
+}
+
+// encodeSType assembles an S-type instruction word.
+func encodeSType(opcode, func3, rs1, rs2 uint32, imm int32) uint32 {
+	u := uint32(imm)
+	return (u>>5&0x7F)<<25 | rs2<<20 | rs1<<15 | func3<<12 |
+		(u&0x1F)<<7 | opcode
+}
+
+// writeWord stores a little-endian instruction word on the bus.
+func writeWord(t testing.TB, bus *devices.Bus, address, value uint32) {
+	t.Helper()
+	for i := uint32(0); i < 4; i++ {
+		err := bus.Write(address+i, byte(value>>(8*i)))
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+}
+
+// setupProgram returns a core with RAM at 0x1000 containing the program.
+func setupProgram(t testing.TB, program ...uint32) (*Core, *devices.Bus) {
+	t.Helper()
+	bus := &devices.Bus{}
+	ramDevice := &devices.RAMDevice{}
+	ramDevice.Initialize(0x1000, 0x1000)
+	bus.AddDevice(ramDevice)
+
+	for i, instruction := range program {
+		writeWord(t, bus, 0x1000+uint32(4*i), instruction)
+	}
+
+	core := NewCore(bus)
+	core.pc = 0x1000
+	return core, bus
+}
+
+func TestDecodeCache_Hit(t *testing.T) {
+	core, _ := setupProgram(t,
+		encodeIType(opcodeAddi, iTypeFunc3Addi, 1, 1, 1), // ADDI x1, x1, 1
+	)
+
+	for i := 0; i < 3; i++ {
+		core.pc = 0x1000
+		err := Step(core)
+		if err != nil {
+			t.Fatalf("Step failed: %v", err)
+		}
+	}
+
+	if core.x[1] != 3 {
+		t.Errorf("Expected x1 to be 3, got %d", core.x[1])
+	}
+	if len(core.cache.pages) != 1 {
+		t.Errorf("Expected 1 cached page, got %d", len(core.cache.pages))
+	}
+}
+
+func TestDecodeCache_InvalidatedByBusWrite(t *testing.T) {
+	core, bus := setupProgram(t,
+		encodeIType(opcodeAddi, iTypeFunc3Addi, 1, 0, 1), // ADDI x1, x0, 1
+	)
+
+	err := Step(core)
+	if err != nil {
+		t.Fatalf("Step failed: %v", err)
+	}
+
+	// Patch the cached instruction to ADDI x1, x0, 2
+	writeWord(t, bus, 0x1000, encodeIType(opcodeAddi, iTypeFunc3Addi, 1, 0, 2))
+	core.pc = 0x1000
+	err = Step(core)
+	if err != nil {
+		t.Fatalf("Step failed: %v", err)
+	}
+
+	if core.x[1] != 2 {
+		t.Errorf("Expected x1 to be 2 after patching, got %d", core.x[1])
+	}
+}
+
+func TestDecodeCache_InvalidatedByStore(t *testing.T) {
+	// The program overwrites the lowest byte of its last instruction,
+	// turning ADDI x3, x0, 7 into ADDI x2, x0, 7.
+	patched := encodeIType(opcodeAddi, iTypeFunc3Addi, 2, 0, 7)
+	core, _ := setupProgram(t,
+		encodeIType(opcodeAddi, iTypeFunc3Addi, 2, 0, int32(patched&0xFF)),
+		encodeSType(opcodeSb, sTypeFunc3Sb, 5, 2, 0), // SB x2, 0(x5)
+		encodeIType(opcodeAddi, iTypeFunc3Addi, 3, 0, 7),
+	)
+	core.x[5] = 0x1008
+
+	// Warm the cache with the unpatched instruction first.
+	core.pc = 0x1008
+	if err := Step(core); err != nil {
+		t.Fatalf("Step failed: %v", err)
+	}
+	core.x[3] = 0
+
+	core.pc = 0x1000
+	for i := 0; i < 3; i++ {
+		if err := Step(core); err != nil {
+			t.Fatalf("Step failed: %v", err)
+		}
+	}
+
+	if core.x[3] != 0 {
+		t.Errorf("Expected x3 to stay 0, got %d", core.x[3])
+	}
+	if core.x[2] != 7 {
+		t.Errorf("Expected x2 to be 7, got %d", core.x[2])
+	}
+}
+
+func TestDecodeCache_FlushedByFenceI(t *testing.T) {
+	core, _ := setupProgram(t,
+		encodeIType(opcodeAddi, iTypeFunc3Addi, 1, 0, 1),
+		encodeIType(opcodeFenceI, iTypeFunc3FenceI, 0, 0, 0),
+	)
+
+	for i := 0; i < 2; i++ {
+		if err := Step(core); err != nil {
+			t.Fatalf("Step failed: %v", err)
+		}
+	}
+
+	if len(core.cache.pages) != 0 {
+		t.Errorf("Expected FENCE.I to flush the cache, got %d pages",
+			len(core.cache.pages))
+	}
+	if core.pc != 0x1008 {
+		t.Errorf("Expected PC to be 1008, got %X", core.pc)
+	}
+}
+
+func TestDecodeCache_FlushedByRemap(t *testing.T) {
+	core, bus := setupProgram(t,
+		encodeIType(opcodeAddi, iTypeFunc3Addi, 1, 0, 1),
+	)
+	if err := Step(core); err != nil {
+		t.Fatalf("Step failed: %v", err)
+	}
+
+	// Replace the RAM with a new device holding a different instruction.
+	bus.RemoveDevice(bus.FindDevice(0x1000))
+	ramDevice := &devices.RAMDevice{}
+	ramDevice.Initialize(0x1000, 0x1000)
+	bus.AddDevice(ramDevice)
+	writeWord(t, bus, 0x1000, encodeIType(opcodeAddi, iTypeFunc3Addi, 1, 0, 5))
+
+	core.pc = 0x1000
+	if err := Step(core); err != nil {
+		t.Fatalf("Step failed: %v", err)
+	}
+
+	if core.x[1] != 5 {
+		t.Errorf("Expected x1 to be 5 after remap, got %d", core.x[1])
+	}
+}
+
+func TestDecodeCache_Disabled(t *testing.T) {
+	core, _ := setupProgram(t,
+		encodeIType(opcodeAddi, iTypeFunc3Addi, 1, 0, 1),
+	)
+	core.SetDecodeCache(false)
+
+	if err := Step(core); err != nil {
+		t.Fatalf("Step failed: %v", err)
+	}
+
+	if len(core.cache.pages) != 0 {
+		t.Errorf("Expected no cached pages, got %d", len(core.cache.pages))
+	}
+	if core.x[1] != 1 {
+		t.Errorf("Expected x1 to be 1, got %d", core.x[1])
+	}
+}
+
+// computeLoop is an endless counting loop used by the benchmarks:
+//
+//	loop: ADDI x1, x1, 1
+//	      ADDI x2, x2, -1
+//	      BNE  x1, x0, loop
+var computeLoop = []uint32{
+	encodeIType(opcodeAddi, iTypeFunc3Addi, 1, 1, 1),
+	encodeIType(opcodeAddi, iTypeFunc3Addi, 2, 2, -1),
+	encodeBType(opcodeBne, bTypeFunc3Bne, 1, 0, -8),
+}
+
+func benchmarkComputeLoop(b *testing.B, cached bool) {
+	core, _ := setupProgram(b, computeLoop...)
+	core.SetDecodeCache(cached)
+
+	for b.Loop() {
+		if err := Step(core); err != nil {
+			b.Fatalf("Step failed: %v", err)
+		}
+	}
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds()/1e6, "MIPS")
+}
+
+func BenchmarkStep_ComputeLoopUncached(b *testing.B) {
+	benchmarkComputeLoop(b, false)
+}
+
+func BenchmarkStep_ComputeLoopCached(b *testing.B) {
+	benchmarkComputeLoop(b, true)
+}
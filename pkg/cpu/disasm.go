@@ -0,0 +1,113 @@
+package cpu
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// abiNames holds the ABI names of the general-purpose registers.
+var abiNames = [32]string{
+	"zero", "ra", "sp", "gp", "tp", "t0", "t1", "t2",
+	"s0", "s1", "a0", "a1", "a2", "a3", "a4", "a5",
+	"a6", "a7", "s2", "s3", "s4", "s5", "s6", "s7",
+	"s8", "s9", "s10", "s11", "t3", "t4", "t5", "t6",
+}
+
+// csrNames holds the names of the implemented CSRs.
+var csrNames = map[uint32]string{
+	CsrMvendorid: "mvendorid",
+	CsrMarchid:   "marchid",
+	CsrMimpid:    "mimpid",
+	CsrMhartid:   "mhartid",
+	CsrMisa:      "misa",
+	CsrMscratch:  "mscratch",
+	CsrMstatus:   "mstatus",
+	CsrMie:       "mie",
+	CsrMtvec:     "mtvec",
+	CsrMepc:      "mepc",
+	CsrMcause:    "mcause",
+	CsrMtval:     "mtval",
+	CsrMip:       "mip",
+}
+
+// RegisterName returns the ABI name of the general-purpose register with
+// the given index, e.g. "sp" for x2.
+func RegisterName(index uint32) string {
+	return abiNames[index]
+}
+
+// ParseRegister returns the index of a general-purpose register given by
+// its ABI name, e.g. "a0", or its numeric name, e.g. "x10". "fp" is
+// accepted for s0.
+func ParseRegister(name string) (uint32, error) {
+	if name == "fp" {
+		return 8, nil
+	}
+	for i, abiName := range abiNames {
+		if name == abiName {
+			return uint32(i), nil
+		}
+	}
+	if number, ok := strings.CutPrefix(name, "x"); ok {
+		index, err := strconv.ParseUint(number, 10, 8)
+		if err == nil && index < 32 {
+			return uint32(index), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown register %q", name)
+}
+
+// csrName returns the name of a CSR, or its number for unknown CSRs.
+func csrName(number uint32) string {
+	if name, ok := csrNames[number]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%03x", number)
+}
+
+// Disassemble returns the assembly of the instruction at address pc in the
+// syntax of the GNU assembler, with registers by their ABI names and branch
+// targets as absolute addresses. Unsupported instructions are shown as
+// ".word".
+func Disassemble(instruction uint32, pc uint32) string {
+	d, err := decode(instruction)
+	if err != nil {
+		return fmt.Sprintf(".word 0x%08x", instruction)
+	}
+
+	rd, rs1, rs2 := abiNames[d.rd], abiNames[d.rs1], abiNames[d.rs2]
+	switch d.mnemonic {
+	case "lui":
+		return fmt.Sprintf("lui %s, 0x%x", rd, uint32(d.imm)&0xFFFFF)
+	case "jal":
+		return fmt.Sprintf("jal %s, 0x%x", rd, pc+uint32(d.imm))
+	case "jalr", "lb", "lbu":
+		return fmt.Sprintf("%s %s, %d(%s)", d.mnemonic, rd, d.imm, rs1)
+	case "sb":
+		return fmt.Sprintf("sb %s, %d(%s)", rs2, d.imm, rs1)
+	case "bne":
+		return fmt.Sprintf("bne %s, %s, 0x%x", rs1, rs2, pc+uint32(d.imm))
+	case "addi":
+		return fmt.Sprintf("addi %s, %s, %d", rd, rs1, d.imm)
+	case "fence", "fence.i", "mret", "wfi":
+		return d.mnemonic
+	case "csrrw", "csrrs", "csrrc":
+		return fmt.Sprintf("%s %s, %s, %s", d.mnemonic, rd,
+			csrName(uint32(d.imm)&0xFFF), rs1)
+	case "csrrwi", "csrrsi", "csrrci":
+		return fmt.Sprintf("%s %s, %s, %d", d.mnemonic, rd,
+			csrName(uint32(d.imm)&0xFFF), d.rs1)
+	case "lr.w":
+		return fmt.Sprintf("lr.w %s, (%s)", rd, rs1)
+	default:
+		// sc.w and the AMOs
+		return fmt.Sprintf("%s %s, %s, (%s)", d.mnemonic, rd, rs2, rs1)
+	}
+}
+
+// IsConditionalBranch reports whether the instruction is a conditional
+// branch, whatever its comparison.
+func IsConditionalBranch(instruction uint32) bool {
+	return instruction&0x7F == opcodeBne
+}
@@ -0,0 +1,59 @@
+package cpu
+
+import "testing"
+
+func TestDisassemble(t *testing.T) {
+	tests := []struct {
+		instruction uint32
+		expected    string
+	}{
+		{encodeIType(opcodeAddi, iTypeFunc3Addi, 10, 2, -16), "addi a0, sp, -16"},
+		{encodeUType(opcodeLui, 5, 0x80001), "lui t0, 0x80001"},
+		{encodeJType(opcodeJal, 1, 0x20), "jal ra, 0x1020"},
+		{encodeIType(opcodeJalr, iTypeFunc3Jalr, 0, 1, 0), "jalr zero, 0(ra)"},
+		{encodeIType(opcodeLbu, iTypeFunc3Lbu, 8, 5, 4), "lbu s0, 4(t0)"},
+		{encodeSType(opcodeSb, sTypeFunc3Sb, 5, 8, -1), "sb s0, -1(t0)"},
+		{encodeBType(opcodeBne, bTypeFunc3Bne, 9, 10, -8), "bne s1, a0, 0xff8"},
+		{encodeIType(opcodeSystem, iTypeFunc3Csrrs, 11, 0, CsrMhartid-0x1000),
+			"csrrs a1, mhartid, zero"},
+		{encodeIType(opcodeSystem, iTypeFunc3Csrrwi, 0, 3, 0x7C0),
+			"csrrwi zero, 0x7c0, 3"},
+		{encodeIType(opcodeFenceI, iTypeFunc3FenceI, 0, 0, 0), "fence.i"},
+		{encodeAmo(amoFunct5Lr, 7, 5, 0), "lr.w t2, (t0)"},
+		{encodeAmo(amoFunct5Amoswap, 0, 5, 6), "amoswap.w zero, t1, (t0)"},
+		{0xFFFFFFFF, ".word 0xffffffff"},
+	}
+
+	for _, test := range tests {
+		actual := Disassemble(test.instruction, 0x1000)
+		if actual != test.expected {
+			t.Errorf("Disassemble(%08X) = %q, expected %q", test.instruction,
+				actual, test.expected)
+		}
+	}
+}
+
+func TestParseRegister(t *testing.T) {
+	tests := map[string]uint32{"zero": 0, "sp": 2, "fp": 8, "s0": 8,
+		"a7": 17, "t6": 31, "x0": 0, "x31": 31}
+	for name, expected := range tests {
+		index, err := ParseRegister(name)
+		if err != nil {
+			t.Fatalf("ParseRegister(%q) failed: %v", name, err)
+		}
+		if index != expected {
+			t.Errorf("ParseRegister(%q) = %d, expected %d", name, index,
+				expected)
+		}
+		if RegisterName(index) != name && name[0] != 'x' && name != "fp" {
+			t.Errorf("RegisterName(%d) = %q, expected %q", index,
+				RegisterName(index), name)
+		}
+	}
+
+	for _, name := range []string{"x32", "pc", ""} {
+		if _, err := ParseRegister(name); err == nil {
+			t.Errorf("Expected error for register %q, got nil", name)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package cpu
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ExceptionCause is the cause of a synchronous exception as reported in the
+// mcause CSR.
+type ExceptionCause uint32
+
+// Causes of the exceptions raised by the implemented instructions.
+const (
+	CauseIllegalInstruction     ExceptionCause = 2
+	CauseLoadAddressMisaligned  ExceptionCause = 4
+	CauseLoadAccessFault        ExceptionCause = 5
+	CauseStoreAddressMisaligned ExceptionCause = 6
+	CauseStoreAccessFault       ExceptionCause = 7
+)
+
+// String returns the name of the cause, e.g. "illegal instruction".
+func (c ExceptionCause) String() string {
+	switch c {
+	case CauseIllegalInstruction:
+		return "illegal instruction"
+	case CauseLoadAddressMisaligned:
+		return "load address misaligned"
+	case CauseLoadAccessFault:
+		return "load access fault"
+	case CauseStoreAddressMisaligned:
+		return "store/AMO address misaligned"
+	case CauseStoreAccessFault:
+		return "store/AMO access fault"
+	default:
+		return fmt.Sprintf("ExceptionCause(%d)", uint32(c))
+	}
+}
+
+// Exception is the error returned for an instruction raising an exception.
+// Exceptions enter the trap handler at mtvec once the guest has set it, and
+// stop execution before.
+type Exception struct {
+	Cause ExceptionCause
+	Err   error
+}
+
+// Error returns the message of the underlying error.
+func (e *Exception) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Exception) Unwrap() error {
+	return e.Err
+}
+
+// ExceptionCauseOf returns the cause of the exception in the error chain, if
+// any.
+func ExceptionCauseOf(err error) (ExceptionCause, bool) {
+	var exception *Exception
+	if errors.As(err, &exception) {
+		return exception.Cause, true
+	}
+	return 0, false
+}
+
+// illegalInstruction returns the exception raised by an unsupported
+// instruction.
+func illegalInstruction(instruction uint32) error {
+	return &Exception{
+		Cause: CauseIllegalInstruction,
+		Err:   fmt.Errorf("unsupported instruction, %032b", instruction),
+	}
+}
+
+// exception wraps the error returned by the handler of the decoded
+// instruction into the exception it raises. Handlers return on the first
+// error without updating registers, so rs1 still holds the address.
+func (c *Core) exception(d *decodedInstruction, err error) error {
+	var cause ExceptionCause
+	switch d.instruction & 0x7F {
+	case opcodeLb:
+		cause = CauseLoadAccessFault
+	case opcodeSb:
+		cause = CauseStoreAccessFault
+	case opcodeAmo:
+		load := d.mnemonic == "lr.w"
+		misaligned := c.x[d.rs1]&3 != 0
+		switch {
+		case load && misaligned:
+			cause = CauseLoadAddressMisaligned
+		case load:
+			cause = CauseLoadAccessFault
+		case misaligned:
+			cause = CauseStoreAddressMisaligned
+		default:
+			cause = CauseStoreAccessFault
+		}
+	default:
+		// CSR accesses
+		cause = CauseIllegalInstruction
+	}
+	return &Exception{Cause: cause, Err: err}
+}
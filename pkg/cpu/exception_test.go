@@ -0,0 +1,53 @@
+package cpu
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRun_ExceptionCauses(t *testing.T) {
+	tests := []struct {
+		name        string
+		instruction uint32
+		rs1         uint32 // Value of x1
+		cause       ExceptionCause
+	}{
+		{"unsupported", 0xFFFFFFFF, 0, CauseIllegalInstruction},
+		{"unsupported CSR", encodeIType(opcodeSystem, iTypeFunc3Csrrs, 2, 0, 0x7C0), 0,
+			CauseIllegalInstruction},
+		{"lb", encodeIType(opcodeLb, iTypeFunc3Lb, 2, 1, 0), 0x9000,
+			CauseLoadAccessFault},
+		{"sb", encodeSType(opcodeSb, sTypeFunc3Sb, 1, 2, 0), 0x9000,
+			CauseStoreAccessFault},
+		{"lr.w misaligned", encodeAmo(amoFunct5Lr, 2, 1, 0), 0x1101,
+			CauseLoadAddressMisaligned},
+		{"amoswap.w", encodeAmo(amoFunct5Amoswap, 2, 1, 0), 0x9000,
+			CauseStoreAccessFault},
+		{"amoswap.w misaligned", encodeAmo(amoFunct5Amoswap, 2, 1, 0), 0x1102,
+			CauseStoreAddressMisaligned},
+	}
+	for _, test := range tests {
+		for _, engine := range []Engine{EngineInterpreter, EngineBlock} {
+			core, _ := setupProgram(t, test.instruction)
+			core.SetEngine(engine)
+			core.x[1] = test.rs1
+
+			_, err := Run(core, 1)
+			cause, ok := ExceptionCauseOf(err)
+			if !ok || cause != test.cause {
+				t.Errorf("%s on %v: expected %v, got %v (%v)", test.name, engine,
+					test.cause, cause, err)
+			}
+		}
+	}
+}
+
+func TestException_Message(t *testing.T) {
+	core, _ := setupProgram(t, encodeIType(opcodeLb, iTypeFunc3Lb, 2, 1, 0))
+	core.x[1] = 0x9000
+
+	err := Step(core)
+	if err == nil || !strings.HasPrefix(err.Error(), "LB failed") {
+		t.Errorf("Expected the handler's error message, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package cpu
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Extensions is a set of ISA extensions implemented on top of the RV32I
+// base.
+type Extensions uint32
+
+const (
+	ExtensionA Extensions = 1 << iota
+	ExtensionZicsr
+	ExtensionZifencei
+
+	// AllExtensions holds every extension the core implements.
+	AllExtensions = ExtensionA | ExtensionZicsr | ExtensionZifencei
+)
+
+// String returns the ISA string of the extensions, e.g.
+// "rv32ia_zicsr_zifencei".
+func (e Extensions) String() string {
+	isa := "rv32i"
+	if e&ExtensionA != 0 {
+		isa += "a"
+	}
+	if e&ExtensionZicsr != 0 {
+		isa += "_zicsr"
+	}
+	if e&ExtensionZifencei != 0 {
+		isa += "_zifencei"
+	}
+	return isa
+}
+
+// ParseExtensions parses an ISA string like "rv32ia_zicsr_zifencei". Only
+// RV32I with the extensions of AllExtensions is supported.
+func ParseExtensions(isa string) (Extensions, error) {
+	lower := strings.ToLower(isa)
+	rest, ok := strings.CutPrefix(lower, "rv32i")
+	if !ok {
+		return 0, fmt.Errorf("ISA string %q does not start with rv32i", isa)
+	}
+
+	var extensions Extensions
+	single, multi, _ := strings.Cut(rest, "_")
+	for _, letter := range single {
+		switch letter {
+		case 'a':
+			extensions |= ExtensionA
+		default:
+			return 0, fmt.Errorf("unsupported extension %q in ISA string %q",
+				strings.ToUpper(string(letter)), isa)
+		}
+	}
+	if multi == "" {
+		return extensions, nil
+	}
+	for _, name := range strings.Split(multi, "_") {
+		switch name {
+		case "zicsr":
+			extensions |= ExtensionZicsr
+		case "zifencei":
+			extensions |= ExtensionZifencei
+		default:
+			return 0, fmt.Errorf("unsupported extension %q in ISA string %q",
+				name, isa)
+		}
+	}
+	return extensions, nil
+}
+
+// SetExtensions selects the extensions the core executes. Instructions of
+// other extensions raise illegal instruction exceptions. Cores implement
+// AllExtensions by default.
+func (c *Core) SetExtensions(extensions Extensions) {
+	c.extensions = extensions
+	c.cache.flush()
+	c.blocks.flush()
+}
+
+// GetExtensions returns the extensions the core executes.
+func (c *Core) GetExtensions() Extensions {
+	return c.extensions
+}
+
+// requiredExtension returns the extension an instruction belongs to, or 0
+// for RV32I instructions.
+func requiredExtension(instruction uint32) Extensions {
+	switch instruction & 0x7F {
+	case opcodeAmo:
+		return ExtensionA
+	case opcodeSystem:
+		if (instruction>>12)&0b111 != 0 {
+			return ExtensionZicsr
+		}
+	case opcodeFenceI:
+		if (instruction>>12)&0b111 == iTypeFunc3FenceI {
+			return ExtensionZifencei
+		}
+	}
+	return 0
+}
+
+// decode decodes an instruction of the extensions the core executes.
+func (c *Core) decode(instruction uint32) (decodedInstruction, error) {
+	if required := requiredExtension(instruction); c.extensions&required != required {
+		return decodedInstruction{}, illegalInstruction(instruction)
+	}
+	return decode(instruction)
+}
@@ -0,0 +1,55 @@
+package cpu
+
+import "testing"
+
+func TestParseExtensions(t *testing.T) {
+	tests := map[string]Extensions{
+		"rv32i":                 0,
+		"RV32IA":                ExtensionA,
+		"rv32i_zicsr":           ExtensionZicsr,
+		"rv32ia_zicsr_zifencei": AllExtensions,
+	}
+	for isa, expected := range tests {
+		extensions, err := ParseExtensions(isa)
+		if err != nil {
+			t.Errorf("ParseExtensions(%q) failed: %v", isa, err)
+			continue
+		}
+		if extensions != expected {
+			t.Errorf("ParseExtensions(%q) = %v, expected %v", isa, extensions,
+				expected)
+		}
+	}
+
+	for _, isa := range []string{"rv64i", "rv32ima", "rv32i_zba", "rv32e"} {
+		if _, err := ParseExtensions(isa); err == nil {
+			t.Errorf("Expected an error for %q", isa)
+		}
+	}
+
+	if isa := AllExtensions.String(); isa != "rv32ia_zicsr_zifencei" {
+		t.Errorf("Unexpected ISA string %q", isa)
+	}
+}
+
+func TestSetExtensions_Disabled(t *testing.T) {
+	for _, engine := range []Engine{EngineInterpreter, EngineBlock} {
+		core, _ := setupProgram(t,
+			encodeIType(opcodeSystem, iTypeFunc3Csrrs, 2, 0, CsrMisa),
+			encodeAmo(amoFunct5Amoswap, 2, 1, 0),
+		)
+		core.SetEngine(engine)
+		core.SetExtensions(ExtensionZicsr)
+		core.x[1] = 0x1100
+
+		_, err := Run(core, 2)
+		if cause, ok := ExceptionCauseOf(err); !ok ||
+			cause != CauseIllegalInstruction {
+			t.Errorf("Expected an illegal instruction on %v, got %v", engine,
+				err)
+		}
+		if misa := core.GetRegister(2); misa&1 != 0 {
+			t.Errorf("Expected misa without A on %v, got %X", engine, misa)
+		}
+	}
+}
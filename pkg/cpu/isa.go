@@ -2,7 +2,6 @@ package cpu
 
 import (
 	"fmt"
-	"log/slog"
 
 	utils "github.com/Keisim/go-riscv-emu/pkg/utils"
 )
@@ -17,6 +16,9 @@ const (
 	opcodeLb   = 0b0000011
 	opcodeLbu  = 0b0000011
 	opcodeBne  = 0b1100011
+
+	opcodeFence  = 0b0001111
+	opcodeFenceI = 0b0001111
 )
 
 // RV32I Funct3 for all instructions
@@ -27,6 +29,9 @@ const (
 	iTypeFunc3Lb   = 0b000
 	iTypeFunc3Lbu  = 0b100
 	bTypeFunc3Bne  = 0b001
+
+	iTypeFunc3Fence  = 0b000
+	iTypeFunc3FenceI = 0b001
 )
 
 // iTypeInstruction represents a parsed I-type instruction
@@ -148,7 +153,6 @@ func parseBType(instruction uint32) bTypeInstruction {
 
 // addi executes the ADDI instruction on the given core.
 func addi(core *Core, instr iTypeInstruction) error {
-	slog.Debug(fmt.Sprintf("Executing ADDI instruction: %+v\n", instr))
 	core.x[instr.rd] = core.x[instr.rs1] + uint32(instr.imm)
 	core.pc += 4
 	return nil
@@ -156,7 +160,6 @@ func addi(core *Core, instr iTypeInstruction) error {
 
 // jarl executes the JALR instruction on the given core.
 func jarl(core *Core, instr iTypeInstruction) error {
-	slog.Debug(fmt.Sprintf("Executing JALR instruction: %+v\n", instr))
 	targetAddress := (core.x[instr.rs1] + uint32(instr.imm)) &^ 1
 	core.x[instr.rd] = core.pc + 4
 	core.pc = targetAddress
@@ -165,7 +168,6 @@ func jarl(core *Core, instr iTypeInstruction) error {
 
 // lui executes the LUI instruction on the given core.
 func lui(core *Core, instr uTypeInstruction) error {
-	slog.Debug(fmt.Sprintf("Executing LUI instruction: %+v\n", instr))
 	core.x[instr.rd] = uint32(instr.imm) << 12
 	core.pc += 4
 	return nil
@@ -173,7 +175,6 @@ func lui(core *Core, instr uTypeInstruction) error {
 
 // sb executes the SB instruction on the given core.
 func sb(core *Core, instr sTypeInstruction) error {
-	slog.Debug(fmt.Sprintf("Executing SB instruction: %+v\n", instr))
 	address := core.x[instr.rs1] + uint32(instr.imm)
 	value := byte(core.x[instr.rs2] & 0xFF)
 
@@ -187,14 +188,12 @@ func sb(core *Core, instr sTypeInstruction) error {
 
 // jal executes the JAL instruction on the given core.
 func jal(core *Core, instr jTypeInstruction) error {
-	slog.Debug(fmt.Sprintf("Executing JAL instruction: %+v\n", instr))
 	core.x[instr.rd] = core.pc + 4
 	core.pc = core.pc + uint32(instr.imm)
 	return nil
 }
 
 func lb(core *Core, instr iTypeInstruction) error {
-	slog.Debug(fmt.Sprintf("Executing LB instruction: %+v\n", instr))
 	address := core.x[instr.rs1] + uint32(instr.imm)
 
 	value, err := core.bus.Read(address)
@@ -208,7 +207,6 @@ func lb(core *Core, instr iTypeInstruction) error {
 }
 
 func lbu(core *Core, instr iTypeInstruction) error {
-	slog.Debug(fmt.Sprintf("Executing LBU instruction: %+v\n", instr))
 	address := core.x[instr.rs1] + uint32(instr.imm)
 
 	value, err := core.bus.Read(address)
@@ -222,7 +220,6 @@ func lbu(core *Core, instr iTypeInstruction) error {
 }
 
 func bne(core *Core, instr bTypeInstruction) error {
-	slog.Debug(fmt.Sprintf("Executing BNE instruction: %+v\n", instr))
 	if core.x[instr.rs1] != core.x[instr.rs2] {
 		core.pc = core.pc + uint32(instr.imm)
 	} else {
@@ -231,37 +228,227 @@ func bne(core *Core, instr bTypeInstruction) error {
 	return nil
 }
 
-// Parse parses a 32-bit instruction word and returns the corresponding
-// instruction struct based on the opcode and funct3 fields.
-func execute(core *Core, instruction uint32) error {
+// fence executes the FENCE instruction on the given core. Memory accesses
+// are performed in program order, so it has nothing to wait for.
+func fence(core *Core, instr iTypeInstruction) error {
+	core.pc += 4
+	return nil
+}
+
+// fenceI executes the FENCE.I instruction on the given core. Every
+// previously decoded instruction and translated block is dropped, so that
+// code written by the core becomes visible to its instruction fetches.
+func fenceI(core *Core, instr iTypeInstruction) error {
+	core.cache.flush()
+	core.blocks.flush()
+	core.pc += 4
+	return nil
+}
+
+// decodedInstruction is an instruction word parsed into its operands,
+// together with the handler that executes it.
+type decodedInstruction struct {
+	handler     func(core *Core, d *decodedInstruction) error
+	mnemonic    string
+	instruction uint32
+	rd          uint32
+	rs1         uint32
+	rs2         uint32
+	imm         int32
+}
+
+func (d *decodedInstruction) iType() iTypeInstruction {
+	return iTypeInstruction{rd: d.rd, rs1: d.rs1, imm: d.imm}
+}
+
+func (d *decodedInstruction) uType() uTypeInstruction {
+	return uTypeInstruction{rd: d.rd, imm: d.imm}
+}
+
+func (d *decodedInstruction) sType() sTypeInstruction {
+	return sTypeInstruction{rs1: d.rs1, rs2: d.rs2, imm: d.imm}
+}
+
+func (d *decodedInstruction) bType() bTypeInstruction {
+	return bTypeInstruction{rs1: d.rs1, rs2: d.rs2, imm: d.imm}
+}
+
+func (d *decodedInstruction) jType() jTypeInstruction {
+	return jTypeInstruction{rd: d.rd, imm: d.imm}
+}
+
+func (d *decodedInstruction) rType() rTypeInstruction {
+	return rTypeInstruction{rd: d.rd, rs1: d.rs1, rs2: d.rs2}
+}
+
+func decodeIType(instruction uint32, mnemonic string,
+	handler func(*Core, *decodedInstruction) error) decodedInstruction {
+	parsed := parseIType(instruction)
+	return decodedInstruction{handler: handler, mnemonic: mnemonic,
+		instruction: instruction, rd: parsed.rd, rs1: parsed.rs1, imm: parsed.imm}
+}
+
+func decodeUType(instruction uint32, mnemonic string,
+	handler func(*Core, *decodedInstruction) error) decodedInstruction {
+	parsed := parseUType(instruction)
+	return decodedInstruction{handler: handler, mnemonic: mnemonic,
+		instruction: instruction, rd: parsed.rd, imm: parsed.imm}
+}
+
+func decodeSType(instruction uint32, mnemonic string,
+	handler func(*Core, *decodedInstruction) error) decodedInstruction {
+	parsed := parseSType(instruction)
+	return decodedInstruction{handler: handler, mnemonic: mnemonic,
+		instruction: instruction, rs1: parsed.rs1, rs2: parsed.rs2, imm: parsed.imm}
+}
+
+func decodeBType(instruction uint32, mnemonic string,
+	handler func(*Core, *decodedInstruction) error) decodedInstruction {
+	parsed := parseBType(instruction)
+	return decodedInstruction{handler: handler, mnemonic: mnemonic,
+		instruction: instruction, rs1: parsed.rs1, rs2: parsed.rs2, imm: parsed.imm}
+}
+
+func decodeJType(instruction uint32, mnemonic string,
+	handler func(*Core, *decodedInstruction) error) decodedInstruction {
+	parsed := parseJType(instruction)
+	return decodedInstruction{handler: handler, mnemonic: mnemonic,
+		instruction: instruction, rd: parsed.rd, imm: parsed.imm}
+}
+
+func decodeRType(instruction uint32, mnemonic string,
+	handler func(*Core, *decodedInstruction) error) decodedInstruction {
+	parsed := parseRType(instruction)
+	return decodedInstruction{handler: handler, mnemonic: mnemonic,
+		instruction: instruction, rd: parsed.rd, rs1: parsed.rs1, rs2: parsed.rs2}
+}
+
+// decode parses a 32-bit instruction word and returns the corresponding
+// decoded instruction based on the opcode and funct3 fields.
+func decode(instruction uint32) (decodedInstruction, error) {
 	opcode := utils.BitsSlice(instruction, 0, 7)
 	func3 := utils.BitsSlice(instruction, 12, 15)
 
 	switch {
 	case opcode == opcodeAddi && func3 == iTypeFunc3Addi:
-		return addi(core, parseIType(instruction))
+		return decodeIType(instruction, "addi", func(c *Core, d *decodedInstruction) error {
+			return addi(c, d.iType())
+		}), nil
 	case opcode == opcodeJalr && func3 == iTypeFunc3Jalr:
-		return jarl(core, parseIType(instruction))
+		return decodeIType(instruction, "jalr", func(c *Core, d *decodedInstruction) error {
+			return jarl(c, d.iType())
+		}), nil
 	case opcode == opcodeLui: // TODO: We might check that before slicing func3
-		return lui(core, parseUType(instruction))
+		return decodeUType(instruction, "lui", func(c *Core, d *decodedInstruction) error {
+			return lui(c, d.uType())
+		}), nil
 	case opcode == opcodeJal:
-		return jal(core, parseJType(instruction))
+		return decodeJType(instruction, "jal", func(c *Core, d *decodedInstruction) error {
+			return jal(c, d.jType())
+		}), nil
 	case opcode == opcodeSb && func3 == sTypeFunc3Sb:
-		return sb(core, parseSType(instruction))
+		return decodeSType(instruction, "sb", func(c *Core, d *decodedInstruction) error {
+			return sb(c, d.sType())
+		}), nil
 	case opcode == opcodeLb && func3 == iTypeFunc3Lb:
-		return lb(core, parseIType(instruction))
+		return decodeIType(instruction, "lb", func(c *Core, d *decodedInstruction) error {
+			return lb(c, d.iType())
+		}), nil
 	case opcode == opcodeLbu && func3 == iTypeFunc3Lbu:
-		return lbu(core, parseIType(instruction))
+		return decodeIType(instruction, "lbu", func(c *Core, d *decodedInstruction) error {
+			return lbu(c, d.iType())
+		}), nil
 	case opcode == opcodeBne && func3 == bTypeFunc3Bne:
-		return bne(core, parseBType(instruction))
+		return decodeBType(instruction, "bne", func(c *Core, d *decodedInstruction) error {
+			return bne(c, d.bType())
+		}), nil
+	case opcode == opcodeFenceI && func3 == iTypeFunc3FenceI:
+		return decodeIType(instruction, "fence.i", func(c *Core, d *decodedInstruction) error {
+			return fenceI(c, d.iType())
+		}), nil
+	case opcode == opcodeFence && func3 == iTypeFunc3Fence:
+		return decodeIType(instruction, "fence", func(c *Core, d *decodedInstruction) error {
+			return fence(c, d.iType())
+		}), nil
+	case instruction == mretInstruction:
+		return decodeIType(instruction, "mret", func(c *Core, d *decodedInstruction) error {
+			return mret(c)
+		}), nil
+	case instruction == wfiInstruction:
+		return decodeIType(instruction, "wfi", func(c *Core, d *decodedInstruction) error {
+			return wfi(c)
+		}), nil
+	case opcode == opcodeSystem && func3 == iTypeFunc3Csrrw:
+		return decodeIType(instruction, "csrrw", func(c *Core, d *decodedInstruction) error {
+			return csrrw(c, d.iType())
+		}), nil
+	case opcode == opcodeSystem && func3 == iTypeFunc3Csrrs:
+		return decodeIType(instruction, "csrrs", func(c *Core, d *decodedInstruction) error {
+			return csrrs(c, d.iType())
+		}), nil
+	case opcode == opcodeSystem && func3 == iTypeFunc3Csrrc:
+		return decodeIType(instruction, "csrrc", func(c *Core, d *decodedInstruction) error {
+			return csrrc(c, d.iType())
+		}), nil
+	case opcode == opcodeSystem && func3 == iTypeFunc3Csrrwi:
+		return decodeIType(instruction, "csrrwi", func(c *Core, d *decodedInstruction) error {
+			return csrrwi(c, d.iType())
+		}), nil
+	case opcode == opcodeSystem && func3 == iTypeFunc3Csrrsi:
+		return decodeIType(instruction, "csrrsi", func(c *Core, d *decodedInstruction) error {
+			return csrrsi(c, d.iType())
+		}), nil
+	case opcode == opcodeSystem && func3 == iTypeFunc3Csrrci:
+		return decodeIType(instruction, "csrrci", func(c *Core, d *decodedInstruction) error {
+			return csrrci(c, d.iType())
+		}), nil
+	case opcode == opcodeAmo:
+		return decodeAtomic(instruction)
 
 	default:
-		return fmt.Errorf("unsupported instruction, %032b", instruction)
+		return decodedInstruction{}, illegalInstruction(instruction)
 	}
 }
 
-// Step fetches and executes the next instruction for the given core.
+// execute decodes and executes a single 32-bit instruction word.
+func execute(core *Core, instruction uint32) error {
+	decoded, err := core.decode(instruction)
+	if err != nil {
+		return err
+	}
+	// The decoded instruction is kept in the core, so that passing it to
+	// the handler does not allocate.
+	core.scratch = decoded
+	return core.retire(&core.scratch)
+}
+
+// Step fetches and executes the next instruction for the given core. When
+// the decode cache is enabled, previously decoded instructions are executed
+// without fetching them over the bus again. A pending interrupt is taken
+// first, and an exception enters the trap handler if mtvec is set.
 func Step(core *Core) error {
+	core.tickTimer(1)
+	if _, err := core.interrupt(); err != nil {
+		return err
+	}
+	err := step(core)
+	if err != nil && core.takeException(err) {
+		return nil
+	}
+	return err
+}
+
+// step fetches and executes the next instruction for the given core.
+func step(core *Core) error {
+	if core.cache.enabled {
+		core.syncCaches()
+		decoded, err := core.cache.lookup(core)
+		if err != nil {
+			return err
+		}
+		return core.retire(decoded)
+	}
+
 	instruction := core.Fetch()
 	err := execute(core, instruction)
 	if err != nil {
@@ -0,0 +1,284 @@
+package cpu
+
+import (
+	"fmt"
+
+	utils "github.com/Keisim/go-riscv-emu/pkg/utils"
+)
+
+// RV32A Instruction opcodes
+const (
+	opcodeAmo = 0b0101111
+)
+
+// RV32A Funct3 for all instructions
+const (
+	rTypeFunc3AmoW = 0b010
+)
+
+// RV32A Funct5 for all instructions
+const (
+	amoFunct5Lr      = 0b00010
+	amoFunct5Sc      = 0b00011
+	amoFunct5Amoswap = 0b00001
+	amoFunct5Amoadd  = 0b00000
+	amoFunct5Amoxor  = 0b00100
+	amoFunct5Amoand  = 0b01100
+	amoFunct5Amoor   = 0b01000
+	amoFunct5Amomin  = 0b10000
+	amoFunct5Amomax  = 0b10100
+	amoFunct5Amominu = 0b11000
+	amoFunct5Amomaxu = 0b11100
+)
+
+// rTypeInstruction represents a parsed R-type instruction
+type rTypeInstruction struct {
+	rd  uint32 // Destination register
+	rs1 uint32 // Source register 1
+	rs2 uint32 // Source register 2
+}
+
+// parseRType parses a 32-bit R-type instruction and returns an
+// rTypeInstruction struct.
+func parseRType(instruction uint32) rTypeInstruction {
+	return rTypeInstruction{
+		rd:  utils.BitsSlice(instruction, 7, 12),
+		rs1: utils.BitsSlice(instruction, 15, 20),
+		rs2: utils.BitsSlice(instruction, 20, 25),
+	}
+}
+
+// reservation is the LR/SC reservation set of a core. It covers a single
+// naturally aligned word and is broken by any write into that word.
+type reservation struct {
+	valid   bool
+	address uint32
+}
+
+// ObserveWrite breaks the reservation when the reserved word is written.
+// The bus calls it with its lock held, so it is safe against concurrent
+// LR/SC on other harts.
+func (r *reservation) ObserveWrite(address uint32) {
+	if r.valid && address&^3 == r.address {
+		r.valid = false
+	}
+}
+
+// readWordLocked reads a little-endian word from the bus. The caller must
+// hold the bus lock.
+func (c *Core) readWordLocked(address uint32) (uint32, error) {
+	var value uint32
+	for i := uint32(0); i < 4; i++ {
+		b, err := c.bus.ReadLocked(address + i)
+		if err != nil {
+			return 0, err
+		}
+		value |= uint32(b) << (8 * i)
+	}
+	return value, nil
+}
+
+// writeWordLocked writes a little-endian word to the bus. The caller must
+// hold the bus lock.
+func (c *Core) writeWordLocked(address uint32, value uint32) error {
+	for i := uint32(0); i < 4; i++ {
+		err := c.bus.WriteLocked(address+i, byte(value>>(8*i)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lrw executes the LR.W instruction on the given core.
+func lrw(core *Core, instr rTypeInstruction) error {
+	address := core.x[instr.rs1]
+	if address&3 != 0 {
+		return fmt.Errorf("LR.W failed: misaligned address %X", address)
+	}
+
+	core.bus.Lock()
+	defer core.bus.Unlock()
+	value, err := core.readWordLocked(address)
+	if err != nil {
+		return fmt.Errorf("LR.W failed: %v", err)
+	}
+
+	core.reservation = reservation{valid: true, address: address}
+	core.x[instr.rd] = value
+	core.pc += 4
+	return nil
+}
+
+// scw executes the SC.W instruction on the given core. rd is set to 0 on
+// success and to 1 when the reservation was lost.
+func scw(core *Core, instr rTypeInstruction) error {
+	address := core.x[instr.rs1]
+	if address&3 != 0 {
+		return fmt.Errorf("SC.W failed: misaligned address %X", address)
+	}
+
+	core.bus.Lock()
+	defer core.bus.Unlock()
+	result := uint32(1)
+	if core.reservation.valid && core.reservation.address == address {
+		err := core.writeWordLocked(address, core.x[instr.rs2])
+		if err != nil {
+			return fmt.Errorf("SC.W failed: %v", err)
+		}
+		result = 0
+	}
+
+	core.reservation.valid = false
+	core.x[instr.rd] = result
+	core.pc += 4
+	return nil
+}
+
+// amo executes an atomic memory operation on the given core. The word at
+// the address in rs1 is replaced with op(old, rs2) and the old value is
+// written to rd, all while holding the bus lock.
+func amo(core *Core, instr rTypeInstruction, name string,
+	op func(old, operand uint32) uint32) error {
+	address := core.x[instr.rs1]
+	if address&3 != 0 {
+		return fmt.Errorf("%s failed: misaligned address %X", name, address)
+	}
+
+	core.bus.Lock()
+	defer core.bus.Unlock()
+	old, err := core.readWordLocked(address)
+	if err != nil {
+		return fmt.Errorf("%s failed: %v", name, err)
+	}
+	err = core.writeWordLocked(address, op(old, core.x[instr.rs2]))
+	if err != nil {
+		return fmt.Errorf("%s failed: %v", name, err)
+	}
+
+	core.x[instr.rd] = old
+	core.pc += 4
+	return nil
+}
+
+// amoswapw executes the AMOSWAP.W instruction on the given core.
+func amoswapw(core *Core, instr rTypeInstruction) error {
+	return amo(core, instr, "AMOSWAP.W", func(old, operand uint32) uint32 {
+		return operand
+	})
+}
+
+// amoaddw executes the AMOADD.W instruction on the given core.
+func amoaddw(core *Core, instr rTypeInstruction) error {
+	return amo(core, instr, "AMOADD.W", func(old, operand uint32) uint32 {
+		return old + operand
+	})
+}
+
+// amoxorw executes the AMOXOR.W instruction on the given core.
+func amoxorw(core *Core, instr rTypeInstruction) error {
+	return amo(core, instr, "AMOXOR.W", func(old, operand uint32) uint32 {
+		return old ^ operand
+	})
+}
+
+// amoandw executes the AMOAND.W instruction on the given core.
+func amoandw(core *Core, instr rTypeInstruction) error {
+	return amo(core, instr, "AMOAND.W", func(old, operand uint32) uint32 {
+		return old & operand
+	})
+}
+
+// amoorw executes the AMOOR.W instruction on the given core.
+func amoorw(core *Core, instr rTypeInstruction) error {
+	return amo(core, instr, "AMOOR.W", func(old, operand uint32) uint32 {
+		return old | operand
+	})
+}
+
+// amominw executes the AMOMIN.W instruction on the given core.
+func amominw(core *Core, instr rTypeInstruction) error {
+	return amo(core, instr, "AMOMIN.W", func(old, operand uint32) uint32 {
+		return uint32(min(int32(old), int32(operand)))
+	})
+}
+
+// amomaxw executes the AMOMAX.W instruction on the given core.
+func amomaxw(core *Core, instr rTypeInstruction) error {
+	return amo(core, instr, "AMOMAX.W", func(old, operand uint32) uint32 {
+		return uint32(max(int32(old), int32(operand)))
+	})
+}
+
+// amominuw executes the AMOMINU.W instruction on the given core.
+func amominuw(core *Core, instr rTypeInstruction) error {
+	return amo(core, instr, "AMOMINU.W", func(old, operand uint32) uint32 {
+		return min(old, operand)
+	})
+}
+
+// amomaxuw executes the AMOMAXU.W instruction on the given core.
+func amomaxuw(core *Core, instr rTypeInstruction) error {
+	return amo(core, instr, "AMOMAXU.W", func(old, operand uint32) uint32 {
+		return max(old, operand)
+	})
+}
+
+// decodeAtomic decodes an instruction of the RV32A extension.
+func decodeAtomic(instruction uint32) (decodedInstruction, error) {
+	func3 := utils.BitsSlice(instruction, 12, 15)
+	funct5 := utils.BitsSlice(instruction, 27, 32)
+	if func3 != rTypeFunc3AmoW {
+		return decodedInstruction{}, illegalInstruction(instruction)
+	}
+
+	switch funct5 {
+	case amoFunct5Lr:
+		return decodeRType(instruction, "lr.w", func(c *Core, d *decodedInstruction) error {
+			return lrw(c, d.rType())
+		}), nil
+	case amoFunct5Sc:
+		return decodeRType(instruction, "sc.w", func(c *Core, d *decodedInstruction) error {
+			return scw(c, d.rType())
+		}), nil
+	case amoFunct5Amoswap:
+		return decodeRType(instruction, "amoswap.w", func(c *Core, d *decodedInstruction) error {
+			return amoswapw(c, d.rType())
+		}), nil
+	case amoFunct5Amoadd:
+		return decodeRType(instruction, "amoadd.w", func(c *Core, d *decodedInstruction) error {
+			return amoaddw(c, d.rType())
+		}), nil
+	case amoFunct5Amoxor:
+		return decodeRType(instruction, "amoxor.w", func(c *Core, d *decodedInstruction) error {
+			return amoxorw(c, d.rType())
+		}), nil
+	case amoFunct5Amoand:
+		return decodeRType(instruction, "amoand.w", func(c *Core, d *decodedInstruction) error {
+			return amoandw(c, d.rType())
+		}), nil
+	case amoFunct5Amoor:
+		return decodeRType(instruction, "amoor.w", func(c *Core, d *decodedInstruction) error {
+			return amoorw(c, d.rType())
+		}), nil
+	case amoFunct5Amomin:
+		return decodeRType(instruction, "amomin.w", func(c *Core, d *decodedInstruction) error {
+			return amominw(c, d.rType())
+		}), nil
+	case amoFunct5Amomax:
+		return decodeRType(instruction, "amomax.w", func(c *Core, d *decodedInstruction) error {
+			return amomaxw(c, d.rType())
+		}), nil
+	case amoFunct5Amominu:
+		return decodeRType(instruction, "amominu.w", func(c *Core, d *decodedInstruction) error {
+			return amominuw(c, d.rType())
+		}), nil
+	case amoFunct5Amomaxu:
+		return decodeRType(instruction, "amomaxu.w", func(c *Core, d *decodedInstruction) error {
+			return amomaxuw(c, d.rType())
+		}), nil
+
+	default:
+		return decodedInstruction{}, illegalInstruction(instruction)
+	}
+}
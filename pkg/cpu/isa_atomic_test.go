@@ -0,0 +1,160 @@
+package cpu
+
+import (
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+// encodeAmo assembles an AMO instruction word with the given funct5.
+func encodeAmo(funct5, rd, rs1, rs2 uint32) uint32 {
+	return funct5<<27 | rs2<<20 | rs1<<15 | rTypeFunc3AmoW<<12 | rd<<7 |
+		opcodeAmo
+}
+
+// setupAtomicCore returns a core with RAM at 0x1000 and x1 pointing at a
+// word initialized to the given value.
+func setupAtomicCore(t *testing.T, value uint32) (*Core, *devices.Bus) {
+	t.Helper()
+	core, bus := setupProgram(t)
+	writeWord(t, bus, 0x1100, value)
+	core.x[1] = 0x1100
+	return core, bus
+}
+
+func readWord(t *testing.T, bus *devices.Bus, address uint32) uint32 {
+	t.Helper()
+	var value uint32
+	for i := uint32(0); i < 4; i++ {
+		b, err := bus.Read(address + i)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		value |= uint32(b) << (8 * i)
+	}
+	return value
+}
+
+func TestAmo(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  func(*Core, rTypeInstruction) error
+		old      uint32
+		operand  uint32
+		expected uint32
+	}{
+		{"amoswap.w", amoswapw, 5, 7, 7},
+		{"amoadd.w", amoaddw, 5, 7, 12},
+		{"amoxor.w", amoxorw, 0b1100, 0b1010, 0b0110},
+		{"amoand.w", amoandw, 0b1100, 0b1010, 0b1000},
+		{"amoor.w", amoorw, 0b1100, 0b1010, 0b1110},
+		{"amomin.w", amominw, 0xFFFFFFFF, 1, 0xFFFFFFFF},
+		{"amomax.w", amomaxw, 0xFFFFFFFF, 1, 1},
+		{"amominu.w", amominuw, 0xFFFFFFFF, 1, 1},
+		{"amomaxu.w", amomaxuw, 0xFFFFFFFF, 1, 0xFFFFFFFF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			core, bus := setupAtomicCore(t, test.old)
+			core.x[2] = test.operand
+
+			err := test.handler(core, rTypeInstruction{rd: 3, rs1: 1, rs2: 2})
+			if err != nil {
+				t.Fatalf("%s failed: %v", test.name, err)
+			}
+
+			if core.x[3] != test.old {
+				t.Errorf("Expected x3 to be %X, got %X", test.old, core.x[3])
+			}
+			value := readWord(t, bus, 0x1100)
+			if value != test.expected {
+				t.Errorf("Expected memory to be %X, got %X", test.expected,
+					value)
+			}
+		})
+	}
+}
+
+func TestAmo_Misaligned(t *testing.T) {
+	core, _ := setupAtomicCore(t, 0)
+	core.x[1] = 0x1101
+
+	err := amoaddw(core, rTypeInstruction{rd: 3, rs1: 1, rs2: 2})
+	if err == nil {
+		t.Error("Expected error for misaligned AMO, got nil")
+	}
+}
+
+func TestLrSc(t *testing.T) {
+	core, bus := setupAtomicCore(t, 0x11223344)
+	core.x[2] = 0xCAFE
+
+	if err := lrw(core, rTypeInstruction{rd: 3, rs1: 1}); err != nil {
+		t.Fatalf("lrw failed: %v", err)
+	}
+	if core.x[3] != 0x11223344 {
+		t.Errorf("Expected x3 to be 11223344, got %X", core.x[3])
+	}
+
+	if err := scw(core, rTypeInstruction{rd: 4, rs1: 1, rs2: 2}); err != nil {
+		t.Fatalf("scw failed: %v", err)
+	}
+	if core.x[4] != 0 {
+		t.Errorf("Expected SC.W to succeed, got %d", core.x[4])
+	}
+	if value := readWord(t, bus, 0x1100); value != 0xCAFE {
+		t.Errorf("Expected memory to be CAFE, got %X", value)
+	}
+
+	// The reservation is consumed by the first SC.W.
+	if err := scw(core, rTypeInstruction{rd: 4, rs1: 1, rs2: 0}); err != nil {
+		t.Fatalf("scw failed: %v", err)
+	}
+	if core.x[4] != 1 {
+		t.Errorf("Expected second SC.W to fail, got %d", core.x[4])
+	}
+}
+
+func TestLrSc_BrokenByOtherHart(t *testing.T) {
+	core, bus := setupAtomicCore(t, 0)
+	other := NewCore(bus)
+	other.SetHartID(1)
+	other.x[1] = 0x1100
+	other.x[2] = 0x42
+
+	if err := lrw(core, rTypeInstruction{rd: 3, rs1: 1}); err != nil {
+		t.Fatalf("lrw failed: %v", err)
+	}
+	if err := sb(other, sTypeInstruction{rs1: 1, rs2: 2, imm: 2}); err != nil {
+		t.Fatalf("sb failed: %v", err)
+	}
+	if err := scw(core, rTypeInstruction{rd: 4, rs1: 1, rs2: 2}); err != nil {
+		t.Fatalf("scw failed: %v", err)
+	}
+
+	if core.x[4] != 1 {
+		t.Errorf("Expected SC.W to fail after a store by another hart, got %d",
+			core.x[4])
+	}
+	if value := readWord(t, bus, 0x1100); value != 0x420000 {
+		t.Errorf("Expected memory to be 420000, got %X", value)
+	}
+}
+
+func TestStep_Amoadd(t *testing.T) {
+	core, bus := setupProgram(t,
+		encodeAmo(amoFunct5Amoadd, 3, 1, 2), // AMOADD.W x3, x2, (x1)
+	)
+	writeWord(t, bus, 0x1100, 40)
+	core.x[1] = 0x1100
+	core.x[2] = 2
+
+	if err := Step(core); err != nil {
+		t.Fatalf("Step failed: %v", err)
+	}
+
+	if value := readWord(t, bus, 0x1100); value != 42 {
+		t.Errorf("Expected memory to be 42, got %d", value)
+	}
+}
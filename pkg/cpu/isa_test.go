@@ -338,3 +338,18 @@ func TestParseJType(t *testing.T) {
 		t.Errorf("Expected imm to be 0, got %d", parsed.imm)
 	}
 }
+
+func TestStep_ZeroRegisterHardwired(t *testing.T) {
+	core, _ := setupProgram(t,
+		encodeJType(opcodeJal, 0, 8), // JAL x0, 8
+	)
+
+	err := Step(core)
+	if err != nil {
+		t.Fatalf("Step failed: %v", err)
+	}
+
+	if core.x[0] != 0 {
+		t.Errorf("Expected x0 to stay 0, got %X", core.x[0])
+	}
+}
@@ -0,0 +1,207 @@
+package cpu
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Zicsr and machine-level opcodes
+const (
+	opcodeSystem = 0b1110011
+)
+
+// Zicsr Funct3 for all instructions
+const (
+	iTypeFunc3Csrrw  = 0b001
+	iTypeFunc3Csrrs  = 0b010
+	iTypeFunc3Csrrc  = 0b011
+	iTypeFunc3Csrrwi = 0b101
+	iTypeFunc3Csrrsi = 0b110
+	iTypeFunc3Csrrci = 0b111
+)
+
+// Machine-level CSR numbers
+const (
+	CsrMvendorid = 0xF11
+	CsrMarchid   = 0xF12
+	CsrMimpid    = 0xF13
+	CsrMhartid   = 0xF14
+	CsrMisa      = 0x301
+	CsrMscratch  = 0x340
+)
+
+// misaValue reports RV32 with the I extension, and A if enabled. The Z
+// extensions have no bits in misa.
+func (c *Core) misaValue() uint32 {
+	value := uint32(1<<30 | 1<<('I'-'A'))
+	if c.extensions&ExtensionA != 0 {
+		value |= 1 << ('A' - 'A')
+	}
+	return value
+}
+
+// csrFile holds the writable control and status registers of a core.
+type csrFile struct {
+	mscratch uint32
+	mstatus  uint32 // MIE and MPIE
+	mie      uint32
+	mtvec    uint32
+	mepc     uint32
+	mcause   uint32
+	mtval    uint32
+
+	// mip is driven by the interrupt lines of devices, see InterruptLine.
+	mip atomic.Uint32
+}
+
+// GetCSR returns the value of the given control and status register.
+func (c *Core) GetCSR(number uint32) (uint32, error) {
+	switch number {
+	case CsrMvendorid, CsrMarchid, CsrMimpid:
+		return 0, nil
+	case CsrMhartid:
+		return c.hartID, nil
+	case CsrMisa:
+		return c.misaValue(), nil
+	case CsrMscratch:
+		return c.csr.mscratch, nil
+	case CsrMstatus:
+		return c.csr.mstatus | mstatusMPP, nil
+	case CsrMie:
+		return c.csr.mie, nil
+	case CsrMip:
+		if c.interrupts != nil {
+			return c.seen.pending, nil
+		}
+		return c.csr.mip.Load(), nil
+	case CsrMtvec:
+		return c.csr.mtvec, nil
+	case CsrMepc:
+		return c.csr.mepc, nil
+	case CsrMcause:
+		return c.csr.mcause, nil
+	case CsrMtval:
+		return c.csr.mtval, nil
+	default:
+		return 0, fmt.Errorf("unsupported CSR %X", number)
+	}
+}
+
+// SetCSR writes the given control and status register. Writes to read-only
+// registers return an error.
+func (c *Core) SetCSR(number uint32, value uint32) error {
+	switch number {
+	case CsrMscratch:
+		c.csr.mscratch = value
+		return nil
+	case CsrMstatus:
+		c.csr.mstatus = value & (mstatusMIE | mstatusMPIE)
+		return nil
+	case CsrMie:
+		c.csr.mie = value & interruptMask
+		return nil
+	case CsrMip:
+		// The pending bits are driven by the CLINT and the PLIC.
+		return nil
+	case CsrMtvec:
+		// Only the direct and vectored modes exist.
+		if value&3 > 1 {
+			value &^= 3
+		}
+		c.csr.mtvec = value
+		return nil
+	case CsrMepc:
+		c.csr.mepc = value &^ 3
+		return nil
+	case CsrMcause:
+		c.csr.mcause = value
+		return nil
+	case CsrMtval:
+		c.csr.mtval = value
+		return nil
+	case CsrMvendorid, CsrMarchid, CsrMimpid, CsrMhartid:
+		return fmt.Errorf("write to read-only CSR %X", number)
+	case CsrMisa:
+		// misa is WARL, the set of extensions cannot be changed.
+		return nil
+	default:
+		return fmt.Errorf("unsupported CSR %X", number)
+	}
+}
+
+// csrNumber returns the CSR number encoded in the immediate of an
+// I-type instruction.
+func csrNumber(instr iTypeInstruction) uint32 {
+	return uint32(instr.imm) & 0xFFF
+}
+
+// csrReadModifyWrite implements the common part of the CSR instructions.
+// The CSR is read only when read is set and written only when write is set.
+func csrReadModifyWrite(core *Core, instr iTypeInstruction, read, write bool,
+	modify func(old uint32) uint32) error {
+	number := csrNumber(instr)
+	var old uint32
+	if read {
+		var err error
+		if number == CsrMip {
+			// Let the interceptor decide the pending interrupts.
+			if _, err := core.pending(); err != nil {
+				return err
+			}
+		}
+		old, err = core.GetCSR(number)
+		if err != nil {
+			return err
+		}
+	}
+	if write {
+		err := core.SetCSR(number, modify(old))
+		if err != nil {
+			return err
+		}
+	}
+	core.x[instr.rd] = old
+	core.pc += 4
+	return nil
+}
+
+// csrrw executes the CSRRW instruction on the given core. With rd = x0 it
+// does not read the CSR.
+func csrrw(core *Core, instr iTypeInstruction) error {
+	value := core.x[instr.rs1]
+	return csrReadModifyWrite(core, instr, instr.rd != 0, true,
+		func(uint32) uint32 { return value })
+}
+
+// csrrs executes the CSRRS instruction on the given core.
+func csrrs(core *Core, instr iTypeInstruction) error {
+	mask := core.x[instr.rs1]
+	return csrReadModifyWrite(core, instr, true, instr.rs1 != 0,
+		func(old uint32) uint32 { return old | mask })
+}
+
+// csrrc executes the CSRRC instruction on the given core.
+func csrrc(core *Core, instr iTypeInstruction) error {
+	mask := core.x[instr.rs1]
+	return csrReadModifyWrite(core, instr, true, instr.rs1 != 0,
+		func(old uint32) uint32 { return old &^ mask })
+}
+
+// csrrwi executes the CSRRWI instruction on the given core. The rs1 field
+// holds a 5-bit unsigned immediate. With rd = x0 it does not read the CSR.
+func csrrwi(core *Core, instr iTypeInstruction) error {
+	return csrReadModifyWrite(core, instr, instr.rd != 0, true,
+		func(uint32) uint32 { return instr.rs1 })
+}
+
+// csrrsi executes the CSRRSI instruction on the given core.
+func csrrsi(core *Core, instr iTypeInstruction) error {
+	return csrReadModifyWrite(core, instr, true, instr.rs1 != 0,
+		func(old uint32) uint32 { return old | instr.rs1 })
+}
+
+// csrrci executes the CSRRCI instruction on the given core.
+func csrrci(core *Core, instr iTypeInstruction) error {
+	return csrReadModifyWrite(core, instr, true, instr.rs1 != 0,
+		func(old uint32) uint32 { return old &^ instr.rs1 })
+}
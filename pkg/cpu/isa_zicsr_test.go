@@ -0,0 +1,111 @@
+package cpu
+
+import (
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+func TestCsrrs_Mhartid(t *testing.T) {
+	core := NewCore(&devices.Bus{})
+	core.SetHartID(3)
+
+	instr := iTypeInstruction{
+		rd:  5,          // Destination register x5
+		rs1: 0,          // No bits to set
+		imm: CsrMhartid, // CSR number
+	}
+
+	err := csrrs(core, instr)
+	if err != nil {
+		t.Fatalf("csrrs failed: %v", err)
+	}
+
+	if core.x[5] != 3 {
+		t.Errorf("Expected x5 to be 3, got %d", core.x[5])
+	}
+}
+
+func TestCsrrw_ReadOnly(t *testing.T) {
+	core := NewCore(&devices.Bus{})
+
+	instr := iTypeInstruction{
+		rd:  5,
+		rs1: 1,
+		imm: int32(0xF14 - 0x1000), // Sign-extended mhartid
+	}
+
+	err := csrrw(core, instr)
+	if err == nil {
+		t.Error("Expected error when writing mhartid, got nil")
+	}
+}
+
+func TestCsrInstructions_Mscratch(t *testing.T) {
+	core := NewCore(&devices.Bus{})
+	scratch := iTypeInstruction{rd: 2, rs1: 1, imm: CsrMscratch}
+
+	core.x[1] = 0xF0
+	if err := csrrw(core, scratch); err != nil {
+		t.Fatalf("csrrw failed: %v", err)
+	}
+
+	core.x[1] = 0x0F
+	if err := csrrs(core, scratch); err != nil {
+		t.Fatalf("csrrs failed: %v", err)
+	}
+	if core.x[2] != 0xF0 {
+		t.Errorf("Expected old value F0, got %X", core.x[2])
+	}
+
+	core.x[1] = 0x11
+	if err := csrrc(core, scratch); err != nil {
+		t.Fatalf("csrrc failed: %v", err)
+	}
+	if core.x[2] != 0xFF {
+		t.Errorf("Expected old value FF, got %X", core.x[2])
+	}
+
+	// The immediate variants take a 5-bit unsigned value in rs1.
+	if err := csrrci(core, iTypeInstruction{rd: 2, rs1: 0x1F, imm: CsrMscratch}); err != nil {
+		t.Fatalf("csrrci failed: %v", err)
+	}
+	if err := csrrsi(core, iTypeInstruction{rd: 2, rs1: 0x01, imm: CsrMscratch}); err != nil {
+		t.Fatalf("csrrsi failed: %v", err)
+	}
+	if err := csrrwi(core, iTypeInstruction{rd: 2, rs1: 0x07, imm: CsrMscratch}); err != nil {
+		t.Fatalf("csrrwi failed: %v", err)
+	}
+	if core.x[2] != 0xE1 {
+		t.Errorf("Expected old value E1, got %X", core.x[2])
+	}
+
+	value, _ := core.GetCSR(CsrMscratch)
+	if value != 0x07 {
+		t.Errorf("Expected mscratch to be 7, got %X", value)
+	}
+}
+
+func TestGetCSR_Unsupported(t *testing.T) {
+	core := NewCore(&devices.Bus{})
+
+	_, err := core.GetCSR(0x7C0)
+	if err == nil {
+		t.Error("Expected error for unsupported CSR, got nil")
+	}
+}
+
+func TestStep_Csrrs(t *testing.T) {
+	core, _ := setupProgram(t,
+		encodeIType(opcodeSystem, iTypeFunc3Csrrs, 10, 0, CsrMhartid-0x1000),
+	)
+	core.SetHartID(1)
+
+	if err := Step(core); err != nil {
+		t.Fatalf("Step failed: %v", err)
+	}
+
+	if core.x[10] != 1 {
+		t.Errorf("Expected a0 to be 1, got %d", core.x[10])
+	}
+}
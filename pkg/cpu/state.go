@@ -0,0 +1,78 @@
+package cpu
+
+// CoreState is the architectural state of a Core, as saved in snapshots.
+type CoreState struct {
+	Pc       uint32
+	X        [32]uint32
+	Mscratch uint32
+	Instret  uint64
+
+	// Machine trap setup and handling CSRs. mip is not saved, as the
+	// devices driving it restore it.
+	Mstatus, Mie, Mtvec, Mepc, Mcause, Mtval uint32
+
+	// The LR/SC reservation, so that an SC after the restore succeeds
+	// exactly when it would have in the saved machine.
+	Reserved    bool
+	Reservation uint32
+
+	// The interrupts last returned by the InterruptInterceptor and whether
+	// it returned them at the current instruction, so that replayed
+	// interrupts continue from the restore as they did in the saved run.
+	Interrupts     uint32
+	InterruptsSeen bool
+}
+
+// State returns the architectural state of the core.
+func (c *Core) State() CoreState {
+	return CoreState{
+		Pc:       c.pc,
+		X:        c.x,
+		Mscratch: c.csr.mscratch,
+		Instret:  c.instret,
+		Mstatus:  c.csr.mstatus,
+		Mie:      c.csr.mie,
+		Mtvec:    c.csr.mtvec,
+		Mepc:     c.csr.mepc,
+		Mcause:   c.csr.mcause,
+		Mtval:    c.csr.mtval,
+
+		Reserved:    c.reservation.valid,
+		Reservation: c.reservation.address,
+
+		Interrupts:     c.seen.pending,
+		InterruptsSeen: c.seen.valid && c.seen.instret == c.instret,
+	}
+}
+
+// SetState replaces the architectural state of the core, including its
+// LR/SC reservation and the interrupts seen through its interceptor.
+func (c *Core) SetState(state CoreState) {
+	c.pc = state.Pc
+	c.x = state.X
+	c.x[0] = 0
+	c.csr.mscratch = state.Mscratch
+	c.instret = state.Instret
+	c.csr.mstatus = state.Mstatus
+	c.csr.mie = state.Mie
+	c.csr.mtvec = state.Mtvec
+	c.csr.mepc = state.Mepc
+	c.csr.mcause = state.Mcause
+	c.csr.mtval = state.Mtval
+	c.reservation = reservation{valid: state.Reserved, address: state.Reservation}
+	c.seen = seenInterrupts{
+		pending: state.Interrupts,
+		instret: state.Instret,
+		valid:   state.InterruptsSeen,
+	}
+	c.resume.valid = false
+}
+
+// FlushCaches drops all decoded instructions and translated blocks. It has
+// to be called when memory is modified without going through the bus, e.g.
+// when a snapshot is restored into the devices directly.
+func (c *Core) FlushCaches() {
+	c.syncCaches()
+	c.cache.flush()
+	c.blocks.flush()
+}
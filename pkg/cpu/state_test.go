@@ -0,0 +1,38 @@
+package cpu
+
+import (
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+func TestCoreState_RoundTrip(t *testing.T) {
+	core := NewCore(&devices.Bus{})
+	core.pc = 0x1234
+	core.x[5] = 42
+	core.csr.mscratch = 0xABCD
+	core.reservation = reservation{valid: true, address: 0x1000}
+	core.seen = seenInterrupts{pending: 1 << 7, valid: true}
+
+	state := core.State()
+	restored := NewCore(&devices.Bus{})
+	restored.SetState(state)
+
+	if restored.State() != state {
+		t.Errorf("Expected state %+v, got %+v", state, restored.State())
+	}
+}
+
+func TestCoreState_ZeroRegister(t *testing.T) {
+	core := NewCore(&devices.Bus{})
+	core.reservation = reservation{valid: true, address: 0x1000}
+
+	core.SetState(CoreState{X: [32]uint32{0: 7}})
+
+	if core.x[0] != 0 {
+		t.Errorf("Expected x0 to stay 0, got %d", core.x[0])
+	}
+	if core.reservation.valid {
+		t.Error("Expected SetState to replace the reservation")
+	}
+}
@@ -0,0 +1,171 @@
+package cpu
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/Keisim/go-riscv-emu/pkg/symbols"
+)
+
+// TraceEvent describes a single instruction retired by a Core.
+type TraceEvent struct {
+	Pc          uint32 // Address of the instruction
+	NextPc      uint32 // Program counter after the instruction
+	Instruction uint32 // Raw instruction word
+	Mnemonic    string // Lower-case instruction mnemonic, e.g. "addi"
+	Rd          uint32 // Destination register
+	Rs1         uint32 // Source register 1
+	Rs2         uint32 // Source register 2
+	Imm         int32  // Immediate value
+	Address     uint32 // Data address of loads, stores and AMOs
+}
+
+// Link registers of the calling convention.
+const (
+	linkRa = 1
+	linkT0 = 5
+)
+
+// isLink reports whether the register is a link register.
+func isLink(register uint32) bool {
+	return register == linkRa || register == linkT0
+}
+
+// IsCall reports whether the instruction is a function call by the calling
+// convention: a JAL or JALR writing a link register.
+func (e TraceEvent) IsCall() bool {
+	return (e.Mnemonic == "jal" || e.Mnemonic == "jalr") && isLink(e.Rd)
+}
+
+// IsReturn reports whether the instruction is a function return by the
+// calling convention: a JALR jumping to a link register without writing
+// one. The return address is NextPc.
+func (e TraceEvent) IsReturn() bool {
+	return e.Mnemonic == "jalr" && e.Rd == 0 && isLink(e.Rs1)
+}
+
+// Tracer receives an event for every instruction retired by a Core. It is
+// called after the instruction has updated the state of the core.
+type Tracer interface {
+	TraceInstruction(core *Core, event TraceEvent)
+}
+
+// SetTracer installs a tracer on the core. A nil tracer disables tracing,
+// which keeps instruction execution free of allocations.
+func (c *Core) SetTracer(tracer Tracer) {
+	c.tracer = tracer
+}
+
+// GetTracer returns the tracer installed on the core, if any.
+func (c *Core) GetTracer() Tracer {
+	return c.tracer
+}
+
+// MultiTracer is a Tracer passing every event to several tracers in order,
+// e.g. to log and profile the same hart.
+type MultiTracer []Tracer
+
+// TraceInstruction passes the event to every tracer.
+func (t MultiTracer) TraceInstruction(core *Core, event TraceEvent) {
+	for _, tracer := range t {
+		tracer.TraceInstruction(core, event)
+	}
+}
+
+// AddTracer installs a tracer in addition to the tracer already installed
+// on the core, if any.
+func (c *Core) AddTracer(tracer Tracer) {
+	switch existing := c.tracer.(type) {
+	case nil:
+		c.tracer = tracer
+	case MultiTracer:
+		c.tracer = append(existing, tracer)
+	default:
+		c.tracer = MultiTracer{existing, tracer}
+	}
+}
+
+// dataAddress returns the address accessed by a load, store or AMO before
+// it executes, or 0 for other instructions.
+func (c *Core) dataAddress(d *decodedInstruction) uint32 {
+	switch d.instruction & 0x7F {
+	case opcodeLb, opcodeSb:
+		return c.x[d.rs1] + uint32(d.imm)
+	case opcodeAmo:
+		return c.x[d.rs1]
+	default:
+		return 0
+	}
+}
+
+// retire executes the decoded instruction on the core and reports it to the
+// installed tracer.
+func (c *Core) retire(d *decodedInstruction) error {
+	pc := c.pc
+	var address uint32
+	if c.tracer != nil {
+		address = c.dataAddress(d)
+	}
+	err := d.handler(c, d)
+	// x0 is hard-wired to zero, discard whatever the handler wrote to it.
+	c.x[0] = 0
+	if err != nil {
+		return c.exception(d, err)
+	}
+	c.instret++
+
+	if c.tracer != nil {
+		c.tracer.TraceInstruction(c, TraceEvent{
+			Pc:          pc,
+			NextPc:      c.pc,
+			Instruction: d.instruction,
+			Mnemonic:    d.mnemonic,
+			Rd:          d.rd,
+			Rs1:         d.rs1,
+			Rs2:         d.rs2,
+			Imm:         d.imm,
+			Address:     address,
+		})
+	}
+	return nil
+}
+
+// LogTracer is a Tracer writing every retired instruction to a structured
+// logger at debug level.
+type LogTracer struct {
+	logger     *slog.Logger
+	symbolizer *symbols.Symbolizer
+}
+
+// NewLogTracer creates a LogTracer writing to the given logger.
+func NewLogTracer(logger *slog.Logger) *LogTracer {
+	return &LogTracer{logger: logger}
+}
+
+// SetSymbolizer makes the tracer log the symbolized location of every
+// instruction.
+func (t *LogTracer) SetSymbolizer(symbolizer *symbols.Symbolizer) {
+	t.symbolizer = symbolizer
+}
+
+// TraceInstruction logs the retired instruction.
+func (t *LogTracer) TraceInstruction(core *Core, event TraceEvent) {
+	if !t.logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	location := ""
+	if t.symbolizer != nil {
+		location = t.symbolizer.Lookup(event.Pc).String()
+	}
+	t.logger.Debug("Executed instruction",
+		"pc", event.Pc,
+		"location", location,
+		"instruction", event.Instruction,
+		"mnemonic", event.Mnemonic,
+		"rd", event.Rd,
+		"rs1", event.Rs1,
+		"rs2", event.Rs2,
+		"imm", event.Imm,
+		"next_pc", event.NextPc,
+	)
+}
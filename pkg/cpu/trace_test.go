@@ -0,0 +1,170 @@
+package cpu
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+type recordingTracer struct {
+	events []TraceEvent
+}
+
+func (r *recordingTracer) TraceInstruction(core *Core, event TraceEvent) {
+	r.events = append(r.events, event)
+}
+
+func TestTracer_Events(t *testing.T) {
+	core, _ := setupProgram(t, computeLoop...)
+	tracer := &recordingTracer{}
+	core.SetTracer(tracer)
+
+	_, err := Run(core, 3)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	expected := []TraceEvent{
+		{Pc: 0x1000, NextPc: 0x1004, Instruction: computeLoop[0],
+			Mnemonic: "addi", Rd: 1, Rs1: 1, Imm: 1},
+		{Pc: 0x1004, NextPc: 0x1008, Instruction: computeLoop[1],
+			Mnemonic: "addi", Rd: 2, Rs1: 2, Imm: -1},
+		{Pc: 0x1008, NextPc: 0x1000, Instruction: computeLoop[2],
+			Mnemonic: "bne", Rs1: 1, Imm: -8},
+	}
+	if len(tracer.events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected),
+			len(tracer.events))
+	}
+	for i, event := range tracer.events {
+		if event != expected[i] {
+			t.Errorf("Expected event %+v, got %+v", expected[i], event)
+		}
+	}
+}
+
+func TestTracer_DataAddress(t *testing.T) {
+	core, _ := setupProgram(t,
+		encodeSType(opcodeSb, sTypeFunc3Sb, 1, 2, 4),    // SB x2, 4(x1)
+		encodeIType(opcodeLbu, iTypeFunc3Lbu, 1, 1, -4), // LBU x1, -4(x1)
+	)
+	core.x[1] = 0x1100
+	tracer := &recordingTracer{}
+	core.SetTracer(tracer)
+
+	if _, err := Run(core, 2); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for i, expected := range []uint32{0x1104, 0x10FC} {
+		if address := tracer.events[i].Address; address != expected {
+			t.Errorf("Expected address %X for event %d, got %X", expected, i,
+				address)
+		}
+	}
+}
+
+func TestTracer_NotCalledOnError(t *testing.T) {
+	core, _ := setupProgram(t, 0xFFFFFFFF)
+	tracer := &recordingTracer{}
+	core.SetTracer(tracer)
+
+	if err := Step(core); err == nil {
+		t.Fatal("Expected error for unsupported instruction, got nil")
+	}
+	if len(tracer.events) != 0 {
+		t.Errorf("Expected no events, got %d", len(tracer.events))
+	}
+}
+
+func TestAddTracer(t *testing.T) {
+	core, _ := setupProgram(t, computeLoop...)
+	first, second, third := &recordingTracer{}, &recordingTracer{},
+		&recordingTracer{}
+	core.AddTracer(first)
+	core.AddTracer(second)
+	core.AddTracer(third)
+
+	if _, err := Run(core, 3); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for i, tracer := range []*recordingTracer{first, second, third} {
+		if len(tracer.events) != 3 {
+			t.Errorf("Expected 3 events for tracer %d, got %d", i,
+				len(tracer.events))
+		}
+	}
+}
+
+func TestTraceEvent_CallReturn(t *testing.T) {
+	tests := []struct {
+		event          TraceEvent
+		call, isReturn bool
+	}{
+		{TraceEvent{Mnemonic: "jal", Rd: 1}, true, false},
+		{TraceEvent{Mnemonic: "jalr", Rd: 5, Rs1: 6}, true, false},
+		{TraceEvent{Mnemonic: "jal", Rd: 0}, false, false},
+		{TraceEvent{Mnemonic: "jalr", Rd: 0, Rs1: 1}, false, true},
+		{TraceEvent{Mnemonic: "jalr", Rd: 0, Rs1: 6}, false, false},
+		{TraceEvent{Mnemonic: "addi", Rd: 1, Rs1: 1}, false, false},
+	}
+	for _, test := range tests {
+		if test.event.IsCall() != test.call ||
+			test.event.IsReturn() != test.isReturn {
+			t.Errorf("Expected %+v to be call %v and return %v", test.event,
+				test.call, test.isReturn)
+		}
+	}
+}
+
+func TestLogTracer(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buffer,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+	core, _ := setupProgram(t, computeLoop...)
+	core.SetTracer(NewLogTracer(logger))
+
+	if err := Step(core); err != nil {
+		t.Fatalf("Step failed: %v", err)
+	}
+
+	if !strings.Contains(buffer.String(), "mnemonic=addi") {
+		t.Errorf("Expected the addi instruction to be logged, got %q",
+			buffer.String())
+	}
+}
+
+// assertNoAllocs runs the program with the given engine and checks that
+// executing instructions does not allocate once the caches are warm.
+func assertNoAllocs(t *testing.T, engine Engine, cached bool,
+	program []uint32) {
+	t.Helper()
+	core, _ := setupProgram(t, program...)
+	core.SetEngine(engine)
+	core.SetDecodeCache(cached)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := Run(core, 100); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations with %v engine, got %v per run",
+			engine, allocs)
+	}
+}
+
+func TestStep_NoAllocations(t *testing.T) {
+	assertNoAllocs(t, EngineInterpreter, true, computeLoop)
+	assertNoAllocs(t, EngineInterpreter, true, callProgram)
+}
+
+func TestStep_NoAllocationsUncached(t *testing.T) {
+	assertNoAllocs(t, EngineInterpreter, false, computeLoop)
+	assertNoAllocs(t, EngineInterpreter, false, callProgram)
+}
+
+func TestRun_NoAllocationsBlock(t *testing.T) {
+	assertNoAllocs(t, EngineBlock, true, computeLoop)
+	assertNoAllocs(t, EngineBlock, true, callProgram)
+}
@@ -0,0 +1,212 @@
+package cpu
+
+import (
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+// Machine-level trap CSR numbers
+const (
+	CsrMstatus = 0x300
+	CsrMie     = 0x304
+	CsrMtvec   = 0x305
+	CsrMepc    = 0x341
+	CsrMcause  = 0x342
+	CsrMtval   = 0x343
+	CsrMip     = 0x344
+)
+
+// Bits of mstatus. The core only runs in machine mode, so MPP always reads
+// as machine mode.
+const (
+	mstatusMIE  = 1 << 3
+	mstatusMPIE = 1 << 7
+	mstatusMPP  = 3 << 11
+)
+
+// interruptMask holds the bits of mie and mip of the implemented machine
+// interrupts.
+const interruptMask = 1<<devices.InterruptMachineSoftware |
+	1<<devices.InterruptMachineTimer | 1<<devices.InterruptMachineExternal
+
+// interruptPriority lists the machine interrupts from the highest priority
+// to the lowest.
+var interruptPriority = [...]uint32{
+	devices.InterruptMachineExternal,
+	devices.InterruptMachineSoftware,
+	devices.InterruptMachineTimer,
+}
+
+// Instructions of the privileged architecture without operands
+const (
+	mretInstruction = 0x30200073
+	wfiInstruction  = 0x10500073
+)
+
+// interruptLine drives a bit of the mip CSR of a core.
+type interruptLine struct {
+	core *Core
+	bit  uint32
+}
+
+// SetLevel sets or clears the pending bit. It may be called from any
+// goroutine.
+func (l interruptLine) SetLevel(high bool) {
+	for {
+		old := l.core.csr.mip.Load()
+		value := old &^ l.bit
+		if high {
+			value |= l.bit
+		}
+		if l.core.csr.mip.CompareAndSwap(old, value) {
+			return
+		}
+	}
+}
+
+// InterruptLine returns the line setting the pending bit of a machine
+// interrupt in mip, e.g. devices.InterruptMachineTimer, for the CLINT and
+// the PLIC to drive.
+func (c *Core) InterruptLine(cause uint32) devices.IRQLine {
+	return interruptLine{c, 1 << cause}
+}
+
+// timerInterval is the number of instructions between two timer checks of
+// a core.
+const timerInterval = 1024
+
+// SetTimer installs a check the core calls every timerInterval instructions
+// while it runs, for the CLINT to raise timer interrupts that became due.
+// A nil check removes it.
+func (c *Core) SetTimer(check func()) {
+	c.timer = check
+	c.timerCountdown = timerInterval
+}
+
+// tickTimer counts down the executed instructions to the next timer check
+// and calls the check when it is due.
+func (c *Core) tickTimer(steps uint64) {
+	if c.timer == nil {
+		return
+	}
+	if steps < c.timerCountdown {
+		c.timerCountdown -= steps
+		return
+	}
+	c.timerCountdown = timerInterval
+	c.timer()
+}
+
+// InterruptInterceptor decides which interrupts a core sees pending, e.g.
+// to record the interrupts devices raise from host input or to replay
+// recorded ones. It gets the bits of mip driven by the interrupt lines and
+// the bits it returned last, and is consulted at most once per retired
+// instruction.
+type InterruptInterceptor interface {
+	InterceptInterrupts(live, last uint32) (uint32, error)
+}
+
+// seenInterrupts holds the interrupts an InterruptInterceptor returned, at
+// the instruction it returned them.
+type seenInterrupts struct {
+	pending uint32
+	instret uint64
+	valid   bool // Returned at instret
+}
+
+// SetInterruptInterceptor installs an interceptor for the pending
+// interrupts, or removes it if nil. The interceptor is consulted again at
+// the current instruction and gets the interrupts returned last by any
+// earlier one.
+func (c *Core) SetInterruptInterceptor(interceptor InterruptInterceptor) {
+	c.interrupts = interceptor
+	c.seen.valid = false
+}
+
+// pending returns the interrupts pending in mip, as returned by the
+// interceptor if one is installed.
+func (c *Core) pending() (uint32, error) {
+	if c.interrupts == nil {
+		return c.csr.mip.Load(), nil
+	}
+	if !c.seen.valid || c.seen.instret != c.instret {
+		pending, err := c.interrupts.InterceptInterrupts(c.csr.mip.Load(),
+			c.seen.pending)
+		if err != nil {
+			return 0, err
+		}
+		c.seen = seenInterrupts{pending: pending, instret: c.instret, valid: true}
+	}
+	return c.seen.pending, nil
+}
+
+// interrupt enters the trap handler for the pending and enabled interrupt
+// with the highest priority, if interrupts are enabled. It reports whether
+// it took one.
+func (c *Core) interrupt() (bool, error) {
+	if c.csr.mstatus&mstatusMIE == 0 {
+		return false, nil
+	}
+	pending, err := c.pending()
+	if err != nil {
+		return false, err
+	}
+	pending &= c.csr.mie
+	if pending == 0 {
+		return false, nil
+	}
+	for _, cause := range interruptPriority {
+		if pending&(1<<cause) != 0 {
+			c.trap(1<<31|cause, 0)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// takeException enters the trap handler for an exception raised by an
+// instruction and reports whether it did. Until the guest sets mtvec, the
+// exception stops execution instead.
+func (c *Core) takeException(err error) bool {
+	cause, ok := ExceptionCauseOf(err)
+	if !ok || c.csr.mtvec&^3 == 0 {
+		return false
+	}
+	c.trap(uint32(cause), 0)
+	return true
+}
+
+// trap saves the PC and the interrupt enable bit and jumps to the trap
+// handler, to the vector of the cause for interrupts in vectored mode.
+func (c *Core) trap(cause, tval uint32) {
+	c.csr.mepc = c.pc
+	c.csr.mcause = cause
+	c.csr.mtval = tval
+	mpie := uint32(0)
+	if c.csr.mstatus&mstatusMIE != 0 {
+		mpie = mstatusMPIE
+	}
+	c.csr.mstatus = c.csr.mstatus&^(mstatusMIE|mstatusMPIE) | mpie
+	c.pc = c.csr.mtvec &^ 3
+	if cause&(1<<31) != 0 && c.csr.mtvec&3 == 1 {
+		c.pc += 4 * (cause &^ (1 << 31))
+	}
+}
+
+// mret executes the MRET instruction: it returns from the trap handler to
+// mepc and restores the interrupt enable bit.
+func mret(core *Core) error {
+	mie := uint32(0)
+	if core.csr.mstatus&mstatusMPIE != 0 {
+		mie = mstatusMIE
+	}
+	core.csr.mstatus = core.csr.mstatus&^mstatusMIE | mie | mstatusMPIE
+	core.pc = core.csr.mepc
+	return nil
+}
+
+// wfi executes the WFI instruction, which may return at any time, so it
+// does not wait.
+func wfi(core *Core) error {
+	core.pc += 4
+	return nil
+}
@@ -0,0 +1,217 @@
+package cpu
+
+import (
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+// nop is ADDI x0, x0, 0.
+var nop = encodeIType(opcodeAddi, iTypeFunc3Addi, 0, 0, 0)
+
+func TestInterrupt(t *testing.T) {
+	tests := []struct {
+		name    string
+		mtvec   uint32
+		cause   uint32
+		handler uint32
+	}{
+		{"direct", 0x1100, devices.InterruptMachineTimer, 0x1100},
+		{"vectored", 0x1101, devices.InterruptMachineTimer, 0x1100 + 4*7},
+		{"external first", 0x1101, devices.InterruptMachineExternal, 0x1100 + 4*11},
+	}
+	for _, test := range tests {
+		for _, engine := range []Engine{EngineInterpreter, EngineBlock} {
+			core, bus := setupProgram(t, nop, nop)
+			writeWord(t, bus, test.handler, mretInstruction)
+			core.SetEngine(engine)
+			core.SetCSR(CsrMtvec, test.mtvec)
+			core.SetCSR(CsrMie, 0xFFFFFFFF)
+
+			core.InterruptLine(devices.InterruptMachineTimer).SetLevel(true)
+			core.InterruptLine(test.cause).SetLevel(true)
+			if _, err := Run(core, 1); err != nil || core.pc != 0x1004 {
+				t.Fatalf("%s on %v: expected no interrupt with MIE clear, got pc %X, %v",
+					test.name, engine, core.pc, err)
+			}
+
+			core.SetCSR(CsrMstatus, mstatusMIE)
+			if _, err := Run(core, 1); err != nil {
+				t.Fatalf("%s on %v: Run failed: %v", test.name, engine, err)
+			}
+			if core.pc != 0x1004 {
+				t.Errorf("%s on %v: expected mret to return to 1004, got %X",
+					test.name, engine, core.pc)
+			}
+			mcause, _ := core.GetCSR(CsrMcause)
+			mepc, _ := core.GetCSR(CsrMepc)
+			if mcause != 1<<31|test.cause || mepc != 0x1004 {
+				t.Errorf("%s on %v: expected mcause %X and mepc 1004, got %X and %X",
+					test.name, engine, 1<<31|test.cause, mcause, mepc)
+			}
+			// mret enabled interrupts again, but with mie cleared the
+			// interrupt still pending is not taken.
+			if mstatus, _ := core.GetCSR(CsrMstatus); mstatus&mstatusMIE == 0 {
+				t.Errorf("%s on %v: expected mret to set MIE, got mstatus %X",
+					test.name, engine, mstatus)
+			}
+			core.SetCSR(CsrMie, 0)
+			if _, err := Run(core, 1); err != nil || core.pc != 0x1008 {
+				t.Errorf("%s on %v: expected no interrupt once disabled, got pc %X, %v",
+					test.name, engine, core.pc, err)
+			}
+		}
+	}
+}
+
+func TestInterrupt_HandlerMasked(t *testing.T) {
+	core, bus := setupProgram(t, nop)
+	writeWord(t, bus, 0x1100, nop)
+	writeWord(t, bus, 0x1104, nop)
+	core.SetCSR(CsrMtvec, 0x1100)
+	core.SetCSR(CsrMie, 1<<devices.InterruptMachineSoftware)
+	core.SetCSR(CsrMstatus, mstatusMIE)
+	core.InterruptLine(devices.InterruptMachineSoftware).SetLevel(true)
+
+	if _, err := Run(core, 2); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if core.pc != 0x1108 {
+		t.Errorf("Expected the handler to run without nesting, got pc %X", core.pc)
+	}
+	if mstatus, _ := core.GetCSR(CsrMstatus); mstatus != mstatusMPIE|mstatusMPP {
+		t.Errorf("Expected mstatus %X in the handler, got %X",
+			mstatusMPIE|mstatusMPP, mstatus)
+	}
+	if mip, _ := core.GetCSR(CsrMip); mip != 1<<devices.InterruptMachineSoftware {
+		t.Errorf("Expected the software interrupt pending, got mip %X", mip)
+	}
+}
+
+func TestSetTimer(t *testing.T) {
+	if _, ok := devices.Hart(&Core{}).(devices.TimerHart); !ok {
+		t.Fatal("Expected cores to install the timer check of the CLINT")
+	}
+	for _, engine := range []Engine{EngineInterpreter, EngineBlock} {
+		core, _ := setupProgram(t, computeLoop...)
+		core.SetEngine(engine)
+		checks := 0
+		core.SetTimer(func() { checks++ })
+
+		if _, err := Run(core, 4*timerInterval); err != nil {
+			t.Fatalf("%v: Run failed: %v", engine, err)
+		}
+		// Blocks may run past the interval before the check.
+		if checks < 3 || checks > 4 {
+			t.Errorf("%v: expected 3 or 4 timer checks, got %d", engine, checks)
+		}
+	}
+}
+
+// onceInterrupts is an InterruptInterceptor raising the timer interrupt
+// the first time it is consulted only.
+type onceInterrupts struct {
+	calls int
+}
+
+func (o *onceInterrupts) InterceptInterrupts(live, last uint32) (uint32, error) {
+	o.calls++
+	if o.calls == 1 {
+		return 1 << devices.InterruptMachineTimer, nil
+	}
+	return 0, nil
+}
+
+func TestSetInterruptInterceptor(t *testing.T) {
+	for _, engine := range []Engine{EngineInterpreter, EngineBlock} {
+		core, bus := setupProgram(t, nop, nop, nop)
+		writeWord(t, bus, 0x1100, mretInstruction)
+		core.SetEngine(engine)
+		core.SetCSR(CsrMtvec, 0x1100)
+		core.SetCSR(CsrMie, 0xFFFFFFFF)
+		core.SetCSR(CsrMstatus, mstatusMIE)
+		interceptor := &onceInterrupts{}
+		core.SetInterruptInterceptor(interceptor)
+		// The devices raise an interrupt the interceptor hides.
+		core.InterruptLine(devices.InterruptMachineExternal).SetLevel(true)
+
+		if _, err := Run(core, 1); err != nil {
+			t.Fatalf("%v: Run failed: %v", engine, err)
+		}
+		if mcause, _ := core.GetCSR(CsrMcause); mcause != 1<<31|devices.InterruptMachineTimer {
+			t.Errorf("%v: expected the intercepted timer interrupt taken, got mcause %X",
+				engine, mcause)
+		}
+		if mip, _ := core.GetCSR(CsrMip); mip != 1<<devices.InterruptMachineTimer {
+			t.Errorf("%v: expected mip to read the intercepted interrupts, got %X",
+				engine, mip)
+		}
+
+		if _, err := Run(core, 2); err != nil || core.pc != 0x1008 {
+			t.Errorf("%v: expected no further interrupts, got pc %X, %v",
+				engine, core.pc, err)
+		}
+		if interceptor.calls > 3 {
+			t.Errorf("%v: expected at most one call per instruction, got %d",
+				engine, interceptor.calls)
+		}
+	}
+}
+
+func TestException_Trap(t *testing.T) {
+	for _, engine := range []Engine{EngineInterpreter, EngineBlock} {
+		core, bus := setupProgram(t, nop, 0xFFFFFFFF)
+		writeWord(t, bus, 0x1100, nop)
+		core.SetEngine(engine)
+		core.SetCSR(CsrMtvec, 0x1101)
+
+		executed, err := Run(core, 3)
+		if err != nil {
+			t.Fatalf("%v: expected the exception to trap, got %v", engine, err)
+		}
+		// Exceptions use the base of mtvec even in vectored mode.
+		if core.pc != 0x1104 || executed != 3 {
+			t.Errorf("%v: expected pc 1104 after 3 steps, got %X after %d",
+				engine, core.pc, executed)
+		}
+		mcause, _ := core.GetCSR(CsrMcause)
+		mepc, _ := core.GetCSR(CsrMepc)
+		if ExceptionCause(mcause) != CauseIllegalInstruction || mepc != 0x1004 {
+			t.Errorf("%v: expected an illegal instruction at 1004, got mcause %X, mepc %X",
+				engine, mcause, mepc)
+		}
+	}
+}
+
+func TestTrapCSRs(t *testing.T) {
+	core := NewCore(&devices.Bus{})
+	tests := []struct {
+		csr           uint32
+		written, read uint32
+	}{
+		{CsrMstatus, 0xFFFFFFFF, mstatusMIE | mstatusMPIE | mstatusMPP},
+		{CsrMie, 0xFFFFFFFF, interruptMask},
+		{CsrMip, 0xFFFFFFFF, 0},
+		{CsrMtvec, 0x80000001, 0x80000001},
+		{CsrMtvec, 0x80000002, 0x80000000},
+		{CsrMepc, 0x80000003, 0x80000000},
+		{CsrMcause, 0x8000000B, 0x8000000B},
+		{CsrMtval, 0x1234, 0x1234},
+	}
+	for _, test := range tests {
+		if err := core.SetCSR(test.csr, test.written); err != nil {
+			t.Fatalf("SetCSR(%s) failed: %v", csrName(test.csr), err)
+		}
+		if value, _ := core.GetCSR(test.csr); value != test.read {
+			t.Errorf("Expected %s to read %X after writing %X, got %X",
+				csrName(test.csr), test.read, test.written, value)
+		}
+	}
+
+	state := core.State()
+	restored := NewCore(&devices.Bus{})
+	restored.SetState(state)
+	if restored.State() != state {
+		t.Errorf("Expected the trap CSRs to be restored, got %+v", restored.State())
+	}
+}
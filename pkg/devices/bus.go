@@ -1,6 +1,10 @@
 package devices
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"sync"
+)
 
 // BusDevice represents a memory-mapped I/O device.
 type BusDevice interface {
@@ -11,14 +15,175 @@ type BusDevice interface {
 	Size() uint32
 }
 
+// WriteObserver is notified about every successful write on the Bus. It is
+// used by caches that need to drop stale copies of memory contents.
+type WriteObserver interface {
+	ObserveWrite(address uint32)
+}
+
+// HostInputDevice is a BusDevice whose reads return input from the host,
+// e.g. keystrokes or wall-clock time, so that they differ between runs.
+type HostInputDevice interface {
+	BusDevice
+	// HostInput reports whether reads currently depend on the host.
+	HostInput() bool
+}
+
+// AsyncInputDevice is a BusDevice that changes state visible to the guest
+// on its own when host input arrives or when it is polled, other than by
+// raising interrupts, e.g. by writing host input into guest memory. An
+// input log cannot capture these changes.
+type AsyncInputDevice interface {
+	BusDevice
+	// AsyncInput reports whether the device currently depends on the host
+	// outside of reads.
+	AsyncInput() bool
+}
+
+// InputInterceptor sees every read from a HostInputDevice in place of the
+// Bus. It either performs the read and records the value, or returns a
+// previously recorded value without touching the device.
+type InputInterceptor interface {
+	InterceptRead(device BusDevice, address uint32) (byte, error)
+}
+
+// AccessWatcher is notified about every successful data access on the Bus,
+// but not about instruction fetches. It is used to implement watchpoints.
+type AccessWatcher interface {
+	WatchAccess(address uint32, value byte, write bool)
+}
+
+// DMADevice is a BusDevice that accesses memory through the Bus itself,
+// e.g. to process the buffers of a virtio queue. Its accesses use
+// ReadLocked and WriteLocked, so they happen with the Bus lock held.
+type DMADevice interface {
+	BusDevice
+	ConnectBus(bus *Bus)
+}
+
+// InstructionCountDevice is a BusDevice depending on the number of
+// instructions retired by all harts, e.g. a clock in virtual time.
+type InstructionCountDevice interface {
+	BusDevice
+	ConnectInstructionCount(count func() uint64)
+}
+
+// PowerAction is what the guest asks of a PowerDevice.
+type PowerAction int
+
+const (
+	// PowerOff ends the machine with an exit code, 0 for success.
+	PowerOff PowerAction = iota + 1
+	// PowerReset restarts the machine.
+	PowerReset
+)
+
+// PowerDevice is a BusDevice through which the guest powers the machine
+// off or resets it. The handler is called by the hart writing to the
+// device, with the Bus lock held.
+type PowerDevice interface {
+	BusDevice
+	ConnectPower(handler func(action PowerAction, code uint32))
+}
+
+// PolledDevice is a BusDevice with work arriving from the host, e.g.
+// received network frames. It performs the work when the Bus is polled
+// between runs of instructions.
+type PolledDevice interface {
+	BusDevice
+	Poll()
+}
+
 // Bus manages a collection of Bus devices.
 type Bus struct {
-	devices []BusDevice
+	devices     []BusDevice
+	observers   []WriteObserver
+	interceptor InputInterceptor
+	watcher     AccessWatcher
+	generation  uint64
+
+	polled           []PolledDevice
+	polledGeneration uint64 // Generation that polled was collected at
+
+	synchronized bool
+	mu           sync.Mutex
 }
 
 // AddDevice adds a new Bus device to the collection.
 func (Bus *Bus) AddDevice(device BusDevice) {
 	Bus.devices = append(Bus.devices, device)
+	Bus.generation++
+}
+
+// RemoveDevice removes the given Bus device from the collection. It returns
+// false if the device was not attached to the Bus.
+func (Bus *Bus) RemoveDevice(device BusDevice) bool {
+	for i, d := range Bus.devices {
+		if d == device {
+			Bus.devices = append(Bus.devices[:i], Bus.devices[i+1:]...)
+			Bus.generation++
+			return true
+		}
+	}
+	return false
+}
+
+// Generation returns a counter that changes every time the memory map of the
+// Bus changes, i.e. whenever a device is added or removed.
+func (Bus *Bus) Generation() uint64 {
+	return Bus.generation
+}
+
+// AddWriteObserver registers an observer notified about every write.
+func (Bus *Bus) AddWriteObserver(observer WriteObserver) {
+	Bus.observers = append(Bus.observers, observer)
+}
+
+// SetSynchronized enables serialization of all accesses to the Bus. It has
+// to be enabled while several goroutines access the Bus at the same time
+// and must not be changed while they do.
+func (Bus *Bus) SetSynchronized(enabled bool) {
+	Bus.synchronized = enabled
+}
+
+// Lock acquires exclusive access to the Bus, so that a sequence of
+// ReadLocked and WriteLocked calls is performed atomically. It does nothing
+// unless the Bus is synchronized.
+func (Bus *Bus) Lock() {
+	if Bus.synchronized {
+		Bus.mu.Lock()
+	}
+}
+
+// Unlock releases the exclusive access acquired with Lock.
+func (Bus *Bus) Unlock() {
+	if Bus.synchronized {
+		Bus.mu.Unlock()
+	}
+}
+
+// SetInputInterceptor installs an interceptor for reads from host input
+// devices. A nil interceptor sends the reads to the devices directly.
+func (Bus *Bus) SetInputInterceptor(interceptor InputInterceptor) {
+	Bus.interceptor = interceptor
+}
+
+// InputInterceptor returns the installed interceptor for reads from host
+// input devices, or nil.
+func (Bus *Bus) InputInterceptor() InputInterceptor {
+	return Bus.interceptor
+}
+
+// SetAccessWatcher installs a watcher notified about data accesses. A nil
+// watcher disables the notifications.
+func (Bus *Bus) SetAccessWatcher(watcher AccessWatcher) {
+	Bus.watcher = watcher
+}
+
+// Devices returns the devices attached to the Bus in the order they were
+// added.
+func (Bus *Bus) Devices() []BusDevice {
+	return Bus.devices
 }
 
 // FindDevice finds the Bus device that contains the specified address.
@@ -32,20 +197,137 @@ func (Bus *Bus) FindDevice(address uint32) BusDevice {
 	return nil
 }
 
+// Poll lets the polled devices on the Bus perform the work that arrived
+// from the host, holding the Bus lock.
+func (Bus *Bus) Poll() {
+	if Bus.polledGeneration != Bus.generation {
+		Bus.polled = nil
+		for _, device := range Bus.devices {
+			if polled, ok := device.(PolledDevice); ok {
+				Bus.polled = append(Bus.polled, polled)
+			}
+		}
+		Bus.polledGeneration = Bus.generation
+	}
+	if len(Bus.polled) == 0 {
+		return
+	}
+	Bus.Lock()
+	defer Bus.Unlock()
+	for _, device := range Bus.polled {
+		device.Poll()
+	}
+}
+
 // Read from Bus device
 func (Bus *Bus) Read(address uint32) (byte, error) {
+	Bus.Lock()
+	defer Bus.Unlock()
+	return Bus.ReadLocked(address)
+}
+
+// Write to Bus device
+func (Bus *Bus) Write(address uint32, value byte) error {
+	Bus.Lock()
+	defer Bus.Unlock()
+	return Bus.WriteLocked(address, value)
+}
+
+// Fetch reads a byte of an instruction from a Bus device. Unlike Read, it
+// is not reported to the access watcher.
+func (Bus *Bus) Fetch(address uint32) (byte, error) {
+	Bus.Lock()
+	defer Bus.Unlock()
+	return Bus.read(address)
+}
+
+// Peek reads a byte for a debugger. Unlike Read, it is neither reported to
+// the access watcher nor passed to the input interceptor, and it refuses
+// to read host input devices, so that it does not consume input or change
+// a recording or replay.
+func (Bus *Bus) Peek(address uint32) (byte, error) {
+	Bus.Lock()
+	defer Bus.Unlock()
 	device := Bus.FindDevice(address)
 	if device == nil {
 		return 0, fmt.Errorf("device not found for address %X read", address)
 	}
+	if input, ok := device.(HostInputDevice); ok && input.HostInput() {
+		return 0, fmt.Errorf("address %X reads host input", address)
+	}
 	return device.Read(address)
 }
 
-// Write to Bus device
-func (Bus *Bus) Write(address uint32, value byte) error {
+// Poke writes a byte for a debugger. Unlike Write, it is not reported to
+// the access watcher, so it does not hit watchpoints. The write observers
+// are notified, so that cached instructions and LR/SC reservations see it.
+func (Bus *Bus) Poke(address uint32, value byte) error {
+	Bus.Lock()
+	defer Bus.Unlock()
 	device := Bus.FindDevice(address)
 	if device == nil {
 		return fmt.Errorf("device not found for address %X write", address)
 	}
-	return device.Write(address, value)
+	err := device.Write(address, value)
+	if err != nil {
+		return err
+	}
+	for _, observer := range Bus.observers {
+		observer.ObserveWrite(address)
+	}
+	return nil
+}
+
+// ReadLocked reads from a Bus device. The caller must hold the Bus lock.
+func (Bus *Bus) ReadLocked(address uint32) (byte, error) {
+	value, err := Bus.read(address)
+	if err == nil && Bus.watcher != nil {
+		Bus.watcher.WatchAccess(address, value, false)
+	}
+	return value, err
+}
+
+// read reads from a Bus device, sending reads from host input devices to
+// the input interceptor.
+func (Bus *Bus) read(address uint32) (byte, error) {
+	device := Bus.FindDevice(address)
+	if device == nil {
+		return 0, fmt.Errorf("device not found for address %X read", address)
+	}
+	if Bus.interceptor != nil {
+		input, ok := device.(HostInputDevice)
+		if ok && input.HostInput() {
+			return Bus.interceptor.InterceptRead(device, address)
+		}
+	}
+	return device.Read(address)
+}
+
+// WriteLocked writes to a Bus device and notifies the write observers. The
+// caller must hold the Bus lock.
+func (Bus *Bus) WriteLocked(address uint32, value byte) error {
+	device := Bus.FindDevice(address)
+	if device == nil {
+		return fmt.Errorf("device not found for address %X write", address)
+	}
+	err := device.Write(address, value)
+	if err != nil {
+		return err
+	}
+	for _, observer := range Bus.observers {
+		observer.ObserveWrite(address)
+	}
+	if Bus.watcher != nil {
+		Bus.watcher.WatchAccess(address, value, true)
+	}
+	return nil
+}
+
+// StatefulDevice is a BusDevice whose internal state can be saved into and
+// restored from a snapshot. The state is restored into a device initialized
+// with the same base address and size.
+type StatefulDevice interface {
+	BusDevice
+	SaveState(w io.Writer) error
+	LoadState(r io.Reader) error
 }
@@ -1,6 +1,10 @@
 package devices
 
-import "testing"
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
 
 type MockBusDevice struct {
 	baseAddress uint32
@@ -121,3 +125,130 @@ func TestBusOutOfBounds(t *testing.T) {
 		t.Errorf("Expected no device at address %X, but found one", address)
 	}
 }
+
+type recordingObserver struct {
+	addresses []uint32
+}
+
+func (o *recordingObserver) ObserveWrite(address uint32) {
+	o.addresses = append(o.addresses, address)
+}
+
+func TestBus_WriteObserver(t *testing.T) {
+	bus := setupBusFixture()
+	observer := &recordingObserver{}
+	bus.AddWriteObserver(observer)
+
+	err := bus.Write(0x1020, 0x01)
+	if err != nil {
+		t.Fatalf("bus.Write failed: %v", err)
+	}
+	_ = bus.Write(0x2000, 0x01) // No device, must not be observed
+
+	if len(observer.addresses) != 1 || observer.addresses[0] != 0x1020 {
+		t.Errorf("Expected one observed write at 1020, got %X",
+			observer.addresses)
+	}
+}
+
+func TestBus_RemoveDevice(t *testing.T) {
+	bus := setupBusFixture()
+	device := bus.FindDevice(0x1000)
+	generation := bus.Generation()
+
+	if !bus.RemoveDevice(device) {
+		t.Fatal("Expected RemoveDevice to succeed")
+	}
+	if bus.FindDevice(0x1000) != nil {
+		t.Error("Expected no device at 1000 after removal")
+	}
+	if bus.Generation() == generation {
+		t.Error("Expected generation to change after removal")
+	}
+	if bus.RemoveDevice(device) {
+		t.Error("Expected second RemoveDevice to fail")
+	}
+}
+
+type recordingWatcher struct {
+	accesses []string
+}
+
+func (w *recordingWatcher) WatchAccess(address uint32, value byte, write bool) {
+	w.accesses = append(w.accesses, fmt.Sprintf("%X=%02X/%v", address, value, write))
+}
+
+func TestBus_AccessWatcher(t *testing.T) {
+	bus := setupBusFixture()
+	watcher := &recordingWatcher{}
+	bus.SetAccessWatcher(watcher)
+
+	if err := bus.Write(0x1020, 0xAB); err != nil {
+		t.Fatalf("bus.Write failed: %v", err)
+	}
+	if _, err := bus.Read(0x1020); err != nil {
+		t.Fatalf("bus.Read failed: %v", err)
+	}
+	if _, err := bus.Fetch(0x1020); err != nil {
+		t.Fatalf("bus.Fetch failed: %v", err)
+	}
+
+	expected := []string{"1020=AB/true", "1020=AB/false"}
+	if fmt.Sprint(watcher.accesses) != fmt.Sprint(expected) {
+		t.Errorf("Expected accesses %v, got %v", expected, watcher.accesses)
+	}
+}
+
+func TestBus_Peek(t *testing.T) {
+	bus := setupBusFixture()
+	watcher := &recordingWatcher{}
+	bus.SetAccessWatcher(watcher)
+
+	if err := bus.Write(0x1020, 0xAB); err != nil {
+		t.Fatalf("bus.Write failed: %v", err)
+	}
+	if value, err := bus.Peek(0x1020); err != nil || value != 0xAB {
+		t.Errorf("Expected to peek AB, got %02X, %v", value, err)
+	}
+	if len(watcher.accesses) != 1 {
+		t.Errorf("Expected only the write to be watched, got %v", watcher.accesses)
+	}
+	if _, err := bus.Peek(0x3000); err == nil {
+		t.Error("Expected an error peeking an unmapped address")
+	}
+
+	uart := NewUART(0, 0)
+	uart.Initialize(0x2000, UARTSize)
+	bus.AddDevice(uart)
+	if _, err := bus.Peek(0x2000); err != nil {
+		t.Errorf("Expected to peek a UART without input, got %v", err)
+	}
+	uart.SetInput(strings.NewReader("a"))
+	if _, err := bus.Peek(0x2000); err == nil {
+		t.Error("Expected an error peeking host input")
+	}
+}
+
+func TestBus_Poke(t *testing.T) {
+	bus := setupBusFixture()
+	watcher := &recordingWatcher{}
+	bus.SetAccessWatcher(watcher)
+	observer := &recordingObserver{}
+	bus.AddWriteObserver(observer)
+
+	if err := bus.Poke(0x1020, 0xAB); err != nil {
+		t.Fatalf("bus.Poke failed: %v", err)
+	}
+	if value, err := bus.Peek(0x1020); err != nil || value != 0xAB {
+		t.Errorf("Expected to peek AB, got %02X, %v", value, err)
+	}
+	if len(watcher.accesses) != 0 {
+		t.Errorf("Expected the poke not to be watched, got %v", watcher.accesses)
+	}
+	if len(observer.addresses) != 1 || observer.addresses[0] != 0x1020 {
+		t.Errorf("Expected the poke to be observed, got %v", observer.addresses)
+	}
+	if err := bus.Poke(0x3000, 0); err == nil {
+		t.Error("Expected an error poking an unmapped address")
+	}
+}
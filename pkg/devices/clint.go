@@ -0,0 +1,293 @@
+package devices
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+func init() {
+	Register("clint", func(baseAddress, size uint32, params json.RawMessage) (BusDevice, error) {
+		p := struct {
+			TimebaseFrequency uint32 `json:"timebase-frequency"`
+		}{TimebaseFrequency: DefaultTimebaseFrequency}
+		if err := DecodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			size = CLINTSize
+		}
+		return NewCLINT(baseAddress, size, p.TimebaseFrequency)
+	})
+}
+
+// CLINTSize is the default size of the CLINT register space.
+const CLINTSize = 0x10000
+
+// DefaultTimebaseFrequency is the default frequency of mtime in Hz.
+const DefaultTimebaseFrequency = 10000000
+
+// Offsets of the CLINT registers.
+const (
+	clintMsip     = 0x0000 // 4 bytes per hart
+	clintMtimecmp = 0x4000 // 8 bytes per hart
+	clintMtime    = 0xBFF8
+	clintHarts    = (clintMtime - clintMtimecmp) / 8 // Harts that fit
+)
+
+// CLINTDevice is a core-local interruptor as found on SiFive cores, with
+// the software interrupt and timer registers of as many harts as fit in
+// its register layout. mtime counts host time at the timebase frequency, so
+// its reads are host input.
+type CLINTDevice struct {
+	baseAddress uint32
+	size        uint32
+	frequency   uint32
+
+	mu       sync.Mutex
+	msip     []uint32
+	mtimecmp []uint64
+	start    time.Time // Host time at which mtime was offset
+	offset   uint64    // mtime at start
+	latch    uint64    // mtime as of the last read of a word of it
+	harts    []clintHart
+}
+
+// clintHart holds the interrupts of a hart connected to the CLINT.
+type clintHart struct {
+	software, timer IRQLine
+}
+
+// NewCLINT returns a CLINT with mtime counting at the given frequency
+// from 0.
+func NewCLINT(baseAddress, size uint32, frequency uint32) (*CLINTDevice, error) {
+	if frequency == 0 {
+		return nil, fmt.Errorf("CLINT needs a timebase frequency")
+	}
+	if size < clintMtime+8 {
+		return nil, fmt.Errorf("CLINT size %X too small", size)
+	}
+	c := &CLINTDevice{frequency: frequency}
+	c.Initialize(baseAddress, size)
+	return c, nil
+}
+
+// Initialize sets up the CLINT at the given base address, restarting
+// mtime from 0.
+func (c *CLINTDevice) Initialize(baseAddress, size uint32) {
+	c.baseAddress = baseAddress
+	c.size = size
+	if c.frequency == 0 {
+		c.frequency = DefaultTimebaseFrequency
+	}
+	c.msip = make([]uint32, clintHarts)
+	c.mtimecmp = make([]uint64, clintHarts)
+	for i := range c.mtimecmp {
+		c.mtimecmp[i] = ^uint64(0)
+	}
+	c.setTime(0)
+}
+
+func (c *CLINTDevice) BaseAddress() uint32 {
+	return c.baseAddress
+}
+
+func (c *CLINTDevice) Size() uint32 {
+	return c.size
+}
+
+// HostInput reports that reads from the CLINT are host input, as mtime
+// follows the host clock.
+func (c *CLINTDevice) HostInput() bool {
+	return true
+}
+
+// ConnectHart connects the software and timer interrupts of a hart.
+func (c *CLINTDevice) ConnectHart(index int, hart Hart) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if index >= clintHarts {
+		return
+	}
+	for len(c.harts) <= index {
+		c.harts = append(c.harts, clintHart{noLine{}, noLine{}})
+	}
+	c.harts[index] = clintHart{
+		software: hart.InterruptLine(InterruptMachineSoftware),
+		timer:    hart.InterruptLine(InterruptMachineTimer),
+	}
+	if timed, ok := hart.(TimerHart); ok {
+		timed.SetTimer(func() { c.checkTimer(index) })
+	}
+	c.update()
+}
+
+// checkTimer raises or clears the timer interrupt of a connected hart by
+// whether mtime has reached its mtimecmp.
+func (c *CLINTDevice) checkTimer(index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.harts[index].timer.SetLevel(c.time() >= c.mtimecmp[index])
+}
+
+// update sets the interrupts of the connected harts to the state of msip
+// and whether mtime has reached mtimecmp.
+func (c *CLINTDevice) update() {
+	if len(c.harts) == 0 {
+		return
+	}
+	now := c.time()
+	for i, hart := range c.harts {
+		hart.software.SetLevel(c.msip[i] != 0)
+		hart.timer.SetLevel(now >= c.mtimecmp[i])
+	}
+}
+
+// Poll raises the timer interrupts that have become due.
+func (c *CLINTDevice) Poll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.update()
+}
+
+// TimebaseFrequency returns the frequency of mtime in Hz.
+func (c *CLINTDevice) TimebaseFrequency() uint32 {
+	return c.frequency
+}
+
+// time returns the current value of mtime.
+func (c *CLINTDevice) time() uint64 {
+	elapsed := time.Since(c.start)
+	seconds := uint64(elapsed / time.Second)
+	fraction := uint64(elapsed % time.Second)
+	return c.offset + seconds*uint64(c.frequency) +
+		fraction*uint64(c.frequency)/uint64(time.Second)
+}
+
+// setTime sets mtime to a value counting on from now.
+func (c *CLINTDevice) setTime(value uint64) {
+	c.start = time.Now()
+	c.offset = value
+	c.latch = value
+}
+
+// Time returns the current value of mtime.
+func (c *CLINTDevice) Time() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.time()
+}
+
+// TimerPending reports whether the machine timer interrupt of a hart is
+// pending, i.e. mtime has reached its mtimecmp.
+func (c *CLINTDevice) TimerPending(hart int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.time() >= c.mtimecmp[hart]
+}
+
+// SoftwarePending reports whether the machine software interrupt of a hart
+// is pending.
+func (c *CLINTDevice) SoftwarePending(hart int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.msip[hart] != 0
+}
+
+// Read reads a byte of a CLINT register. Reading the first byte of either
+// word of mtime samples the host clock.
+func (c *CLINTDevice) Read(address uint32) (byte, error) {
+	if address < c.baseAddress || address-c.baseAddress >= c.size {
+		return 0, fmt.Errorf(
+			"attempted to read from invalid CLINT address %X", address)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	offset := address - c.baseAddress
+	switch {
+	case offset < clintMsip+4*clintHarts:
+		return byte(c.msip[offset/4] >> (8 * (offset & 3))), nil
+	case offset >= clintMtimecmp && offset < clintMtimecmp+8*clintHarts:
+		hart := (offset - clintMtimecmp) / 8
+		return byte(c.mtimecmp[hart] >> (8 * (offset & 7))), nil
+	case offset >= clintMtime && offset < clintMtime+8:
+		if offset&3 == 0 {
+			c.latch = c.time()
+		}
+		return byte(c.latch >> (8 * (offset & 7))), nil
+	}
+	return 0, nil
+}
+
+// Write writes a byte of a CLINT register. Writes to reserved addresses
+// are ignored.
+func (c *CLINTDevice) Write(address uint32, value byte) error {
+	if address < c.baseAddress || address-c.baseAddress >= c.size {
+		return fmt.Errorf(
+			"attempted to write %X to invalid CLINT address %X", value, address)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	offset := address - c.baseAddress
+	switch {
+	case offset < clintMsip+4*clintHarts:
+		// Only bit 0 of msip is implemented.
+		if offset&3 == 0 {
+			c.msip[offset/4] = uint32(value & 1)
+		}
+	case offset >= clintMtimecmp && offset < clintMtimecmp+8*clintHarts:
+		hart, shift := (offset-clintMtimecmp)/8, 8*(offset&7)
+		c.mtimecmp[hart] = c.mtimecmp[hart]&^(0xFF<<shift) |
+			uint64(value)<<shift
+	case offset >= clintMtime && offset < clintMtime+8:
+		shift := 8 * (offset & 7)
+		c.setTime(c.time()&^(0xFF<<shift) | uint64(value)<<shift)
+	}
+	c.update()
+	return nil
+}
+
+// AddToDeviceTree adds the CLINT node, delivering the machine software and
+// timer interrupts to the harts, and sets the timebase frequency of the
+// CPUs.
+func (c *CLINTDevice) AddToDeviceTree(tree *DeviceTree) {
+	node := tree.AddDevice(c, "clint", "sifive,clint0", "riscv,clint0")
+	var interrupts []uint32
+	for hart := 0; hart < tree.Harts && hart < clintHarts; hart++ {
+		intc := tree.CPUInterruptController(hart)
+		interrupts = append(interrupts, intc, 3, intc, 7)
+	}
+	node.SetU32("interrupts-extended", interrupts...)
+	tree.CPUs.SetU32("timebase-frequency", c.frequency)
+}
+
+// SaveState writes msip, mtimecmp and the current mtime of the CLINT to w.
+func (c *CLINTDevice) SaveState(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, data := range []any{c.msip, c.mtimecmp, c.time()} {
+		if err := binary.Write(w, binary.LittleEndian, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadState restores the state of the CLINT saved by SaveState. mtime
+// counts on from the saved value.
+func (c *CLINTDevice) LoadState(r io.Reader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var mtime uint64
+	for _, data := range []any{c.msip, c.mtimecmp, &mtime} {
+		if err := binary.Read(r, binary.LittleEndian, data); err != nil {
+			return fmt.Errorf("failed to read CLINT state: %v", err)
+		}
+	}
+	c.setTime(mtime)
+	c.update()
+	return nil
+}
@@ -0,0 +1,119 @@
+package devices
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestCLINT(t *testing.T) {
+	const base = 0x02000000
+	clint, err := NewCLINT(base, CLINTSize, DefaultTimebaseFrequency)
+	if err != nil {
+		t.Fatalf("NewCLINT failed: %v", err)
+	}
+
+	writeWord(t, clint, base+clintMsip+4, 0xFFFFFFFF)
+	if !clint.SoftwarePending(1) || clint.SoftwarePending(0) {
+		t.Error("Expected only the software interrupt of hart 1")
+	}
+	if msip := readWord(t, clint, base+clintMsip+4); msip != 1 {
+		t.Errorf("Expected msip 1, got %X", msip)
+	}
+
+	if clint.TimerPending(0) {
+		t.Error("Expected no timer interrupt with mtimecmp at its maximum")
+	}
+	writeWord(t, clint, base+clintMtimecmp, 0)
+	writeWord(t, clint, base+clintMtimecmp+4, 0)
+	if !clint.TimerPending(0) || clint.TimerPending(1) {
+		t.Error("Expected only the timer interrupt of hart 0")
+	}
+
+	writeWord(t, clint, base+clintMtime, 0)
+	writeWord(t, clint, base+clintMtime+4, 5)
+	if high := readWord(t, clint, base+clintMtime+4); high != 5 {
+		t.Errorf("Expected the high word of mtime to be 5, got %d", high)
+	}
+
+	var state bytes.Buffer
+	if err := clint.SaveState(&state); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	data := state.Bytes()
+	if mtime := binary.LittleEndian.Uint64(data[len(data)-8:]); mtime>>32 != 5 {
+		t.Errorf("Expected mtime saved, got %X", mtime)
+	}
+	restored, _ := NewCLINT(base, CLINTSize, DefaultTimebaseFrequency)
+	if err := restored.LoadState(&state); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if !restored.SoftwarePending(1) || restored.Time()>>32 != 5 {
+		t.Error("Expected the state restored")
+	}
+}
+
+func TestCLINT_ConnectHart(t *testing.T) {
+	clint, _ := NewCLINT(0, CLINTSize, DefaultTimebaseFrequency)
+	hart := &testHart{map[uint32]bool{}}
+	clint.ConnectHart(0, hart)
+	if hart.levels[InterruptMachineSoftware] || hart.levels[InterruptMachineTimer] {
+		t.Errorf("Expected no interrupts, got %v", hart.levels)
+	}
+
+	writeWord(t, clint, clintMsip, 1)
+	if !hart.levels[InterruptMachineSoftware] {
+		t.Error("Expected the software interrupt raised by msip")
+	}
+	writeWord(t, clint, clintMsip, 0)
+	if hart.levels[InterruptMachineSoftware] {
+		t.Error("Expected the software interrupt cleared by msip")
+	}
+
+	// Arm the timer a second ahead; it fires once mtime passes it.
+	writeWord(t, clint, clintMtimecmp, DefaultTimebaseFrequency)
+	writeWord(t, clint, clintMtimecmp+4, 0)
+	clint.Poll()
+	if hart.levels[InterruptMachineTimer] {
+		t.Error("Expected no timer interrupt before mtimecmp")
+	}
+	writeWord(t, clint, clintMtime, 2*DefaultTimebaseFrequency)
+	if !hart.levels[InterruptMachineTimer] {
+		t.Error("Expected the timer interrupt once mtime passed mtimecmp")
+	}
+}
+
+// timerHart is a testHart installing a timer check.
+type timerHart struct {
+	testHart
+	check func()
+}
+
+func (h *timerHart) SetTimer(check func()) {
+	h.check = check
+}
+
+func TestCLINT_TimerHart(t *testing.T) {
+	clint, _ := NewCLINT(0, CLINTSize, DefaultTimebaseFrequency)
+	hart := &timerHart{testHart: testHart{map[uint32]bool{}}}
+	clint.ConnectHart(0, hart)
+	if hart.check == nil {
+		t.Fatal("Expected the CLINT to install a timer check")
+	}
+
+	writeWord(t, clint, clintMtimecmp, DefaultTimebaseFrequency)
+	writeWord(t, clint, clintMtimecmp+4, 0)
+	hart.check()
+	if hart.levels[InterruptMachineTimer] {
+		t.Error("Expected no timer interrupt before mtimecmp")
+	}
+	// Two seconds pass on the host.
+	clint.mu.Lock()
+	clint.start = clint.start.Add(-2 * time.Second)
+	clint.mu.Unlock()
+	hart.check()
+	if !hart.levels[InterruptMachineTimer] {
+		t.Error("Expected the timer check to raise the interrupt")
+	}
+}
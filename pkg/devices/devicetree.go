@@ -0,0 +1,100 @@
+package devices
+
+import (
+	"fmt"
+
+	"github.com/Keisim/go-riscv-emu/pkg/fdt"
+)
+
+// DeviceTreeDevice is a device describing itself in the device tree passed
+// to the guest.
+type DeviceTreeDevice interface {
+	BusDevice
+	AddToDeviceTree(tree *DeviceTree)
+}
+
+// DeviceTree is the device tree of a machine while devices add their nodes.
+type DeviceTree struct {
+	Root  *fdt.Node
+	CPUs  *fdt.Node // The /cpus node
+	SoC   *fdt.Node // The /soc bus that memory-mapped devices are added to
+	Harts int
+
+	// StdoutPath is the path of the console device for /chosen, set by the
+	// first UART.
+	StdoutPath string
+
+	controller InterruptController
+	phandles   map[any]uint32
+}
+
+// NewDeviceTree returns a device tree with the root, /cpus and /soc nodes
+// for a machine with the given harts and devices. The interrupt controller
+// among the devices, if any, is the interrupt parent of all devices.
+func NewDeviceTree(harts int, devices []BusDevice) *DeviceTree {
+	tree := &DeviceTree{
+		Root:     fdt.NewNode(""),
+		CPUs:     fdt.NewNode("cpus"),
+		SoC:      fdt.NewNode("soc"),
+		Harts:    harts,
+		phandles: map[any]uint32{},
+	}
+	tree.Root.SetU32("#address-cells", 1)
+	tree.Root.SetU32("#size-cells", 1)
+	tree.Root.AddChild(tree.CPUs)
+	tree.CPUs.SetU32("#address-cells", 1)
+	tree.CPUs.SetU32("#size-cells", 0)
+	tree.Root.AddChild(tree.SoC)
+	tree.SoC.SetU32("#address-cells", 1)
+	tree.SoC.SetU32("#size-cells", 1)
+	tree.SoC.SetStrings("compatible", "simple-bus")
+	tree.SoC.SetEmpty("ranges")
+
+	for _, device := range devices {
+		if controller, ok := device.(InterruptController); ok {
+			tree.controller = controller
+		}
+	}
+	return tree
+}
+
+// Phandle returns the phandle of the node of an object, e.g. a device,
+// allocating one on first use.
+func (t *DeviceTree) Phandle(object any) uint32 {
+	phandle, ok := t.phandles[object]
+	if !ok {
+		phandle = uint32(len(t.phandles) + 1)
+		t.phandles[object] = phandle
+	}
+	return phandle
+}
+
+// cpuInterruptController identifies the local interrupt controller of a
+// hart for Phandle.
+type cpuInterruptController int
+
+// CPUInterruptController returns the phandle of the local interrupt
+// controller of a hart.
+func (t *DeviceTree) CPUInterruptController(hart int) uint32 {
+	return t.Phandle(cpuInterruptController(hart))
+}
+
+// AddDevice adds a node for a memory-mapped device to /soc, named after its
+// base address, with its compatible strings and reg property.
+func (t *DeviceTree) AddDevice(device BusDevice, name string, compatible ...string) *fdt.Node {
+	node := t.SoC.AddChild(fdt.NewNode(fmt.Sprintf("%s@%x", name,
+		device.BaseAddress())))
+	node.SetStrings("compatible", compatible...)
+	node.SetU32("reg", device.BaseAddress(), device.Size())
+	return node
+}
+
+// AddInterrupt wires the node of a device to its interrupt source at the
+// interrupt controller. It does nothing for sources without an interrupt.
+func (t *DeviceTree) AddInterrupt(node *fdt.Node, source uint32) {
+	if t.controller == nil || source == 0 {
+		return
+	}
+	node.SetU32("interrupt-parent", t.Phandle(t.controller))
+	node.SetU32("interrupts", source)
+}
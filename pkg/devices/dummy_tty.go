@@ -1,6 +1,24 @@
 package devices
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+func init() {
+	Register("dummy-tty", func(baseAddress, size uint32, params json.RawMessage) (BusDevice, error) {
+		if err := noParams(params); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			size = 1
+		}
+		tty := &DummyTTYDevice{}
+		tty.Initialize(baseAddress, size)
+		return tty, nil
+	})
+}
 
 type DummyTTYDevice struct {
 	baseAddress uint32
@@ -36,6 +54,12 @@ func (d *DummyTTYDevice) Write(address uint32, value byte) error {
 	return nil
 }
 
+// HostInput reports that reads from the DummyTTY are host input, as they
+// are meant to return keystrokes.
+func (d *DummyTTYDevice) HostInput() bool {
+	return true
+}
+
 func (d *DummyTTYDevice) BaseAddress() uint32 {
 	return d.baseAddress
 }
@@ -43,3 +67,18 @@ func (d *DummyTTYDevice) BaseAddress() uint32 {
 func (d *DummyTTYDevice) Size() uint32 {
 	return d.size
 }
+
+// SaveState does nothing, the DummyTTY device has no internal state.
+func (d *DummyTTYDevice) SaveState(w io.Writer) error {
+	return nil
+}
+
+// LoadState does nothing, the DummyTTY device has no internal state.
+func (d *DummyTTYDevice) LoadState(r io.Reader) error {
+	return nil
+}
+
+// AddToDeviceTree adds a node for the DummyTTY device.
+func (d *DummyTTYDevice) AddToDeviceTree(tree *DeviceTree) {
+	tree.AddDevice(d, "tty", "keisim,dummy-tty")
+}
@@ -0,0 +1,267 @@
+package devices
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+func init() {
+	Register("framebuffer", func(baseAddress, size uint32, params json.RawMessage) (BusDevice, error) {
+		p := struct {
+			Width    uint32 `json:"width"`
+			Height   uint32 `json:"height"`
+			Format   string `json:"format"`
+			PNG      string `json:"png"`       // Path of the frames, %d for the frame number
+			PNGEvery uint64 `json:"png-every"` // Frames between PNG files
+		}{Width: 640, Height: 480, Format: "x8r8g8b8", PNGEvery: 1}
+		if err := DecodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		fb, err := NewFramebuffer(p.Width, p.Height, p.Format)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			size = fb.stride * fb.height
+		}
+		if size < fb.stride*fb.height {
+			return nil, fmt.Errorf("framebuffer of %d bytes needs a size of %d",
+				size, fb.stride*fb.height)
+		}
+		fb.Initialize(baseAddress, size)
+		if p.PNG != "" {
+			fb.DumpFrames(p.PNG, p.PNGEvery)
+		}
+		return fb, nil
+	})
+}
+
+// PixelFormat is a pixel format of simple-framebuffer. Pixels are little
+// endian and their channels are bit fields.
+type PixelFormat struct {
+	Name                            string
+	BytesPerPixel                   uint32
+	RedShift, GreenShift, BlueShift uint8
+	RedBits, GreenBits, BlueBits    uint8
+}
+
+// PixelFormats holds the pixel formats of the Linux simplefb driver by
+// name.
+var PixelFormats = map[string]PixelFormat{
+	"r5g6b5":   {"r5g6b5", 2, 11, 5, 0, 5, 6, 5},
+	"x1r5g5b5": {"x1r5g5b5", 2, 10, 5, 0, 5, 5, 5},
+	"a1r5g5b5": {"a1r5g5b5", 2, 10, 5, 0, 5, 5, 5},
+	"r8g8b8":   {"r8g8b8", 3, 16, 8, 0, 8, 8, 8},
+	"x8r8g8b8": {"x8r8g8b8", 4, 16, 8, 0, 8, 8, 8},
+	"a8r8g8b8": {"a8r8g8b8", 4, 16, 8, 0, 8, 8, 8},
+	"x8b8g8r8": {"x8b8g8r8", 4, 0, 8, 16, 8, 8, 8},
+	"a8b8g8r8": {"a8b8g8r8", 4, 0, 8, 16, 8, 8, 8},
+}
+
+// channel extracts a channel of a pixel and scales it to 8 bits.
+func channel(pixel uint32, shift, bits uint8) uint8 {
+	mask := uint32(1)<<bits - 1
+	return uint8((pixel >> shift & mask) * 255 / mask)
+}
+
+// FramebufferDevice is a linear framebuffer, a display whose pixels are
+// memory on the bus. Alpha channels are ignored, as by a display.
+//
+// A frame ends whenever the bus is polled after the guest changed pixels,
+// so frames follow the rendering of the guest without depending on host
+// time.
+type FramebufferDevice struct {
+	baseAddress uint32
+	size        uint32
+	width       uint32
+	height      uint32
+	stride      uint32
+	format      PixelFormat
+	memory      []byte
+
+	dirty      bool
+	frame      uint64 // Number of frames ended
+	pngPattern string
+	pngEvery   uint64
+	listeners  []func(*image.NRGBA)
+}
+
+// NewFramebuffer returns a framebuffer of width by height pixels of the
+// given format, with rows following each other without padding.
+func NewFramebuffer(width, height uint32, format string) (*FramebufferDevice, error) {
+	pixelFormat, ok := PixelFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown pixel format %q", format)
+	}
+	if width == 0 || height == 0 || width > 8192 || height > 8192 {
+		return nil, fmt.Errorf("invalid framebuffer resolution %dx%d", width, height)
+	}
+	return &FramebufferDevice{
+		width:  width,
+		height: height,
+		stride: width * pixelFormat.BytesPerPixel,
+		format: pixelFormat,
+	}, nil
+}
+
+// Initialize maps the framebuffer at baseAddress, with size bytes of memory
+// of which the first rows are displayed.
+func (f *FramebufferDevice) Initialize(baseAddress, size uint32) {
+	f.baseAddress = baseAddress
+	f.size = size
+	f.memory = make([]byte, size)
+}
+
+// Read reads a byte of the framebuffer memory.
+func (f *FramebufferDevice) Read(address uint32) (byte, error) {
+	if address < f.baseAddress || address-f.baseAddress >= f.size {
+		return 0, fmt.Errorf(
+			"attempted to read from invalid framebuffer address %X", address)
+	}
+	return f.memory[address-f.baseAddress], nil
+}
+
+// Write writes a byte of the framebuffer memory.
+func (f *FramebufferDevice) Write(address uint32, value byte) error {
+	if address < f.baseAddress || address-f.baseAddress >= f.size {
+		return fmt.Errorf(
+			"attempted to write %X to invalid framebuffer address %X",
+			value, address)
+	}
+	f.memory[address-f.baseAddress] = value
+	f.dirty = true
+	return nil
+}
+
+// BaseAddress returns the base address of the framebuffer.
+func (f *FramebufferDevice) BaseAddress() uint32 {
+	return f.baseAddress
+}
+
+// Size returns the size of the framebuffer memory in bytes.
+func (f *FramebufferDevice) Size() uint32 {
+	return f.size
+}
+
+// Image returns a copy of the displayed frame.
+func (f *FramebufferDevice) Image() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, int(f.width), int(f.height)))
+	bpp := f.format.BytesPerPixel
+	var raw [4]byte
+	for y := range f.height {
+		row := f.memory[y*f.stride:]
+		for x := range f.width {
+			copy(raw[:], row[x*bpp:(x+1)*bpp])
+			pixel := binary.LittleEndian.Uint32(raw[:])
+			img.SetNRGBA(int(x), int(y), color.NRGBA{
+				R: channel(pixel, f.format.RedShift, f.format.RedBits),
+				G: channel(pixel, f.format.GreenShift, f.format.GreenBits),
+				B: channel(pixel, f.format.BlueShift, f.format.BlueBits),
+				A: 0xFF,
+			})
+		}
+	}
+	return img
+}
+
+// WritePNG writes the displayed frame as PNG image to w.
+func (f *FramebufferDevice) WritePNG(w io.Writer) error {
+	return png.Encode(w, f.Image())
+}
+
+// DumpFrames writes every n-th frame to a PNG file. The path is formatted
+// with the frame number if it contains a verb like %06d, and otherwise
+// overwritten with every dumped frame.
+func (f *FramebufferDevice) DumpFrames(pattern string, n uint64) {
+	f.pngPattern = pattern
+	f.pngEvery = max(n, 1)
+}
+
+// OnFrame calls listener with every frame when it ends, with the lock of
+// the bus held. Listeners must not modify the image.
+func (f *FramebufferDevice) OnFrame(listener func(*image.NRGBA)) {
+	f.listeners = append(f.listeners, listener)
+}
+
+// Frame returns the number of frames ended so far.
+func (f *FramebufferDevice) Frame() uint64 {
+	return f.frame
+}
+
+// Poll ends a frame if the guest changed pixels since the last one.
+func (f *FramebufferDevice) Poll() {
+	if !f.dirty {
+		return
+	}
+	f.dirty = false
+	f.frame++
+	dump := f.pngPattern != "" && f.frame%f.pngEvery == 0
+	if !dump && len(f.listeners) == 0 {
+		return
+	}
+	img := f.Image()
+	for _, listener := range f.listeners {
+		listener(img)
+	}
+	if !dump {
+		return
+	}
+	path := f.pngPattern
+	if strings.Contains(path, "%") {
+		path = fmt.Sprintf(path, f.frame)
+	}
+	if err := savePNG(path, img); err != nil {
+		slog.Warn("Failed to write frame", "frame", f.frame, "error", err)
+	}
+}
+
+// savePNG writes an image to a PNG file.
+func savePNG(path string, img image.Image) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// SaveState writes the framebuffer memory and the frame counter to w.
+func (f *FramebufferDevice) SaveState(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, f.frame); err != nil {
+		return err
+	}
+	_, err := w.Write(f.memory)
+	return err
+}
+
+// LoadState restores the framebuffer memory and the frame counter.
+func (f *FramebufferDevice) LoadState(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &f.frame); err != nil {
+		return fmt.Errorf("failed to read framebuffer state: %v", err)
+	}
+	if _, err := io.ReadFull(r, f.memory); err != nil {
+		return fmt.Errorf("failed to read framebuffer memory: %v", err)
+	}
+	f.dirty = false
+	return nil
+}
+
+// AddToDeviceTree adds a simple-framebuffer node.
+func (f *FramebufferDevice) AddToDeviceTree(tree *DeviceTree) {
+	node := tree.AddDevice(f, "framebuffer", "simple-framebuffer")
+	node.SetU32("width", f.width)
+	node.SetU32("height", f.height)
+	node.SetU32("stride", f.stride)
+	node.SetString("format", f.format.Name)
+}
@@ -0,0 +1,104 @@
+package devices
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFramebuffer(t *testing.T) {
+	const base = 0x50000000
+	fb, err := NewFramebuffer(4, 2, "r5g6b5")
+	if err != nil {
+		t.Fatalf("NewFramebuffer failed: %v", err)
+	}
+	fb.Initialize(base, 16)
+	dir := t.TempDir()
+	fb.DumpFrames(filepath.Join(dir, "frame%d.png"), 2)
+
+	// Pure red at (1, 0) and pure blue at (3, 1).
+	for _, write := range []struct {
+		address uint32
+		value   byte
+	}{{base + 3, 0xF8}, {base + 14, 0x1F}} {
+		if err := fb.Write(write.address, write.value); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	img := fb.Image()
+	if c := img.NRGBAAt(1, 0); c != (color.NRGBA{0xFF, 0, 0, 0xFF}) {
+		t.Errorf("Expected red, got %v", c)
+	}
+	if c := img.NRGBAAt(3, 1); c != (color.NRGBA{0, 0, 0xFF, 0xFF}) {
+		t.Errorf("Expected blue, got %v", c)
+	}
+
+	fb.Poll()
+	fb.Poll() // Nothing changed, no frame
+	if err := fb.Write(base, 0xFF); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	fb.Poll()
+	if fb.Frame() != 2 {
+		t.Errorf("Expected 2 frames, got %d", fb.Frame())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "frame1.png")); err == nil {
+		t.Error("Expected only every second frame to be written")
+	}
+	f, err := os.Open(filepath.Join(dir, "frame2.png"))
+	if err != nil {
+		t.Fatalf("Expected frame 2 to be written: %v", err)
+	}
+	defer f.Close()
+	decoded, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("Failed to decode PNG: %v", err)
+	}
+	if r, _, b, _ := decoded.At(3, 1).RGBA(); r != 0 || b != 0xFFFF {
+		t.Errorf("Unexpected pixel in PNG %v", decoded.At(3, 1))
+	}
+
+	var state bytes.Buffer
+	if err := fb.SaveState(&state); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	restored, _ := NewFramebuffer(4, 2, "r5g6b5")
+	restored.Initialize(base, 16)
+	if err := restored.LoadState(&state); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if restored.Frame() != 2 || !bytes.Equal(restored.memory, fb.memory) {
+		t.Error("Expected the restored frame")
+	}
+}
+
+func TestFramebuffer_DeviceTree(t *testing.T) {
+	fb, err := NewFramebuffer(640, 480, "a8b8g8r8")
+	if err != nil {
+		t.Fatalf("NewFramebuffer failed: %v", err)
+	}
+	fb.Initialize(0x50000000, 640*480*4)
+	tree := NewDeviceTree(1, []BusDevice{fb})
+	fb.AddToDeviceTree(tree)
+
+	node := tree.Root.Lookup("/soc/framebuffer@50000000")
+	if node == nil {
+		t.Fatal("Expected a framebuffer node")
+	}
+	if compatible, _ := node.String("compatible"); compatible != "simple-framebuffer" {
+		t.Errorf("Unexpected compatible %q", compatible)
+	}
+	if stride, _ := node.U32("stride"); len(stride) != 1 || stride[0] != 2560 {
+		t.Errorf("Expected stride 2560, got %v", stride)
+	}
+	if format, _ := node.String("format"); format != "a8b8g8r8" {
+		t.Errorf("Unexpected format %q", format)
+	}
+
+	if _, err := NewFramebuffer(640, 480, "rgb"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
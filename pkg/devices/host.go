@@ -0,0 +1,76 @@
+package devices
+
+import (
+	"errors"
+	"sync"
+)
+
+// HostDevice is a BusDevice using host resources, e.g. files, sockets or
+// goroutines reading from them. Its factory only checks the parameters;
+// Open acquires the resources once the device is part of a machine and
+// Close releases them, so devices built only to validate a configuration
+// leave nothing behind.
+type HostDevice interface {
+	BusDevice
+	Open(host *Host) error
+	Close() error
+}
+
+// Host holds the host resources shared by the devices of one machine, e.g.
+// the named links between its network devices.
+type Host struct {
+	mu     sync.Mutex
+	shared map[string]any
+	opened []HostDevice
+}
+
+// NewHost returns a Host sharing nothing yet.
+func NewHost() *Host {
+	return &Host{shared: map[string]any{}}
+}
+
+// Shared returns the value shared under key by the devices of the machine,
+// creating it on first use.
+func (h *Host) Shared(key string, create func() any) any {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	value, ok := h.shared[key]
+	if !ok {
+		value = create()
+		h.shared[key] = value
+	}
+	return value
+}
+
+// Open opens the host devices among devices. If one fails, those opened
+// before are closed again.
+func (h *Host) Open(devices []BusDevice) error {
+	for _, device := range devices {
+		hostDevice, ok := device.(HostDevice)
+		if !ok {
+			continue
+		}
+		if err := hostDevice.Open(h); err != nil {
+			h.Close()
+			return err
+		}
+		h.mu.Lock()
+		h.opened = append(h.opened, hostDevice)
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+// Close closes the devices opened by Open, in reverse order, and returns
+// their errors.
+func (h *Host) Close() error {
+	h.mu.Lock()
+	opened := h.opened
+	h.opened = nil
+	h.mu.Unlock()
+	var errs []error
+	for i := len(opened) - 1; i >= 0; i-- {
+		errs = append(errs, opened[i].Close())
+	}
+	return errors.Join(errs...)
+}
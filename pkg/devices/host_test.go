@@ -0,0 +1,56 @@
+package devices
+
+import (
+	"errors"
+	"testing"
+)
+
+// hostDevice records being opened and closed.
+type hostDevice struct {
+	RAMDevice
+	fail   bool
+	opened bool
+}
+
+func (d *hostDevice) Open(host *Host) error {
+	if d.fail {
+		return errors.New("open failed")
+	}
+	d.opened = true
+	return nil
+}
+
+func (d *hostDevice) Close() error {
+	d.opened = false
+	return nil
+}
+
+func TestHost(t *testing.T) {
+	host := NewHost()
+	a, b := &hostDevice{}, &hostDevice{}
+	if err := host.Open([]BusDevice{a, &RAMDevice{}, b}); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if !a.opened || !b.opened {
+		t.Error("Expected both devices opened")
+	}
+	if err := host.Close(); err != nil || a.opened || b.opened {
+		t.Errorf("Expected both devices closed, got %v", err)
+	}
+
+	c := &hostDevice{}
+	if err := NewHost().Open([]BusDevice{c, &hostDevice{fail: true}}); err == nil {
+		t.Fatal("Expected the error of the second device")
+	}
+	if c.opened {
+		t.Error("Expected the first device closed after the failure")
+	}
+
+	first := host.Shared("link", func() any { return new(int) })
+	if host.Shared("link", func() any { return new(int) }) != first {
+		t.Error("Expected the shared value created once")
+	}
+	if NewHost().Shared("link", func() any { return new(int) }) == first {
+		t.Error("Expected hosts not to share values")
+	}
+}
@@ -0,0 +1,101 @@
+package devices
+
+import "fmt"
+
+// IRQLine is a level-triggered interrupt line from a device to an
+// interrupt controller.
+type IRQLine interface {
+	SetLevel(high bool)
+}
+
+// InterruptController is a device that devices raise interrupts on, e.g.
+// the PLIC.
+type InterruptController interface {
+	BusDevice
+	// Line returns the interrupt line of the given source number.
+	Line(source uint32) (IRQLine, error)
+}
+
+// Machine interrupts of a hart, numbered by their bits in mip.
+const (
+	InterruptMachineSoftware = 3
+	InterruptMachineTimer    = 7
+	InterruptMachineExternal = 11
+)
+
+// Hart is a hart receiving interrupts.
+type Hart interface {
+	// InterruptLine returns the line of a machine interrupt of the hart.
+	InterruptLine(cause uint32) IRQLine
+}
+
+// TimerHart is a Hart that calls a timer check every few instructions while
+// it runs, so that timer interrupts following the host clock are raised
+// without waiting for the bus to be polled.
+type TimerHart interface {
+	Hart
+	// SetTimer installs the check, replacing any earlier one.
+	SetTimer(check func())
+}
+
+// HartInterruptController is a device raising the interrupts of harts,
+// e.g. the CLINT or the PLIC.
+type HartInterruptController interface {
+	BusDevice
+	// ConnectHart connects the interrupts of the hart with the given index.
+	ConnectHart(index int, hart Hart)
+}
+
+// InterruptSource is a device with an interrupt line.
+type InterruptSource interface {
+	BusDevice
+	// IRQ returns the source number of the device at the interrupt
+	// controller, or 0 if it does not use interrupts.
+	IRQ() uint32
+	// ConnectIRQ connects the device to its line at the controller.
+	ConnectIRQ(line IRQLine)
+}
+
+// ConnectInterrupts connects the interrupt sources among the devices to the
+// interrupt controller among them. Sources using interrupts need exactly one
+// controller and distinct source numbers.
+func ConnectInterrupts(devices []BusDevice) error {
+	var controller InterruptController
+	for _, device := range devices {
+		if c, ok := device.(InterruptController); ok {
+			if controller != nil {
+				return fmt.Errorf("more than one interrupt controller")
+			}
+			controller = c
+		}
+	}
+
+	used := map[uint32]BusDevice{}
+	for _, device := range devices {
+		source, ok := device.(InterruptSource)
+		if !ok || source.IRQ() == 0 {
+			continue
+		}
+		irq := source.IRQ()
+		if controller == nil {
+			return fmt.Errorf("%T at %X uses IRQ %d, but there is no interrupt controller",
+				device, device.BaseAddress(), irq)
+		}
+		if other, ok := used[irq]; ok {
+			return fmt.Errorf("%T at %X and %T at %X both use IRQ %d", other,
+				other.BaseAddress(), device, device.BaseAddress(), irq)
+		}
+		used[irq] = device
+		line, err := controller.Line(irq)
+		if err != nil {
+			return fmt.Errorf("%T at %X: %v", device, device.BaseAddress(), err)
+		}
+		source.ConnectIRQ(line)
+	}
+	return nil
+}
+
+// noLine is the interrupt line of unconnected devices.
+type noLine struct{}
+
+func (noLine) SetLevel(high bool) {}
@@ -0,0 +1,391 @@
+package devices
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+func init() {
+	Register("plic", func(baseAddress, size uint32, params json.RawMessage) (BusDevice, error) {
+		p := struct {
+			Sources int `json:"sources"`
+			Harts   int `json:"harts"`
+		}{Sources: 31, Harts: 1}
+		if err := DecodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			size = PLICSize
+		}
+		return NewPLIC(baseAddress, size, p.Sources, p.Harts)
+	})
+}
+
+// PLICSize is the default size of the PLIC register space.
+const PLICSize = 0x4000000
+
+// Offsets of the PLIC register blocks.
+const (
+	plicPriority     = 0x000000 // Priority of each source, 4 bytes apart
+	plicPending      = 0x001000 // Pending bits, 32 sources per word
+	plicEnable       = 0x002000 // Enable bits, 0x80 bytes per context
+	plicContext      = 0x200000 // Threshold and claim/complete, 0x1000 per context
+	plicMaxSource    = 1023
+	plicPriorityMask = 7
+)
+
+// PLICDevice is a RISC-V platform-level interrupt controller as found on
+// SiFive cores. It has two contexts per hart, for machine and supervisor
+// mode external interrupts.
+//
+// Registers are 32 bits wide. Reading the first byte of a claim register
+// claims the interrupt and writing the last byte of it completes one.
+type PLICDevice struct {
+	baseAddress uint32
+	size        uint32
+	sources     int
+	contexts    int
+
+	mu        sync.Mutex
+	priority  []uint32  // By source
+	level     []bool    // By source, the level of its line
+	pending   []bool    // By source
+	claimed   []bool    // By source, claimed but not completed yet
+	enable    []uint32  // By context and source word
+	threshold []uint32  // By context
+	claim     []uint32  // By context, the ID read by the last claim
+	complete  []uint32  // By context, the ID being written to complete
+	outputs   []IRQLine // By context, the interrupt of its hart, or nil
+	connected bool      // A line of a source has been handed out
+}
+
+// NewPLIC returns a PLIC with the given number of interrupt sources for
+// the given number of harts.
+func NewPLIC(baseAddress, size uint32, sources, harts int) (*PLICDevice, error) {
+	if sources < 1 || sources > plicMaxSource {
+		return nil, fmt.Errorf("PLIC needs 1 to %d sources, got %d",
+			plicMaxSource, sources)
+	}
+	if harts < 1 {
+		return nil, fmt.Errorf("PLIC needs at least one hart")
+	}
+	if uint64(size) < plicContext+0x1000*2*uint64(harts) {
+		return nil, fmt.Errorf("PLIC size %X too small for %d harts", size, harts)
+	}
+	p := &PLICDevice{sources: sources, contexts: 2 * harts}
+	p.Initialize(baseAddress, size)
+	return p, nil
+}
+
+// Initialize sets up the PLIC at the given base address, with all
+// interrupts disabled.
+func (p *PLICDevice) Initialize(baseAddress, size uint32) {
+	p.baseAddress = baseAddress
+	p.size = size
+	if p.sources == 0 {
+		p.sources, p.contexts = 31, 2
+	}
+	p.priority = make([]uint32, p.sources+1)
+	p.level = make([]bool, p.sources+1)
+	p.pending = make([]bool, p.sources+1)
+	p.claimed = make([]bool, p.sources+1)
+	p.enable = make([]uint32, p.contexts*p.words())
+	p.threshold = make([]uint32, p.contexts)
+	p.claim = make([]uint32, p.contexts)
+	p.complete = make([]uint32, p.contexts)
+}
+
+// words returns the number of words of pending and enable bits.
+func (p *PLICDevice) words() int {
+	return p.sources/32 + 1
+}
+
+func (p *PLICDevice) BaseAddress() uint32 {
+	return p.baseAddress
+}
+
+func (p *PLICDevice) Size() uint32 {
+	return p.size
+}
+
+// Sources returns the number of interrupt sources, numbered from 1.
+func (p *PLICDevice) Sources() int {
+	return p.sources
+}
+
+// Contexts returns the number of contexts: machine mode of hart 0,
+// supervisor mode of hart 0, machine mode of hart 1 and so on.
+func (p *PLICDevice) Contexts() int {
+	return p.contexts
+}
+
+// Line returns the interrupt line of a source.
+func (p *PLICDevice) Line(source uint32) (IRQLine, error) {
+	if source < 1 || source > uint32(p.sources) {
+		return nil, fmt.Errorf("PLIC has no interrupt source %d", source)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connected = true
+	return plicLine{p, source}, nil
+}
+
+// HostInput reports that reads from the PLIC are host input once devices
+// are connected to it, as their lines may follow host input, e.g. those of
+// a UART receiving from the terminal.
+func (p *PLICDevice) HostInput() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.connected
+}
+
+// plicLine is the interrupt line of a PLIC source.
+type plicLine struct {
+	plic   *PLICDevice
+	source uint32
+}
+
+// SetLevel sets the level of the line. The gateway makes a high line
+// pending unless it is being served.
+func (l plicLine) SetLevel(high bool) {
+	l.plic.mu.Lock()
+	defer l.plic.mu.Unlock()
+	l.plic.level[l.source] = high
+	if high && !l.plic.claimed[l.source] {
+		l.plic.pending[l.source] = true
+	}
+	l.plic.update()
+}
+
+// ConnectHart connects the machine-mode context of a hart to its external
+// interrupt. Supervisor mode is not implemented, so its context raises
+// nothing.
+func (p *PLICDevice) ConnectHart(index int, hart Hart) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if 2*index >= p.contexts {
+		return
+	}
+	if p.outputs == nil {
+		p.outputs = make([]IRQLine, p.contexts)
+	}
+	p.outputs[2*index] = hart.InterruptLine(InterruptMachineExternal)
+	p.update()
+}
+
+// update sets the interrupt of every connected context to whether it has
+// an external interrupt to take.
+func (p *PLICDevice) update() {
+	for context, output := range p.outputs {
+		if output != nil {
+			output.SetLevel(p.best(context) != 0)
+		}
+	}
+}
+
+// Pending reports whether a context has an external interrupt to take.
+func (p *PLICDevice) Pending(context int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.best(context) != 0
+}
+
+// best returns the pending and enabled source of a context with the
+// highest priority above its threshold, or 0 if there is none.
+func (p *PLICDevice) best(context int) uint32 {
+	var best, priority uint32
+	for source := 1; source <= p.sources; source++ {
+		if p.pending[source] && p.enabled(context, source) &&
+			p.priority[source] > priority {
+			best, priority = uint32(source), p.priority[source]
+		}
+	}
+	if priority <= p.threshold[context] {
+		return 0
+	}
+	return best
+}
+
+func (p *PLICDevice) enabled(context, source int) bool {
+	return p.enable[context*p.words()+source/32]&(1<<(source%32)) != 0
+}
+
+// Read reads a byte of a PLIC register.
+func (p *PLICDevice) Read(address uint32) (byte, error) {
+	if address < p.baseAddress || address-p.baseAddress >= p.size {
+		return 0, fmt.Errorf(
+			"attempted to read from invalid PLIC address %X", address)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	offset := address - p.baseAddress
+	shift := 8 * (offset & 3)
+	if register := p.register(offset &^ 3); register != nil {
+		return byte(*register >> shift), nil
+	}
+
+	var value uint32
+	if offset >= plicPending && offset < plicPending+4*uint32(p.words()) {
+		word := int(offset-plicPending) / 4
+		for bit := range 32 {
+			source := 32*word + bit
+			if source <= p.sources && p.pending[source] {
+				value |= 1 << bit
+			}
+		}
+	}
+	if context, ok := p.contextOf(offset, plicContext+4, 4, 0x1000); ok {
+		if offset&3 == 0 {
+			p.claim[context] = p.best(context)
+			if source := p.claim[context]; source != 0 {
+				p.pending[source] = false
+				p.claimed[source] = true
+				p.update()
+			}
+		}
+		value = p.claim[context]
+	}
+	return byte(value >> shift), nil
+}
+
+// Write writes a byte of a PLIC register. Writes to read-only or reserved
+// registers are ignored.
+func (p *PLICDevice) Write(address uint32, value byte) error {
+	if address < p.baseAddress || address-p.baseAddress >= p.size {
+		return fmt.Errorf(
+			"attempted to write %X to invalid PLIC address %X", value, address)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	offset := address - p.baseAddress
+	shift := 8 * (offset & 3)
+	if register := p.register(offset &^ 3); register != nil {
+		*register = *register&^(0xFF<<shift) | uint32(value)<<shift
+		p.mask(offset &^ 3)
+		p.update()
+		return nil
+	}
+
+	context, ok := p.contextOf(offset, plicContext+4, 4, 0x1000)
+	if !ok {
+		return nil
+	}
+	p.complete[context] = p.complete[context]&^(0xFF<<shift) |
+		uint32(value)<<shift
+	if offset&3 == 3 {
+		source := p.complete[context]
+		if source >= 1 && source <= uint32(p.sources) &&
+			p.enabled(context, int(source)) && p.claimed[source] {
+			p.claimed[source] = false
+			p.pending[source] = p.level[source]
+			p.update()
+		}
+	}
+	return nil
+}
+
+// register returns the plain read-write register at a word offset, or nil
+// if there is none.
+func (p *PLICDevice) register(offset uint32) *uint32 {
+	if offset < plicPending {
+		if source := offset / 4; source >= 1 && source <= uint32(p.sources) {
+			return &p.priority[source]
+		}
+		return nil
+	}
+	words := uint32(p.words())
+	if offset >= plicEnable && offset < plicEnable+0x80*uint32(p.contexts) {
+		context, word := (offset-plicEnable)/0x80, (offset-plicEnable)%0x80/4
+		if word < words {
+			return &p.enable[context*words+word]
+		}
+		return nil
+	}
+	if context, ok := p.contextOf(offset, plicContext, 4, 0x1000); ok {
+		return &p.threshold[context]
+	}
+	return nil
+}
+
+// mask clears the bits of a register at a word offset that are not
+// implemented.
+func (p *PLICDevice) mask(offset uint32) {
+	if offset < plicPending {
+		p.priority[offset/4] &= plicPriorityMask
+	} else if offset >= plicEnable && offset < plicContext {
+		// Source 0 does not exist.
+		p.enable[(offset-plicEnable)/0x80*uint32(p.words())] &^= 1
+	} else {
+		p.threshold[(offset-plicContext)/0x1000] &= plicPriorityMask
+	}
+	// Bits of sources past the last one in the last enable word.
+	for context := range p.contexts {
+		last := context*p.words() + p.words() - 1
+		p.enable[last] &= 1<<(p.sources%32+1) - 1
+	}
+}
+
+// contextOf returns the context whose block of size bytes, at start plus
+// stride bytes per context, covers offset.
+func (p *PLICDevice) contextOf(offset, start, size, stride uint32) (int, bool) {
+	if offset < start {
+		return 0, false
+	}
+	context := (offset - start) / stride
+	if context >= uint32(p.contexts) || (offset-start)%stride >= size {
+		return 0, false
+	}
+	return int(context), true
+}
+
+// AddToDeviceTree adds the PLIC node, delivering the contexts to the
+// machine and supervisor external interrupts of the harts.
+func (p *PLICDevice) AddToDeviceTree(tree *DeviceTree) {
+	node := tree.AddDevice(p, "plic", "sifive,plic-1.0.0", "riscv,plic0")
+	node.SetU32("phandle", tree.Phandle(p))
+	node.SetU32("#address-cells", 0)
+	node.SetU32("#interrupt-cells", 1)
+	node.SetEmpty("interrupt-controller")
+	node.SetU32("riscv,ndev", uint32(p.sources))
+	var interrupts []uint32
+	for hart := 0; hart < tree.Harts && hart < p.contexts/2; hart++ {
+		intc := tree.CPUInterruptController(hart)
+		interrupts = append(interrupts, intc, 11, intc, 9)
+	}
+	node.SetU32("interrupts-extended", interrupts...)
+}
+
+// SaveState writes the priorities, pending and enable bits, thresholds and
+// claims of the PLIC to w.
+func (p *PLICDevice) SaveState(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, data := range p.state() {
+		if err := binary.Write(w, binary.LittleEndian, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadState restores the state of the PLIC saved by SaveState.
+func (p *PLICDevice) LoadState(r io.Reader) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, data := range p.state() {
+		if err := binary.Read(r, binary.LittleEndian, data); err != nil {
+			return fmt.Errorf("failed to read PLIC state: %v", err)
+		}
+	}
+	p.update()
+	return nil
+}
+
+// state returns the slices holding the state of the PLIC.
+func (p *PLICDevice) state() []any {
+	return []any{p.priority, p.level, p.pending, p.claimed, p.enable,
+		p.threshold, p.claim, p.complete}
+}
@@ -0,0 +1,198 @@
+package devices
+
+import (
+	"bytes"
+	"testing"
+)
+
+// writeWord writes a little-endian word to a device byte by byte.
+func writeWord(t *testing.T, device BusDevice, address, value uint32) {
+	t.Helper()
+	for i := range uint32(4) {
+		if err := device.Write(address+i, byte(value>>(8*i))); err != nil {
+			t.Fatalf("Write(%X) failed: %v", address+i, err)
+		}
+	}
+}
+
+// readWord reads a little-endian word from a device byte by byte.
+func readWord(t *testing.T, device BusDevice, address uint32) uint32 {
+	t.Helper()
+	var value uint32
+	for i := range uint32(4) {
+		b, err := device.Read(address + i)
+		if err != nil {
+			t.Fatalf("Read(%X) failed: %v", address+i, err)
+		}
+		value |= uint32(b) << (8 * i)
+	}
+	return value
+}
+
+func TestPLIC_ClaimComplete(t *testing.T) {
+	const base = 0x0C000000
+	plic, err := NewPLIC(base, PLICSize, 40, 1)
+	if err != nil {
+		t.Fatalf("NewPLIC failed: %v", err)
+	}
+	line3, _ := plic.Line(3)
+	line35, _ := plic.Line(35)
+
+	writeWord(t, plic, base+4*3, 1)
+	writeWord(t, plic, base+4*35, 2)
+	writeWord(t, plic, base+plicEnable, 1<<3)
+	writeWord(t, plic, base+plicEnable+4, 1<<(35-32))
+
+	line3.SetLevel(true)
+	line35.SetLevel(true)
+	if pending := readWord(t, plic, base+plicPending+4); pending != 1<<3 {
+		t.Errorf("Expected source 35 pending, got %X", pending)
+	}
+	if !plic.Pending(0) || plic.Pending(1) {
+		t.Errorf("Expected only context 0 to have an interrupt")
+	}
+
+	// The source with the highest priority is claimed first.
+	claim := uint32(base + plicContext + 4)
+	if source := readWord(t, plic, claim); source != 35 {
+		t.Fatalf("Expected claim of source 35, got %d", source)
+	}
+	if source := readWord(t, plic, claim); source != 3 {
+		t.Fatalf("Expected claim of source 3, got %d", source)
+	}
+	if source := readWord(t, plic, claim); source != 0 {
+		t.Fatalf("Expected no claim, got %d", source)
+	}
+
+	// A line still high after completion is pending again.
+	line3.SetLevel(false)
+	writeWord(t, plic, claim, 3)
+	writeWord(t, plic, claim, 35)
+	if source := readWord(t, plic, claim); source != 35 {
+		t.Fatalf("Expected claim of source 35 again, got %d", source)
+	}
+
+	// The threshold masks interrupts of lower or equal priority.
+	writeWord(t, plic, claim, 35)
+	writeWord(t, plic, base+plicContext, 2)
+	if plic.Pending(0) {
+		t.Errorf("Expected the threshold to mask source 35")
+	}
+	if threshold := readWord(t, plic, base+plicContext); threshold != 2 {
+		t.Errorf("Expected threshold 2, got %d", threshold)
+	}
+}
+
+func TestPLIC_Registers(t *testing.T) {
+	const base = 0x0C000000
+	plic, err := NewPLIC(base, PLICSize, 31, 1)
+	if err != nil {
+		t.Fatalf("NewPLIC failed: %v", err)
+	}
+	writeWord(t, plic, base+4*5, 0xFF)
+	if priority := readWord(t, plic, base+4*5); priority != 7 {
+		t.Errorf("Expected priority masked to 7, got %d", priority)
+	}
+	writeWord(t, plic, base+plicEnable, 0xFFFFFFFF)
+	if enable := readWord(t, plic, base+plicEnable); enable != 0xFFFFFFFE {
+		t.Errorf("Expected enable bits of sources 1 to 31, got %X", enable)
+	}
+	// Registers of missing sources and contexts are reserved.
+	writeWord(t, plic, base+4*32, 1)
+	if priority := readWord(t, plic, base+4*32); priority != 0 {
+		t.Errorf("Expected no priority of source 32, got %d", priority)
+	}
+	if _, err := plic.Line(32); err == nil {
+		t.Error("Expected no line of source 32")
+	}
+	if _, err := NewPLIC(base, plicContext, 31, 1); err == nil {
+		t.Error("Expected error for a PLIC without room for its contexts")
+	}
+}
+
+func TestPLIC_State(t *testing.T) {
+	plic, _ := NewPLIC(0, PLICSize, 31, 1)
+	line, _ := plic.Line(1)
+	writeWord(t, plic, 4, 1)
+	writeWord(t, plic, plicEnable, 2)
+	line.SetLevel(true)
+
+	var state bytes.Buffer
+	if err := plic.SaveState(&state); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	restored, _ := NewPLIC(0, PLICSize, 31, 1)
+	if err := restored.LoadState(&state); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if source := readWord(t, restored, plicContext+4); source != 1 {
+		t.Errorf("Expected claim of source 1 after restore, got %d", source)
+	}
+}
+
+// testHart records the levels of the interrupts of a hart.
+type testHart struct {
+	levels map[uint32]bool
+}
+
+func (h *testHart) InterruptLine(cause uint32) IRQLine {
+	return testHartLine{h, cause}
+}
+
+type testHartLine struct {
+	hart  *testHart
+	cause uint32
+}
+
+func (l testHartLine) SetLevel(high bool) {
+	l.hart.levels[l.cause] = high
+}
+
+func TestPLIC_ConnectHart(t *testing.T) {
+	plic, _ := NewPLIC(0, PLICSize, 31, 2)
+	harts := []*testHart{{map[uint32]bool{}}, {map[uint32]bool{}}}
+	for i, hart := range harts {
+		plic.ConnectHart(i, hart)
+	}
+	line, _ := plic.Line(1)
+	writeWord(t, plic, 4, 1)
+	line.SetLevel(true)
+	if harts[0].levels[InterruptMachineExternal] {
+		t.Error("Expected no interrupt while the source is disabled")
+	}
+
+	// Enable source 1 in the machine context of hart 1.
+	writeWord(t, plic, plicEnable+2*0x80, 2)
+	if harts[0].levels[InterruptMachineExternal] ||
+		!harts[1].levels[InterruptMachineExternal] {
+		t.Errorf("Expected only hart 1 interrupted, got %v and %v",
+			harts[0].levels, harts[1].levels)
+	}
+	writeWord(t, plic, plicContext+2*0x1000, 1)
+	if harts[1].levels[InterruptMachineExternal] {
+		t.Error("Expected no interrupt at the threshold")
+	}
+	writeWord(t, plic, plicContext+2*0x1000, 0)
+
+	if source := readWord(t, plic, plicContext+2*0x1000+4); source != 1 {
+		t.Fatalf("Expected claim of source 1, got %d", source)
+	}
+	if harts[1].levels[InterruptMachineExternal] {
+		t.Error("Expected the interrupt cleared by the claim")
+	}
+	writeWord(t, plic, plicContext+2*0x1000+4, 1)
+	if !harts[1].levels[InterruptMachineExternal] {
+		t.Error("Expected the interrupt raised again by the completion of a high line")
+	}
+}
+
+func TestPLIC_HostInput(t *testing.T) {
+	plic, _ := NewPLIC(0x0C000000, PLICSize, 4, 1)
+	if plic.HostInput() {
+		t.Error("Expected no host input without sources")
+	}
+	plic.Line(1)
+	if !plic.HostInput() {
+		t.Error("Expected reads to be host input once a source is connected")
+	}
+}
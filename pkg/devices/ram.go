@@ -1,11 +1,28 @@
 package devices
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 
+	"github.com/Keisim/go-riscv-emu/pkg/fdt"
 	"github.com/Keisim/go-riscv-emu/pkg/memory"
 )
 
+func init() {
+	Register("ram", func(baseAddress, size uint32, params json.RawMessage) (BusDevice, error) {
+		if err := noParams(params); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, fmt.Errorf("RAM needs a size")
+		}
+		ram := &RAMDevice{}
+		ram.Initialize(baseAddress, size)
+		return ram, nil
+	})
+}
+
 // RAMDevice represents a block of RAM accessible via MMIO.
 type RAMDevice struct {
 	baseAddress uint32
@@ -51,3 +68,20 @@ func (r *RAMDevice) Initialize(baseAddress, size uint32) {
 	r.size = size
 	r.memory = memory.NewRAM(size)
 }
+
+// SaveState writes the contents of the RAM device to w.
+func (r *RAMDevice) SaveState(w io.Writer) error {
+	return r.memory.SaveState(w)
+}
+
+// LoadState restores the contents of the RAM device from r.
+func (r *RAMDevice) LoadState(state io.Reader) error {
+	return r.memory.LoadState(state)
+}
+
+// AddToDeviceTree adds a memory node for the RAM device.
+func (r *RAMDevice) AddToDeviceTree(tree *DeviceTree) {
+	node := tree.Root.AddChild(fdt.NewNode(fmt.Sprintf("memory@%x", r.baseAddress)))
+	node.SetString("device_type", "memory")
+	node.SetU32("reg", r.baseAddress, r.size)
+}
@@ -0,0 +1,68 @@
+package devices
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Factory creates a device of a registered type at the given base address
+// and size. params holds the device-specific parameters of the machine
+// configuration as JSON, or is empty if there are none. Factories must not
+// acquire host resources, which HostDevice.Open does instead, as devices
+// are also created only to validate a configuration.
+type Factory func(baseAddress, size uint32, params json.RawMessage) (BusDevice, error)
+
+// factories holds the registered device types by name.
+var factories = map[string]Factory{}
+
+// Register makes a device type available to machine configurations under
+// the given name. It panics if the name is already registered.
+func Register(name string, factory Factory) {
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("device type %q registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// Types returns the names of all registered device types, sorted.
+func Types() []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates a device of the registered type with the given name.
+func New(name string, baseAddress, size uint32, params json.RawMessage) (BusDevice, error) {
+	factory, ok := factories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown device type %q, known types are %v",
+			name, Types())
+	}
+	return factory(baseAddress, size, params)
+}
+
+// DecodeParams decodes the parameters of a device into v. Unknown
+// parameters are an error, so that typos do not go unnoticed. Empty
+// parameters leave v unchanged.
+func DecodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid parameters: %v", err)
+	}
+	return nil
+}
+
+// noParams returns an error if a device without parameters got some.
+func noParams(params json.RawMessage) error {
+	var none struct{}
+	return DecodeParams(params, &none)
+}
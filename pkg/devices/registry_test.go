@@ -0,0 +1,48 @@
+package devices
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	device, err := New("ram", 0x80000000, 0x1000, nil)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, ok := device.(*RAMDevice); !ok {
+		t.Fatalf("Expected a RAMDevice, got %T", device)
+	}
+	if device.BaseAddress() != 0x80000000 || device.Size() != 0x1000 {
+		t.Errorf("Unexpected range %X+%X", device.BaseAddress(), device.Size())
+	}
+
+	device, err = New("dummy-tty", 0x10000000, 0, json.RawMessage("{}"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if device.Size() != 1 {
+		t.Errorf("Expected the default size of 1, got %d", device.Size())
+	}
+}
+
+func TestNew_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   uint32
+		params string
+		err    string
+	}{
+		{"floppy", 1, "", `unknown device type "floppy"`},
+		{"ram", 0, "", "RAM needs a size"},
+		{"ram", 1, `{"speed": 1}`, `unknown field "speed"`},
+	}
+	for _, test := range tests {
+		_, err := New(test.name, 0, test.size, json.RawMessage(test.params))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected error containing %q for %s, got %v", test.err,
+				test.name, err)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package devices
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+func init() {
+	Register("goldfish-rtc", func(baseAddress, size uint32, params json.RawMessage) (BusDevice, error) {
+		p := struct {
+			IRQ                   uint32 `json:"irq"`
+			Mode                  string `json:"mode"`  // host, fixed or virtual
+			Epoch                 string `json:"epoch"` // RFC 3339 time of the fixed and virtual modes
+			InstructionsPerSecond uint64 `json:"instructions-per-second"`
+		}{Mode: "host", Epoch: DefaultRTCEpoch, InstructionsPerSecond: DefaultInstructionsPerSecond}
+		if err := DecodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		mode, err := ParseRTCMode(p.Mode)
+		if err != nil {
+			return nil, err
+		}
+		epoch, err := time.Parse(time.RFC3339, p.Epoch)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RTC epoch: %v", err)
+		}
+		if p.InstructionsPerSecond == 0 {
+			return nil, fmt.Errorf("RTC needs a number of instructions per second")
+		}
+		if size == 0 {
+			size = RTCSize
+		}
+		if size < rtcClearInterrupt+4 {
+			return nil, fmt.Errorf("RTC size %X too small", size)
+		}
+		rtc := NewRTC(p.IRQ, mode, epoch, p.InstructionsPerSecond)
+		rtc.Initialize(baseAddress, size)
+		return rtc, nil
+	})
+}
+
+// RTCSize is the default size of the RTC register space.
+const RTCSize = 0x1000
+
+// DefaultRTCEpoch is the time at which the fixed and virtual clocks of the
+// RTC start.
+const DefaultRTCEpoch = "2000-01-01T00:00:00Z"
+
+// DefaultInstructionsPerSecond is the rate at which the virtual clock of
+// the RTC advances with the instructions retired.
+const DefaultInstructionsPerSecond = 100000000
+
+// Offsets of the Goldfish RTC registers.
+const (
+	rtcTimeLow        = 0x00
+	rtcTimeHigh       = 0x04
+	rtcAlarmLow       = 0x08
+	rtcAlarmHigh      = 0x0C
+	rtcIRQEnabled     = 0x10
+	rtcClearAlarm     = 0x14
+	rtcAlarmStatus    = 0x18
+	rtcClearInterrupt = 0x1C
+)
+
+// RTCMode is where the time of an RTC comes from.
+type RTCMode int
+
+const (
+	// RTCHostTime follows the clock of the host.
+	RTCHostTime RTCMode = iota
+	// RTCFixedEpoch stands still at the epoch unless the guest sets it.
+	RTCFixedEpoch
+	// RTCVirtualTime starts at the epoch and advances with the
+	// instructions retired by the harts, so runs are reproducible.
+	RTCVirtualTime
+)
+
+// ParseRTCMode parses the name of an RTC mode: host, fixed or virtual.
+func ParseRTCMode(name string) (RTCMode, error) {
+	switch name {
+	case "host":
+		return RTCHostTime, nil
+	case "fixed":
+		return RTCFixedEpoch, nil
+	case "virtual":
+		return RTCVirtualTime, nil
+	}
+	return 0, fmt.Errorf("unknown RTC mode %q", name)
+}
+
+// RTCDevice is a Goldfish RTC, counting nanoseconds since the Unix epoch,
+// with an alarm raising its interrupt.
+type RTCDevice struct {
+	baseAddress uint32
+	size        uint32
+	irq         uint32
+	mode        RTCMode
+	epoch       int64 // Nanoseconds since the Unix epoch
+	rate        uint64
+	count       func() uint64 // Instructions retired, for virtual time
+
+	mu           sync.Mutex
+	line         IRQLine
+	offset       int64  // Added to the time of the mode
+	latch        uint64 // Time as of the last read of TIME_LOW
+	timeHigh     uint32 // Last value written to TIME_HIGH
+	alarm        uint64
+	alarmHigh    uint32 // Last value written to ALARM_HIGH
+	alarmRunning bool
+	irqPending   bool
+	irqEnabled   bool
+	written      uint32 // Bytes of the register word being written
+}
+
+// NewRTC returns an RTC in the given mode raising the given interrupt
+// source, 0 for none. The epoch and rate apply to the fixed and virtual
+// modes.
+func NewRTC(irq uint32, mode RTCMode, epoch time.Time, instructionsPerSecond uint64) *RTCDevice {
+	return &RTCDevice{irq: irq, mode: mode, epoch: epoch.UnixNano(),
+		rate: instructionsPerSecond, line: noLine{},
+		count: func() uint64 { return 0 }}
+}
+
+// Initialize sets up the RTC at the given base address.
+func (r *RTCDevice) Initialize(baseAddress, size uint32) {
+	r.baseAddress = baseAddress
+	r.size = size
+}
+
+func (r *RTCDevice) BaseAddress() uint32 {
+	return r.baseAddress
+}
+
+func (r *RTCDevice) Size() uint32 {
+	return r.size
+}
+
+// IRQ returns the interrupt source of the RTC.
+func (r *RTCDevice) IRQ() uint32 {
+	return r.irq
+}
+
+// ConnectIRQ connects the RTC to its interrupt line.
+func (r *RTCDevice) ConnectIRQ(line IRQLine) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.line = line
+	r.update()
+}
+
+// ConnectInstructionCount connects the virtual clock to the number of
+// instructions retired by the harts.
+func (r *RTCDevice) ConnectInstructionCount(count func() uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.count = count
+}
+
+// HostInput reports that reads from the RTC are host input in host-time
+// mode.
+func (r *RTCDevice) HostInput() bool {
+	return r.mode == RTCHostTime
+}
+
+// base returns the time of the mode in nanoseconds since the Unix epoch.
+func (r *RTCDevice) base() int64 {
+	switch r.mode {
+	case RTCFixedEpoch:
+		return r.epoch
+	case RTCVirtualTime:
+		n := r.count()
+		return r.epoch + int64(n/r.rate*uint64(time.Second)+
+			n%r.rate*uint64(time.Second)/r.rate)
+	}
+	return time.Now().UnixNano()
+}
+
+// now returns the time of the RTC.
+func (r *RTCDevice) now() uint64 {
+	return uint64(r.base() + r.offset)
+}
+
+// Time returns the time of the RTC.
+func (r *RTCDevice) Time() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Unix(0, int64(r.now()))
+}
+
+// check fires the alarm once the time has reached it.
+func (r *RTCDevice) check() {
+	if r.alarmRunning && r.now() >= r.alarm {
+		r.alarmRunning = false
+		r.irqPending = true
+		r.update()
+	}
+}
+
+// update sets the interrupt line to whether an enabled interrupt is
+// pending.
+func (r *RTCDevice) update() {
+	r.line.SetLevel(r.irqPending && r.irqEnabled)
+}
+
+// Poll fires the alarm if it is due.
+func (r *RTCDevice) Poll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.check()
+}
+
+// Read reads a byte of an RTC register. Reading the first byte of
+// TIME_LOW samples the clock for both words of the time.
+func (r *RTCDevice) Read(address uint32) (byte, error) {
+	if address < r.baseAddress || address-r.baseAddress >= r.size {
+		return 0, fmt.Errorf(
+			"attempted to read from invalid RTC address %X", address)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	offset := address - r.baseAddress
+	shift := 8 * (offset & 3)
+	var value uint32
+	switch offset &^ 3 {
+	case rtcTimeLow:
+		if shift == 0 {
+			r.latch = r.now()
+			r.check()
+		}
+		value = uint32(r.latch)
+	case rtcTimeHigh:
+		value = uint32(r.latch >> 32)
+	case rtcAlarmLow:
+		value = uint32(r.alarm)
+	case rtcAlarmHigh:
+		value = uint32(r.alarm >> 32)
+	case rtcIRQEnabled:
+		value = boolWord(r.irqEnabled)
+	case rtcAlarmStatus:
+		if shift == 0 {
+			r.check()
+		}
+		value = boolWord(r.alarmRunning)
+	}
+	return byte(value >> shift), nil
+}
+
+// boolWord returns 1 for true and 0 for false.
+func boolWord(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Write writes a byte of an RTC register. Registers take the written word
+// when its last byte is written.
+func (r *RTCDevice) Write(address uint32, value byte) error {
+	if address < r.baseAddress || address-r.baseAddress >= r.size {
+		return fmt.Errorf(
+			"attempted to write %X to invalid RTC address %X", value, address)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	offset := address - r.baseAddress
+	shift := 8 * (offset & 3)
+	r.written = r.written&^(0xFF<<shift) | uint32(value)<<shift
+	if offset&3 != 3 {
+		return nil
+	}
+	word := r.written
+	switch offset &^ 3 {
+	case rtcTimeLow:
+		r.offset += int64(uint64(r.timeHigh)<<32|uint64(word)) - int64(r.now())
+	case rtcTimeHigh:
+		r.timeHigh = word
+	case rtcAlarmLow:
+		r.alarm = uint64(r.alarmHigh)<<32 | uint64(word)
+		r.alarmRunning = true
+	case rtcAlarmHigh:
+		r.alarmHigh = word
+	case rtcIRQEnabled:
+		r.irqEnabled = word&1 != 0
+	case rtcClearAlarm:
+		r.alarmRunning = false
+	case rtcClearInterrupt:
+		r.irqPending = false
+	}
+	r.check()
+	r.update()
+	return nil
+}
+
+// AddToDeviceTree adds the RTC node.
+func (r *RTCDevice) AddToDeviceTree(tree *DeviceTree) {
+	node := tree.AddDevice(r, "rtc", "google,goldfish-rtc")
+	tree.AddInterrupt(node, r.irq)
+}
+
+// rtcRegisters holds the registers of an RTC in a snapshot.
+type rtcRegisters struct {
+	Time, Offset, Latch, Alarm        uint64
+	TimeHigh, AlarmHigh, Written      uint32
+	AlarmRunning, IRQPending, Enabled bool
+}
+
+// SaveState writes the registers and the time of the RTC to w.
+func (r *RTCDevice) SaveState(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return binary.Write(w, binary.LittleEndian, rtcRegisters{
+		r.now(), uint64(r.offset), r.latch, r.alarm,
+		r.timeHigh, r.alarmHigh, r.written,
+		r.alarmRunning, r.irqPending, r.irqEnabled})
+}
+
+// LoadState restores the state of the RTC saved by SaveState. In host-time
+// mode, the time continues from the saved one.
+func (r *RTCDevice) LoadState(state io.Reader) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var registers rtcRegisters
+	if err := binary.Read(state, binary.LittleEndian, &registers); err != nil {
+		return fmt.Errorf("failed to read RTC state: %v", err)
+	}
+	r.offset = int64(registers.Offset)
+	if r.mode == RTCHostTime {
+		r.offset = int64(registers.Time) - r.base()
+	}
+	r.latch, r.alarm = registers.Latch, registers.Alarm
+	r.timeHigh, r.alarmHigh, r.written = registers.TimeHigh,
+		registers.AlarmHigh, registers.Written
+	r.alarmRunning, r.irqPending, r.irqEnabled = registers.AlarmRunning,
+		registers.IRQPending, registers.Enabled
+	r.update()
+	return nil
+}
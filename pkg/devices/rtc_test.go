@@ -0,0 +1,122 @@
+package devices
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// readTime reads the time of an RTC as a guest does, low word first.
+func readTime(t *testing.T, rtc *RTCDevice) uint64 {
+	t.Helper()
+	low := readWord(t, rtc, rtc.BaseAddress()+rtcTimeLow)
+	high := readWord(t, rtc, rtc.BaseAddress()+rtcTimeHigh)
+	return uint64(high)<<32 | uint64(low)
+}
+
+func TestRTC_VirtualTime(t *testing.T) {
+	const base = 0x101000
+	epoch := time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)
+	rtc := NewRTC(11, RTCVirtualTime, epoch, 1000)
+	rtc.Initialize(base, RTCSize)
+	var instructions uint64
+	rtc.ConnectInstructionCount(func() uint64 { return instructions })
+	line := &levelLine{}
+	rtc.ConnectIRQ(line)
+
+	if now := readTime(t, rtc); now != uint64(epoch.UnixNano()) {
+		t.Errorf("Expected the epoch, got %d", now)
+	}
+	instructions = 1500
+	if now := readTime(t, rtc); now != uint64(epoch.UnixNano())+1500*uint64(time.Millisecond) {
+		t.Errorf("Expected 1.5s after the epoch, got %d", now)
+	}
+
+	// Arm the alarm one second ahead.
+	alarm := uint64(epoch.Add(2500 * time.Millisecond).UnixNano())
+	writeWord(t, rtc, base+rtcIRQEnabled, 1)
+	writeWord(t, rtc, base+rtcAlarmHigh, uint32(alarm>>32))
+	writeWord(t, rtc, base+rtcAlarmLow, uint32(alarm))
+	if readWord(t, rtc, base+rtcAlarmStatus) != 1 || line.high {
+		t.Error("Expected the alarm armed and not fired")
+	}
+	instructions = 2500
+	rtc.Poll()
+	if readWord(t, rtc, base+rtcAlarmStatus) != 0 || !line.high {
+		t.Error("Expected the alarm to fire")
+	}
+	writeWord(t, rtc, base+rtcClearInterrupt, 1)
+	if line.high {
+		t.Error("Expected the interrupt cleared")
+	}
+
+	// Setting the time moves the clock, which keeps advancing.
+	set := uint64(time.Date(2038, 1, 19, 3, 14, 8, 0, time.UTC).UnixNano())
+	writeWord(t, rtc, base+rtcTimeHigh, uint32(set>>32))
+	writeWord(t, rtc, base+rtcTimeLow, uint32(set))
+	instructions = 3500
+	if now := readTime(t, rtc); now != set+uint64(time.Second) {
+		t.Errorf("Expected a second after the set time, got %d", now)
+	}
+
+	var state bytes.Buffer
+	if err := rtc.SaveState(&state); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	restored := NewRTC(11, RTCVirtualTime, epoch, 1000)
+	restored.Initialize(base, RTCSize)
+	restored.ConnectInstructionCount(func() uint64 { return instructions })
+	if err := restored.LoadState(&state); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if !restored.Time().Equal(rtc.Time()) {
+		t.Errorf("Expected %v restored, got %v", rtc.Time(), restored.Time())
+	}
+}
+
+func TestRTC_AlarmDisabledIRQ(t *testing.T) {
+	const base = 0x101000
+	rtc := NewRTC(11, RTCFixedEpoch, time.Unix(100, 0), DefaultInstructionsPerSecond)
+	rtc.Initialize(base, RTCSize)
+	line := &levelLine{}
+	rtc.ConnectIRQ(line)
+
+	writeWord(t, rtc, base+rtcAlarmHigh, 0)
+	writeWord(t, rtc, base+rtcAlarmLow, 1)
+	if line.high {
+		t.Error("Expected no interrupt while disabled")
+	}
+	writeWord(t, rtc, base+rtcIRQEnabled, 1)
+	if !line.high {
+		t.Error("Expected the pending interrupt once enabled")
+	}
+	if now := readTime(t, rtc); now != 100*uint64(time.Second) {
+		t.Errorf("Expected the fixed epoch, got %d", now)
+	}
+}
+
+func TestRTC_HostTime(t *testing.T) {
+	rtc := NewRTC(0, RTCHostTime, time.Time{}, DefaultInstructionsPerSecond)
+	rtc.Initialize(0x101000, RTCSize)
+	if !rtc.HostInput() {
+		t.Error("Expected host time to be host input")
+	}
+	before := time.Now()
+	now := time.Unix(0, int64(readTime(t, rtc)))
+	if now.Before(before) || now.After(time.Now()) {
+		t.Errorf("Expected the host time, got %v", now)
+	}
+}
+
+func TestParseRTCMode(t *testing.T) {
+	for name, want := range map[string]RTCMode{
+		"host": RTCHostTime, "fixed": RTCFixedEpoch, "virtual": RTCVirtualTime,
+	} {
+		if mode, err := ParseRTCMode(name); err != nil || mode != want {
+			t.Errorf("ParseRTCMode(%q) = %v, %v", name, mode, err)
+		}
+	}
+	if _, err := ParseRTCMode("guest"); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,150 @@
+package devices
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Keisim/go-riscv-emu/pkg/fdt"
+)
+
+func init() {
+	Register("sifive-test", func(baseAddress, size uint32, params json.RawMessage) (BusDevice, error) {
+		if err := DecodeParams(params, &struct{}{}); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			size = SiFiveTestSize
+		}
+		if size < 4 {
+			return nil, fmt.Errorf("SiFive test device size %X too small", size)
+		}
+		test := &SiFiveTestDevice{}
+		test.Initialize(baseAddress, size)
+		return test, nil
+	})
+}
+
+// SiFiveTestSize is the default size of the SiFive test device.
+const SiFiveTestSize = 0x1000
+
+// Values written to the SiFive test device, in the low half of the word.
+const (
+	// SiFiveTestFail powers off with the exit code in the high half.
+	SiFiveTestFail = 0x3333
+	// SiFiveTestPass powers off with success.
+	SiFiveTestPass = 0x5555
+	// SiFiveTestReset resets the machine.
+	SiFiveTestReset = 0x7777
+)
+
+// SiFiveTestDevice is the SiFive test finisher, the syscon register the
+// guest writes to power the machine off or reset it. A failure with exit
+// code 0 is reported as exit code 1, so that it is never taken for
+// success.
+type SiFiveTestDevice struct {
+	baseAddress uint32
+	size        uint32
+
+	mu      sync.Mutex
+	handler func(action PowerAction, code uint32)
+	written uint32 // Bytes of the word being written
+}
+
+// Initialize sets up the device at the given base address.
+func (d *SiFiveTestDevice) Initialize(baseAddress, size uint32) {
+	d.baseAddress = baseAddress
+	d.size = size
+}
+
+func (d *SiFiveTestDevice) BaseAddress() uint32 {
+	return d.baseAddress
+}
+
+func (d *SiFiveTestDevice) Size() uint32 {
+	return d.size
+}
+
+// ConnectPower connects the device to the handler carrying out the
+// requests of the guest. Without a handler, writes are ignored.
+func (d *SiFiveTestDevice) ConnectPower(handler func(action PowerAction, code uint32)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handler = handler
+}
+
+// Read reads a byte of the device, which always reads as 0.
+func (d *SiFiveTestDevice) Read(address uint32) (byte, error) {
+	if address < d.baseAddress || address-d.baseAddress >= d.size {
+		return 0, fmt.Errorf(
+			"attempted to read from invalid SiFive test address %X", address)
+	}
+	return 0, nil
+}
+
+// Write writes a byte of the finisher register. The request is made when
+// the last byte of the word is written; unknown values are ignored.
+func (d *SiFiveTestDevice) Write(address uint32, value byte) error {
+	if address < d.baseAddress || address-d.baseAddress >= d.size {
+		return fmt.Errorf(
+			"attempted to write %X to invalid SiFive test address %X",
+			value, address)
+	}
+	offset := address - d.baseAddress
+	if offset >= 4 {
+		return nil
+	}
+	d.mu.Lock()
+	shift := 8 * offset
+	d.written = d.written&^(0xFF<<shift) | uint32(value)<<shift
+	word, handler := d.written, d.handler
+	d.mu.Unlock()
+	if offset != 3 || handler == nil {
+		return nil
+	}
+	switch word & 0xFFFF {
+	case SiFiveTestPass:
+		handler(PowerOff, 0)
+	case SiFiveTestFail:
+		handler(PowerOff, max(word>>16, 1))
+	case SiFiveTestReset:
+		handler(PowerReset, 0)
+	}
+	return nil
+}
+
+// AddToDeviceTree adds the syscon node of the device and the
+// syscon-poweroff and syscon-reboot nodes using it.
+func (d *SiFiveTestDevice) AddToDeviceTree(tree *DeviceTree) {
+	node := tree.AddDevice(d, "test", "sifive,test1", "sifive,test0", "syscon")
+	node.SetU32("phandle", tree.Phandle(d))
+	for _, action := range []struct {
+		name  string
+		value uint32
+	}{{"poweroff", SiFiveTestPass}, {"reboot", SiFiveTestReset}} {
+		child := tree.Root.AddChild(fdt.NewNode(action.name))
+		child.SetStrings("compatible", "syscon-"+action.name)
+		child.SetU32("regmap", tree.Phandle(d))
+		child.SetU32("offset", 0)
+		child.SetU32("value", action.value)
+	}
+}
+
+// SaveState writes the partially written word to w.
+func (d *SiFiveTestDevice) SaveState(w io.Writer) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return binary.Write(w, binary.LittleEndian, d.written)
+}
+
+// LoadState restores the state saved by SaveState.
+func (d *SiFiveTestDevice) LoadState(r io.Reader) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := binary.Read(r, binary.LittleEndian, &d.written); err != nil {
+		return fmt.Errorf("failed to read SiFive test state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package devices
+
+import "testing"
+
+func TestSiFiveTest(t *testing.T) {
+	const base = 0x100000
+	test := &SiFiveTestDevice{}
+	test.Initialize(base, SiFiveTestSize)
+	writeWord(t, test, base, SiFiveTestPass) // Ignored without a handler
+
+	type request struct {
+		action PowerAction
+		code   uint32
+	}
+	var requests []request
+	test.ConnectPower(func(action PowerAction, code uint32) {
+		requests = append(requests, request{action, code})
+	})
+	for _, value := range []uint32{
+		SiFiveTestPass, 3<<16 | SiFiveTestFail, SiFiveTestFail,
+		SiFiveTestReset, 0x1234,
+	} {
+		writeWord(t, test, base, value)
+	}
+	expected := []request{{PowerOff, 0}, {PowerOff, 3}, {PowerOff, 1}, {PowerReset, 0}}
+	if len(requests) != len(expected) {
+		t.Fatalf("Expected %d requests, got %v", len(expected), requests)
+	}
+	for i, r := range requests {
+		if r != expected[i] {
+			t.Errorf("Expected request %d to be %v, got %v", i, expected[i], r)
+		}
+	}
+	if value := readWord(t, test, base); value != 0 {
+		t.Errorf("Expected the register to read as 0, got %X", value)
+	}
+}
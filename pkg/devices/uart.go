@@ -0,0 +1,331 @@
+package devices
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+func init() {
+	Register("ns16550a", func(baseAddress, size uint32, params json.RawMessage) (BusDevice, error) {
+		p := struct {
+			IRQ            uint32 `json:"irq"`
+			ClockFrequency uint32 `json:"clock-frequency"`
+		}{ClockFrequency: DefaultUARTClock}
+		if err := DecodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			size = UARTSize
+		}
+		if size < 8 {
+			return nil, fmt.Errorf("UART size %X too small", size)
+		}
+		uart := NewUART(p.IRQ, p.ClockFrequency)
+		uart.Initialize(baseAddress, size)
+		return uart, nil
+	})
+}
+
+// UARTSize is the default size of the UART register space.
+const UARTSize = 0x100
+
+// DefaultUARTClock is the default input clock of the UART in Hz.
+const DefaultUARTClock = 3686400
+
+// Offsets of the UART registers.
+const (
+	uartData    = 0 // RBR, THR, or DLL with DLAB set
+	uartIER     = 1 // IER, or DLM with DLAB set
+	uartIIR     = 2 // IIR when read, FCR when written
+	uartLCR     = 3
+	uartMCR     = 4
+	uartLSR     = 5
+	uartMSR     = 6
+	uartScratch = 7
+)
+
+// Bits of the UART registers.
+const (
+	uartIERReceive  = 0x01 // Received data available interrupt
+	uartIERTransmit = 0x02 // Transmitter holding register empty interrupt
+	uartIIRNone     = 0x01
+	uartIIRTransmit = 0x02
+	uartIIRReceive  = 0x04
+	uartIIRFIFO     = 0xC0
+	uartFCREnable   = 0x01
+	uartFCRClearRx  = 0x02
+	uartLCRDLAB     = 0x80
+	uartLSRReady    = 0x01
+	uartLSREmpty    = 0x60 // THRE and TEMT, transmission is instant
+	uartMSRLines    = 0xB0 // DCD, DSR and CTS
+)
+
+// UARTDevice is a 16550A UART with byte-wide registers. Transmitted bytes
+// are written to an output, by default standard output, immediately.
+// Received bytes come from an optional input.
+type UARTDevice struct {
+	baseAddress uint32
+	size        uint32
+	irq         uint32
+	clock       uint32
+	output      io.Writer
+	line        IRQLine
+
+	mu       sync.Mutex
+	input    bool
+	received []byte
+	ier      byte
+	fcr      byte
+	lcr      byte
+	mcr      byte
+	scratch  byte
+	divisor  uint16
+	transmit bool // Transmitter holding register empty interrupt pending
+}
+
+// NewUART returns a UART raising the given interrupt source, 0 for none,
+// that writes to standard output.
+func NewUART(irq, clock uint32) *UARTDevice {
+	return &UARTDevice{irq: irq, clock: clock, output: os.Stdout,
+		line: noLine{}}
+}
+
+// Initialize sets up the UART at the given base address.
+func (u *UARTDevice) Initialize(baseAddress, size uint32) {
+	u.baseAddress = baseAddress
+	u.size = size
+	if u.output == nil {
+		u.output, u.line = os.Stdout, noLine{}
+	}
+}
+
+func (u *UARTDevice) BaseAddress() uint32 {
+	return u.baseAddress
+}
+
+func (u *UARTDevice) Size() uint32 {
+	return u.size
+}
+
+// IRQ returns the interrupt source of the UART.
+func (u *UARTDevice) IRQ() uint32 {
+	return u.irq
+}
+
+// ConnectIRQ connects the UART to its interrupt line.
+func (u *UARTDevice) ConnectIRQ(line IRQLine) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.line = line
+	u.update()
+}
+
+// SetOutput sets the writer that transmitted bytes are written to.
+func (u *UARTDevice) SetOutput(w io.Writer) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.output = w
+}
+
+// SetInput starts receiving the bytes read from r in the background, until
+// it returns an error.
+func (u *UARTDevice) SetInput(r io.Reader) {
+	u.mu.Lock()
+	u.input = true
+	u.mu.Unlock()
+	go func() {
+		buffer := make([]byte, 256)
+		for {
+			n, err := r.Read(buffer)
+			u.Receive(buffer[:n])
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Receive queues bytes as received by the UART.
+func (u *UARTDevice) Receive(data []byte) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.received = append(u.received, data...)
+	u.update()
+}
+
+// HostInput reports that reads from the UART are host input once it has
+// an input.
+func (u *UARTDevice) HostInput() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.input
+}
+
+// interrupt returns the identification of the pending interrupt with the
+// highest priority.
+func (u *UARTDevice) interrupt() byte {
+	switch {
+	case u.ier&uartIERReceive != 0 && len(u.received) > 0:
+		return uartIIRReceive
+	case u.ier&uartIERTransmit != 0 && u.transmit:
+		return uartIIRTransmit
+	}
+	return uartIIRNone
+}
+
+// update sets the interrupt line to whether an interrupt is pending.
+func (u *UARTDevice) update() {
+	u.line.SetLevel(u.interrupt() != uartIIRNone)
+}
+
+// Read reads a UART register.
+func (u *UARTDevice) Read(address uint32) (byte, error) {
+	if address < u.baseAddress || address-u.baseAddress >= u.size {
+		return 0, fmt.Errorf(
+			"attempted to read from invalid UART address %X", address)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	defer u.update()
+	dlab := u.lcr&uartLCRDLAB != 0
+	switch address - u.baseAddress {
+	case uartData:
+		if dlab {
+			return byte(u.divisor), nil
+		}
+		if len(u.received) == 0 {
+			return 0, nil
+		}
+		value := u.received[0]
+		u.received = u.received[1:]
+		return value, nil
+	case uartIER:
+		if dlab {
+			return byte(u.divisor >> 8), nil
+		}
+		return u.ier, nil
+	case uartIIR:
+		value := u.interrupt()
+		if value == uartIIRTransmit {
+			u.transmit = false
+		}
+		if u.fcr&uartFCREnable != 0 {
+			value |= uartIIRFIFO
+		}
+		return value, nil
+	case uartLCR:
+		return u.lcr, nil
+	case uartMCR:
+		return u.mcr, nil
+	case uartLSR:
+		value := byte(uartLSREmpty)
+		if len(u.received) > 0 {
+			value |= uartLSRReady
+		}
+		return value, nil
+	case uartMSR:
+		return uartMSRLines, nil
+	case uartScratch:
+		return u.scratch, nil
+	}
+	return 0, nil
+}
+
+// Write writes a UART register.
+func (u *UARTDevice) Write(address uint32, value byte) error {
+	if address < u.baseAddress || address-u.baseAddress >= u.size {
+		return fmt.Errorf(
+			"attempted to write %X to invalid UART address %X", value, address)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	defer u.update()
+	dlab := u.lcr&uartLCRDLAB != 0
+	switch address - u.baseAddress {
+	case uartData:
+		if dlab {
+			u.divisor = u.divisor&0xFF00 | uint16(value)
+			return nil
+		}
+		if _, err := u.output.Write([]byte{value}); err != nil {
+			return fmt.Errorf("failed to write UART output: %v", err)
+		}
+		u.transmit = true
+	case uartIER:
+		if dlab {
+			u.divisor = u.divisor&0x00FF | uint16(value)<<8
+			return nil
+		}
+		if value&uartIERTransmit != 0 && u.ier&uartIERTransmit == 0 {
+			u.transmit = true
+		}
+		u.ier = value & 0x0F
+	case uartIIR:
+		if value&uartFCRClearRx != 0 {
+			u.received = nil
+		}
+		u.fcr = value
+	case uartLCR:
+		u.lcr = value
+	case uartMCR:
+		u.mcr = value
+	case uartScratch:
+		u.scratch = value
+	}
+	return nil
+}
+
+// AddToDeviceTree adds the UART node. The first UART is the console.
+func (u *UARTDevice) AddToDeviceTree(tree *DeviceTree) {
+	node := tree.AddDevice(u, "serial", "ns16550a")
+	node.SetU32("clock-frequency", u.clock)
+	tree.AddInterrupt(node, u.irq)
+	if tree.StdoutPath == "" {
+		tree.StdoutPath = "/soc/" + node.Name
+	}
+}
+
+// uartRegisters holds the registers of a UART in a snapshot.
+type uartRegisters struct {
+	IER, FCR, LCR, MCR, Scratch byte
+	Divisor                     uint16
+	Transmit                    bool
+	Received                    uint32 // Number of received bytes following
+}
+
+// SaveState writes the registers and received bytes of the UART to w.
+func (u *UARTDevice) SaveState(w io.Writer) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	registers := uartRegisters{u.ier, u.fcr, u.lcr, u.mcr, u.scratch,
+		u.divisor, u.transmit, uint32(len(u.received))}
+	if err := binary.Write(w, binary.LittleEndian, registers); err != nil {
+		return err
+	}
+	_, err := w.Write(u.received)
+	return err
+}
+
+// LoadState restores the state of the UART saved by SaveState.
+func (u *UARTDevice) LoadState(r io.Reader) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var registers uartRegisters
+	if err := binary.Read(r, binary.LittleEndian, &registers); err != nil {
+		return fmt.Errorf("failed to read UART state: %v", err)
+	}
+	received := make([]byte, registers.Received)
+	if _, err := io.ReadFull(r, received); err != nil {
+		return fmt.Errorf("failed to read UART state: %v", err)
+	}
+	u.ier, u.fcr, u.lcr, u.mcr, u.scratch = registers.IER, registers.FCR,
+		registers.LCR, registers.MCR, registers.Scratch
+	u.divisor, u.transmit, u.received = registers.Divisor,
+		registers.Transmit, received
+	u.update()
+	return nil
+}
@@ -0,0 +1,109 @@
+package devices
+
+import (
+	"bytes"
+	"testing"
+)
+
+// levelLine records the level of an interrupt line.
+type levelLine struct {
+	high bool
+}
+
+func (l *levelLine) SetLevel(high bool) {
+	l.high = high
+}
+
+func TestUART(t *testing.T) {
+	const base = 0x10000000
+	uart := NewUART(10, DefaultUARTClock)
+	uart.Initialize(base, UARTSize)
+	var output bytes.Buffer
+	uart.SetOutput(&output)
+	line := &levelLine{}
+	uart.ConnectIRQ(line)
+
+	for _, b := range []byte("hi") {
+		if err := uart.Write(base+uartData, b); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if output.String() != "hi" {
+		t.Errorf("Expected output %q, got %q", "hi", output.String())
+	}
+
+	// The divisor latch shadows the data and IER registers.
+	uart.Write(base+uartLCR, uartLCRDLAB)
+	uart.Write(base+uartData, 0x01)
+	uart.Write(base+uartIER, 0x02)
+	uart.Write(base+uartLCR, 0x03)
+	if uart.divisor != 0x0201 || output.Len() != 2 {
+		t.Errorf("Expected divisor 0201 and no output, got %04X", uart.divisor)
+	}
+
+	uart.Write(base+uartIER, uartIERReceive)
+	if line.high {
+		t.Error("Expected no interrupt without received data")
+	}
+	uart.Receive([]byte("ok"))
+	if !line.high {
+		t.Error("Expected a receive interrupt")
+	}
+	if iir, _ := uart.Read(base + uartIIR); iir != uartIIRReceive {
+		t.Errorf("Expected IIR %02X, got %02X", uartIIRReceive, iir)
+	}
+	for _, expected := range []byte("ok") {
+		if lsr, _ := uart.Read(base + uartLSR); lsr != uartLSREmpty|uartLSRReady {
+			t.Errorf("Expected LSR %02X, got %02X", uartLSREmpty|uartLSRReady, lsr)
+		}
+		if b, _ := uart.Read(base + uartData); b != expected {
+			t.Errorf("Expected %q, got %q", expected, b)
+		}
+	}
+	if line.high {
+		t.Error("Expected the interrupt cleared once all data is read")
+	}
+
+	// Enabling the transmit interrupt raises it until IIR is read.
+	uart.Write(base+uartIER, uartIERTransmit)
+	if !line.high {
+		t.Error("Expected a transmit interrupt")
+	}
+	if iir, _ := uart.Read(base + uartIIR); iir != uartIIRTransmit {
+		t.Errorf("Expected IIR %02X, got %02X", uartIIRTransmit, iir)
+	}
+	if line.high {
+		t.Error("Expected reading IIR to clear the transmit interrupt")
+	}
+}
+
+func TestConnectInterrupts(t *testing.T) {
+	plic, _ := NewPLIC(0x0C000000, PLICSize, 31, 1)
+	newUART := func(base, irq uint32) *UARTDevice {
+		uart := NewUART(irq, DefaultUARTClock)
+		uart.Initialize(base, UARTSize)
+		return uart
+	}
+
+	uart := newUART(0x10000000, 10)
+	if err := ConnectInterrupts([]BusDevice{uart, plic}); err != nil {
+		t.Fatalf("ConnectInterrupts failed: %v", err)
+	}
+	writeWord(t, plic, 0x0C000000+4*10, 1)
+	writeWord(t, plic, 0x0C000000+plicEnable, 1<<10)
+	uart.Write(0x10000000+uartIER, uartIERTransmit)
+	if !plic.Pending(0) {
+		t.Error("Expected the UART interrupt at the PLIC")
+	}
+
+	tests := [][]BusDevice{
+		{newUART(0x10000000, 1)},
+		{newUART(0x10000000, 1), newUART(0x10000100, 1), plic},
+		{newUART(0x10000000, 32), plic},
+	}
+	for i, devices := range tests {
+		if err := ConnectInterrupts(devices); err == nil {
+			t.Errorf("Expected error for devices %d", i)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+// Package fdt builds and parses flattened device tree blobs as described in
+// the Devicetree Specification.
+package fdt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Header constants of version 17 blobs.
+const (
+	magic           = 0xD00DFEED
+	version         = 17
+	lastCompVersion = 16
+	headerSize      = 40
+	reservationSize = 16
+	tokenBeginNode  = 1
+	tokenEndNode    = 2
+	tokenProp       = 3
+	tokenNop        = 4
+	tokenEnd        = 9
+)
+
+// Property is a property of a node with its raw big-endian value.
+type Property struct {
+	Name  string
+	Value []byte
+}
+
+// Node is a node of a device tree.
+type Node struct {
+	Name       string // Node name with unit address, e.g. "memory@80000000"
+	Properties []Property
+	Children   []*Node
+}
+
+// NewNode returns a node without properties or children.
+func NewNode(name string) *Node {
+	return &Node{Name: name}
+}
+
+// set adds a property, replacing any property of the same name.
+func (n *Node) set(name string, value []byte) {
+	for i := range n.Properties {
+		if n.Properties[i].Name == name {
+			n.Properties[i].Value = value
+			return
+		}
+	}
+	n.Properties = append(n.Properties, Property{Name: name, Value: value})
+}
+
+// SetEmpty sets a property without a value, e.g. "interrupt-controller".
+func (n *Node) SetEmpty(name string) {
+	n.set(name, []byte{})
+}
+
+// SetString sets a string property.
+func (n *Node) SetString(name, value string) {
+	n.SetStrings(name, value)
+}
+
+// SetStrings sets a string list property, e.g. "compatible".
+func (n *Node) SetStrings(name string, values ...string) {
+	var value []byte
+	for _, s := range values {
+		value = append(value, s...)
+		value = append(value, 0)
+	}
+	n.set(name, value)
+}
+
+// SetU32 sets a property of one or more 32-bit cells.
+func (n *Node) SetU32(name string, values ...uint32) {
+	value := make([]byte, 0, 4*len(values))
+	for _, v := range values {
+		value = binary.BigEndian.AppendUint32(value, v)
+	}
+	n.set(name, value)
+}
+
+// SetU64 sets a property of one or more 64-bit values.
+func (n *Node) SetU64(name string, values ...uint64) {
+	value := make([]byte, 0, 8*len(values))
+	for _, v := range values {
+		value = binary.BigEndian.AppendUint64(value, v)
+	}
+	n.set(name, value)
+}
+
+// Property returns the value of the property with the given name.
+func (n *Node) Property(name string) ([]byte, bool) {
+	for _, p := range n.Properties {
+		if p.Name == name {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+// String returns the value of a string property without the terminating
+// NUL.
+func (n *Node) String(name string) (string, bool) {
+	value, ok := n.Property(name)
+	if !ok {
+		return "", false
+	}
+	return strings.TrimSuffix(string(value), "\x00"), true
+}
+
+// U32 returns the cells of a property.
+func (n *Node) U32(name string) ([]uint32, bool) {
+	value, ok := n.Property(name)
+	if !ok || len(value)%4 != 0 {
+		return nil, false
+	}
+	cells := make([]uint32, len(value)/4)
+	for i := range cells {
+		cells[i] = binary.BigEndian.Uint32(value[4*i:])
+	}
+	return cells, true
+}
+
+// AddChild appends a child node and returns it.
+func (n *Node) AddChild(child *Node) *Node {
+	n.Children = append(n.Children, child)
+	return child
+}
+
+// Child returns the child with the given name, or nil.
+func (n *Node) Child(name string) *Node {
+	for _, child := range n.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// Lookup returns the node at an absolute path like "/soc/serial@10000000",
+// or nil.
+func (n *Node) Lookup(path string) *Node {
+	node := n
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if node = node.Child(name); node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// SortChildren orders the children of the node by name, recursively, so
+// that the nodes of devices appear in address order.
+func (n *Node) SortChildren() {
+	sort.SliceStable(n.Children, func(i, j int) bool {
+		return lessNodeName(n.Children[i].Name, n.Children[j].Name)
+	})
+	for _, child := range n.Children {
+		child.SortChildren()
+	}
+}
+
+// lessNodeName orders node names by name and then by unit address,
+// comparing unit addresses of different lengths numerically.
+func lessNodeName(a, b string) bool {
+	nameA, unitA, _ := strings.Cut(a, "@")
+	nameB, unitB, _ := strings.Cut(b, "@")
+	if nameA != nameB {
+		return nameA < nameB
+	}
+	if len(unitA) != len(unitB) {
+		return len(unitA) < len(unitB)
+	}
+	return unitA < unitB
+}
+
+// Reservation is an entry of the memory reservation block.
+type Reservation struct {
+	Address uint64
+	Size    uint64
+}
+
+// Blob returns the flattened device tree blob of the tree with the given
+// root node, the boot CPU ID and memory reservations.
+func Blob(root *Node, bootCPU uint32, reservations []Reservation) []byte {
+	var structure, stringTable bytes.Buffer
+	offsets := map[string]uint32{}
+	stringOffset := func(name string) uint32 {
+		offset, ok := offsets[name]
+		if !ok {
+			offset = uint32(stringTable.Len())
+			offsets[name] = offset
+			stringTable.WriteString(name)
+			stringTable.WriteByte(0)
+		}
+		return offset
+	}
+	u32 := func(value uint32) {
+		binary.Write(&structure, binary.BigEndian, value)
+	}
+	pad := func() {
+		for structure.Len()%4 != 0 {
+			structure.WriteByte(0)
+		}
+	}
+
+	var writeNode func(n *Node)
+	writeNode = func(n *Node) {
+		u32(tokenBeginNode)
+		structure.WriteString(n.Name)
+		structure.WriteByte(0)
+		pad()
+		for _, p := range n.Properties {
+			u32(tokenProp)
+			u32(uint32(len(p.Value)))
+			u32(stringOffset(p.Name))
+			structure.Write(p.Value)
+			pad()
+		}
+		for _, child := range n.Children {
+			writeNode(child)
+		}
+		u32(tokenEndNode)
+	}
+	writeNode(root)
+	u32(tokenEnd)
+
+	var reserved bytes.Buffer
+	for _, r := range reservations {
+		binary.Write(&reserved, binary.BigEndian, r)
+	}
+	binary.Write(&reserved, binary.BigEndian, Reservation{})
+
+	reservedOffset := uint32(headerSize)
+	structOffset := reservedOffset + uint32(reserved.Len())
+	stringsOffset := structOffset + uint32(structure.Len())
+	total := stringsOffset + uint32(stringTable.Len())
+
+	var blob bytes.Buffer
+	for _, value := range []uint32{magic, total, structOffset, stringsOffset,
+		reservedOffset, version, lastCompVersion, bootCPU,
+		uint32(stringTable.Len()), uint32(structure.Len())} {
+		binary.Write(&blob, binary.BigEndian, value)
+	}
+	blob.Write(reserved.Bytes())
+	blob.Write(structure.Bytes())
+	blob.Write(stringTable.Bytes())
+	return blob.Bytes()
+}
+
+// Parse returns the root node of a flattened device tree blob.
+func Parse(blob []byte) (*Node, error) {
+	if len(blob) < headerSize || binary.BigEndian.Uint32(blob) != magic {
+		return nil, fmt.Errorf("not a flattened device tree")
+	}
+	header := func(i int) uint32 {
+		return binary.BigEndian.Uint32(blob[4*i:])
+	}
+	total, structOffset, stringsOffset := header(1), header(2), header(3)
+	structSize, stringsSize := header(9), header(8)
+	if header(6) > version || int(total) > len(blob) ||
+		uint64(structOffset)+uint64(structSize) > uint64(total) ||
+		uint64(stringsOffset)+uint64(stringsSize) > uint64(total) {
+		return nil, fmt.Errorf("invalid flattened device tree header")
+	}
+	structure := blob[structOffset : structOffset+structSize]
+	stringTable := blob[stringsOffset : stringsOffset+stringsSize]
+
+	errTruncated := fmt.Errorf("truncated flattened device tree")
+	offset := 0
+	next := func() (uint32, error) {
+		if offset+4 > len(structure) {
+			return 0, errTruncated
+		}
+		value := binary.BigEndian.Uint32(structure[offset:])
+		offset += 4
+		return value, nil
+	}
+	cString := func(data []byte, start int) (string, error) {
+		if start > len(data) {
+			return "", errTruncated
+		}
+		end := bytes.IndexByte(data[start:], 0)
+		if end < 0 {
+			return "", errTruncated
+		}
+		return string(data[start : start+end]), nil
+	}
+	align := func() {
+		offset = (offset + 3) &^ 3
+	}
+
+	var root *Node
+	var stack []*Node
+	for {
+		token, err := next()
+		if err != nil {
+			return nil, err
+		}
+		switch token {
+		case tokenBeginNode:
+			name, err := cString(structure, offset)
+			if err != nil {
+				return nil, err
+			}
+			offset += len(name) + 1
+			align()
+			node := NewNode(name)
+			if len(stack) > 0 {
+				stack[len(stack)-1].AddChild(node)
+			} else if root == nil {
+				root = node
+			} else {
+				return nil, fmt.Errorf("multiple root nodes")
+			}
+			stack = append(stack, node)
+		case tokenEndNode:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("unbalanced end of node")
+			}
+			stack = stack[:len(stack)-1]
+		case tokenProp:
+			length, err := next()
+			if err != nil {
+				return nil, err
+			}
+			nameOffset, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if len(stack) == 0 || offset+int(length) > len(structure) {
+				return nil, errTruncated
+			}
+			name, err := cString(stringTable, int(nameOffset))
+			if err != nil {
+				return nil, err
+			}
+			value := append([]byte{}, structure[offset:offset+int(length)]...)
+			offset += int(length)
+			align()
+			stack[len(stack)-1].Properties = append(
+				stack[len(stack)-1].Properties, Property{name, value})
+		case tokenNop:
+		case tokenEnd:
+			if root == nil || len(stack) != 0 {
+				return nil, errTruncated
+			}
+			return root, nil
+		default:
+			return nil, fmt.Errorf("unknown token %d in flattened device tree", token)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package fdt
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func testTree() *Node {
+	root := NewNode("")
+	root.SetU32("#address-cells", 1)
+	root.SetU32("#size-cells", 1)
+	root.SetStrings("compatible", "test,board", "simple-bus")
+	memory := root.AddChild(NewNode("memory@80000000"))
+	memory.SetString("device_type", "memory")
+	memory.SetU32("reg", 0x80000000, 0x10000000)
+	chosen := root.AddChild(NewNode("chosen"))
+	chosen.SetString("bootargs", "console=ttyS0")
+	intc := chosen.AddChild(NewNode("interrupt-controller"))
+	intc.SetEmpty("interrupt-controller")
+	intc.SetU64("big", 0x123456789)
+	return root
+}
+
+func TestBlob_RoundTrip(t *testing.T) {
+	root := testTree()
+	blob := Blob(root, 1, []Reservation{{Address: 0x80000000, Size: 0x1000}})
+
+	if binary.BigEndian.Uint32(blob) != magic ||
+		binary.BigEndian.Uint32(blob[4:]) != uint32(len(blob)) {
+		t.Fatalf("Invalid header % x", blob[:8])
+	}
+	if bootCPU := binary.BigEndian.Uint32(blob[28:]); bootCPU != 1 {
+		t.Errorf("Expected boot CPU 1, got %d", bootCPU)
+	}
+	reservation := blob[headerSize : headerSize+reservationSize]
+	if binary.BigEndian.Uint64(reservation) != 0x80000000 {
+		t.Errorf("Unexpected reservation % x", reservation)
+	}
+
+	parsed, err := Parse(blob)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, root) {
+		t.Errorf("Expected %+v, got %+v", root, parsed)
+	}
+	if bootargs, _ := parsed.Lookup("/chosen").String("bootargs"); bootargs != "console=ttyS0" {
+		t.Errorf("Unexpected bootargs %q", bootargs)
+	}
+	if reg, _ := parsed.Lookup("/memory@80000000").U32("reg"); !reflect.DeepEqual(reg,
+		[]uint32{0x80000000, 0x10000000}) {
+		t.Errorf("Unexpected reg %X", reg)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	blob := Blob(testTree(), 0, nil)
+	for _, invalid := range [][]byte{
+		nil,
+		blob[:headerSize],
+		blob[:len(blob)-8],
+		append([]byte{0}, blob[1:]...),
+	} {
+		if _, err := Parse(invalid); err == nil {
+			t.Errorf("Expected an error for % x", invalid)
+		}
+	}
+}
+
+func TestSortChildren(t *testing.T) {
+	root := NewNode("")
+	for _, name := range []string{"serial@10000000", "clint@2000000",
+		"serial@9000000", "cpus"} {
+		root.AddChild(NewNode(name))
+	}
+	root.SortChildren()
+
+	var names []string
+	for _, child := range root.Children {
+		names = append(names, child.Name)
+	}
+	expected := []string{"clint@2000000", "cpus", "serial@9000000",
+		"serial@10000000"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+}
@@ -0,0 +1,259 @@
+package loader
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+	"github.com/Keisim/go-riscv-emu/pkg/fdt"
+	"github.com/Keisim/go-riscv-emu/pkg/system"
+)
+
+// Layout of the header of a RISC-V Linux kernel Image, see
+// Documentation/arch/riscv/boot-image-header.rst in the kernel sources.
+const (
+	imageHeaderSize  = 64
+	imageMagicOffset = 48
+	imageMagic       = "RISCV\x00\x00\x00" // Deprecated since version 0.2
+	imageMagic2      = "RSC\x05"
+	imageBigEndian   = 1 // Flag of big-endian kernels
+)
+
+const (
+	// kernelAlignment is the alignment of the base that the kernel is
+	// loaded at text_offset from, a megapage of Sv32.
+	kernelAlignment = 4 << 20
+	// maxInitrdOffset is the largest offset of the initrd from the kernel.
+	maxInitrdOffset = 128 << 20
+	pageSize        = 4096
+)
+
+// fw_dynamic_info of OpenSBI, passed in a2 to the firmware.
+const (
+	dynamicInfoMagic     = 0x4942534F // "OSBI"
+	dynamicInfoVersion   = 2
+	dynamicInfoNextModeS = 1
+	dynamicInfoSize      = 6 * 4
+)
+
+// ImageHeader is the header of a RISC-V Linux kernel Image.
+type ImageHeader struct {
+	TextOffset uint64 // Offset of the Image from an aligned base in RAM
+	ImageSize  uint64 // Memory used by the kernel including bss, 0 if unknown
+	Flags      uint64
+	Version    uint32 // Major version in the upper, minor in the lower half
+}
+
+// ParseImageHeader parses the header at the start of a kernel Image.
+func ParseImageHeader(data []byte) (*ImageHeader, error) {
+	if len(data) < imageHeaderSize {
+		return nil, fmt.Errorf("kernel image of %d bytes has no header",
+			len(data))
+	}
+	if string(data[imageMagicOffset:imageMagicOffset+8]) != imageMagic &&
+		string(data[imageMagicOffset+8:imageMagicOffset+12]) != imageMagic2 {
+		return nil, fmt.Errorf("not a RISC-V Linux kernel image")
+	}
+	header := &ImageHeader{
+		TextOffset: binary.LittleEndian.Uint64(data[8:]),
+		ImageSize:  binary.LittleEndian.Uint64(data[16:]),
+		Flags:      binary.LittleEndian.Uint64(data[24:]),
+		Version:    binary.LittleEndian.Uint32(data[32:]),
+	}
+	if header.Flags&imageBigEndian != 0 {
+		return nil, fmt.Errorf("big-endian kernel images are not supported")
+	}
+	return header, nil
+}
+
+// BootConfig selects the images booted by Boot.
+type BootConfig struct {
+	Firmware string // Path of the firmware, an ELF file or raw binary
+	Kernel   string // Path of a Linux kernel Image
+	Initrd   string // Path of an initramfs, needs a kernel
+	Bootargs string // Kernel command line
+}
+
+// BootInfo holds the addresses that Boot placed the images at. Addresses
+// of images that were not loaded are 0.
+type BootInfo struct {
+	Entry       uint32 // Address the harts start at
+	Kernel      uint32
+	Initrd      uint32
+	InitrdEnd   uint32
+	DeviceTree  uint32
+	DynamicInfo uint32 // fw_dynamic_info of OpenSBI
+}
+
+// Boot loads firmware, a kernel, an initrd and a generated device tree
+// into the first RAM device of the system, as QEMU does:
+//   - the firmware, e.g. OpenSBI fw_jump or fw_dynamic, at the start of RAM;
+//   - the kernel at its text_offset from the next 4 MiB boundary after the
+//     firmware;
+//   - the initrd up to 128 MiB after the kernel, and the device tree at the
+//     end of RAM, pointing at the initrd and holding the command line.
+//
+// Every hart starts at the firmware, or the kernel without firmware, with
+// its hart ID in a0, the address of the device tree in a1 and the address
+// of a fw_dynamic_info structure in a2, which fw_jump ignores.
+//
+// Boot only prepares the machine; the harts cannot run OpenSBI or Linux,
+// which need instructions and privilege modes they do not implement.
+func Boot(sys *system.System, config BootConfig) (*BootInfo, error) {
+	ram := firstRAM(sys)
+	if ram == nil {
+		return nil, fmt.Errorf("machine has no RAM")
+	}
+	if config.Firmware == "" && config.Kernel == "" {
+		return nil, fmt.Errorf("nothing to boot, neither firmware nor kernel given")
+	}
+	if config.Initrd != "" && config.Kernel == "" {
+		return nil, fmt.Errorf("an initrd needs a kernel")
+	}
+	info := &BootInfo{}
+	end := uint64(ram.BaseAddress())
+	ramEnd := uint64(ram.BaseAddress()) + uint64(ram.Size())
+
+	if config.Firmware != "" {
+		var err error
+		info.Entry, end, err = loadFirmware(sys, config.Firmware)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var kernelEnd uint64
+	if config.Kernel != "" {
+		data, err := os.ReadFile(config.Kernel)
+		if err != nil {
+			return nil, fmt.Errorf("error reading kernel: %v", err)
+		}
+		header, err := ParseImageHeader(data)
+		if err != nil {
+			return nil, fmt.Errorf("error reading kernel %s: %v", config.Kernel, err)
+		}
+		address := alignUp(end, kernelAlignment) + header.TextOffset
+		kernelEnd = address + max(header.ImageSize, uint64(len(data)))
+		if kernelEnd > ramEnd {
+			return nil, fmt.Errorf("kernel at %X does not fit in RAM", address)
+		}
+		if err := writeMemory(sys, uint32(address), data); err != nil {
+			return nil, fmt.Errorf("error loading kernel: %v", err)
+		}
+		info.Kernel = uint32(address)
+		if config.Firmware == "" {
+			info.Entry = info.Kernel
+		}
+	}
+
+	tree := sys.DeviceTree(config.Bootargs)
+	var initrd []byte
+	if config.Initrd != "" {
+		var err error
+		initrd, err = os.ReadFile(config.Initrd)
+		if err != nil {
+			return nil, fmt.Errorf("error reading initrd: %v", err)
+		}
+		start := max(uint64(info.Kernel)+min(uint64(ram.Size())/2, maxInitrdOffset),
+			alignUp(kernelEnd, pageSize))
+		info.Initrd = uint32(start)
+		info.InitrdEnd = uint32(start + uint64(len(initrd)))
+		chosen := tree.Child("chosen")
+		chosen.SetU32("linux,initrd-start", info.Initrd)
+		chosen.SetU32("linux,initrd-end", info.InitrdEnd)
+	}
+
+	var err error
+	info.DeviceTree, err = sys.LoadDeviceTreeBlob(
+		fdt.Blob(tree, sys.Harts()[0].GetHartID(), nil))
+	if err != nil {
+		return nil, err
+	}
+	info.DynamicInfo = (info.DeviceTree - dynamicInfoSize) &^ 7
+	if uint64(info.DynamicInfo) < max(kernelEnd, uint64(info.InitrdEnd), end) {
+		return nil, fmt.Errorf("images do not fit in RAM below the device tree at %X",
+			info.DeviceTree)
+	}
+	if err := writeMemory(sys, info.Initrd, initrd); err != nil {
+		return nil, fmt.Errorf("error loading initrd: %v", err)
+	}
+
+	var next uint32
+	if config.Firmware != "" {
+		next = info.Kernel
+	}
+	dynamicInfo := binary.LittleEndian.AppendUint32(nil, dynamicInfoMagic)
+	for _, field := range []uint32{dynamicInfoVersion, next,
+		dynamicInfoNextModeS, 0, sys.Harts()[0].GetHartID()} {
+		dynamicInfo = binary.LittleEndian.AppendUint32(dynamicInfo, field)
+	}
+	if err := writeMemory(sys, info.DynamicInfo, dynamicInfo); err != nil {
+		return nil, fmt.Errorf("error loading fw_dynamic_info: %v", err)
+	}
+
+	for _, hart := range sys.Harts() {
+		hart.SetPc(info.Entry)
+		hart.SetRegister(12, info.DynamicInfo)
+	}
+	return info, nil
+}
+
+// loadFirmware loads firmware at the start of RAM and returns its entry
+// point and end. ELF files are loaded like programs; other files are raw
+// binaries starting at their first byte.
+func loadFirmware(sys *system.System, path string) (entry uint32, end uint64, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading firmware: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+		base := firstRAM(sys).BaseAddress()
+		if err := writeMemory(sys, base, data); err != nil {
+			return 0, 0, fmt.Errorf("error loading firmware: %v", err)
+		}
+		return base, uint64(base) + uint64(len(data)), nil
+	}
+
+	if err := LoadELFToSystem(path, sys); err != nil {
+		return 0, 0, err
+	}
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, fmt.Errorf("error opening ELF file: %v", err)
+	}
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD {
+			end = max(end, prog.Vaddr+prog.Memsz)
+		}
+	}
+	return uint32(f.Entry), end, nil
+}
+
+// firstRAM returns the first RAM device on the bus, or nil.
+func firstRAM(sys *system.System) *devices.RAMDevice {
+	for _, device := range sys.Bus().Devices() {
+		if ram, ok := device.(*devices.RAMDevice); ok {
+			return ram
+		}
+	}
+	return nil
+}
+
+// writeMemory writes data through the bus, so that caches observing it see
+// the change.
+func writeMemory(sys *system.System, address uint32, data []byte) error {
+	for i, value := range data {
+		if err := sys.Bus().Write(address+uint32(i), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// alignUp rounds value up to a multiple of alignment, a power of two.
+func alignUp(value, alignment uint64) uint64 {
+	return (value + alignment - 1) &^ (alignment - 1)
+}
@@ -0,0 +1,136 @@
+package loader
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/fdt"
+	"github.com/Keisim/go-riscv-emu/pkg/system"
+)
+
+// kernelImage returns a kernel Image with a header and the given size.
+func kernelImage(textOffset, imageSize uint64, size int) []byte {
+	image := make([]byte, size)
+	binary.LittleEndian.PutUint64(image[8:], textOffset)
+	binary.LittleEndian.PutUint64(image[16:], imageSize)
+	binary.LittleEndian.PutUint32(image[32:], 2)
+	copy(image[imageMagicOffset:], imageMagic)
+	copy(image[imageMagicOffset+8:], imageMagic2)
+	return image
+}
+
+// writeFile writes a file into the test directory and returns its path.
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return path
+}
+
+// readMemory reads size bytes from the bus of the system.
+func readMemory(t *testing.T, sys *system.System, address, size uint32) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	for i := range data {
+		value, err := sys.Bus().Read(address + uint32(i))
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		data[i] = value
+	}
+	return data
+}
+
+func TestBoot(t *testing.T) {
+	sys := system.NewSystemWithHarts(false, 2)
+	firmware := writeFile(t, "fw_dynamic.bin", []byte{0x13, 0, 0, 0})
+	kernel := writeFile(t, "Image", kernelImage(0, 0x2000, 0x100))
+	initrd := writeFile(t, "initrd", []byte("initramfs"))
+
+	info, err := Boot(sys, BootConfig{Firmware: firmware, Kernel: kernel,
+		Initrd: initrd, Bootargs: "console=ttyS0"})
+	if err != nil {
+		t.Fatalf("Boot failed: %v", err)
+	}
+	if info.Entry != 0x80000000 || info.Kernel != 0x80400000 ||
+		info.Initrd != 0x80400000+128<<20 {
+		t.Errorf("Unexpected layout %+v", info)
+	}
+	for i, hart := range sys.Harts() {
+		if hart.GetPc() != info.Entry || hart.GetRegister(10) != uint32(i) ||
+			hart.GetRegister(11) != info.DeviceTree ||
+			hart.GetRegister(12) != info.DynamicInfo {
+			t.Errorf("Unexpected boot registers of hart %d", i)
+		}
+	}
+	if data := readMemory(t, sys, info.Initrd, 9); string(data) != "initramfs" {
+		t.Errorf("Expected the initrd at %X, got %q", info.Initrd, data)
+	}
+
+	dynamicInfo := readMemory(t, sys, info.DynamicInfo, dynamicInfoSize)
+	expected := []uint32{dynamicInfoMagic, dynamicInfoVersion, info.Kernel,
+		dynamicInfoNextModeS, 0, 0}
+	for i, value := range expected {
+		if actual := binary.LittleEndian.Uint32(dynamicInfo[4*i:]); actual != value {
+			t.Errorf("Expected field %d of fw_dynamic_info to be %X, got %X",
+				i, value, actual)
+		}
+	}
+
+	blob := readMemory(t, sys, info.DeviceTree,
+		system.RAMOffset+0x10000000-info.DeviceTree)
+	root, err := fdt.Parse(blob)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	chosen := root.Child("chosen")
+	bootargs, _ := chosen.String("bootargs")
+	start, _ := chosen.U32("linux,initrd-start")
+	end, _ := chosen.U32("linux,initrd-end")
+	if bootargs != "console=ttyS0" || start[0] != info.Initrd ||
+		end[0] != info.Initrd+9 {
+		t.Errorf("Unexpected /chosen: %q, %X, %X", bootargs, start, end)
+	}
+}
+
+func TestBoot_KernelOnly(t *testing.T) {
+	sys := system.NewSystem(false)
+	kernel := writeFile(t, "Image", kernelImage(0x200000, 0, 0x100))
+
+	info, err := Boot(sys, BootConfig{Kernel: kernel})
+	if err != nil {
+		t.Fatalf("Boot failed: %v", err)
+	}
+	if info.Entry != 0x80200000 || sys.Core().GetPc() != 0x80200000 {
+		t.Errorf("Expected the kernel entered at 80200000, got %+v", info)
+	}
+}
+
+func TestBoot_Errors(t *testing.T) {
+	big := kernelImage(0, 0x20000000, 0x100)
+	bigEndian := kernelImage(0, 0, 0x100)
+	bigEndian[24] = imageBigEndian
+	tests := []struct {
+		config BootConfig
+		err    string
+	}{
+		{BootConfig{}, "nothing to boot"},
+		{BootConfig{Firmware: "fw", Initrd: "initrd"}, "an initrd needs a kernel"},
+		{BootConfig{Kernel: writeFile(t, "Image", []byte("short"))}, "has no header"},
+		{BootConfig{Kernel: writeFile(t, "Image", make([]byte, 64))},
+			"not a RISC-V Linux kernel image"},
+		{BootConfig{Kernel: writeFile(t, "Image", bigEndian)}, "big-endian"},
+		{BootConfig{Kernel: writeFile(t, "Image", big)}, "does not fit in RAM"},
+	}
+	for _, test := range tests {
+		_, err := Boot(system.NewSystem(false), test.config)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected error containing %q, got %v", test.err, err)
+		}
+	}
+}
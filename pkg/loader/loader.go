@@ -10,11 +10,12 @@ import (
 
 // LoadELFToSystem loads an ELF file from the specified file path into the
 // provided system. It maps the ELF segments into the system's memory-mapped
-// devices and sets the CPU's program counter to the ELF entry point.
+// devices, adds its symbols and line tables to the symbolizer of the system
+// and sets the program counter of every hart to the ELF entry point.
 func LoadELFToSystem(filePath string, sys *system.System) error {
 	f, err := elf.Open(filePath)
 	if err != nil {
-		slog.Error(fmt.Sprintf("Error opening ELF file: %v", err))
+		return fmt.Errorf("error opening ELF file: %v", err)
 	}
 	defer f.Close()
 
@@ -39,8 +40,10 @@ func LoadELFToSystem(filePath string, sys *system.System) error {
 				prog.Off, err)
 		}
 
+		// Segments are written through the bus, so that caches observing
+		// it see code loaded into an already running system.
 		for i := uint32(0); i < uint32(prog.Filesz); i++ {
-			err := device.Write(uint32(prog.Vaddr)+i, segmentData[i])
+			err := sys.Bus().Write(uint32(prog.Vaddr)+i, segmentData[i])
 			if err != nil {
 				return fmt.Errorf(
 					"error writing to device at address 0X%X: %v",
@@ -49,7 +52,18 @@ func LoadELFToSystem(filePath string, sys *system.System) error {
 		}
 	}
 
-	sys.Core().SetPc(uint32(f.Entry))
+	// Symbols are kept for error messages, traces and backtraces; a file
+	// with broken debug information can still be run.
+	err = sys.Symbolizer().AddELF(f)
+	if err != nil {
+		slog.Warn("Failed to read ELF symbols:", "path", filePath, "error", err)
+	}
+
+	// Every hart starts at the entry point and tells itself apart from the
+	// others by reading mhartid.
+	for _, hart := range sys.Harts() {
+		hart.SetPc(uint32(f.Entry))
+	}
 
 	return nil
 }
@@ -51,4 +51,9 @@ func TestLoadELFToSystem(t *testing.T) {
 	if sys.Core().GetPc() != expected_pc {
 		t.Errorf("Expected PC %X, got %X", expected_pc, sys.Core().GetPc())
 	}
+
+	if address, ok := sys.Symbolizer().LookupSymbol("main"); !ok ||
+		address != expected_pc {
+		t.Errorf("Expected symbol main at %X, got %X", expected_pc, address)
+	}
 }
@@ -1,7 +1,9 @@
 package memory
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
 	"log/slog"
 )
 
@@ -43,3 +45,68 @@ func (ram *RandomAccessMemory) Write(address uint32, value byte) error {
 func (ram *RandomAccessMemory) Size() uint32 {
 	return ram.size
 }
+
+// statePageSize is the granularity of the sparse RAM state encoding.
+const statePageSize = 4096
+
+// SaveState writes the contents of the RAM to w. Only pages holding
+// non-zero bytes are written, each prefixed with its offset.
+func (ram *RandomAccessMemory) SaveState(w io.Writer) error {
+	for offset := uint32(0); offset < ram.size; offset += statePageSize {
+		page := ram.data[offset:min(offset+statePageSize, ram.size)]
+		if isZero(page) {
+			continue
+		}
+		err := binary.Write(w, binary.LittleEndian, offset)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(page)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadState replaces the contents of the RAM with the state written by
+// SaveState. The pages are decoded before the RAM is touched, so the RAM is
+// left unchanged when the state is truncated or corrupt.
+func (ram *RandomAccessMemory) LoadState(r io.Reader) error {
+	pages := make(map[uint32][]byte)
+	for {
+		var offset uint32
+		err := binary.Read(r, binary.LittleEndian, &offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if offset >= ram.size || offset%statePageSize != 0 {
+			return fmt.Errorf("invalid RAM page offset %X", offset)
+		}
+		page := make([]byte, min(statePageSize, ram.size-offset))
+		_, err = io.ReadFull(r, page)
+		if err != nil {
+			return err
+		}
+		pages[offset] = page
+	}
+
+	clear(ram.data)
+	for offset, page := range pages {
+		copy(ram.data[offset:], page)
+	}
+	return nil
+}
+
+// isZero reports whether all bytes of the slice are zero.
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
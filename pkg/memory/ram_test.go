@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -46,3 +47,65 @@ func TestRAMOutOfBounds(t *testing.T) {
 		t.Errorf("Expected error when writing out of bounds, got nil")
 	}
 }
+
+func TestRAMSaveLoadState(t *testing.T) {
+	ram := setupRAMFixture(t)
+	ram.Write(10, 0xAA)
+	ram.Write(1023, 0xBB)
+
+	var state bytes.Buffer
+	err := ram.SaveState(&state)
+	if err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+
+	restored := NewRAM(ram.Size())
+	restored.Write(500, 0xCC) // Must be cleared by LoadState
+	err = restored.LoadState(&state)
+	if err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+
+	for address, expected := range map[uint32]byte{10: 0xAA, 1023: 0xBB, 500: 0} {
+		value, _ := restored.Read(address)
+		if value != expected {
+			t.Errorf("Expected value %X at address %d, got %X", expected,
+				address, value)
+		}
+	}
+}
+
+func TestRAMSaveStateSparse(t *testing.T) {
+	ram := NewRAM(1 << 20)
+	ram.Write(0x12345, 1)
+
+	var state bytes.Buffer
+	err := ram.SaveState(&state)
+	if err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+
+	// A single page with its offset.
+	if state.Len() != 4+4096 {
+		t.Errorf("Expected state of %d bytes, got %d", 4+4096, state.Len())
+	}
+}
+
+func TestRAMLoadStateCorrupt(t *testing.T) {
+	ram := setupRAMFixture(t)
+	ram.Write(10, 0xAA)
+	var state bytes.Buffer
+	if err := ram.SaveState(&state); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+
+	restored := setupRAMFixture(t)
+	restored.Write(500, 0xCC)
+	truncated := state.Bytes()[:state.Len()-1]
+	if err := restored.LoadState(bytes.NewReader(truncated)); err == nil {
+		t.Fatal("Expected error for a truncated state, got nil")
+	}
+	if value, _ := restored.Read(500); value != 0xCC {
+		t.Errorf("Expected the RAM to be left untouched, got %X at 500", value)
+	}
+}
@@ -0,0 +1,223 @@
+// Package profiler counts the instructions retired by guest code per PC and
+// call stack, and writes them as a pprof profile.
+package profiler
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+	"github.com/Keisim/go-riscv-emu/pkg/symbols"
+)
+
+// maxDepth bounds the tracked call depth, e.g. for runaway recursion.
+const maxDepth = 1024
+
+// frame is a node of the call tree: a function called from callSite by the
+// function of the parent frame.
+type frame struct {
+	parent        *frame
+	callSite      uint32
+	returnAddress uint32
+	depth         int
+	children      map[uint32]*frame // Callees by call site
+	counts        map[uint32]uint64 // Instructions retired by PC
+}
+
+// child returns the frame called from the call site.
+func (f *frame) child(callSite uint32) *frame {
+	if f.children == nil {
+		f.children = make(map[uint32]*frame)
+	}
+	child, ok := f.children[callSite]
+	if !ok {
+		child = &frame{parent: f, callSite: callSite, depth: f.depth + 1}
+		f.children[callSite] = child
+	}
+	return child
+}
+
+// stack returns the call sites leading to the frame, innermost first.
+func (f *frame) stack() []uint32 {
+	var sites []uint32
+	for ; f.parent != nil; f = f.parent {
+		sites = append(sites, f.callSite)
+	}
+	return sites
+}
+
+// Profiler counts every instruction retired by the harts it traces. Each
+// hart needs its own tracer from Tracer, so harts running in parallel do not
+// share state.
+type Profiler struct {
+	start time.Time
+	mu    sync.Mutex
+	harts []*hartTracer
+}
+
+// New returns a Profiler without any tracers.
+func New() *Profiler {
+	return &Profiler{start: time.Now()}
+}
+
+// Tracer returns a new tracer to install on a single hart. Its counts are
+// part of the profile written by WriteProfile.
+func (p *Profiler) Tracer() cpu.Tracer {
+	tracer := &hartTracer{}
+	tracer.current = &tracer.root
+	p.mu.Lock()
+	p.harts = append(p.harts, tracer)
+	p.mu.Unlock()
+	return tracer
+}
+
+// hartTracer tracks the call stack of a hart through JAL and JALR.
+type hartTracer struct {
+	root     frame
+	current  *frame
+	overflow int // Calls beyond maxDepth that were not tracked
+}
+
+// TraceInstruction counts the instruction in the current frame and follows
+// calls and returns.
+func (t *hartTracer) TraceInstruction(core *cpu.Core, event cpu.TraceEvent) {
+	f := t.current
+	if f.counts == nil {
+		f.counts = make(map[uint32]uint64)
+	}
+	f.counts[event.Pc]++
+
+	if event.IsCall() {
+		t.call(event.Pc)
+	} else if event.IsReturn() {
+		t.ret(event.NextPc)
+	}
+}
+
+// call enters a function called from the call site.
+func (t *hartTracer) call(callSite uint32) {
+	if t.current.depth >= maxDepth {
+		t.overflow++
+		return
+	}
+	t.current = t.current.child(callSite)
+	t.current.returnAddress = callSite + 4
+}
+
+// ret leaves functions until the one returning to the address. Returns
+// that match no tracked frame, e.g. after a longjmp past the root, leave
+// the stack unchanged.
+func (t *hartTracer) ret(address uint32) {
+	if t.overflow > 0 {
+		t.overflow--
+		return
+	}
+	for f := t.current; f.parent != nil; f = f.parent {
+		if f.returnAddress == address {
+			t.current = f.parent
+			return
+		}
+	}
+}
+
+// sample is the number of instructions retired at a PC with a call stack.
+type sample struct {
+	pc    uint32
+	stack []uint32 // Call sites, innermost first
+	count uint64
+}
+
+// samples returns the counts of all harts.
+func (p *Profiler) samples() []sample {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var samples []sample
+	var walk func(f *frame)
+	walk = func(f *frame) {
+		if len(f.counts) > 0 {
+			stack := f.stack()
+			for pc, count := range f.counts {
+				samples = append(samples, sample{pc: pc, stack: stack, count: count})
+			}
+		}
+		for _, child := range f.children {
+			walk(child)
+		}
+	}
+	for _, hart := range p.harts {
+		walk(&hart.root)
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].pc < samples[j].pc
+	})
+	return samples
+}
+
+// Instructions returns the number of instructions counted on all harts.
+func (p *Profiler) Instructions() uint64 {
+	var total uint64
+	for _, s := range p.samples() {
+		total += s.count
+	}
+	return total
+}
+
+// FunctionCount is the number of instructions attributed to a function.
+type FunctionCount struct {
+	Name  string
+	Self  uint64 // Instructions of the function itself
+	Total uint64 // Instructions of the function and its callees
+}
+
+// Functions aggregates the counts by the functions the symbolizer resolves
+// PCs to, sorted by decreasing self count. PCs without a symbol are counted
+// under their address.
+func (p *Profiler) Functions(symbolizer *symbols.Symbolizer) []FunctionCount {
+	counts := map[string]*FunctionCount{}
+	get := func(name string) *FunctionCount {
+		count, ok := counts[name]
+		if !ok {
+			count = &FunctionCount{Name: name}
+			counts[name] = count
+		}
+		return count
+	}
+
+	for _, s := range p.samples() {
+		name := symbolName(symbolizer, s.pc)
+		get(name).Self += s.count
+
+		seen := map[string]bool{name: true}
+		get(name).Total += s.count
+		for _, site := range s.stack {
+			caller := symbolName(symbolizer, site)
+			if !seen[caller] {
+				seen[caller] = true
+				get(caller).Total += s.count
+			}
+		}
+	}
+
+	result := make([]FunctionCount, 0, len(counts))
+	for _, count := range counts {
+		result = append(result, *count)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Self != result[j].Self {
+			return result[i].Self > result[j].Self
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// symbolName returns the name of the function containing the address,
+// or the address if it has no symbol.
+func symbolName(symbolizer *symbols.Symbolizer, address uint32) string {
+	if name := symbolizer.Lookup(address).Function; name != "" {
+		return name
+	}
+	return fmt.Sprintf("%08x", address)
+}
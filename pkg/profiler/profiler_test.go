@@ -0,0 +1,232 @@
+package profiler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+	"github.com/Keisim/go-riscv-emu/pkg/symbols"
+)
+
+// callProgram is the trace of main calling f, which calls g.
+var callProgram = []cpu.TraceEvent{
+	{Pc: 0x1000, NextPc: 0x1004, Mnemonic: "addi"},
+	{Pc: 0x1004, NextPc: 0x2000, Mnemonic: "jal", Rd: 1}, // call f
+	{Pc: 0x2000, NextPc: 0x2004, Mnemonic: "addi"},
+	{Pc: 0x2004, NextPc: 0x3000, Mnemonic: "jal", Rd: 1}, // call g
+	{Pc: 0x3000, NextPc: 0x3004, Mnemonic: "addi"},
+	{Pc: 0x3004, NextPc: 0x3008, Mnemonic: "addi"},
+	{Pc: 0x3008, NextPc: 0x2008, Mnemonic: "jalr", Rs1: 1}, // return
+	{Pc: 0x2008, NextPc: 0x1008, Mnemonic: "jalr", Rs1: 1}, // return
+	{Pc: 0x1008, NextPc: 0x100C, Mnemonic: "addi"},
+}
+
+func newSymbolizer() *symbols.Symbolizer {
+	symbolizer := symbols.New()
+	symbolizer.AddSymbol(symbols.Symbol{Name: "main", Address: 0x1000, Size: 0x100})
+	symbolizer.AddSymbol(symbols.Symbol{Name: "f", Address: 0x2000, Size: 0x100})
+	symbolizer.AddSymbol(symbols.Symbol{Name: "g", Address: 0x3000, Size: 0x100})
+	return symbolizer
+}
+
+func trace(tracer cpu.Tracer, events []cpu.TraceEvent) {
+	for _, event := range events {
+		tracer.TraceInstruction(nil, event)
+	}
+}
+
+func TestProfiler_Functions(t *testing.T) {
+	p := New()
+	trace(p.Tracer(), callProgram)
+
+	expected := []FunctionCount{
+		{Name: "f", Self: 3, Total: 6},
+		{Name: "g", Self: 3, Total: 3},
+		{Name: "main", Self: 3, Total: 9},
+	}
+	functions := p.Functions(newSymbolizer())
+	if !slices.Equal(functions, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, functions)
+	}
+	if p.Instructions() != 9 {
+		t.Errorf("Expected 9 instructions, got %d", p.Instructions())
+	}
+}
+
+func TestProfiler_Recursion(t *testing.T) {
+	p := New()
+	trace(p.Tracer(), []cpu.TraceEvent{
+		{Pc: 0x2000, NextPc: 0x2004, Mnemonic: "jal", Rd: 1},   // call f
+		{Pc: 0x2000, NextPc: 0x2004, Mnemonic: "jal", Rd: 1},   // call f
+		{Pc: 0x2000, NextPc: 0x2004, Mnemonic: "jal", Rd: 1},   // call f
+		{Pc: 0x2004, NextPc: 0x2004, Mnemonic: "jalr", Rs1: 1}, // return
+		{Pc: 0x2004, NextPc: 0x2004, Mnemonic: "jalr", Rs1: 1}, // return
+		{Pc: 0x2004, NextPc: 0x2004, Mnemonic: "jalr", Rs1: 1}, // return
+		{Pc: 0x2004, NextPc: 0x2008, Mnemonic: "addi"},
+	})
+
+	expected := []FunctionCount{{Name: "f", Self: 7, Total: 7}}
+	functions := p.Functions(newSymbolizer())
+	if !slices.Equal(functions, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, functions)
+	}
+	tracer := p.harts[0]
+	if tracer.current != &tracer.root {
+		t.Errorf("Expected to be back at the root, at depth %d",
+			tracer.current.depth)
+	}
+}
+
+func TestProfiler_MaxDepth(t *testing.T) {
+	p := New()
+	tracer := p.Tracer()
+	call := cpu.TraceEvent{Pc: 0x2000, NextPc: 0x2000, Mnemonic: "jal", Rd: 1}
+	ret := cpu.TraceEvent{Pc: 0x2004, NextPc: 0x2004, Mnemonic: "jalr", Rs1: 1}
+	for range maxDepth + 10 {
+		tracer.TraceInstruction(nil, call)
+	}
+	for range maxDepth + 10 {
+		tracer.TraceInstruction(nil, ret)
+	}
+
+	if h := p.harts[0]; h.current != &h.root || h.overflow != 0 {
+		t.Errorf("Expected to be back at the root, at depth %d with %d untracked calls",
+			h.current.depth, h.overflow)
+	}
+}
+
+// field is a field of a protocol buffer message.
+type field struct {
+	number int
+	value  uint64 // For varints
+	data   []byte // For length-delimited fields
+}
+
+// decode splits a protocol buffer message into its fields.
+func decode(t *testing.T, data []byte) []field {
+	t.Helper()
+	var fields []field
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		data = data[n:]
+		f := field{number: int(key >> 3)}
+		switch key & 7 {
+		case wireVarint:
+			f.value, n = binary.Uvarint(data)
+			data = data[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			f.data = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			t.Fatalf("Unexpected wire type %d", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// packed decodes a packed repeated varint field.
+func packed(data []byte) []uint64 {
+	var values []uint64
+	for len(data) > 0 {
+		value, n := binary.Uvarint(data)
+		values = append(values, value)
+		data = data[n:]
+	}
+	return values
+}
+
+func TestWriteProfile(t *testing.T) {
+	p := New()
+	trace(p.Tracer(), callProgram)
+	trace(p.Tracer(), callProgram[:2])
+
+	var buffer bytes.Buffer
+	if err := p.WriteProfile(&buffer, newSymbolizer()); err != nil {
+		t.Fatalf("WriteProfile failed: %v", err)
+	}
+	gz, err := gzip.NewReader(&buffer)
+	if err != nil {
+		t.Fatalf("Expected a gzip-compressed profile: %v", err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Failed to decompress profile: %v", err)
+	}
+
+	var stringTable []string
+	functions := map[uint64]uint64{} // Name by function ID
+	locations := map[uint64]uint64{} // Function ID by location ID
+	stacks := map[string]uint64{}    // Counts by "g;f;main"
+	var samples [][]uint64
+	for _, f := range decode(t, data) {
+		switch f.number {
+		case profileStringTable:
+			stringTable = append(stringTable, string(f.data))
+		case profileFunction:
+			var id, name uint64
+			for _, ff := range decode(t, f.data) {
+				switch ff.number {
+				case functionID:
+					id = ff.value
+				case functionName:
+					name = ff.value
+				}
+			}
+			functions[id] = name
+		case profileLocation:
+			var id, function uint64
+			for _, ff := range decode(t, f.data) {
+				switch ff.number {
+				case locationID:
+					id = ff.value
+				case locationLine:
+					function = decode(t, ff.data)[0].value
+				}
+			}
+			locations[id] = function
+		case profileSample:
+			var sample []uint64
+			for _, ff := range decode(t, f.data) {
+				switch ff.number {
+				case sampleLocationID:
+					sample = append(packed(ff.data), sample...)
+				case sampleValue:
+					sample = append(sample, packed(ff.data)...)
+				}
+			}
+			samples = append(samples, sample)
+		}
+	}
+	if len(stringTable) == 0 || stringTable[0] != "" {
+		t.Fatalf("Expected the string table to start with \"\", got %q",
+			stringTable)
+	}
+	for _, sample := range samples {
+		ids, count := sample[:len(sample)-1], sample[len(sample)-1]
+		stack := ""
+		for i, id := range ids {
+			if i > 0 {
+				stack += ";"
+			}
+			stack += stringTable[functions[locations[id]]]
+		}
+		stacks[stack] += count
+	}
+
+	expected := map[string]uint64{"main": 5, "f;main": 3, "g;f;main": 3}
+	if len(stacks) != len(expected) {
+		t.Errorf("Expected stacks %v, got %v", expected, stacks)
+	}
+	for stack, count := range expected {
+		if stacks[stack] != count {
+			t.Errorf("Expected %d instructions in %s, got %d", count, stack,
+				stacks[stack])
+		}
+	}
+}
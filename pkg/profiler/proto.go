@@ -0,0 +1,230 @@
+package profiler
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Keisim/go-riscv-emu/pkg/symbols"
+)
+
+// Field numbers of the messages in profile.proto, see
+// https://github.com/google/pprof/blob/main/proto/profile.proto.
+const (
+	profileSampleType    = 1
+	profileSample        = 2
+	profileMapping       = 3
+	profileLocation      = 4
+	profileFunction      = 5
+	profileStringTable   = 6
+	profileTimeNanos     = 9
+	profileDurationNanos = 10
+	profilePeriodType    = 11
+	profilePeriod        = 12
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	mappingID           = 1
+	mappingMemoryStart  = 2
+	mappingMemoryLimit  = 3
+	mappingFilename     = 5
+	mappingHasFunctions = 7
+	mappingHasFilenames = 8
+	mappingHasLines     = 9
+
+	locationID        = 1
+	locationMappingID = 2
+	locationAddress   = 3
+	locationLine      = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID       = 1
+	functionName     = 2
+	functionFilename = 4
+)
+
+// Protocol buffer wire types.
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// encoder builds a protocol buffer message.
+type encoder struct {
+	data []byte
+}
+
+func (e *encoder) key(field, wireType int) {
+	e.data = binary.AppendUvarint(e.data, uint64(field)<<3|uint64(wireType))
+}
+
+// uint64 encodes a varint field, leaving out zero values like proto3.
+func (e *encoder) uint64(field int, value uint64) {
+	if value == 0 {
+		return
+	}
+	e.key(field, wireVarint)
+	e.data = binary.AppendUvarint(e.data, value)
+}
+
+func (e *encoder) bool(field int, value bool) {
+	if value {
+		e.uint64(field, 1)
+	}
+}
+
+// packed encodes a repeated varint field.
+func (e *encoder) packed(field int, values []uint64) {
+	var packed []byte
+	for _, value := range values {
+		packed = binary.AppendUvarint(packed, value)
+	}
+	e.bytes(field, packed)
+}
+
+func (e *encoder) bytes(field int, value []byte) {
+	e.key(field, wireBytes)
+	e.data = binary.AppendUvarint(e.data, uint64(len(value)))
+	e.data = append(e.data, value...)
+}
+
+func (e *encoder) message(field int, message *encoder) {
+	e.bytes(field, message.data)
+}
+
+// function is an entry of the function table of a profile.
+type function struct {
+	name string
+	file string
+}
+
+// profileBuilder assigns the IDs of locations and functions and the
+// indices of strings.
+type profileBuilder struct {
+	profile    encoder
+	symbolizer *symbols.Symbolizer
+	strings    map[string]uint64
+	locations  map[uint32]uint64
+	functions  map[function]uint64
+	hasLines   bool
+}
+
+// string returns the index of the string in the string table.
+func (b *profileBuilder) string(s string) uint64 {
+	index, ok := b.strings[s]
+	if !ok {
+		index = uint64(len(b.strings))
+		b.strings[s] = index
+		b.profile.bytes(profileStringTable, []byte(s))
+	}
+	return index
+}
+
+// function returns the ID of the function.
+func (b *profileBuilder) function(f function) uint64 {
+	id, ok := b.functions[f]
+	if !ok {
+		id = uint64(len(b.functions) + 1)
+		b.functions[f] = id
+		var message encoder
+		message.uint64(functionID, id)
+		message.uint64(functionName, b.string(f.name))
+		message.uint64(functionFilename, b.string(f.file))
+		b.profile.message(profileFunction, &message)
+	}
+	return id
+}
+
+// location returns the ID of the location of the address.
+func (b *profileBuilder) location(address uint32) uint64 {
+	id, ok := b.locations[address]
+	if !ok {
+		id = uint64(len(b.locations) + 1)
+		b.locations[address] = id
+
+		location := b.symbolizer.Lookup(address)
+		name := symbolName(b.symbolizer, address)
+		if location.File != "" {
+			b.hasLines = true
+		}
+		var line encoder
+		line.uint64(lineFunctionID, b.function(function{name, location.File}))
+		line.uint64(lineLine, uint64(location.Line))
+
+		var message encoder
+		message.uint64(locationID, id)
+		message.uint64(locationMappingID, 1)
+		message.uint64(locationAddress, uint64(address))
+		message.message(locationLine, &line)
+		b.profile.message(profileLocation, &message)
+	}
+	return id
+}
+
+// valueType encodes a ValueType message.
+func (b *profileBuilder) valueType(field int, typ, unit string) {
+	var message encoder
+	message.uint64(valueTypeType, b.string(typ))
+	message.uint64(valueTypeUnit, b.string(unit))
+	b.profile.message(field, &message)
+}
+
+// WriteProfile writes the instruction counts as a gzip-compressed profile in
+// the profile.proto format read by "go tool pprof". Every sample is the
+// number of instructions retired at a PC with a call stack; the symbolizer
+// provides the function names and source lines and may be nil.
+func (p *Profiler) WriteProfile(w io.Writer, symbolizer *symbols.Symbolizer) error {
+	b := &profileBuilder{
+		symbolizer: symbolizer,
+		strings:    map[string]uint64{},
+		locations:  map[uint32]uint64{},
+		functions:  map[function]uint64{},
+	}
+	b.string("")
+	b.valueType(profileSampleType, "instructions", "count")
+
+	for _, s := range p.samples() {
+		ids := make([]uint64, 0, len(s.stack)+1)
+		ids = append(ids, b.location(s.pc))
+		for _, site := range s.stack {
+			ids = append(ids, b.location(site))
+		}
+		var message encoder
+		message.packed(sampleLocationID, ids)
+		message.packed(sampleValue, []uint64{s.count})
+		b.profile.message(profileSample, &message)
+	}
+
+	// All guest code is in a single mapping, already symbolized.
+	var mapping encoder
+	mapping.uint64(mappingID, 1)
+	mapping.uint64(mappingMemoryStart, 0)
+	mapping.uint64(mappingMemoryLimit, 1<<32)
+	mapping.uint64(mappingFilename, b.string("guest"))
+	mapping.bool(mappingHasFunctions, true)
+	mapping.bool(mappingHasFilenames, b.hasLines)
+	mapping.bool(mappingHasLines, b.hasLines)
+	b.profile.message(profileMapping, &mapping)
+
+	b.profile.uint64(profileTimeNanos, uint64(p.start.UnixNano()))
+	b.profile.uint64(profileDurationNanos, uint64(time.Since(p.start)))
+	b.valueType(profilePeriodType, "instructions", "count")
+	b.profile.uint64(profilePeriod, 1)
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(b.profile.data); err != nil {
+		return fmt.Errorf("failed to write profile: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to write profile: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+// Package replay records the bytes a guest reads from host input devices
+// and the interrupts its harts see pending, keyed by instructions retired,
+// and feeds them back to reproduce a run.
+//
+// Devices changing state visible to the guest on their own other than by
+// raising interrupts, e.g. by writing host input into guest memory, are not
+// recorded, so the system refuses to record or replay while such devices
+// are present.
+package replay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+// logMagic identifies input log files.
+var logMagic = [8]byte{'R', 'V', 'E', 'M', 'U', 'R', 'E', 'C'}
+
+// LogVersion is the version of the input log format.
+const LogVersion = 2
+
+// EventKind identifies the kind of a recorded nondeterministic input.
+type EventKind uint8
+
+const (
+	// EventRead is a byte read from a host input device.
+	EventRead EventKind = 1
+	// EventInterrupt is a change of the interrupts pending at a hart.
+	EventInterrupt EventKind = 2
+)
+
+// Event is a single nondeterministic input, keyed by the hart that consumed
+// it and the number of instructions the hart had retired at that point.
+type Event struct {
+	Kind    EventKind
+	Value   byte
+	Hart    uint32
+	Instret uint64
+	Address uint32
+	Pending uint32 // Pending interrupts of an EventInterrupt, as in mip
+}
+
+// Clock returns the hart currently executing and the number of
+// instructions it has retired.
+type Clock func() (hart uint32, instret uint64)
+
+// logHeader starts every input log.
+type logHeader struct {
+	Magic   [8]byte
+	Version uint32
+}
+
+// Recorder is a devices.InputInterceptor writing every host input read on
+// the bus to an input log. Flush may be called from another goroutine, e.g.
+// a signal handler.
+type Recorder struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	clock Clock
+	count uint64
+	harts map[uint32]bool // Harts whose interrupts were recorded
+}
+
+// NewRecorder writes the log header to w and returns a Recorder appending
+// events to it.
+func NewRecorder(w io.Writer, clock Clock) (*Recorder, error) {
+	buffered := bufio.NewWriter(w)
+	err := binary.Write(buffered, binary.LittleEndian, logHeader{
+		Magic:   logMagic,
+		Version: LogVersion,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{w: buffered, clock: clock, harts: map[uint32]bool{}}, nil
+}
+
+// InterceptRead reads from the device and records the returned value.
+func (r *Recorder) InterceptRead(device devices.BusDevice,
+	address uint32) (byte, error) {
+	value, err := device.Read(address)
+	if err != nil {
+		return 0, err
+	}
+
+	hart, instret := r.clock()
+	err = r.write(Event{
+		Kind:    EventRead,
+		Value:   value,
+		Hart:    hart,
+		Instret: instret,
+		Address: address,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return value, nil
+}
+
+// InterceptInterrupts returns the interrupts raised by the devices and
+// records them if they changed, or if the hart has not been recorded yet.
+func (r *Recorder) InterceptInterrupts(live, last uint32) (uint32, error) {
+	hart, instret := r.clock()
+	if live == last && r.harts[hart] {
+		return live, nil
+	}
+	r.harts[hart] = true
+	err := r.write(Event{
+		Kind:    EventInterrupt,
+		Hart:    hart,
+		Instret: instret,
+		Pending: live,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return live, nil
+}
+
+// write appends an event to the log.
+func (r *Recorder) write(event Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := binary.Write(r.w, binary.LittleEndian, event)
+	if err != nil {
+		return fmt.Errorf("failed to record input: %v", err)
+	}
+	r.count++
+	return nil
+}
+
+// Count returns the number of recorded events.
+func (r *Recorder) Count() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.count
+}
+
+// Flush writes buffered events to the underlying writer.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.w.Flush()
+}
+
+// Replayer is a devices.InputInterceptor feeding the reads and interrupts
+// recorded in an input log back to the guest instead of taking them from
+// the devices.
+type Replayer struct {
+	r     *bufio.Reader
+	clock Clock
+	next  Event
+	done  bool
+}
+
+// NewReplayer reads the log header from r and returns a Replayer for it.
+func NewReplayer(r io.Reader, clock Clock) (*Replayer, error) {
+	buffered := bufio.NewReader(r)
+	var header logHeader
+	err := binary.Read(buffered, binary.LittleEndian, &header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input log header: %v", err)
+	}
+	if header.Magic != logMagic {
+		return nil, fmt.Errorf("not an input log file")
+	}
+	if header.Version != LogVersion {
+		return nil, fmt.Errorf("unsupported input log version %d, expected %d",
+			header.Version, LogVersion)
+	}
+
+	replayer := &Replayer{r: buffered, clock: clock}
+	err = replayer.advance()
+	if err != nil {
+		return nil, err
+	}
+	return replayer, nil
+}
+
+// advance reads the next event of the log.
+func (p *Replayer) advance() error {
+	err := binary.Read(p.r, binary.LittleEndian, &p.next)
+	if err == io.EOF {
+		p.done = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read input log: %v", err)
+	}
+	return nil
+}
+
+// InterceptRead returns the recorded value of the read. The read has to
+// match the next event of the log, otherwise the run has diverged from the
+// recorded one and an error is returned.
+func (p *Replayer) InterceptRead(device devices.BusDevice,
+	address uint32) (byte, error) {
+	hart, instret := p.clock()
+	if p.done {
+		return 0, fmt.Errorf(
+			"replay diverged: unexpected read of %X by hart %d at instruction %d after the end of the log",
+			address, hart, instret)
+	}
+	event := p.next
+	if event.Kind == EventInterrupt {
+		return 0, fmt.Errorf(
+			"replay diverged: read of %X by hart %d at instruction %d, recorded interrupts of hart %d at instruction %d",
+			address, hart, instret, event.Hart, event.Instret)
+	}
+	if event.Hart != hart || event.Instret != instret ||
+		event.Address != address {
+		return 0, fmt.Errorf(
+			"replay diverged: read of %X by hart %d at instruction %d, recorded read of %X by hart %d at instruction %d",
+			address, hart, instret, event.Address, event.Hart, event.Instret)
+	}
+
+	err := p.advance()
+	if err != nil {
+		return 0, err
+	}
+	return event.Value, nil
+}
+
+// InterceptInterrupts returns the recorded interrupts of the hart, ignoring
+// the ones raised by the devices. The interrupts change where the log
+// records a change, and an error is returned if the hart has passed a
+// recorded change.
+func (p *Replayer) InterceptInterrupts(live, last uint32) (uint32, error) {
+	event := p.next
+	if p.done || event.Kind != EventInterrupt {
+		return last, nil
+	}
+	hart, instret := p.clock()
+	if event.Hart != hart || event.Instret > instret {
+		return last, nil
+	}
+	if event.Instret < instret {
+		return 0, fmt.Errorf(
+			"replay diverged: hart %d reached instruction %d without seeing its recorded interrupts at instruction %d",
+			hart, instret, event.Instret)
+	}
+
+	if err := p.advance(); err != nil {
+		return 0, err
+	}
+	return event.Pending, nil
+}
+
+// Done reports whether every recorded event has been replayed.
+func (p *Replayer) Done() bool {
+	return p.done
+}
@@ -0,0 +1,225 @@
+package replay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// mockInputDevice returns a new value on every read, like a host input
+// device would.
+type mockInputDevice struct {
+	next  byte
+	reads int
+}
+
+func (m *mockInputDevice) Initialize(baseAddress, size uint32) {}
+
+func (m *mockInputDevice) Read(address uint32) (byte, error) {
+	m.reads++
+	m.next += 7
+	return m.next, nil
+}
+
+func (m *mockInputDevice) Write(address uint32, value byte) error {
+	return nil
+}
+
+func (m *mockInputDevice) BaseAddress() uint32 {
+	return 0x3000
+}
+
+func (m *mockInputDevice) Size() uint32 {
+	return 0x10
+}
+
+// testClock is a Clock advanced by the tests.
+type testClock struct {
+	hart    uint32
+	instret uint64
+}
+
+func (c *testClock) now() (uint32, uint64) {
+	return c.hart, c.instret
+}
+
+func record(t *testing.T, reads int) ([]byte, []byte) {
+	t.Helper()
+	var log bytes.Buffer
+	clock := &testClock{}
+	recorder, err := NewRecorder(&log, clock.now)
+	if err != nil {
+		t.Fatalf("NewRecorder failed: %v", err)
+	}
+
+	device := &mockInputDevice{}
+	var values []byte
+	for i := 0; i < reads; i++ {
+		clock.instret = uint64(10 * i)
+		value, err := recorder.InterceptRead(device, 0x3000+uint32(i%4))
+		if err != nil {
+			t.Fatalf("InterceptRead failed: %v", err)
+		}
+		values = append(values, value)
+	}
+
+	if recorder.Count() != uint64(reads) {
+		t.Errorf("Expected %d recorded events, got %d", reads,
+			recorder.Count())
+	}
+	if err := recorder.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	return log.Bytes(), values
+}
+
+func TestRecordReplay(t *testing.T) {
+	log, values := record(t, 5)
+
+	clock := &testClock{}
+	replayer, err := NewReplayer(bytes.NewReader(log), clock.now)
+	if err != nil {
+		t.Fatalf("NewReplayer failed: %v", err)
+	}
+
+	device := &mockInputDevice{next: 100}
+	for i, expected := range values {
+		clock.instret = uint64(10 * i)
+		value, err := replayer.InterceptRead(device, 0x3000+uint32(i%4))
+		if err != nil {
+			t.Fatalf("InterceptRead failed: %v", err)
+		}
+		if value != expected {
+			t.Errorf("Expected replayed value %X, got %X", expected, value)
+		}
+	}
+
+	if device.reads != 0 {
+		t.Errorf("Expected replay not to read the device, got %d reads",
+			device.reads)
+	}
+	if !replayer.Done() {
+		t.Error("Expected the whole log to be replayed")
+	}
+}
+
+func TestReplay_Divergence(t *testing.T) {
+	log, _ := record(t, 2)
+
+	tests := []struct {
+		name    string
+		instret uint64
+		address uint32
+	}{
+		{"instruction count", 3, 0x3000},
+		{"address", 0, 0x3001},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := &testClock{instret: test.instret}
+			replayer, err := NewReplayer(bytes.NewReader(log), clock.now)
+			if err != nil {
+				t.Fatalf("NewReplayer failed: %v", err)
+			}
+
+			_, err = replayer.InterceptRead(&mockInputDevice{}, test.address)
+			if err == nil || !strings.Contains(err.Error(), "diverged") {
+				t.Errorf("Expected divergence error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReplay_PastEndOfLog(t *testing.T) {
+	log, _ := record(t, 0)
+	clock := &testClock{}
+	replayer, err := NewReplayer(bytes.NewReader(log), clock.now)
+	if err != nil {
+		t.Fatalf("NewReplayer failed: %v", err)
+	}
+
+	_, err = replayer.InterceptRead(&mockInputDevice{}, 0x3000)
+	if err == nil {
+		t.Error("Expected error for read past the end of the log, got nil")
+	}
+}
+
+func TestNewReplayer_InvalidLog(t *testing.T) {
+	clock := &testClock{}
+	_, err := NewReplayer(strings.NewReader("RVEMUSNP\x01\x00\x00\x00"),
+		clock.now)
+	if err == nil {
+		t.Error("Expected error for invalid log, got nil")
+	}
+}
+
+func TestRecordReplay_Interrupts(t *testing.T) {
+	var log bytes.Buffer
+	clock := &testClock{}
+	recorder, err := NewRecorder(&log, clock.now)
+	if err != nil {
+		t.Fatalf("NewRecorder failed: %v", err)
+	}
+	// Hart 0 is recorded at its first instruction and where its interrupts
+	// change, at instructions 5 and 8.
+	live := map[uint64]uint32{5: 1 << 7, 6: 1 << 7, 8: 0}
+	var last uint32
+	for instret := range uint64(10) {
+		clock.instret = instret
+		last, err = recorder.InterceptInterrupts(live[instret], last)
+		if err != nil {
+			t.Fatalf("InterceptInterrupts failed: %v", err)
+		}
+	}
+	if recorder.Count() != 3 {
+		t.Errorf("Expected 3 recorded events, got %d", recorder.Count())
+	}
+	recorder.Flush()
+
+	replayer, err := NewReplayer(bytes.NewReader(log.Bytes()), clock.now)
+	if err != nil {
+		t.Fatalf("NewReplayer failed: %v", err)
+	}
+	last = 0
+	for instret := range uint64(10) {
+		clock.instret = instret
+		// The devices raise nothing while replaying.
+		last, err = replayer.InterceptInterrupts(0, last)
+		if err != nil {
+			t.Fatalf("InterceptInterrupts failed: %v", err)
+		}
+		if last != live[instret] {
+			t.Errorf("Expected interrupts %X at instruction %d, got %X",
+				live[instret], instret, last)
+		}
+	}
+	if !replayer.Done() {
+		t.Error("Expected the whole log to be replayed")
+	}
+}
+
+func TestReplay_InterruptsDiverged(t *testing.T) {
+	var log bytes.Buffer
+	clock := &testClock{instret: 5}
+	recorder, _ := NewRecorder(&log, clock.now)
+	recorder.InterceptInterrupts(1<<7, 0)
+	recorder.Flush()
+
+	clock.instret = 6
+	replayer, err := NewReplayer(bytes.NewReader(log.Bytes()), clock.now)
+	if err != nil {
+		t.Fatalf("NewReplayer failed: %v", err)
+	}
+	_, err = replayer.InterceptInterrupts(0, 0)
+	if err == nil || !strings.Contains(err.Error(), "diverged") {
+		t.Errorf("Expected divergence error, got %v", err)
+	}
+
+	// A read where the log records interrupts diverges as well.
+	clock.instret = 5
+	replayer, _ = NewReplayer(bytes.NewReader(log.Bytes()), clock.now)
+	_, err = replayer.InterceptRead(&mockInputDevice{}, 0x3000)
+	if err == nil || !strings.Contains(err.Error(), "diverged") {
+		t.Errorf("Expected divergence error, got %v", err)
+	}
+}
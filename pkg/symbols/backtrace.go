@@ -0,0 +1,47 @@
+package symbols
+
+// maxFrameSize bounds the distance between two frame pointers considered
+// plausible when telling leaf functions from others.
+const maxFrameSize = 1 << 20
+
+// Backtrace walks the frame pointer chain of the guest. It follows the
+// RISC-V convention of GCC with -fno-omit-frame-pointer: fp (s0) points
+// just above the frame, the return address is saved at fp-4 and the frame
+// pointer of the caller at fp-8. Leaf functions only save the frame pointer
+// of the caller, at fp-4; their return address is still in ra.
+//
+// It returns pc followed by the return addresses of the callers, at most
+// max entries. The walk stops at the first frame pointer that is zero,
+// misaligned, unreadable or does not point to an older frame, so the
+// result is best effort for code built without frame pointers.
+func Backtrace(pc, ra, fp uint32, readWord func(address uint32) (uint32, error), max int) []uint32 {
+	frames := []uint32{pc}
+	if fp == 0 || fp%4 != 0 {
+		return frames
+	}
+
+	// A leaf function has no saved return address; the word below the
+	// frame pointer is then the frame pointer of the caller.
+	if saved, err := readWord(fp - 4); err == nil &&
+		saved > fp && saved-fp < maxFrameSize && saved%4 == 0 {
+		frames = append(frames, ra)
+		fp = saved
+	}
+
+	for len(frames) < max {
+		returnAddress, err := readWord(fp - 4)
+		if err != nil || returnAddress == 0 {
+			break
+		}
+		previous, err := readWord(fp - 8)
+		if err != nil {
+			break
+		}
+		frames = append(frames, returnAddress)
+		if previous <= fp || previous%4 != 0 {
+			break
+		}
+		fp = previous
+	}
+	return frames[:min(len(frames), max)]
+}
@@ -0,0 +1,283 @@
+// Package symbols maps guest addresses to function names and source lines
+// using the symbol tables and DWARF line tables of loaded ELF files.
+package symbols
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Symbol is a function or label of a loaded ELF file.
+type Symbol struct {
+	Name    string
+	Address uint32
+	Size    uint32 // 0 if unknown
+}
+
+// line is a row of a DWARF line table. A row covers the addresses up to
+// the next row; end rows mark the end of a sequence.
+type line struct {
+	address uint32
+	file    string // Path as recorded in the line table
+	line    int
+	end     bool
+}
+
+// LineRange is a range of addresses generated for a single source line.
+type LineRange struct {
+	Address uint32 // First address of the range
+	End     uint32 // Address following the range
+	File    string // Path of the source file as recorded in DWARF
+	Line    int
+}
+
+// Location is the symbolized form of an address.
+type Location struct {
+	Address  uint32
+	Function string // Empty if no symbol covers the address
+	Offset   uint32 // Offset of the address in the function
+	File     string // Base name of the source file, empty if unknown
+	Path     string // Path of the source file as recorded in DWARF
+	Line     int
+}
+
+// String formats the location as "func+0x10 (file.c:12)", leaving out the
+// parts that are unknown. Addresses without a symbol are shown in hex.
+func (l Location) String() string {
+	var b strings.Builder
+	if l.Function == "" {
+		fmt.Fprintf(&b, "%08x", l.Address)
+	} else if l.Offset == 0 {
+		b.WriteString(l.Function)
+	} else {
+		fmt.Fprintf(&b, "%s+0x%x", l.Function, l.Offset)
+	}
+	if l.File != "" {
+		fmt.Fprintf(&b, " (%s:%d)", l.File, l.Line)
+	}
+	return b.String()
+}
+
+// Symbolizer resolves guest addresses to functions and source lines. The
+// zero value knows no symbols and is ready to use.
+type Symbolizer struct {
+	symbols []Symbol // Sorted by address
+	lines   []line   // Sorted by address
+}
+
+// New returns an empty Symbolizer.
+func New() *Symbolizer {
+	return &Symbolizer{}
+}
+
+// AddELF adds the function symbols and, if present, the DWARF line tables
+// of an ELF file. Files without debug information only provide symbols.
+func (s *Symbolizer) AddELF(f *elf.File) error {
+	symbols, err := f.Symbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return fmt.Errorf("failed to read symbols: %v", err)
+	}
+	for _, symbol := range symbols {
+		if isCodeSymbol(symbol) {
+			s.AddSymbol(Symbol{
+				Name:    symbol.Name,
+				Address: uint32(symbol.Value),
+				Size:    uint32(symbol.Size),
+			})
+		}
+	}
+
+	if f.Section(".debug_info") == nil || f.Section(".debug_line") == nil {
+		return nil
+	}
+	data, err := f.DWARF()
+	if err != nil {
+		return fmt.Errorf("failed to read DWARF data: %v", err)
+	}
+	return s.AddDWARF(data)
+}
+
+// isCodeSymbol reports whether an ELF symbol names a function or code label.
+// Section, file and RISC-V mapping symbols like "$x" are skipped.
+func isCodeSymbol(symbol elf.Symbol) bool {
+	if symbol.Section == elf.SHN_UNDEF || symbol.Section == elf.SHN_ABS ||
+		symbol.Name == "" || strings.HasPrefix(symbol.Name, "$") ||
+		strings.HasPrefix(symbol.Name, ".L") {
+		return false
+	}
+	switch elf.ST_TYPE(symbol.Info) {
+	case elf.STT_FUNC, elf.STT_NOTYPE:
+		return true
+	default:
+		return false
+	}
+}
+
+// AddSymbol adds a single symbol.
+func (s *Symbolizer) AddSymbol(symbol Symbol) {
+	i := sort.Search(len(s.symbols), func(i int) bool {
+		return s.symbols[i].Address > symbol.Address
+	})
+	s.symbols = append(s.symbols, Symbol{})
+	copy(s.symbols[i+1:], s.symbols[i:])
+	s.symbols[i] = symbol
+}
+
+// AddDWARF adds the line tables of every compilation unit in the DWARF
+// data.
+func (s *Symbolizer) AddDWARF(data *dwarf.Data) error {
+	reader := data.Reader()
+	for {
+		entry, err := reader.Next()
+		if err != nil {
+			return fmt.Errorf("failed to read DWARF info: %v", err)
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Tag != dwarf.TagCompileUnit {
+			reader.SkipChildren()
+			continue
+		}
+
+		lines, err := data.LineReader(entry)
+		if err != nil {
+			return fmt.Errorf("failed to read DWARF line table: %v", err)
+		}
+		if lines != nil {
+			if err := s.addLines(lines); err != nil {
+				return err
+			}
+		}
+		reader.SkipChildren()
+	}
+
+	sort.SliceStable(s.lines, func(i, j int) bool {
+		return s.lines[i].address < s.lines[j].address
+	})
+	return nil
+}
+
+// addLines appends the rows of a line table.
+func (s *Symbolizer) addLines(lines *dwarf.LineReader) error {
+	var entry dwarf.LineEntry
+	for {
+		err := lines.Next(&entry)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read DWARF line table: %v", err)
+		}
+		row := line{address: uint32(entry.Address), line: entry.Line,
+			end: entry.EndSequence}
+		if entry.File != nil {
+			row.file = entry.File.Name
+		}
+		s.lines = append(s.lines, row)
+	}
+}
+
+// AddLine adds a range of addresses generated for a source line, for
+// programs whose line information does not come from DWARF.
+func (s *Symbolizer) AddLine(r LineRange) {
+	s.lines = append(s.lines,
+		line{address: r.Address, file: r.File, line: r.Line},
+		line{address: r.End, end: true})
+	sort.SliceStable(s.lines, func(i, j int) bool {
+		return s.lines[i].address < s.lines[j].address
+	})
+}
+
+// Lines returns the address ranges of all source lines, sorted by address.
+func (s *Symbolizer) Lines() []LineRange {
+	var ranges []LineRange
+	for i, row := range s.lines {
+		if row.end || i+1 == len(s.lines) ||
+			s.lines[i+1].address == row.address {
+			continue
+		}
+		ranges = append(ranges, LineRange{
+			Address: row.address,
+			End:     s.lines[i+1].address,
+			File:    row.file,
+			Line:    row.line,
+		})
+	}
+	return ranges
+}
+
+// Symbols returns all known symbols, sorted by address.
+func (s *Symbolizer) Symbols() []Symbol {
+	return s.symbols
+}
+
+// LookupSymbol returns the address of the symbol with the given name.
+func (s *Symbolizer) LookupSymbol(name string) (uint32, bool) {
+	for _, symbol := range s.symbols {
+		if symbol.Name == name {
+			return symbol.Address, true
+		}
+	}
+	return 0, false
+}
+
+// function returns the symbol covering the address. Symbols without a size
+// cover the addresses up to the next symbol.
+func (s *Symbolizer) function(address uint32) (Symbol, bool) {
+	i := sort.Search(len(s.symbols), func(i int) bool {
+		return s.symbols[i].Address > address
+	})
+	for i--; i >= 0; i-- {
+		symbol := s.symbols[i]
+		if symbol.Size == 0 || address-symbol.Address < symbol.Size {
+			return symbol, true
+		}
+	}
+	return Symbol{}, false
+}
+
+// sourceLine returns the line table row covering the address.
+func (s *Symbolizer) sourceLine(address uint32) (line, bool) {
+	i := sort.Search(len(s.lines), func(i int) bool {
+		return s.lines[i].address > address
+	})
+	if i == 0 || s.lines[i-1].end {
+		return line{}, false
+	}
+	return s.lines[i-1], true
+}
+
+// Lookup symbolizes an address.
+func (s *Symbolizer) Lookup(address uint32) Location {
+	location := Location{Address: address}
+	if s == nil {
+		return location
+	}
+	if symbol, ok := s.function(address); ok {
+		location.Function = symbol.Name
+		location.Offset = address - symbol.Address
+	}
+	if row, ok := s.sourceLine(address); ok {
+		location.File = filepath.Base(row.file)
+		location.Path = row.file
+		location.Line = row.line
+	}
+	return location
+}
+
+// Describe formats an address for messages: the address in hex followed by
+// its symbolized location, if known.
+func (s *Symbolizer) Describe(address uint32) string {
+	location := s.Lookup(address)
+	if location.Function == "" && location.File == "" {
+		return fmt.Sprintf("%08x", address)
+	}
+	return fmt.Sprintf("%08x %s", address, location)
+}
@@ -0,0 +1,218 @@
+package symbols
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestAddELF_Symbols(t *testing.T) {
+	f, err := elf.Open("../../misc/c/terminal_mmio_write.o")
+	if err != nil {
+		t.Fatalf("Failed to open ELF: %v", err)
+	}
+	defer f.Close()
+
+	s := New()
+	if err := s.AddELF(f); err != nil {
+		t.Fatalf("AddELF failed: %v", err)
+	}
+
+	// Mapping symbols like $xrv32i2p1 share the address of main.
+	if len(s.Symbols()) != 1 || s.Symbols()[0].Name != "main" {
+		t.Fatalf("Expected only the main symbol, got %v", s.Symbols())
+	}
+	if location := s.Lookup(0x80000008).String(); location != "main+0x8" {
+		t.Errorf("Expected main+0x8, got %q", location)
+	}
+	// main is 44 bytes long; the string constants after it are no code.
+	if location := s.Lookup(0x8000002C).String(); location != "8000002c" {
+		t.Errorf("Expected no symbol past main, got %q", location)
+	}
+}
+
+func TestLookup_SymbolsWithoutSize(t *testing.T) {
+	s := New()
+	s.AddSymbol(Symbol{Name: "_start", Address: 0x1000})
+	s.AddSymbol(Symbol{Name: "loop", Address: 0x1010})
+	s.AddSymbol(Symbol{Name: "handler", Address: 0x2000, Size: 8})
+
+	tests := map[uint32]string{
+		0x0FFC: "00000ffc",
+		0x1000: "_start",
+		0x100C: "_start+0xc",
+		0x1014: "loop+0x4",
+		0x2004: "handler+0x4",
+		0x2008: "loop+0xff8",
+	}
+	for address, expected := range tests {
+		if actual := s.Lookup(address).String(); actual != expected {
+			t.Errorf("Lookup(%X) = %q, expected %q", address, actual, expected)
+		}
+	}
+}
+
+// uleb128 appends an unsigned LEB128 number.
+func uleb128(b []byte, value uint64) []byte {
+	for {
+		c := byte(value & 0x7F)
+		value >>= 7
+		if value != 0 {
+			b = append(b, c|0x80)
+		} else {
+			return append(b, c)
+		}
+	}
+}
+
+// lineTestDWARF returns DWARF data for a single compilation unit test.c
+// whose line table maps 0x80000000 to line 10, 0x80000008 to line 12 and
+// ends at 0x80000010.
+func lineTestDWARF(t *testing.T) *dwarf.Data {
+	t.Helper()
+	abbrev := []byte{
+		1, 0x11, 0, // Abbreviation 1: DW_TAG_compile_unit, no children
+		0x03, 0x08, // DW_AT_name, DW_FORM_string
+		0x10, 0x06, // DW_AT_stmt_list, DW_FORM_data4
+		0x1b, 0x08, // DW_AT_comp_dir, DW_FORM_string
+		0, 0,
+		0,
+	}
+
+	var die []byte
+	die = append(die, 1)
+	die = append(die, "test.c\x00"...)
+	die = binary.LittleEndian.AppendUint32(die, 0)
+	die = append(die, "/src\x00"...)
+	var info []byte
+	info = binary.LittleEndian.AppendUint32(info, uint32(2+4+1+len(die)))
+	info = binary.LittleEndian.AppendUint16(info, 4)
+	info = binary.LittleEndian.AppendUint32(info, 0)
+	info = append(info, 4)
+	info = append(info, die...)
+
+	header := []byte{
+		1, 1, 1, // Minimum instruction length, maximum operations, is_stmt
+		0xFB, 14, 13, // line_base -5, line_range, opcode_base
+		0, 1, 1, 1, 1, 0, 0, 0, 1, 0, 0, 1, // Standard opcode lengths
+		0, // No include directories
+	}
+	header = append(header, "test.c\x00"...)
+	header = append(header, 0, 0, 0, 0)
+
+	program := []byte{0, 5, 2} // DW_LNE_set_address
+	program = binary.LittleEndian.AppendUint32(program, 0x80000000)
+	program = append(program, 3, 9, 1) // Advance line to 10, copy
+	program = append(program, 2, 8)    // Advance PC by 8
+	program = append(program, 3, 2, 1) // Advance line to 12, copy
+	program = append(program, 2, 8)    // Advance PC by 8
+	program = append(program, 0, 1, 1) // DW_LNE_end_sequence
+
+	var lines []byte
+	lines = binary.LittleEndian.AppendUint32(lines,
+		uint32(2+4+len(header)+len(program)))
+	lines = binary.LittleEndian.AppendUint16(lines, 4)
+	lines = binary.LittleEndian.AppendUint32(lines, uint32(len(header)))
+	lines = append(lines, header...)
+	lines = append(lines, program...)
+
+	data, err := dwarf.New(abbrev, nil, nil, info, lines, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("dwarf.New failed: %v", err)
+	}
+	return data
+}
+
+func TestAddDWARF_Lines(t *testing.T) {
+	s := New()
+	s.AddSymbol(Symbol{Name: "main", Address: 0x80000000, Size: 16})
+	if err := s.AddDWARF(lineTestDWARF(t)); err != nil {
+		t.Fatalf("AddDWARF failed: %v", err)
+	}
+
+	tests := map[uint32]string{
+		0x80000000: "main (test.c:10)",
+		0x80000004: "main+0x4 (test.c:10)",
+		0x8000000C: "main+0xc (test.c:12)",
+		0x80000010: "80000010",
+	}
+	for address, expected := range tests {
+		if actual := s.Lookup(address).String(); actual != expected {
+			t.Errorf("Lookup(%X) = %q, expected %q", address, actual, expected)
+		}
+	}
+
+	if actual := s.Describe(0x80000004); actual != "80000004 main+0x4 (test.c:10)" {
+		t.Errorf("Unexpected description %q", actual)
+	}
+}
+
+func TestLines(t *testing.T) {
+	s := New()
+	if err := s.AddDWARF(lineTestDWARF(t)); err != nil {
+		t.Fatalf("AddDWARF failed: %v", err)
+	}
+	s.AddLine(LineRange{Address: 0x1000, End: 0x1008, File: "/src/start.S", Line: 3})
+
+	expected := []LineRange{
+		{Address: 0x1000, End: 0x1008, File: "/src/start.S", Line: 3},
+		{Address: 0x80000000, End: 0x80000008, File: "/src/test.c", Line: 10},
+		{Address: 0x80000008, End: 0x80000010, File: "/src/test.c", Line: 12},
+	}
+	if lines := s.Lines(); !slices.Equal(lines, expected) {
+		t.Errorf("Expected lines %+v, got %+v", expected, lines)
+	}
+	if location := s.Lookup(0x1004); location.File != "start.S" ||
+		location.Path != "/src/start.S" {
+		t.Errorf("Unexpected location %+v", location)
+	}
+}
+
+func TestDescribe_NilSymbolizer(t *testing.T) {
+	var s *Symbolizer
+	if actual := s.Describe(0x1234); actual != "00001234" {
+		t.Errorf("Expected plain address, got %q", actual)
+	}
+}
+
+// stackMemory is a word-addressed guest memory for backtrace tests.
+type stackMemory map[uint32]uint32
+
+func (m stackMemory) readWord(address uint32) (uint32, error) {
+	value, ok := m[address]
+	if !ok {
+		return 0, fmt.Errorf("unmapped address %X", address)
+	}
+	return value, nil
+}
+
+func TestBacktrace(t *testing.T) {
+	// main (frame at 0x2000) calls f (frame at 0x1F00), which calls the
+	// leaf g (frame at 0x1E00).
+	memory := stackMemory{
+		0x1DFC: 0x1F00, // g: saved fp of f
+		0x1EFC: 0x1104, // f: return address into main
+		0x1EF8: 0x2000, // f: saved fp of main
+		0x1FFC: 0,      // main: no caller
+		0x1FF8: 0,
+	}
+
+	frames := Backtrace(0x1300, 0x1208, 0x1E00, memory.readWord, 10)
+	expected := []uint32{0x1300, 0x1208, 0x1104}
+	if !slices.Equal(frames, expected) {
+		t.Errorf("Expected frames %X, got %X", expected, frames)
+	}
+
+	frames = Backtrace(0x1300, 0x1208, 0x1E00, memory.readWord, 2)
+	if len(frames) != 2 {
+		t.Errorf("Expected 2 frames, got %X", frames)
+	}
+
+	frames = Backtrace(0x1300, 0x1208, 0, memory.readWord, 10)
+	if len(frames) != 1 {
+		t.Errorf("Expected only the PC without frame pointer, got %X", frames)
+	}
+}
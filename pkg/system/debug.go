@@ -0,0 +1,243 @@
+package system
+
+import (
+	"fmt"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+)
+
+// WatchKind selects the accesses that trigger a watchpoint.
+type WatchKind int
+
+const (
+	// WatchRead triggers on data reads.
+	WatchRead WatchKind = 1 << iota
+	// WatchWrite triggers on writes.
+	WatchWrite
+	// WatchAccess triggers on reads and writes.
+	WatchAccess = WatchRead | WatchWrite
+)
+
+// String returns the name of the watch kind.
+func (k WatchKind) String() string {
+	switch k {
+	case WatchRead:
+		return "read"
+	case WatchWrite:
+		return "write"
+	case WatchAccess:
+		return "access"
+	default:
+		return fmt.Sprintf("WatchKind(%d)", int(k))
+	}
+}
+
+// StopReason tells why Run returned before executing all steps.
+type StopReason int
+
+const (
+	// StopBreakpoint is reported when a hart reached a breakpoint.
+	StopBreakpoint StopReason = iota + 1
+	// StopWatchpoint is reported after an access hit a watchpoint.
+	StopWatchpoint
+	// StopPowerOff is reported after the guest powered the machine off.
+	StopPowerOff
+	// StopReset is reported after the guest requested a reset.
+	StopReset
+)
+
+// String returns the name of the stop reason.
+func (r StopReason) String() string {
+	switch r {
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopWatchpoint:
+		return "watchpoint"
+	case StopPowerOff:
+		return "power off"
+	case StopReset:
+		return "reset"
+	default:
+		return fmt.Sprintf("StopReason(%d)", int(r))
+	}
+}
+
+// Stop describes the breakpoint, watchpoint or power request that stopped
+// Run.
+type Stop struct {
+	Reason   StopReason
+	ID       int    // ID of the breakpoint or watchpoint
+	Hart     uint32 // Hart that hit it
+	Pc       uint32 // PC of the hart after stopping
+	ExitCode uint32 // Exit code of a power off, 0 for success
+	Steps    uint64 // Steps the first hart ran in Run before the stop
+
+	// The access that hit a watchpoint.
+	Address uint32
+	Value   byte
+	Write   bool
+}
+
+// String describes the stop, e.g. for the command line.
+func (s *Stop) String() string {
+	switch s.Reason {
+	case StopPowerOff:
+		return fmt.Sprintf("power off: exit code %d", s.ExitCode)
+	case StopReset:
+		return "reset requested"
+	case StopWatchpoint:
+		access := "read"
+		if s.Write {
+			access = "write"
+		}
+		return fmt.Sprintf("watchpoint %d: hart %d %s of %02X at %X, pc %X",
+			s.ID, s.Hart, access, s.Value, s.Address, s.Pc)
+	}
+	return fmt.Sprintf("breakpoint %d: hart %d at pc %X", s.ID, s.Hart, s.Pc)
+}
+
+// breakpoint stops a hart before it executes the instruction at pc.
+type breakpoint struct {
+	id        int
+	pc        uint32
+	condition func(*cpu.Core) bool // nil for unconditional breakpoints
+}
+
+// watchpoint stops a hart after it accessed an address range.
+type watchpoint struct {
+	id      int
+	address uint32
+	size    uint32
+	kind    WatchKind
+}
+
+// busWatcher reports accesses on the bus to the watchpoints of a System.
+type busWatcher struct {
+	s *System
+}
+
+// WatchAccess records the first access hitting a watchpoint and stops the
+// executing hart.
+func (w busWatcher) WatchAccess(address uint32, value byte, write bool) {
+	s := w.s
+	if s.hit != nil {
+		return
+	}
+	kind := WatchRead
+	if write {
+		kind = WatchWrite
+	}
+	for _, wp := range s.watchpoints {
+		if wp.kind&kind != 0 && address-wp.address < wp.size {
+			hart := s.harts[s.current]
+			s.hit = &Stop{
+				Reason:  StopWatchpoint,
+				ID:      wp.id,
+				Hart:    hart.GetHartID(),
+				Address: address,
+				Value:   value,
+				Write:   write,
+			}
+			hart.RequestStop()
+			return
+		}
+	}
+}
+
+// AddBreakpoint adds a breakpoint stopping Run before any hart executes the
+// instruction at pc, and returns its ID. This includes the instruction a
+// hart starts from and the entry of trap handlers. Calling Run again
+// executes the instruction the hart stopped at.
+func (s *System) AddBreakpoint(pc uint32) int {
+	return s.AddConditionalBreakpoint(pc, nil)
+}
+
+// AddConditionalBreakpoint adds a breakpoint like AddBreakpoint that only
+// stops if condition returns true for the hart that reached it. A nil
+// condition always stops.
+func (s *System) AddConditionalBreakpoint(pc uint32, condition func(*cpu.Core) bool) int {
+	s.nextID++
+	s.breakpoints = append(s.breakpoints, breakpoint{
+		id:        s.nextID,
+		pc:        pc,
+		condition: condition,
+	})
+	s.updateBreakpoints()
+	return s.nextID
+}
+
+// RemoveBreakpoint removes the breakpoint with the given ID. It returns
+// false if there is no such breakpoint.
+func (s *System) RemoveBreakpoint(id int) bool {
+	for i, b := range s.breakpoints {
+		if b.id == id {
+			s.breakpoints = append(s.breakpoints[:i], s.breakpoints[i+1:]...)
+			s.updateBreakpoints()
+			return true
+		}
+	}
+	return false
+}
+
+// updateBreakpoints passes the breakpoint addresses to every hart.
+func (s *System) updateBreakpoints() {
+	pcs := make([]uint32, len(s.breakpoints))
+	for i, b := range s.breakpoints {
+		pcs[i] = b.pc
+	}
+	for _, hart := range s.harts {
+		hart.SetBreakpoints(pcs)
+	}
+}
+
+// AddWatchpoint adds a watchpoint stopping Run after a hart accessed the
+// size bytes starting at address, and returns its ID. Instruction fetches
+// do not trigger watchpoints.
+func (s *System) AddWatchpoint(address, size uint32, kind WatchKind) int {
+	s.nextID++
+	s.watchpoints = append(s.watchpoints, watchpoint{
+		id:      s.nextID,
+		address: address,
+		size:    size,
+		kind:    kind,
+	})
+	s.bus.SetAccessWatcher(busWatcher{s})
+	return s.nextID
+}
+
+// RemoveWatchpoint removes the watchpoint with the given ID. It returns
+// false if there is no such watchpoint.
+func (s *System) RemoveWatchpoint(id int) bool {
+	for i, wp := range s.watchpoints {
+		if wp.id == id {
+			s.watchpoints = append(s.watchpoints[:i], s.watchpoints[i+1:]...)
+			if len(s.watchpoints) == 0 {
+				s.bus.SetAccessWatcher(nil)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// stopped returns the breakpoint or watchpoint that made the hart stop, or
+// nil if execution continues because no breakpoint condition is true.
+func (s *System) stopped(hart *cpu.Core) *Stop {
+	if stop := s.hit; stop != nil {
+		s.hit = nil
+		stop.Pc = hart.GetPc()
+		return stop
+	}
+	pc := hart.GetPc()
+	for _, b := range s.breakpoints {
+		if b.pc == pc && (b.condition == nil || b.condition(hart)) {
+			return &Stop{
+				Reason: StopBreakpoint,
+				ID:     b.id,
+				Hart:   hart.GetHartID(),
+				Pc:     pc,
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package system
+
+import (
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+)
+
+func TestRun_Breakpoint(t *testing.T) {
+	for _, engine := range []cpu.Engine{cpu.EngineInterpreter, cpu.EngineBlock} {
+		t.Run(engine.String(), func(t *testing.T) {
+			sys := NewSystem(false)
+			sys.Core().SetEngine(engine)
+			loadProgram(t, sys, spinlockProgram)
+			id := sys.AddBreakpoint(RAMOffset + 0x2C) // ADDI x9, x9, 1
+
+			for i := uint32(0); i < 3; i++ {
+				stop, err := sys.Run(0)
+				if err != nil {
+					t.Fatalf("Run failed: %v", err)
+				}
+				if stop == nil || stop.Reason != StopBreakpoint || stop.ID != id {
+					t.Fatalf("Expected breakpoint %d, got %v", id, stop)
+				}
+				if stop.Pc != RAMOffset+0x2C || sys.Core().GetPc() != stop.Pc {
+					t.Errorf("Expected stop at %X, got %X", RAMOffset+0x2C,
+						stop.Pc)
+				}
+				if x9 := sys.Core().GetRegister(9); x9 != i {
+					t.Errorf("Expected x9 to be %d, got %d", i, x9)
+				}
+			}
+
+			if !sys.RemoveBreakpoint(id) {
+				t.Fatal("Expected breakpoint to be removed")
+			}
+			stop, err := sys.Run(1000)
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if stop != nil {
+				t.Errorf("Expected no stop, got %v", stop)
+			}
+			if sys.RemoveBreakpoint(id) {
+				t.Error("Expected removing a removed breakpoint to fail")
+			}
+		})
+	}
+}
+
+func TestRun_ConditionalBreakpoint(t *testing.T) {
+	sys := NewSystemWithHarts(false, 2)
+	sys.SetScheduling(ScheduleRoundRobin, 5)
+	loadProgram(t, sys, spinlockProgram)
+	id := sys.AddConditionalBreakpoint(RAMOffset+0x2C, func(core *cpu.Core) bool {
+		return core.GetHartID() == 1 && core.GetRegister(9) == 10
+	})
+
+	stop, err := sys.Run(0)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stop == nil || stop.ID != id || stop.Hart != 1 {
+		t.Fatalf("Expected breakpoint %d on hart 1, got %v", id, stop)
+	}
+	if x9 := sys.Harts()[1].GetRegister(9); x9 != 10 {
+		t.Errorf("Expected x9 to be 10, got %d", x9)
+	}
+}
+
+func TestRun_Watchpoint(t *testing.T) {
+	tests := []struct {
+		kind  WatchKind
+		pc    uint32 // PC after the access
+		write bool
+	}{
+		{WatchWrite, RAMOffset + 0x28, true},
+		{WatchRead, RAMOffset + 0x20, false},
+		{WatchAccess, RAMOffset + 0x20, false},
+	}
+	for _, test := range tests {
+		t.Run(test.kind.String(), func(t *testing.T) {
+			sys := NewSystemWithHarts(false, 2)
+			sys.SetScheduling(ScheduleRoundRobin, 3)
+			loadProgram(t, sys, spinlockProgram)
+			id := sys.AddWatchpoint(0x80001004, 1, test.kind)
+			// The bytes after the counter are never accessed.
+			sys.AddWatchpoint(0x80001005, 3, test.kind)
+
+			stop, err := sys.Run(0)
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if stop == nil || stop.Reason != StopWatchpoint || stop.ID != id {
+				t.Fatalf("Expected watchpoint %d, got %v", id, stop)
+			}
+			if stop.Address != 0x80001004 || stop.Write != test.write {
+				t.Errorf("Unexpected access %X (write %v)", stop.Address,
+					stop.Write)
+			}
+			if stop.Pc != test.pc {
+				t.Errorf("Expected stop at %X, got %X", test.pc, stop.Pc)
+			}
+			if pc := sys.Harts()[stop.Hart].GetPc(); pc != stop.Pc {
+				t.Errorf("Expected hart %d at %X, got %X", stop.Hart, stop.Pc, pc)
+			}
+		})
+	}
+}
+
+func TestRun_DebugParallelUnsupported(t *testing.T) {
+	sys := NewSystemWithHarts(false, 2)
+	sys.SetScheduling(ScheduleParallel, 0)
+	loadProgram(t, sys, spinlockProgram)
+	sys.AddBreakpoint(RAMOffset)
+
+	if _, err := sys.Run(100); err == nil {
+		t.Error("Expected error for breakpoints in parallel mode, got nil")
+	}
+}
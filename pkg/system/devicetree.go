@@ -0,0 +1,107 @@
+package system
+
+import (
+	"fmt"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+	"github.com/Keisim/go-riscv-emu/pkg/fdt"
+)
+
+// DeviceTree returns a device tree describing the harts and the devices on
+// the bus, with the given kernel command line in /chosen. Every device
+// implementing devices.DeviceTreeDevice adds its own node; other devices
+// are left out.
+func (s *System) DeviceTree(bootargs string) *fdt.Node {
+	tree := devices.NewDeviceTree(len(s.harts), s.bus.Devices())
+	tree.Root.SetStrings("compatible", "keisim,go-riscv-emu")
+	tree.Root.SetString("model", "go-riscv-emu")
+	tree.CPUs.SetU32("timebase-frequency", devices.DefaultTimebaseFrequency)
+	for i, hart := range s.harts {
+		cpu := tree.CPUs.AddChild(fdt.NewNode(fmt.Sprintf("cpu@%d", i)))
+		cpu.SetString("device_type", "cpu")
+		cpu.SetU32("reg", hart.GetHartID())
+		cpu.SetString("status", "okay")
+		cpu.SetStrings("compatible", "riscv")
+		cpu.SetString("riscv,isa", hart.GetExtensions().String())
+
+		intc := cpu.AddChild(fdt.NewNode("interrupt-controller"))
+		intc.SetU32("#interrupt-cells", 1)
+		intc.SetEmpty("interrupt-controller")
+		intc.SetStrings("compatible", "riscv,cpu-intc")
+		intc.SetU32("phandle", tree.CPUInterruptController(i))
+	}
+
+	for _, device := range s.bus.Devices() {
+		if device, ok := device.(devices.DeviceTreeDevice); ok {
+			device.AddToDeviceTree(tree)
+		}
+	}
+	tree.Root.SortChildren()
+	tree.SoC.SortChildren()
+
+	chosen := tree.Root.AddChild(fdt.NewNode("chosen"))
+	if bootargs != "" {
+		chosen.SetString("bootargs", bootargs)
+	}
+	if tree.StdoutPath != "" {
+		chosen.SetString("stdout-path", tree.StdoutPath)
+	}
+	return tree.Root
+}
+
+// DeviceTreeBlob returns the device tree of DeviceTree as a flattened
+// device tree blob.
+func (s *System) DeviceTreeBlob(bootargs string) []byte {
+	return fdt.Blob(s.DeviceTree(bootargs), s.harts[0].GetHartID(), nil)
+}
+
+// LoadDeviceTree writes the device tree blob of DeviceTreeBlob to the end
+// of the first RAM device and passes it to the harts, see
+// LoadDeviceTreeBlob.
+func (s *System) LoadDeviceTree(bootargs string) (uint32, error) {
+	return s.LoadDeviceTreeBlob(s.DeviceTreeBlob(bootargs))
+}
+
+// LoadDeviceTreeBlob writes a device tree blob to the end of the first RAM
+// device and passes it to the harts as a boot loader would: a0 holds the
+// hart ID and a1 the address of the blob, which is returned.
+func (s *System) LoadDeviceTreeBlob(blob []byte) (uint32, error) {
+	address, err := s.topOfRAM(uint32(len(blob)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to place device tree: %v", err)
+	}
+	if err := s.writeBytes(address, blob); err != nil {
+		return 0, fmt.Errorf("failed to load device tree: %v", err)
+	}
+	for _, hart := range s.harts {
+		hart.SetRegister(10, hart.GetHartID())
+		hart.SetRegister(11, address)
+	}
+	return address, nil
+}
+
+// topOfRAM returns the highest 8-byte aligned address of the first RAM
+// device that size bytes fit at.
+func (s *System) topOfRAM(size uint32) (uint32, error) {
+	for _, device := range s.bus.Devices() {
+		if ram, ok := device.(*devices.RAMDevice); ok {
+			if size > ram.Size() {
+				return 0, fmt.Errorf("%d bytes do not fit in RAM of %d bytes",
+					size, ram.Size())
+			}
+			return (ram.BaseAddress() + ram.Size() - size) &^ 7, nil
+		}
+	}
+	return 0, fmt.Errorf("machine has no RAM")
+}
+
+// writeBytes writes data to the bus, so that caches observing it see the
+// change.
+func (s *System) writeBytes(address uint32, data []byte) error {
+	for i, value := range data {
+		if err := s.bus.Write(address+uint32(i), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
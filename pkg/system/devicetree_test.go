@@ -0,0 +1,99 @@
+package system
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/fdt"
+)
+
+func TestLoadDeviceTree(t *testing.T) {
+	config, err := LoadMachineConfig("../../misc/machines/virt.json")
+	if err != nil {
+		t.Fatalf("LoadMachineConfig failed: %v", err)
+	}
+	config.Harts = 2
+	config.Devices[1].Params = []byte(`{"harts": 2}`)
+	sys, err := NewMachine(config)
+	if err != nil {
+		t.Fatalf("NewMachine failed: %v", err)
+	}
+
+	address, err := sys.LoadDeviceTree("console=ttyS0")
+	if err != nil {
+		t.Fatalf("LoadDeviceTree failed: %v", err)
+	}
+	if address%8 != 0 || address < RAMOffset {
+		t.Errorf("Unexpected device tree address %X", address)
+	}
+	for i, hart := range sys.Harts() {
+		if hart.GetRegister(10) != uint32(i) || hart.GetRegister(11) != address {
+			t.Errorf("Expected a0=%d and a1=%X on hart %d, got %X and %X", i,
+				address, i, hart.GetRegister(10), hart.GetRegister(11))
+		}
+	}
+
+	blob := make([]byte, RAMOffset+0x10000000-address)
+	for i := range blob {
+		blob[i], _ = sys.Bus().Read(address + uint32(i))
+	}
+	root, err := fdt.Parse(blob)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	strings := map[string]string{
+		"/cpus/cpu@1/riscv,isa":           "rv32ia_zicsr_zifencei",
+		"/memory@80000000/device_type":    "memory",
+		"/soc/serial@10000000/compatible": "ns16550a",
+		"/soc/rtc@101000/compatible":      "google,goldfish-rtc",
+		"/poweroff/compatible":            "syscon-poweroff",
+		"/chosen/bootargs":                "console=ttyS0",
+		"/chosen/stdout-path":             "/soc/serial@10000000",
+	}
+	for path, expected := range strings {
+		node, name := lookupProperty(t, root, path)
+		if value, _ := node.String(name); value != expected {
+			t.Errorf("Expected %s = %q, got %q", path, expected, value)
+		}
+	}
+
+	intc0, _ := root.Lookup("/cpus/cpu@0/interrupt-controller").U32("phandle")
+	intc1, _ := root.Lookup("/cpus/cpu@1/interrupt-controller").U32("phandle")
+	plic, _ := root.Lookup("/soc/plic@c000000").U32("phandle")
+	test, _ := root.Lookup("/soc/test@100000").U32("phandle")
+	cells := map[string][]uint32{
+		"/cpus/timebase-frequency":               {10000000},
+		"/memory@80000000/reg":                   {0x80000000, 0x10000000},
+		"/soc/clint@2000000/interrupts-extended": {intc0[0], 3, intc0[0], 7, intc1[0], 3, intc1[0], 7},
+		"/soc/plic@c000000/interrupts-extended":  {intc0[0], 11, intc0[0], 9, intc1[0], 11, intc1[0], 9},
+		"/soc/plic@c000000/riscv,ndev":           {31},
+		"/soc/serial@10000000/interrupt-parent":  plic,
+		"/soc/serial@10000000/interrupts":        {10},
+		"/soc/rtc@101000/interrupts":             {11},
+		"/poweroff/regmap":                       test,
+		"/poweroff/value":                        {0x5555},
+		"/reboot/value":                          {0x7777},
+	}
+	for path, expected := range cells {
+		node, name := lookupProperty(t, root, path)
+		if value, _ := node.U32(name); !slices.Equal(value, expected) {
+			t.Errorf("Expected %s = %v, got %v", path, expected, value)
+		}
+	}
+}
+
+// lookupProperty returns the node holding the property at the given path
+// and the name of the property.
+func lookupProperty(t *testing.T, root *fdt.Node, path string) (*fdt.Node, string) {
+	t.Helper()
+	i := len(path) - 1
+	for path[i] != '/' {
+		i--
+	}
+	node := root.Lookup(path[:i])
+	if node == nil {
+		t.Fatalf("Node %s not found", path[:i])
+	}
+	return node, path[i+1:]
+}
@@ -0,0 +1,434 @@
+package system
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+	"github.com/Keisim/go-riscv-emu/pkg/replay"
+)
+
+// DefaultCheckpointInterval is the number of instructions between two
+// checkpoints of the execution history.
+const DefaultCheckpointInterval = 1 << 24
+
+// DefaultMaxCheckpoints is the number of checkpoints the execution history
+// keeps before it thins them out.
+const DefaultMaxCheckpoints = 64
+
+// ErrHistoryStart is returned by reverse execution when it reaches the
+// oldest point of the execution history.
+var ErrHistoryStart = errors.New("reached the start of the execution history")
+
+// checkpoint is a snapshot of the system taken during forward execution.
+type checkpoint struct {
+	position uint64
+	state    []byte
+	events   int // Host inputs consumed before the checkpoint
+}
+
+// scheduleChange is a hart switch of the round-robin scheduler that did not
+// happen at the end of a quantum.
+type scheduleChange struct {
+	position uint64
+	current  int
+	used     uint64
+}
+
+// history holds what reverse execution needs to reproduce any earlier
+// position: periodic checkpoints, every host input and every hart switch
+// not implied by the quantum. It intercepts host input reads and the
+// interrupts of the harts, so that re-execution sees the inputs of the
+// original run.
+type history struct {
+	interval    uint64
+	max         int // Checkpoints kept before thinning them out
+	checkpoints []checkpoint
+	schedule    []scheduleChange
+	events      []replay.Event
+	next        int    // Next event returned to the guest
+	end         uint64 // Position up to which the events are complete
+	inner       inputInterceptor
+	clock       replay.Clock
+	position    func() uint64
+}
+
+// InterceptRead returns the recorded value while re-executing and reads
+// the device otherwise.
+func (h *history) InterceptRead(device devices.BusDevice, address uint32) (byte, error) {
+	hart, instret := h.clock()
+	if h.next < len(h.events) {
+		event := h.events[h.next]
+		if event.Kind == replay.EventRead && event.Hart == hart &&
+			event.Instret == instret && event.Address == address {
+			h.next++
+			return event.Value, nil
+		}
+		// Execution left the recorded path, e.g. because registers were
+		// modified, so the remaining inputs do not apply anymore.
+		h.events = h.events[:h.next]
+		h.end = h.position()
+	}
+
+	var value byte
+	var err error
+	if h.inner != nil {
+		value, err = h.inner.InterceptRead(device, address)
+	} else {
+		value, err = device.Read(address)
+	}
+	if err != nil {
+		return 0, err
+	}
+	h.events = append(h.events, replay.Event{
+		Kind:    replay.EventRead,
+		Value:   value,
+		Hart:    hart,
+		Instret: instret,
+		Address: address,
+	})
+	h.next++
+	return value, nil
+}
+
+// InterceptInterrupts returns the recorded interrupts while re-executing
+// the positions executed before, and the interrupts of the devices beyond
+// them, recording their changes.
+func (h *history) InterceptInterrupts(live, last uint32) (uint32, error) {
+	hart, instret := h.clock()
+	if h.next < len(h.events) {
+		event := h.events[h.next]
+		if event.Kind == replay.EventInterrupt && event.Hart == hart &&
+			event.Instret == instret {
+			h.next++
+			return event.Pending, nil
+		}
+	}
+	if h.position() < h.end {
+		return last, nil
+	}
+
+	pending := live
+	if h.inner != nil {
+		var err error
+		pending, err = h.inner.InterceptInterrupts(live, last)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if pending != last {
+		h.events = append(h.events[:h.next], replay.Event{
+			Kind:    replay.EventInterrupt,
+			Hart:    hart,
+			Instret: instret,
+			Pending: pending,
+		})
+		h.next++
+	}
+	return pending, nil
+}
+
+// recordSchedule records the scheduler state after a hart switch at the
+// given position. Only the last switch at a position is kept.
+func (h *history) recordSchedule(position uint64, current int, used uint64) {
+	if n := len(h.schedule); n > 0 && h.schedule[n-1].position == position {
+		h.schedule = h.schedule[:n-1]
+	}
+	h.schedule = append(h.schedule, scheduleChange{
+		position: position,
+		current:  current,
+		used:     used,
+	})
+}
+
+// last returns the newest checkpoint.
+func (h *history) last() checkpoint {
+	return h.checkpoints[len(h.checkpoints)-1]
+}
+
+// Position returns the number of instructions retired by all harts
+// together. It identifies a point in the execution history.
+func (s *System) Position() uint64 {
+	var position uint64
+	for _, hart := range s.harts {
+		position += hart.GetInstret()
+	}
+	return position
+}
+
+// EnableHistory starts recording an execution history for ReverseStep and
+// ReverseContinue, with a checkpoint every interval instructions. The
+// history starts at the current position. Every checkpoint holds a full
+// snapshot, so all devices have to support snapshots and shorter intervals
+// trade memory for faster reverse execution.
+//
+// At most DefaultMaxCheckpoints checkpoints are kept, see
+// SetMaxCheckpoints.
+//
+// Reverse execution requires round-robin scheduling. An input log has to be
+// recorded or replayed before the history is enabled, and loading a
+// snapshot invalidates the history.
+func (s *System) EnableHistory(interval uint64) error {
+	if s.mode == ScheduleParallel && len(s.harts) > 1 {
+		return fmt.Errorf("reverse execution requires round-robin scheduling")
+	}
+	if interval == 0 {
+		interval = DefaultCheckpointInterval
+	}
+	h := &history{
+		interval: interval,
+		max:      DefaultMaxCheckpoints,
+		end:      s.Position(),
+		inner:    s.inputLog,
+		clock:    s.inputClock,
+		position: s.Position,
+	}
+	s.history = h
+	if err := s.takeCheckpoint(); err != nil {
+		s.history = nil
+		return err
+	}
+	s.setInputInterceptor(h)
+	return nil
+}
+
+// DisableHistory drops the execution history.
+func (s *System) DisableHistory() {
+	if s.history == nil {
+		return
+	}
+	s.setInputInterceptor(s.history.inner)
+	s.history = nil
+}
+
+// SetMaxCheckpoints limits the number of checkpoints of the execution
+// history, at least 2. Once there are more, every second checkpoint
+// between the oldest and the newest one is dropped, so that older positions
+// are reached by re-executing from sparser checkpoints.
+func (s *System) SetMaxCheckpoints(limit int) error {
+	if s.history == nil {
+		return fmt.Errorf("execution history is not enabled")
+	}
+	if limit < 2 {
+		return fmt.Errorf("the execution history needs at least 2 checkpoints, got %d", limit)
+	}
+	s.history.max = limit
+	s.history.thin()
+	return nil
+}
+
+// thin drops every second checkpoint but the oldest and the newest one
+// until at most max checkpoints are left. The oldest checkpoint is the
+// start of the history.
+func (h *history) thin() {
+	for len(h.checkpoints) > h.max {
+		old := h.checkpoints
+		kept := old[:1]
+		for i := 2; i < len(old)-1; i += 2 {
+			kept = append(kept, old[i])
+		}
+		h.checkpoints = append(kept, old[len(old)-1])
+		// Release the states of the dropped checkpoints.
+		clear(old[len(h.checkpoints):])
+	}
+}
+
+// takeCheckpoint appends a checkpoint at the current position.
+func (s *System) takeCheckpoint() error {
+	var state bytes.Buffer
+	if err := s.SaveSnapshot(&state); err != nil {
+		return fmt.Errorf("failed to take checkpoint: %v", err)
+	}
+	s.history.checkpoints = append(s.history.checkpoints, checkpoint{
+		position: s.Position(),
+		state:    state.Bytes(),
+		events:   s.history.next,
+	})
+	s.history.thin()
+	return nil
+}
+
+// untilCheckpoint limits the number of instructions executed next so that
+// execution stops at the position of the next checkpoint.
+func (s *System) untilCheckpoint(steps uint64) uint64 {
+	if s.history == nil {
+		return steps
+	}
+	next := s.history.last().position + s.history.interval
+	return max(min(steps, next-s.Position()), 1)
+}
+
+// checkpoint takes a checkpoint if one is due. It is called after forward
+// execution, which completes the events up to the current position.
+func (s *System) checkpoint() error {
+	if s.history == nil {
+		return nil
+	}
+	s.history.end = max(s.history.end, s.Position())
+	if s.Position() < s.history.last().position+s.history.interval {
+		return nil
+	}
+	return s.takeCheckpoint()
+}
+
+// restore resets the system to a checkpoint.
+func (s *System) restore(c checkpoint) error {
+	if err := s.LoadSnapshot(bytes.NewReader(c.state)); err != nil {
+		return fmt.Errorf("failed to restore checkpoint: %v", err)
+	}
+	s.history.next = c.events
+	s.applySchedule()
+	return nil
+}
+
+// scheduleAt returns the index of the first recorded hart switch at or
+// after the position.
+func (h *history) scheduleAt(position uint64) int {
+	return sort.Search(len(h.schedule), func(i int) bool {
+		return h.schedule[i].position >= position
+	})
+}
+
+// applySchedule applies the recorded hart switch at the current position.
+func (s *System) applySchedule() {
+	position := s.Position()
+	i := s.history.scheduleAt(position)
+	if i < len(s.history.schedule) && s.history.schedule[i].position == position {
+		s.current = s.history.schedule[i].current
+		s.used = s.history.schedule[i].used
+	}
+}
+
+// runTo re-executes up to the given position, following the hart switches
+// of the original run. Breakpoints and watchpoints are ignored. Unless each
+// is nil, it is called at the current position and after every instruction
+// retired before the target, in a single pass over the interval.
+func (s *System) runTo(target uint64, each func(position uint64)) error {
+	if each != nil && s.Position() < target {
+		tracer := &positionTracer{position: s.Position(), target: target, each: each}
+		for _, hart := range s.harts {
+			defer hart.SetTracer(hart.GetTracer())
+			hart.AddTracer(tracer)
+		}
+		each(tracer.position)
+	}
+
+	for position := s.Position(); position < target; position = s.Position() {
+		budget := min(s.quantum-s.used, target-position)
+		if i := s.history.scheduleAt(position + 1); i < len(s.history.schedule) {
+			budget = min(budget, s.history.schedule[i].position-position)
+		}
+		hart := s.harts[s.current]
+		executed, err := cpu.Run(hart, budget)
+		s.used += executed
+		s.hit = nil
+		if err != nil && !errors.Is(err, cpu.ErrStopped) {
+			return s.hartError(hart, err)
+		}
+		if s.used >= s.quantum {
+			s.nextHart()
+		}
+		s.applySchedule()
+	}
+	return nil
+}
+
+// positionTracer follows the position during re-execution and calls each
+// at every position before the target.
+type positionTracer struct {
+	position uint64
+	target   uint64
+	each     func(position uint64)
+}
+
+// TraceInstruction advances the position by the retired instruction.
+func (t *positionTracer) TraceInstruction(*cpu.Core, cpu.TraceEvent) {
+	t.position++
+	if t.position < t.target {
+		t.each(t.position)
+	}
+}
+
+// seek moves the system to an earlier position by restoring the nearest
+// checkpoint before it and re-executing forward. Checkpoints and hart
+// switches past the position are dropped, since execution may take a
+// different path from there on.
+func (s *System) seek(target uint64) error {
+	h := s.history
+	i := len(h.checkpoints) - 1
+	for i > 0 && h.checkpoints[i].position > target {
+		i--
+	}
+	h.checkpoints = h.checkpoints[:i+1]
+	if err := s.restore(h.checkpoints[i]); err != nil {
+		return err
+	}
+	if err := s.runTo(target, nil); err != nil {
+		return err
+	}
+	j := len(h.schedule)
+	for j > 0 && h.schedule[j-1].position > target {
+		j--
+	}
+	h.schedule = h.schedule[:j]
+	return nil
+}
+
+// ReverseStep undoes the last instruction executed, moving the system to
+// the position before it. It returns ErrHistoryStart if the system is at
+// the start of the execution history.
+func (s *System) ReverseStep() error {
+	if s.history == nil {
+		return fmt.Errorf("execution history is not enabled")
+	}
+	position := s.Position()
+	if position <= s.history.checkpoints[0].position {
+		return ErrHistoryStart
+	}
+	return s.seek(position - 1)
+}
+
+// ReverseContinue executes backwards until stop reports true, moving the
+// system to the latest earlier position at which stop is true. If there is
+// none, the system is moved to the start of the execution history and
+// ErrHistoryStart is returned.
+func (s *System) ReverseContinue(stop func(*System) bool) error {
+	if s.history == nil {
+		return fmt.Errorf("execution history is not enabled")
+	}
+	h := s.history
+	end := s.Position()
+	for i := len(h.checkpoints) - 1; i >= 0; i-- {
+		start := h.checkpoints[i].position
+		if start >= end {
+			continue
+		}
+		if err := s.restore(h.checkpoints[i]); err != nil {
+			return err
+		}
+
+		found := false
+		var match uint64
+		err := s.runTo(end, func(position uint64) {
+			if stop(s) {
+				found = true
+				match = position
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if found {
+			return s.seek(match)
+		}
+		end = start
+	}
+
+	if err := s.seek(h.checkpoints[0].position); err != nil {
+		return err
+	}
+	return ErrHistoryStart
+}
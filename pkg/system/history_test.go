@@ -0,0 +1,228 @@
+package system
+
+import (
+	"errors"
+	"testing"
+)
+
+// dataPage returns the bytes the test programs write.
+func dataPage(t *testing.T, sys *System) [8]byte {
+	t.Helper()
+	var data [8]byte
+	for i := range data {
+		value, err := sys.Bus().Read(0x80001000 + uint32(i))
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		data[i] = value
+	}
+	return data
+}
+
+func TestReverseContinue_Positions(t *testing.T) {
+	sys := NewSystemWithHarts(false, 3)
+	sys.SetScheduling(ScheduleRoundRobin, 4)
+	loadProgram(t, sys, spinlockProgram)
+	if err := sys.EnableHistory(50); err != nil {
+		t.Fatalf("EnableHistory failed: %v", err)
+	}
+
+	// Run calls of different lengths switch harts before the end of their
+	// quantum, which re-execution has to reproduce.
+	states := map[uint64]string{}
+	var positions []uint64
+	for _, steps := range []uint64{1, 7, 30, 2, 61, 13, 5} {
+		if _, err := sys.Run(steps); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		states[sys.Position()] = systemState(t, sys)
+		positions = append(positions, sys.Position())
+	}
+
+	for i := len(positions) - 2; i >= 0; i-- {
+		target := positions[i]
+		err := sys.ReverseContinue(func(s *System) bool {
+			return s.Position() == target
+		})
+		if err != nil {
+			t.Fatalf("ReverseContinue to %d failed: %v", target, err)
+		}
+		if sys.Position() != target {
+			t.Fatalf("Expected position %d, got %d", target, sys.Position())
+		}
+		if systemState(t, sys) != states[target] {
+			t.Errorf("Expected state at position %d to match the original run",
+				target)
+		}
+	}
+}
+
+func TestReverseStep_Crash(t *testing.T) {
+	sys := NewSystem(false)
+	loadProgram(t, sys, []uint32{
+		0x80001<<12 | 5<<7 | 0b0110111,   // LUI x5, 0x80001
+		addi(6, 0, 42),                   // ADDI x6, x0, 42
+		sType(0b0100011, 0b000, 5, 6, 0), // SB x6, 0(x5)
+		0xFFFFFFFF,
+	})
+	if err := sys.EnableHistory(2); err != nil {
+		t.Fatalf("EnableHistory failed: %v", err)
+	}
+
+	if _, err := sys.Run(0); err == nil {
+		t.Fatal("Expected error for unsupported instruction, got nil")
+	}
+
+	// Step back over the store that wrote the memory.
+	for i := 0; i < 2; i++ {
+		if err := sys.ReverseStep(); err != nil {
+			t.Fatalf("ReverseStep failed: %v", err)
+		}
+	}
+	if pc := sys.Core().GetPc(); pc != RAMOffset+4 {
+		t.Errorf("Expected PC %X, got %X", RAMOffset+4, pc)
+	}
+	value, err := sys.Bus().Read(0x80001000)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if value != 0 {
+		t.Errorf("Expected the store to be undone, got %d", value)
+	}
+
+	err = sys.ReverseContinue(func(s *System) bool { return false })
+	if !errors.Is(err, ErrHistoryStart) {
+		t.Errorf("Expected ErrHistoryStart, got %v", err)
+	}
+	if sys.Position() != 0 {
+		t.Errorf("Expected position 0, got %d", sys.Position())
+	}
+	if err := sys.ReverseStep(); !errors.Is(err, ErrHistoryStart) {
+		t.Errorf("Expected ErrHistoryStart, got %v", err)
+	}
+}
+
+func TestReverse_HostInputs(t *testing.T) {
+	sys, device := newInputSystem(t, 0)
+	if err := sys.EnableHistory(40); err != nil {
+		t.Fatalf("EnableHistory failed: %v", err)
+	}
+	if _, err := sys.Run(100); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	expected := dataPage(t, sys)
+	reads := device.reads
+
+	// Go back to where hart 0 has copied two bytes and run forward again.
+	err := sys.ReverseContinue(func(s *System) bool {
+		return s.Harts()[0].GetRegister(9) == 2
+	})
+	if err != nil {
+		t.Fatalf("ReverseContinue failed: %v", err)
+	}
+	if sys.Harts()[0].GetRegister(9) != 2 {
+		t.Fatalf("Expected x9 to be 2, got %d", sys.Harts()[0].GetRegister(9))
+	}
+	if _, err := sys.Run(100); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if actual := dataPage(t, sys); actual != expected {
+		t.Errorf("Expected re-executed run to see the original inputs")
+	}
+	if device.reads != reads {
+		t.Errorf("Expected no further device reads, got %d", device.reads-reads)
+	}
+}
+
+func TestReverse_Interrupts(t *testing.T) {
+	sys, line := newInterruptSystem(t)
+	if err := sys.EnableHistory(40); err != nil {
+		t.Fatalf("EnableHistory failed: %v", err)
+	}
+	runInterrupted(t, sys, line)
+	if taken := sys.Harts()[0].GetRegister(20); taken != 2 {
+		t.Fatalf("Expected 2 interrupts taken, got %d", taken)
+	}
+	end := sys.Position()
+
+	// Go back to before the first interrupt and run forward again, with the
+	// line low as the handler left it.
+	err := sys.ReverseContinue(func(s *System) bool {
+		return s.Harts()[0].GetRegister(20) == 0
+	})
+	if err != nil {
+		t.Fatalf("ReverseContinue failed: %v", err)
+	}
+	if err := sys.seek(end); err != nil {
+		t.Fatalf("seek failed: %v", err)
+	}
+
+	if taken := sys.Harts()[0].GetRegister(20); taken != 2 {
+		t.Errorf("Expected re-execution to take the 2 interrupts, got %d", taken)
+	}
+}
+
+func TestEnableHistory_Parallel(t *testing.T) {
+	sys := NewSystemWithHarts(false, 2)
+	sys.SetScheduling(ScheduleParallel, 0)
+
+	if err := sys.EnableHistory(0); err == nil {
+		t.Error("Expected error for reverse execution in parallel mode, got nil")
+	}
+}
+
+func TestHistory_MaxCheckpoints(t *testing.T) {
+	sys := NewSystemWithHarts(false, 3)
+	sys.SetScheduling(ScheduleRoundRobin, 4)
+	loadProgram(t, sys, spinlockProgram)
+	if err := sys.SetMaxCheckpoints(4); err == nil {
+		t.Error("Expected error without a history, got nil")
+	}
+	if err := sys.EnableHistory(10); err != nil {
+		t.Fatalf("EnableHistory failed: %v", err)
+	}
+	if err := sys.SetMaxCheckpoints(1); err == nil {
+		t.Error("Expected error for a single checkpoint, got nil")
+	}
+	if err := sys.SetMaxCheckpoints(3); err != nil {
+		t.Fatalf("SetMaxCheckpoints failed: %v", err)
+	}
+
+	states := map[uint64]string{}
+	var positions []uint64
+	for range 8 {
+		if _, err := sys.Run(11); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		states[sys.Position()] = systemState(t, sys)
+		positions = append(positions, sys.Position())
+
+		checkpoints := sys.history.checkpoints
+		if len(checkpoints) > 3 {
+			t.Fatalf("Expected at most 3 checkpoints, got %d", len(checkpoints))
+		}
+		if checkpoints[0].position != 0 {
+			t.Fatalf("Expected the start of the history kept, got position %d",
+				checkpoints[0].position)
+		}
+		if newest := checkpoints[len(checkpoints)-1].position; sys.Position()-newest >= 10 {
+			t.Fatalf("Expected the newest checkpoint kept, got position %d at %d",
+				newest, sys.Position())
+		}
+	}
+
+	// The positions of dropped checkpoints are re-executed from older ones.
+	for _, target := range []uint64{positions[5], positions[1]} {
+		err := sys.ReverseContinue(func(s *System) bool {
+			return s.Position() == target
+		})
+		if err != nil {
+			t.Fatalf("ReverseContinue to %d failed: %v", target, err)
+		}
+		if systemState(t, sys) != states[target] {
+			t.Errorf("Expected state at position %d to match the original run",
+				target)
+		}
+	}
+}
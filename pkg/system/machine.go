@@ -0,0 +1,285 @@
+package system
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+// MachineConfig describes the harts and the memory map of a System, e.g.
+//
+//	{
+//	  "harts": 2,
+//	  "isa": "rv32ia_zicsr_zifencei",
+//	  "devices": [
+//	    {"type": "ram", "base": "0x80000000", "size": "256M"},
+//	    {"type": "dummy-tty", "base": "0x10000000"}
+//	  ]
+//	}
+type MachineConfig struct {
+	Harts   int            `json:"harts"` // 1 if unset
+	ISA     string         `json:"isa"`   // All implemented extensions if unset
+	Devices []DeviceConfig `json:"devices"`
+
+	// validated holds the devices built by Validate until NewMachine
+	// takes them.
+	validated *machineBuild
+}
+
+// machineBuild holds the devices and extensions built from a copy of a
+// configuration.
+type machineBuild struct {
+	config     MachineConfig
+	devices    []devices.BusDevice
+	extensions cpu.Extensions
+}
+
+// DeviceConfig describes a device of a machine. Base and size accept JSON
+// numbers as well as strings in any Go integer syntax, e.g. "0x80000000",
+// with an optional K, M or G suffix for sizes.
+type DeviceConfig struct {
+	Type   string          `json:"type"` // Registered device type, see devices.Types
+	Base   uint32          `json:"base"`
+	Size   uint32          `json:"size"`   // 0 selects the default size of the type
+	Params json.RawMessage `json:"params"` // Device-specific parameters
+}
+
+// UnmarshalJSON decodes a device, parsing base and size.
+func (d *DeviceConfig) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Type   string          `json:"type"`
+		Base   json.RawMessage `json:"base"`
+		Size   json.RawMessage `json:"size"`
+		Params json.RawMessage `json:"params"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+	if raw.Base == nil {
+		return fmt.Errorf("device %q has no base address", raw.Type)
+	}
+	base, err := parseConfigNumber(raw.Base)
+	if err != nil {
+		return fmt.Errorf("invalid base address of device %q: %v", raw.Type, err)
+	}
+	var size uint32
+	if raw.Size != nil {
+		size, err = parseConfigNumber(raw.Size)
+		if err != nil {
+			return fmt.Errorf("invalid size of device %q: %v", raw.Type, err)
+		}
+	}
+	*d = DeviceConfig{Type: raw.Type, Base: base, Size: size, Params: raw.Params}
+	return nil
+}
+
+// parseConfigNumber parses a 32-bit number given as a JSON number or string.
+func parseConfigNumber(data json.RawMessage) (uint32, error) {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		text = string(data)
+	}
+	multiplier := uint64(1)
+	for suffix, value := range map[string]uint64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30} {
+		if number, ok := strings.CutSuffix(text, suffix); ok {
+			text, multiplier = number, value
+		}
+	}
+	value, err := strconv.ParseUint(text, 0, 32)
+	if err != nil || value*multiplier > 1<<32-1 {
+		return 0, fmt.Errorf("%s is not a 32-bit number", data)
+	}
+	return uint32(value * multiplier), nil
+}
+
+// ParseMachineConfig reads and validates a machine configuration in JSON.
+func ParseMachineConfig(r io.Reader) (*MachineConfig, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	var config MachineConfig
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid machine configuration: %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// LoadMachineConfig reads and validates a machine configuration file.
+func LoadMachineConfig(path string) (*MachineConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config, err := ParseMachineConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// DefaultMachineConfig returns the configuration of NewSystemWithHarts: RAM
+// at RAMOffset with 256 MB and, optionally, the dummy TTY at DummyTTYOffset.
+func DefaultMachineConfig(dummyTTY bool, harts int) *MachineConfig {
+	config := &MachineConfig{
+		Harts: harts,
+		Devices: []DeviceConfig{
+			{Type: "ram", Base: RAMOffset, Size: 0x10000000},
+		},
+	}
+	if dummyTTY {
+		config.Devices = append(config.Devices,
+			DeviceConfig{Type: "dummy-tty", Base: DummyTTYOffset, Size: 1})
+	}
+	return config
+}
+
+// Validate checks the configuration. The devices are created to check their
+// parameters and kept for the next NewMachine, so that they are built only
+// once; as factories acquire no host resources, this has no side effects.
+func (c *MachineConfig) Validate() error {
+	built, extensions, err := c.build()
+	if err != nil {
+		c.validated = nil
+		return err
+	}
+	c.validated = &machineBuild{
+		config:     c.clone(),
+		devices:    built,
+		extensions: extensions,
+	}
+	return nil
+}
+
+// clone returns a deep copy of the configuration without the validated
+// devices.
+func (c *MachineConfig) clone() MachineConfig {
+	clone := MachineConfig{Harts: c.Harts, ISA: c.ISA}
+	if c.Devices != nil {
+		clone.Devices = make([]DeviceConfig, len(c.Devices))
+		for i, d := range c.Devices {
+			d.Params = bytes.Clone(d.Params)
+			clone.Devices[i] = d
+		}
+	}
+	return clone
+}
+
+// take returns the devices built by Validate if the configuration has not
+// changed since, and builds them otherwise. Devices are never shared between
+// machines, so the validated devices are only returned once.
+func (c *MachineConfig) take() ([]devices.BusDevice, cpu.Extensions, error) {
+	validated := c.validated
+	c.validated = nil
+	if validated != nil && reflect.DeepEqual(validated.config, c.clone()) {
+		return validated.devices, validated.extensions, nil
+	}
+	return c.build()
+}
+
+// build creates the devices of the configuration and parses its ISA string.
+func (c *MachineConfig) build() ([]devices.BusDevice, cpu.Extensions, error) {
+	if c.Harts < 0 {
+		return nil, 0, fmt.Errorf("invalid number of harts %d", c.Harts)
+	}
+	extensions := cpu.AllExtensions
+	if c.ISA != "" {
+		var err error
+		extensions, err = cpu.ParseExtensions(c.ISA)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(c.Devices) == 0 {
+		return nil, 0, fmt.Errorf("machine has no devices")
+	}
+
+	var built []devices.BusDevice
+	for i, d := range c.Devices {
+		device, err := devices.New(d.Type, d.Base, d.Size, d.Params)
+		if err != nil {
+			return nil, 0, fmt.Errorf("device %d (%s at %X): %v", i, d.Type,
+				d.Base, err)
+		}
+		if end := uint64(device.BaseAddress()) + uint64(device.Size()); end > 1<<32 {
+			return nil, 0, fmt.Errorf(
+				"device %d (%s at %X): size %X exceeds the address space", i,
+				d.Type, d.Base, device.Size())
+		}
+		built = append(built, device)
+	}
+
+	order := make([]int, len(built))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return built[order[i]].BaseAddress() < built[order[j]].BaseAddress()
+	})
+	for k := 1; k < len(order); k++ {
+		previous, next := built[order[k-1]], built[order[k]]
+		if uint64(previous.BaseAddress())+uint64(previous.Size()) > uint64(next.BaseAddress()) {
+			i, j := min(order[k-1], order[k]), max(order[k-1], order[k])
+			return nil, 0, fmt.Errorf("devices %d (%s at %X) and %d (%s at %X) overlap",
+				i, c.Devices[i].Type, c.Devices[i].Base,
+				j, c.Devices[j].Type, c.Devices[j].Base)
+		}
+	}
+	if err := devices.ConnectInterrupts(built); err != nil {
+		return nil, 0, err
+	}
+	return built, extensions, nil
+}
+
+// NewMachine creates a System from a machine configuration. Devices are
+// added to the bus in the order of the configuration, and host devices are
+// opened until Close is called.
+func NewMachine(config *MachineConfig) (*System, error) {
+	built, extensions, err := config.take()
+	if err != nil {
+		return nil, err
+	}
+	host := devices.NewHost()
+	if err := host.Open(built); err != nil {
+		return nil, err
+	}
+	bus := &devices.Bus{}
+	for _, device := range built {
+		bus.AddDevice(device)
+		if dma, ok := device.(devices.DMADevice); ok {
+			dma.ConnectBus(bus)
+		}
+	}
+	sys := newSystem(bus, max(config.Harts, 1))
+	sys.host = host
+	for _, hart := range sys.harts {
+		hart.SetExtensions(extensions)
+	}
+	for _, device := range built {
+		if counted, ok := device.(devices.InstructionCountDevice); ok {
+			counted.ConnectInstructionCount(sys.Instructions)
+		}
+		if power, ok := device.(devices.PowerDevice); ok {
+			power.ConnectPower(sys.power)
+		}
+		if controller, ok := device.(devices.HartInterruptController); ok {
+			for i, hart := range sys.harts {
+				controller.ConnectHart(i, hart)
+			}
+		}
+	}
+	return sys, nil
+}
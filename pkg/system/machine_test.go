@@ -0,0 +1,348 @@
+package system
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+	_ "github.com/Keisim/go-riscv-emu/pkg/virtio"
+)
+
+func TestNewMachine(t *testing.T) {
+	config, err := ParseMachineConfig(strings.NewReader(`{
+		"harts": 2,
+		"isa": "rv32i_zicsr",
+		"devices": [
+			{"type": "dummy-tty", "base": 268435456},
+			{"type": "ram", "base": "0x80000000", "size": "64K", "params": {}}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("ParseMachineConfig failed: %v", err)
+	}
+	sys, err := NewMachine(config)
+	if err != nil {
+		t.Fatalf("NewMachine failed: %v", err)
+	}
+
+	if len(sys.Harts()) != 2 {
+		t.Errorf("Expected 2 harts, got %d", len(sys.Harts()))
+	}
+	for _, hart := range sys.Harts() {
+		if hart.GetExtensions() != cpu.ExtensionZicsr {
+			t.Errorf("Expected only Zicsr, got %v", hart.GetExtensions())
+		}
+	}
+	busDevices := sys.Bus().Devices()
+	if len(busDevices) != 2 {
+		t.Fatalf("Expected 2 devices, got %d", len(busDevices))
+	}
+	if _, ok := busDevices[0].(*devices.DummyTTYDevice); !ok ||
+		busDevices[0].BaseAddress() != DummyTTYOffset {
+		t.Errorf("Expected the dummy TTY at %X, got %T at %X", DummyTTYOffset,
+			busDevices[0], busDevices[0].BaseAddress())
+	}
+	if _, ok := busDevices[1].(*devices.RAMDevice); !ok ||
+		busDevices[1].BaseAddress() != RAMOffset || busDevices[1].Size() != 64<<10 {
+		t.Errorf("Expected 64K of RAM at %X, got %T at %X+%X", RAMOffset,
+			busDevices[1], busDevices[1].BaseAddress(), busDevices[1].Size())
+	}
+}
+
+func TestNewMachine_ValidatedDevices(t *testing.T) {
+	config, err := ParseMachineConfig(strings.NewReader(`{
+		"devices": [{"type": "ram", "base": "0x80000000", "size": "64K"}]
+	}`))
+	if err != nil {
+		t.Fatalf("ParseMachineConfig failed: %v", err)
+	}
+	validated := config.validated.devices[0]
+
+	first, err := NewMachine(config)
+	if err != nil {
+		t.Fatalf("NewMachine failed: %v", err)
+	}
+	if first.Bus().Devices()[0] != validated {
+		t.Error("Expected NewMachine to use the devices built by Validate")
+	}
+	second, err := NewMachine(config)
+	if err != nil {
+		t.Fatalf("NewMachine failed: %v", err)
+	}
+	if second.Bus().Devices()[0] == validated {
+		t.Error("Expected a second machine to get its own devices")
+	}
+
+	// Changes after validation are built, not the validated devices.
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	config.Devices[0].Size = 128 << 10
+	changed, err := NewMachine(config)
+	if err != nil {
+		t.Fatalf("NewMachine failed: %v", err)
+	}
+	if size := changed.Bus().Devices()[0].Size(); size != 128<<10 {
+		t.Errorf("Expected the changed RAM size %X, got %X", 128<<10, size)
+	}
+}
+
+func TestParseMachineConfig_Errors(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{`{"harts": 1, "cpus": 2}`, `unknown field "cpus"`},
+		{`{"harts": -1, "devices": []}`, "invalid number of harts -1"},
+		{`{"isa": "rv32imac", "devices": []}`, `unsupported extension "M"`},
+		{`{"devices": []}`, "machine has no devices"},
+		{`{"devices": [{"type": "ram", "size": 1}]}`, `device "ram" has no base address`},
+		{`{"devices": [{"type": "ram", "base": "0x1", "size": "8G"}]}`,
+			`invalid size of device "ram": "8G" is not a 32-bit number`},
+		{`{"devices": [{"type": "ram", "base": "0xFFFFFF00", "size": "1K"}]}`,
+			"device 0 (ram at FFFFFF00): size 400 exceeds the address space"},
+		{`{"devices": [{"type": "floppy", "base": 0}]}`,
+			`device 0 (floppy at 0): unknown device type "floppy"`},
+		{`{"devices": [{"type": "ram", "base": 0, "size": "1K", "params": {"fast": true}}]}`,
+			`unknown field "fast"`},
+		{`{"devices": [
+			{"type": "ram", "base": "0x1000", "size": "4K"},
+			{"type": "dummy-tty", "base": "0x100"},
+			{"type": "dummy-tty", "base": "0x1FFF"}
+		]}`, "devices 0 (ram at 1000) and 2 (dummy-tty at 1FFF) overlap"},
+		{`{"devices": [{"type": "ns16550a", "base": 0, "params": {"irq": 1}}]}`,
+			"uses IRQ 1, but there is no interrupt controller"},
+	}
+	for _, test := range tests {
+		_, err := ParseMachineConfig(strings.NewReader(test.config))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected error containing %q, got %v", test.err, err)
+		}
+	}
+}
+
+func TestDefaultMachineConfig(t *testing.T) {
+	sys, err := NewMachine(DefaultMachineConfig(true, 3))
+	if err != nil {
+		t.Fatalf("NewMachine failed: %v", err)
+	}
+	if len(sys.Harts()) != 3 || len(sys.Bus().Devices()) != 2 {
+		t.Errorf("Expected 3 harts and 2 devices, got %d and %d",
+			len(sys.Harts()), len(sys.Bus().Devices()))
+	}
+}
+
+func TestNewMachine_VirtualTimeRTC(t *testing.T) {
+	config, err := ParseMachineConfig(strings.NewReader(`{
+		"devices": [
+			{"type": "goldfish-rtc", "base": "0x101000", "params": {
+				"mode": "virtual", "epoch": "2020-01-01T00:00:00Z",
+				"instructions-per-second": 1000}},
+			{"type": "ram", "base": "0x80000000", "size": "64K"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("ParseMachineConfig failed: %v", err)
+	}
+	sys, err := NewMachine(config)
+	if err != nil {
+		t.Fatalf("NewMachine failed: %v", err)
+	}
+	loadProgram(t, sys, []uint32{0b1101111}) // JAL x0, 0
+	if _, err := sys.Run(2000); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	rtc := sys.Bus().Devices()[0].(*devices.RTCDevice)
+	expected := time.Date(2020, 1, 1, 0, 0, 2, 0, time.UTC)
+	if !rtc.Time().Equal(expected) {
+		t.Errorf("Expected %v after 2000 instructions, got %v", expected, rtc.Time())
+	}
+}
+
+func TestNewMachine_PowerOff(t *testing.T) {
+	// Writes 0x00053333 byte by byte to power off with exit code 5, then
+	// spins:
+	//
+	//	0x00: LUI  x5, 0x100
+	//	0x04: ADDI x6, x0, 0x33
+	//	0x08: SB   x6, 0(x5)
+	//	0x0C: SB   x6, 1(x5)
+	//	0x10: ADDI x6, x0, 5
+	//	0x14: SB   x6, 2(x5)
+	//	0x18: SB   x0, 3(x5)
+	//	0x1C: JAL  x0, 0
+	program := []uint32{
+		0x100<<12 | 5<<7 | 0b0110111,
+		addi(6, 0, 0x33),
+		sType(0b0100011, 0b000, 5, 6, 0),
+		sType(0b0100011, 0b000, 5, 6, 1),
+		addi(6, 0, 5),
+		sType(0b0100011, 0b000, 5, 6, 2),
+		sType(0b0100011, 0b000, 5, 0, 3),
+		0b1101111,
+	}
+	for _, mode := range []SchedulingMode{ScheduleRoundRobin, ScheduleParallel} {
+		t.Run(mode.String(), func(t *testing.T) {
+			config, err := ParseMachineConfig(strings.NewReader(`{
+				"harts": 2,
+				"devices": [
+					{"type": "sifive-test", "base": "0x100000"},
+					{"type": "ram", "base": "0x80000000", "size": "64K"}
+				]
+			}`))
+			if err != nil {
+				t.Fatalf("ParseMachineConfig failed: %v", err)
+			}
+			sys, err := NewMachine(config)
+			if err != nil {
+				t.Fatalf("NewMachine failed: %v", err)
+			}
+			sys.SetScheduling(mode, 0)
+			loadProgram(t, sys, program)
+
+			stop, err := sys.Run(0)
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if stop == nil || stop.Reason != StopPowerOff || stop.ExitCode != 5 {
+				t.Fatalf("Expected a power off with exit code 5, got %v", stop)
+			}
+			if mode == ScheduleRoundRobin && (stop.Pc != RAMOffset+0x1C || stop.Steps != 7) {
+				t.Errorf("Expected the hart to stop after the store in step 7, got pc %X in step %d",
+					stop.Pc, stop.Steps)
+			}
+		})
+	}
+}
+
+func TestNewMachine_Interrupts(t *testing.T) {
+	// Enables the machine software interrupt and raises it through the
+	// CLINT; the handler powers off:
+	//
+	//	0x00: LUI    x5, 0x80000
+	//	0x04: ADDI   x5, x5, 0x40
+	//	0x08: CSRRW  x0, mtvec, x5
+	//	0x0C: ADDI   x6, x0, 8
+	//	0x10: CSRRW  x0, mie, x6
+	//	0x14: CSRRSI x0, mstatus, 8
+	//	0x18: LUI    x7, 0x2000
+	//	0x1C: ADDI   x6, x0, 1
+	//	0x20: SB     x6, 0(x7)
+	//	0x24: JAL    x0, 0
+	//	0x40: LUI    x5, 0x100      handler
+	//	0x44: ADDI   x6, x0, 0x55
+	//	0x48: SB     x6, 0(x5)
+	//	0x4C: SB     x6, 1(x5)
+	//	0x50: SB     x0, 2(x5)
+	//	0x54: SB     x0, 3(x5)
+	//	0x58: JAL    x0, 0
+	program := make([]uint32, 23)
+	copy(program, []uint32{
+		0x80000<<12 | 5<<7 | 0b0110111,
+		addi(5, 5, 0x40),
+		iType(0b1110011, 0b001, 0, 5, cpu.CsrMtvec),
+		addi(6, 0, 8),
+		iType(0b1110011, 0b001, 0, 6, cpu.CsrMie),
+		iType(0b1110011, 0b110, 0, 8, cpu.CsrMstatus),
+		0x2000<<12 | 7<<7 | 0b0110111,
+		addi(6, 0, 1),
+		sType(0b0100011, 0b000, 7, 6, 0),
+		0b1101111,
+	})
+	copy(program[16:], []uint32{
+		0x100<<12 | 5<<7 | 0b0110111,
+		addi(6, 0, 0x55),
+		sType(0b0100011, 0b000, 5, 6, 0),
+		sType(0b0100011, 0b000, 5, 6, 1),
+		sType(0b0100011, 0b000, 5, 0, 2),
+		sType(0b0100011, 0b000, 5, 0, 3),
+		0b1101111,
+	})
+	config, err := ParseMachineConfig(strings.NewReader(`{
+		"devices": [
+			{"type": "sifive-test", "base": "0x100000"},
+			{"type": "clint", "base": "0x2000000"},
+			{"type": "ram", "base": "0x80000000", "size": "64K"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("ParseMachineConfig failed: %v", err)
+	}
+	sys, err := NewMachine(config)
+	if err != nil {
+		t.Fatalf("NewMachine failed: %v", err)
+	}
+	recorder, err := sys.StartRecording(&strings.Builder{})
+	if err != nil {
+		t.Fatalf("Expected recording with CLINT interrupts, got %v", err)
+	}
+	loadProgram(t, sys, program)
+
+	stop, err := sys.Run(1000)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stop == nil || stop.Reason != StopPowerOff || stop.ExitCode != 0 {
+		t.Fatalf("Expected the handler to power off, got %v", stop)
+	}
+	mcause, _ := sys.Core().GetCSR(cpu.CsrMcause)
+	mepc, _ := sys.Core().GetCSR(cpu.CsrMepc)
+	if mcause != 1<<31|devices.InterruptMachineSoftware || mepc != RAMOffset+0x24 {
+		t.Errorf("Expected the software interrupt taken at %X, got mcause %X, mepc %X",
+			RAMOffset+0x24, mcause, mepc)
+	}
+	if recorder.Count() < 2 {
+		t.Errorf("Expected the software interrupt recorded, got %d events",
+			recorder.Count())
+	}
+}
+
+func TestNewMachine_HostDevices(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "console.sock")
+	path := filepath.Join(dir, "machine.json")
+	err := os.WriteFile(path, []byte(`{
+		"devices": [
+			{"type": "ram", "base": "0x80000000", "size": "64K"},
+			{"type": "virtio-console", "base": "0x10001000", "params": {
+				"ports": [{"name": "org.test.0", "socket": "`+socket+`"}]}},
+			{"type": "virtio-net", "base": "0x10002000",
+			 "params": {"backend": "loopback", "link": "a"}},
+			{"type": "virtio-net", "base": "0x10003000",
+			 "params": {"backend": "loopback", "link": "a"}}
+		]
+	}`), 0o644)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	config, err := LoadMachineConfig(path)
+	if err != nil {
+		t.Fatalf("LoadMachineConfig failed: %v", err)
+	}
+	if _, err := os.Stat(socket); err == nil {
+		t.Error("Expected no socket created by validation")
+	}
+
+	// A second machine can use the configuration once the first is closed.
+	for range 2 {
+		sys, err := NewMachine(config)
+		if err != nil {
+			t.Fatalf("NewMachine failed: %v", err)
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Errorf("Expected the console socket listening, got %v", err)
+		} else {
+			conn.Close()
+		}
+		if err := sys.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package system
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+// power carries out a request of the guest to power the machine off or
+// reset it by stopping Run. In round-robin mode, the writing hart stops
+// after the write; in parallel mode, all harts stop at the end of their
+// current run of instructions.
+func (s *System) power(action devices.PowerAction, code uint32) {
+	stop := &Stop{Reason: StopPowerOff, ExitCode: code}
+	if action == devices.PowerReset {
+		stop = &Stop{Reason: StopReset}
+	}
+	if s.parallel.Load() {
+		s.powerStop.CompareAndSwap(nil, stop)
+		return
+	}
+	if s.hit != nil {
+		return
+	}
+	hart := s.harts[s.current]
+	stop.Hart = hart.GetHartID()
+	s.hit = stop
+	hart.RequestStop()
+}
+
+// SaveResetState records the current state of the machine, e.g. right
+// after loading the boot images, as the state that Reset returns to.
+func (s *System) SaveResetState() error {
+	var state bytes.Buffer
+	if err := s.SaveSnapshot(&state); err != nil {
+		return err
+	}
+	s.resetState = state.Bytes()
+	return nil
+}
+
+// Reset returns the machine to the state recorded by SaveResetState, e.g.
+// after the guest requested a reset. Disk images keep what was written to
+// them, but copy-on-write overlays return to their recorded state.
+func (s *System) Reset() error {
+	if s.resetState == nil {
+		return fmt.Errorf("no reset state saved")
+	}
+	return s.LoadSnapshot(bytes.NewReader(s.resetState))
+}
@@ -0,0 +1,105 @@
+package system
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+	"github.com/Keisim/go-riscv-emu/pkg/replay"
+)
+
+// inputInterceptor sees the host input reaching the guest: the reads from
+// host input devices and the interrupts the harts see pending.
+type inputInterceptor interface {
+	devices.InputInterceptor
+	cpu.InterruptInterceptor
+}
+
+// setInputInterceptor installs an interceptor on the bus and the harts, or
+// removes it if nil.
+func (s *System) setInputInterceptor(interceptor inputInterceptor) {
+	s.bus.SetInputInterceptor(interceptor)
+	for _, hart := range s.harts {
+		hart.SetInterruptInterceptor(interceptor)
+	}
+}
+
+// inputClock identifies the hart executing in round-robin mode and the
+// number of instructions it has retired, keying recorded inputs.
+func (s *System) inputClock() (uint32, uint64) {
+	hart := s.harts[s.current]
+	return hart.GetHartID(), hart.GetInstret()
+}
+
+// checkInputLog returns an error if a device on the bus changes state
+// visible to the guest from host input other than through reads and
+// interrupts, which an input log does not capture.
+func (s *System) checkInputLog() error {
+	for _, device := range s.bus.Devices() {
+		if async, ok := device.(devices.AsyncInputDevice); ok && async.AsyncInput() {
+			return fmt.Errorf("input logs cannot capture the host input of %T at %X",
+				device, device.BaseAddress())
+		}
+	}
+	return nil
+}
+
+// StartRecording records every read from a host input device and every
+// change of the interrupts pending at a hart into an input log written to
+// w. Recording requires round-robin scheduling, so that the run can be
+// reproduced by StartReplay, and no device delivering host input into
+// guest memory, e.g. a virtio console.
+func (s *System) StartRecording(w io.Writer) (*replay.Recorder, error) {
+	if s.mode == ScheduleParallel && len(s.harts) > 1 {
+		return nil, fmt.Errorf("recording requires round-robin scheduling")
+	}
+	if err := s.checkInputLog(); err != nil {
+		return nil, err
+	}
+	if s.history != nil {
+		return nil, fmt.Errorf("recording has to start before history is enabled")
+	}
+	recorder, err := replay.NewRecorder(w, s.inputClock)
+	if err != nil {
+		return nil, err
+	}
+	s.inputLog = recorder
+	s.setInputInterceptor(recorder)
+	return recorder, nil
+}
+
+// StartReplay feeds the reads and interrupts recorded in the input log read
+// from r back to the guest. Interrupts raised by the devices are ignored
+// while replaying. The system has to be in the state the recording started
+// from.
+func (s *System) StartReplay(r io.Reader) (*replay.Replayer, error) {
+	if s.mode == ScheduleParallel && len(s.harts) > 1 {
+		return nil, fmt.Errorf("replay requires round-robin scheduling")
+	}
+	if err := s.checkInputLog(); err != nil {
+		return nil, err
+	}
+	if s.history != nil {
+		return nil, fmt.Errorf("replay has to start before history is enabled")
+	}
+	replayer, err := replay.NewReplayer(r, s.inputClock)
+	if err != nil {
+		return nil, err
+	}
+	s.inputLog = replayer
+	s.setInputInterceptor(replayer)
+	return replayer, nil
+}
+
+// StopRecordReplay detaches the active recorder or replayer. Host input
+// devices are read directly again and the harts see the interrupts of the
+// devices.
+func (s *System) StopRecordReplay() {
+	s.inputLog = nil
+	if s.history != nil {
+		s.history.inner = nil
+		return
+	}
+	s.setInputInterceptor(nil)
+}
@@ -0,0 +1,309 @@
+package system
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+	"github.com/Keisim/go-riscv-emu/pkg/virtio"
+)
+
+// counterDevice is a host input device returning a different value on every
+// read, standing in for a terminal or clock.
+type counterDevice struct {
+	value byte
+	reads int
+}
+
+func (c *counterDevice) Initialize(baseAddress, size uint32) {}
+
+func (c *counterDevice) Read(address uint32) (byte, error) {
+	c.reads++
+	c.value += 3
+	return c.value, nil
+}
+
+func (c *counterDevice) Write(address uint32, value byte) error {
+	return nil
+}
+
+func (c *counterDevice) BaseAddress() uint32 {
+	return 0x20000000
+}
+
+func (c *counterDevice) Size() uint32 {
+	return 1
+}
+
+func (c *counterDevice) HostInput() bool {
+	return true
+}
+
+// SaveState saves nothing, like for other host input devices.
+func (c *counterDevice) SaveState(w io.Writer) error {
+	return nil
+}
+
+// LoadState restores nothing.
+func (c *counterDevice) LoadState(r io.Reader) error {
+	return nil
+}
+
+// inputProgram copies eight bytes read from the counter device into the data
+// page:
+//
+//	0x00: LUI  x5, 0x20000
+//	0x04: LUI  x6, 0x80001
+//	0x08: ADDI x10, x0, 8
+//	0x0C: LBU  x7, 0(x5)        loop
+//	0x10: SB   x7, 0(x6)
+//	0x14: ADDI x6, x6, 1
+//	0x18: ADDI x9, x9, 1
+//	0x1C: BNE  x9, x10, loop
+//	0x20: JAL  x0, 0
+var inputProgram = []uint32{
+	0x20000<<12 | 5<<7 | 0b0110111,
+	0x80001<<12 | 6<<7 | 0b0110111,
+	addi(10, 0, 8),
+	iType(0b0000011, 0b100, 7, 5, 0),
+	sType(0b0100011, 0b000, 6, 7, 0),
+	addi(6, 6, 1),
+	addi(9, 9, 1),
+	bne(9, 10, -16),
+	0b1101111,
+}
+
+func newInputSystem(t *testing.T, start byte) (*System, *counterDevice) {
+	t.Helper()
+	sys := NewSystemWithHarts(false, 2)
+	sys.SetScheduling(ScheduleRoundRobin, 3)
+	device := &counterDevice{value: start}
+	sys.Bus().AddDevice(device)
+	loadProgram(t, sys, inputProgram)
+	return sys, device
+}
+
+func TestRecordReplay(t *testing.T) {
+	sys, _ := newInputSystem(t, 0)
+	var log bytes.Buffer
+	recorder, err := sys.StartRecording(&log)
+	if err != nil {
+		t.Fatalf("StartRecording failed: %v", err)
+	}
+	if _, err := sys.Run(100); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if err := recorder.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if recorder.Count() != 16 {
+		t.Errorf("Expected 16 recorded reads, got %d", recorder.Count())
+	}
+	expected := systemState(t, sys)
+
+	// The device of the replayed system would return different values.
+	replayed, device := newInputSystem(t, 100)
+	replayer, err := replayed.StartReplay(&log)
+	if err != nil {
+		t.Fatalf("StartReplay failed: %v", err)
+	}
+	if _, err := replayed.Run(100); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if actual := systemState(t, replayed); actual != expected {
+		t.Errorf("Expected replayed run to match the recorded run")
+	}
+	if device.reads != 0 {
+		t.Errorf("Expected replay not to read the device, got %d reads",
+			device.reads)
+	}
+	if !replayer.Done() {
+		t.Error("Expected the whole log to be replayed")
+	}
+}
+
+// lineDevice lowers the interrupt line that the tests raise like host
+// input would, when the guest writes to it.
+type lineDevice struct {
+	line devices.IRQLine
+}
+
+func (l *lineDevice) Initialize(baseAddress, size uint32) {}
+
+func (l *lineDevice) Read(address uint32) (byte, error) {
+	return 0, nil
+}
+
+func (l *lineDevice) Write(address uint32, value byte) error {
+	l.line.SetLevel(false)
+	return nil
+}
+
+func (l *lineDevice) BaseAddress() uint32 {
+	return 0x20000000
+}
+
+func (l *lineDevice) Size() uint32 {
+	return 1
+}
+
+// SaveState saves nothing, the line is driven by the test.
+func (l *lineDevice) SaveState(w io.Writer) error {
+	return nil
+}
+
+// LoadState restores nothing.
+func (l *lineDevice) LoadState(r io.Reader) error {
+	return nil
+}
+
+// interruptProgram counts timer interrupts in x20, lowering the line of the
+// line device in the handler, while counting loop iterations in x9:
+//
+//	0x00: LUI    x5, 0x20000
+//	0x04: LUI    x6, 0x80000
+//	0x08: ADDI   x6, x6, 0x24
+//	0x0C: CSRRW  x0, mtvec, x6
+//	0x10: ADDI   x6, x0, 0x80
+//	0x14: CSRRW  x0, mie, x6
+//	0x18: CSRRSI x0, mstatus, 8
+//	0x1C: ADDI   x9, x9, 1       loop
+//	0x20: JAL    x0, loop
+//	0x24: ADDI   x20, x20, 1     handler
+//	0x28: SB     x0, 0(x5)
+//	0x2C: MRET
+var interruptProgram = []uint32{
+	0x20000<<12 | 5<<7 | 0b0110111,
+	0x80000<<12 | 6<<7 | 0b0110111,
+	addi(6, 6, 0x24),
+	iType(0b1110011, 0b001, 0, 6, cpu.CsrMtvec),
+	addi(6, 0, 0x80),
+	iType(0b1110011, 0b001, 0, 6, cpu.CsrMie),
+	iType(0b1110011, 0b110, 0, 8, cpu.CsrMstatus),
+	addi(9, 9, 1),
+	0xFFDFF06F,
+	addi(20, 20, 1),
+	sType(0b0100011, 0b000, 5, 0, 0),
+	0x30200073,
+}
+
+// newInterruptSystem returns two harts running interruptProgram and the
+// timer line of hart 0.
+func newInterruptSystem(t *testing.T) (*System, devices.IRQLine) {
+	t.Helper()
+	sys := NewSystemWithHarts(false, 2)
+	sys.SetScheduling(ScheduleRoundRobin, 3)
+	line := sys.Harts()[0].InterruptLine(devices.InterruptMachineTimer)
+	sys.Bus().AddDevice(&lineDevice{line})
+	loadProgram(t, sys, interruptProgram)
+	return sys, line
+}
+
+// runInterrupted runs the system three times for 50 steps, raising the
+// line before the second and third run unless it is nil.
+func runInterrupted(t *testing.T, sys *System, line devices.IRQLine) {
+	t.Helper()
+	for i := 0; i < 3; i++ {
+		if i > 0 && line != nil {
+			line.SetLevel(true)
+		}
+		if _, err := sys.Run(50); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+	}
+}
+
+func TestRecordReplay_Interrupts(t *testing.T) {
+	sys, line := newInterruptSystem(t)
+	var log bytes.Buffer
+	recorder, err := sys.StartRecording(&log)
+	if err != nil {
+		t.Fatalf("StartRecording failed: %v", err)
+	}
+	runInterrupted(t, sys, line)
+	if err := recorder.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if taken := sys.Harts()[0].GetRegister(20); taken != 2 {
+		t.Fatalf("Expected 2 interrupts taken, got %d", taken)
+	}
+	expected := systemState(t, sys)
+
+	// Nothing raises the line of the replayed system.
+	replayed, _ := newInterruptSystem(t)
+	replayer, err := replayed.StartReplay(&log)
+	if err != nil {
+		t.Fatalf("StartReplay failed: %v", err)
+	}
+	runInterrupted(t, replayed, nil)
+
+	if actual := systemState(t, replayed); actual != expected {
+		t.Errorf("Expected replayed run to take the recorded interrupts")
+	}
+	if !replayer.Done() {
+		t.Error("Expected the whole log to be replayed")
+	}
+}
+
+func TestReplay_Diverged(t *testing.T) {
+	sys, _ := newInputSystem(t, 0)
+	var log bytes.Buffer
+	recorder, err := sys.StartRecording(&log)
+	if err != nil {
+		t.Fatalf("StartRecording failed: %v", err)
+	}
+	if _, err := sys.Run(100); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	recorder.Flush()
+
+	// A single hart executes its reads where the log expects hart 1.
+	replayed := NewSystem(false)
+	replayed.Bus().AddDevice(&counterDevice{})
+	loadProgram(t, replayed, inputProgram)
+	if _, err := replayed.StartReplay(&log); err != nil {
+		t.Fatalf("StartReplay failed: %v", err)
+	}
+
+	_, err = replayed.Run(100)
+	if err == nil || !strings.Contains(err.Error(), "diverged") {
+		t.Errorf("Expected divergence error, got %v", err)
+	}
+}
+
+func TestRecord_ParallelUnsupported(t *testing.T) {
+	sys := NewSystemWithHarts(false, 2)
+	sys.SetScheduling(ScheduleParallel, 0)
+
+	if _, err := sys.StartRecording(&bytes.Buffer{}); err == nil {
+		t.Error("Expected error for recording in parallel mode, got nil")
+	}
+}
+
+func TestRecord_AsyncInputUnsupported(t *testing.T) {
+	sys := NewSystem(false)
+	console := virtio.NewTransport(virtio.NewConsole(), 0)
+	console.Initialize(0x10001000, virtio.TransportSize)
+	sys.Bus().AddDevice(console)
+
+	if _, err := sys.StartRecording(&bytes.Buffer{}); err == nil {
+		t.Error("Expected error for recording with a virtio console, got nil")
+	}
+	if _, err := sys.StartReplay(&bytes.Buffer{}); err == nil {
+		t.Error("Expected error for replaying with a virtio console, got nil")
+	}
+
+	// The alarm of a host-time RTC is recorded as an interrupt.
+	host := NewSystem(false)
+	rtc := devices.NewRTC(1, devices.RTCHostTime, time.Unix(0, 0), 0)
+	rtc.Initialize(0x101000, devices.RTCSize)
+	host.Bus().AddDevice(rtc)
+	if _, err := host.StartRecording(&bytes.Buffer{}); err != nil {
+		t.Errorf("Expected recording with a host-time RTC, got %v", err)
+	}
+}
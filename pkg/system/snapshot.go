@@ -0,0 +1,254 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+// snapshotMagic identifies snapshot files.
+var snapshotMagic = [8]byte{'R', 'V', 'E', 'M', 'U', 'S', 'N', 'P'}
+
+// SnapshotVersion is the version of the snapshot format written by
+// SaveSnapshot. Snapshots of other versions are rejected.
+//
+// Version 2 added the number of retired instructions to the hart state,
+// version 3 the machine trap CSRs, version 4 the LR/SC reservation,
+// version 5 the interrupts seen through an interrupt interceptor.
+const SnapshotVersion = 5
+
+// snapshotHeader starts every snapshot.
+type snapshotHeader struct {
+	Magic   [8]byte
+	Version uint32
+	Harts   uint32
+	Devices uint32
+	Current uint32 // Hart executing in round-robin mode
+	Used    uint64 // Instructions executed by the current hart
+}
+
+// snapshotHart holds the state of a single hart.
+type snapshotHart struct {
+	HartID uint32
+	State  cpu.CoreState
+}
+
+// snapshotDevice describes a device and the length of its state.
+type snapshotDevice struct {
+	BaseAddress uint32
+	Size        uint32
+	NameLength  uint32
+	StateLength uint64
+}
+
+// deviceName returns the name identifying the type of a device in
+// snapshots.
+func deviceName(device devices.BusDevice) string {
+	return fmt.Sprintf("%T", device)
+}
+
+// SaveSnapshot writes the complete state of the system to w: registers and
+// CSRs of every hart, the scheduler position and the state of every device
+// on the bus. All devices have to implement devices.StatefulDevice.
+func (s *System) SaveSnapshot(w io.Writer) error {
+	busDevices := s.bus.Devices()
+	header := snapshotHeader{
+		Magic:   snapshotMagic,
+		Version: SnapshotVersion,
+		Harts:   uint32(len(s.harts)),
+		Devices: uint32(len(busDevices)),
+		Current: uint32(s.current),
+		Used:    s.used,
+	}
+	err := binary.Write(w, binary.LittleEndian, &header)
+	if err != nil {
+		return err
+	}
+
+	for _, hart := range s.harts {
+		err := binary.Write(w, binary.LittleEndian, snapshotHart{
+			HartID: hart.GetHartID(),
+			State:  hart.State(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, device := range busDevices {
+		stateful, ok := device.(devices.StatefulDevice)
+		if !ok {
+			return fmt.Errorf("device %s at %X does not support snapshots",
+				deviceName(device), device.BaseAddress())
+		}
+
+		var state bytes.Buffer
+		err := stateful.SaveState(&state)
+		if err != nil {
+			return fmt.Errorf("failed to save state of device %s at %X: %v",
+				deviceName(device), device.BaseAddress(), err)
+		}
+
+		name := deviceName(device)
+		err = binary.Write(w, binary.LittleEndian, snapshotDevice{
+			BaseAddress: device.BaseAddress(),
+			Size:        device.Size(),
+			NameLength:  uint32(len(name)),
+			StateLength: uint64(state.Len()),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, name)
+		if err != nil {
+			return err
+		}
+		_, err = state.WriteTo(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadSnapshot restores the state written by SaveSnapshot. The system must
+// have been created with the same harts and devices as the one the snapshot
+// was taken from.
+func (s *System) LoadSnapshot(r io.Reader) error {
+	var header snapshotHeader
+	err := binary.Read(r, binary.LittleEndian, &header)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot header: %v", err)
+	}
+	if header.Magic != snapshotMagic {
+		return fmt.Errorf("not a snapshot file")
+	}
+	if header.Version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d, expected %d",
+			header.Version, SnapshotVersion)
+	}
+	busDevices := s.bus.Devices()
+	if int(header.Harts) != len(s.harts) {
+		return fmt.Errorf("snapshot has %d harts, system has %d",
+			header.Harts, len(s.harts))
+	}
+	if int(header.Devices) != len(busDevices) {
+		return fmt.Errorf("snapshot has %d devices, system has %d",
+			header.Devices, len(busDevices))
+	}
+	if int(header.Current) >= len(s.harts) {
+		return fmt.Errorf("invalid current hart %d in snapshot", header.Current)
+	}
+
+	states := make([]cpu.CoreState, len(s.harts))
+	for i, hart := range s.harts {
+		var saved snapshotHart
+		err := binary.Read(r, binary.LittleEndian, &saved)
+		if err != nil {
+			return fmt.Errorf("failed to read hart %d: %v", i, err)
+		}
+		if saved.HartID != hart.GetHartID() {
+			return fmt.Errorf("snapshot has hart ID %d at position %d, system has %d",
+				saved.HartID, i, hart.GetHartID())
+		}
+		states[i] = saved.State
+	}
+
+	// Every device is validated before any state is restored, so that a
+	// mismatching snapshot leaves the system untouched.
+	deviceStates := make([][]byte, len(busDevices))
+	for i, device := range busDevices {
+		var saved snapshotDevice
+		err := binary.Read(r, binary.LittleEndian, &saved)
+		if err != nil {
+			return fmt.Errorf("failed to read device header: %v", err)
+		}
+		// Names of other lengths cannot match, so they are not read.
+		var name []byte
+		if int(saved.NameLength) == len(deviceName(device)) {
+			name = make([]byte, saved.NameLength)
+			_, err = io.ReadFull(r, name)
+			if err != nil {
+				return fmt.Errorf("failed to read device name: %v", err)
+			}
+		}
+		if string(name) != deviceName(device) ||
+			saved.BaseAddress != device.BaseAddress() ||
+			saved.Size != device.Size() {
+			return fmt.Errorf(
+				"snapshot device %s at %X (size %X) does not match %s at %X (size %X)",
+				name, saved.BaseAddress, saved.Size, deviceName(device),
+				device.BaseAddress(), device.Size())
+		}
+		if _, ok := device.(devices.StatefulDevice); !ok {
+			return fmt.Errorf("device %s at %X does not support snapshots",
+				deviceName(device), device.BaseAddress())
+		}
+
+		// The state is copied rather than allocated at its length, so that
+		// a corrupt length fails at the end of the file.
+		if saved.StateLength > math.MaxInt64 {
+			return fmt.Errorf("invalid state length %d of device %s at %X",
+				saved.StateLength, deviceName(device), device.BaseAddress())
+		}
+		var state bytes.Buffer
+		_, err = io.CopyN(&state, r, int64(saved.StateLength))
+		if err != nil {
+			return fmt.Errorf("failed to read state of device %s at %X: %v",
+				deviceName(device), device.BaseAddress(), err)
+		}
+		deviceStates[i] = state.Bytes()
+	}
+
+	for i, device := range busDevices {
+		stateful := device.(devices.StatefulDevice)
+		err := stateful.LoadState(bytes.NewReader(deviceStates[i]))
+		if err != nil {
+			return fmt.Errorf("failed to load state of device %s at %X: %v",
+				deviceName(device), device.BaseAddress(), err)
+		}
+	}
+
+	for i, hart := range s.harts {
+		hart.SetState(states[i])
+		hart.FlushCaches()
+	}
+	s.current = int(header.Current)
+	s.used = header.Used
+	return nil
+}
+
+// SaveSnapshotFile writes a snapshot of the system to the file at path.
+func (s *System) SaveSnapshotFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = s.SaveSnapshot(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// LoadSnapshotFile restores a snapshot from the file at path.
+func (s *System) LoadSnapshotFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.LoadSnapshot(bufio.NewReader(f))
+}
@@ -0,0 +1,165 @@
+package system
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// systemState captures what a run is compared on: hart registers and the
+// program's data page.
+func systemState(t *testing.T, sys *System) string {
+	t.Helper()
+	var state strings.Builder
+	for _, hart := range sys.Harts() {
+		binary.Write(&state, binary.LittleEndian, hart.State())
+	}
+	for address := uint32(0x80001000); address < 0x80001008; address++ {
+		value, err := sys.Bus().Read(address)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		state.WriteByte(value)
+	}
+	return state.String()
+}
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	sys := NewSystemWithHarts(true, 2)
+	sys.SetScheduling(ScheduleRoundRobin, 5)
+	loadProgram(t, sys, spinlockProgram)
+	if _, err := sys.Run(333); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	var snapshot bytes.Buffer
+	if err := sys.SaveSnapshot(&snapshot); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	if _, err := sys.Run(1000); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	expected := systemState(t, sys)
+
+	restored := NewSystemWithHarts(true, 2)
+	restored.SetScheduling(ScheduleRoundRobin, 5)
+	if err := restored.LoadSnapshot(&snapshot); err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	if _, err := restored.Run(1000); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if actual := systemState(t, restored); actual != expected {
+		t.Errorf("Expected restored run to match the original run")
+	}
+}
+
+func TestSnapshot_RestoreTwice(t *testing.T) {
+	sys := NewSystem(false)
+	loadProgram(t, sys, spinlockProgram)
+	if _, err := sys.Run(100); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "boot.snap")
+	if err := sys.SaveSnapshotFile(path); err != nil {
+		t.Fatalf("SaveSnapshotFile failed: %v", err)
+	}
+	expected := systemState(t, sys)
+
+	for i := 0; i < 2; i++ {
+		if _, err := sys.Run(200); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if err := sys.LoadSnapshotFile(path); err != nil {
+			t.Fatalf("LoadSnapshotFile failed: %v", err)
+		}
+		if actual := systemState(t, sys); actual != expected {
+			t.Errorf("Expected restore %d to return to the snapshot state", i)
+		}
+	}
+}
+
+func TestSnapshot_Mismatch(t *testing.T) {
+	sys := NewSystemWithHarts(false, 2)
+	var snapshot bytes.Buffer
+	if err := sys.SaveSnapshot(&snapshot); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		system *System
+	}{
+		{"harts", NewSystemWithHarts(false, 1)},
+		{"devices", NewSystemWithHarts(true, 2)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.system.LoadSnapshot(bytes.NewReader(snapshot.Bytes()))
+			if err == nil {
+				t.Error("Expected error for mismatching system, got nil")
+			}
+		})
+	}
+}
+
+func TestSnapshot_Version(t *testing.T) {
+	sys := NewSystem(false)
+	var snapshot bytes.Buffer
+	if err := sys.SaveSnapshot(&snapshot); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+
+	data := snapshot.Bytes()
+	binary.LittleEndian.PutUint32(data[8:], SnapshotVersion+1)
+	err := sys.LoadSnapshot(bytes.NewReader(data))
+	if err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("Expected version error, got %v", err)
+	}
+
+	err = sys.LoadSnapshot(strings.NewReader("not a snapshot at all"))
+	if err == nil {
+		t.Error("Expected error for invalid snapshot, got nil")
+	}
+}
+
+func TestSnapshot_CorruptLengths(t *testing.T) {
+	sys := NewSystem(false)
+	var snapshot bytes.Buffer
+	if err := sys.SaveSnapshot(&snapshot); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	// The header of the first device follows the hart.
+	device := binary.Size(snapshotHeader{}) + binary.Size(snapshotHart{})
+	nameLength := device + 8
+	stateLength := device + 12
+
+	tests := []struct {
+		name    string
+		offset  int
+		value   uint64
+		size    int
+		message string
+	}{
+		{"name length", nameLength, 0xFFFFFFFF, 4, "does not match"},
+		{"state length", stateLength, 1 << 40, 8, "failed to read state"},
+		{"negative state length", stateLength, 1 << 63, 8, "invalid state length"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := bytes.Clone(snapshot.Bytes())
+			if test.size == 4 {
+				binary.LittleEndian.PutUint32(data[test.offset:], uint32(test.value))
+			} else {
+				binary.LittleEndian.PutUint64(data[test.offset:], test.value)
+			}
+			err := sys.LoadSnapshot(bytes.NewReader(data))
+			if err == nil || !strings.Contains(err.Error(), test.message) {
+				t.Errorf("Expected error %q, got %v", test.message, err)
+			}
+		})
+	}
+}
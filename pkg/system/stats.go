@@ -0,0 +1,192 @@
+package system
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+// Stats summarizes the execution of a System across all calls to Run.
+// Mnemonics, branches and device accesses are only counted after
+// EnableStats.
+type Stats struct {
+	Instructions     uint64            `json:"instructions"` // Retired in Run by all harts
+	WallTime         time.Duration     `json:"wall_time_ns"` // Host time spent in Run
+	MIPS             float64           `json:"mips"`         // Instructions per microsecond of wall time
+	Traps            map[string]uint64 `json:"traps"`        // Exceptions that stopped a hart, by cause
+	Mnemonics        map[string]uint64 `json:"mnemonics"`
+	Branches         uint64            `json:"branches"` // Conditional branches
+	BranchesTaken    uint64            `json:"branches_taken"`
+	BranchTakenRatio float64           `json:"branch_taken_ratio"`
+	Devices          []DeviceStats     `json:"devices"` // Sorted by base address
+}
+
+// DeviceStats counts the loads and stores of a bus device. Loads and stores
+// are counted per instruction, whatever their width; AMOs count as both.
+type DeviceStats struct {
+	Name        string `json:"name"`
+	BaseAddress uint32 `json:"base_address"`
+	Loads       uint64 `json:"loads"`
+	Stores      uint64 `json:"stores"`
+}
+
+// runStats holds the statistics of a System.
+type runStats struct {
+	instructions uint64
+	wallTime     time.Duration
+	traps        map[cpu.ExceptionCause]uint64
+	tracers      []*statsTracer // One per hart after EnableStats
+}
+
+// statsTracer counts the instructions of a single hart.
+type statsTracer struct {
+	bus       *devices.Bus
+	mnemonics map[string]uint64
+	branches  uint64
+	taken     uint64
+	accesses  map[devices.BusDevice]*[2]uint64 // Loads and stores
+}
+
+// TraceInstruction counts the instruction by mnemonic, branch outcome and
+// accessed device.
+func (t *statsTracer) TraceInstruction(core *cpu.Core, event cpu.TraceEvent) {
+	t.mnemonics[event.Mnemonic]++
+	if cpu.IsConditionalBranch(event.Instruction) {
+		t.branches++
+		if event.NextPc != event.Pc+4 {
+			t.taken++
+		}
+		return
+	}
+
+	var load, store bool
+	switch {
+	case event.Mnemonic == "lb" || event.Mnemonic == "lbu" ||
+		event.Mnemonic == "lr.w":
+		load = true
+	case event.Mnemonic == "sb" || event.Mnemonic == "sc.w":
+		store = true
+	case strings.HasPrefix(event.Mnemonic, "amo"):
+		load, store = true, true
+	default:
+		return
+	}
+	device := t.bus.FindDevice(event.Address)
+	if device == nil {
+		return
+	}
+	counts, ok := t.accesses[device]
+	if !ok {
+		counts = &[2]uint64{}
+		t.accesses[device] = counts
+	}
+	if load {
+		counts[0]++
+	}
+	if store {
+		counts[1]++
+	}
+}
+
+// EnableStats starts counting instructions by mnemonic, conditional
+// branches and loads and stores by device. It installs a tracer on every
+// hart, which slows down execution.
+func (s *System) EnableStats() {
+	if s.stats.tracers != nil {
+		return
+	}
+	for _, hart := range s.harts {
+		tracer := &statsTracer{
+			bus:       s.bus,
+			mnemonics: make(map[string]uint64),
+			accesses:  make(map[devices.BusDevice]*[2]uint64),
+		}
+		s.stats.tracers = append(s.stats.tracers, tracer)
+		hart.AddTracer(tracer)
+	}
+}
+
+// instret returns the number of instructions retired by all harts.
+func (s *System) instret() uint64 {
+	var total uint64
+	for _, hart := range s.harts {
+		total += hart.GetInstret()
+	}
+	return total
+}
+
+// Instructions returns the number of instructions retired by all harts.
+// While the harts run in parallel, it is updated whenever a hart returns
+// from a chunk of execution, so it may be called from any goroutine.
+func (s *System) Instructions() uint64 {
+	if s.parallel.Load() {
+		return s.retired.Load()
+	}
+	return s.instret()
+}
+
+// account adds a call to Run that took the given time, starting with the
+// given number of retired instructions and returning err.
+func (s *System) account(start time.Time, instret uint64, err error) {
+	s.stats.wallTime += time.Since(start)
+	s.stats.instructions += s.instret() - instret
+	if cause, ok := cpu.ExceptionCauseOf(err); ok {
+		if s.stats.traps == nil {
+			s.stats.traps = make(map[cpu.ExceptionCause]uint64)
+		}
+		s.stats.traps[cause]++
+	}
+}
+
+// Stats returns the statistics of all calls to Run so far.
+func (s *System) Stats() Stats {
+	stats := Stats{
+		Instructions: s.stats.instructions,
+		WallTime:     s.stats.wallTime,
+		Traps:        make(map[string]uint64),
+		Mnemonics:    make(map[string]uint64),
+		Devices:      []DeviceStats{},
+	}
+	if seconds := s.stats.wallTime.Seconds(); seconds > 0 {
+		stats.MIPS = float64(stats.Instructions) / seconds / 1e6
+	}
+	for cause, count := range s.stats.traps {
+		stats.Traps[cause.String()] += count
+	}
+
+	accesses := map[devices.BusDevice]*DeviceStats{}
+	for _, tracer := range s.stats.tracers {
+		for mnemonic, count := range tracer.mnemonics {
+			stats.Mnemonics[mnemonic] += count
+		}
+		stats.Branches += tracer.branches
+		stats.BranchesTaken += tracer.taken
+		for device, counts := range tracer.accesses {
+			d, ok := accesses[device]
+			if !ok {
+				d = &DeviceStats{
+					Name:        strings.TrimPrefix(fmt.Sprintf("%T", device), "*"),
+					BaseAddress: device.BaseAddress(),
+				}
+				accesses[device] = d
+			}
+			d.Loads += counts[0]
+			d.Stores += counts[1]
+		}
+	}
+	if stats.Branches > 0 {
+		stats.BranchTakenRatio = float64(stats.BranchesTaken) /
+			float64(stats.Branches)
+	}
+	for _, d := range accesses {
+		stats.Devices = append(stats.Devices, *d)
+	}
+	sort.Slice(stats.Devices, func(i, j int) bool {
+		return stats.Devices[i].BaseAddress < stats.Devices[j].BaseAddress
+	})
+	return stats
+}
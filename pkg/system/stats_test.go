@@ -0,0 +1,68 @@
+package system
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	sys := NewSystem(false)
+	sys.EnableStats()
+	// Run into an illegal instruction after the loop.
+	program := slices.Clone(spinlockProgram)
+	program[len(program)-1] = 0xFFFFFFFF
+	loadProgram(t, sys, program)
+
+	if _, err := sys.Run(0); err == nil {
+		t.Fatal("Expected error for unsupported instruction, got nil")
+	}
+	stats := sys.Stats()
+
+	if stats.Instructions != 504 {
+		t.Errorf("Expected 504 instructions, got %d", stats.Instructions)
+	}
+	mnemonics := map[string]uint64{
+		"lui": 1, "addi": 102, "lr.w": 50, "bne": 150, "sc.w": 50, "lbu": 50,
+		"sb": 50, "amoswap.w": 50, "csrrs": 1,
+	}
+	if !maps.Equal(stats.Mnemonics, mnemonics) {
+		t.Errorf("Expected mnemonics %v, got %v", mnemonics, stats.Mnemonics)
+	}
+	if stats.Branches != 150 || stats.BranchesTaken != 49 ||
+		stats.BranchTakenRatio != 49.0/150 {
+		t.Errorf("Expected 49 of 150 branches taken, got %d of %d (%f)",
+			stats.BranchesTaken, stats.Branches, stats.BranchTakenRatio)
+	}
+	devices := []DeviceStats{{Name: "devices.RAMDevice",
+		BaseAddress: RAMOffset, Loads: 150, Stores: 150}}
+	if !slices.Equal(stats.Devices, devices) {
+		t.Errorf("Expected device accesses %+v, got %+v", devices,
+			stats.Devices)
+	}
+	traps := map[string]uint64{"illegal instruction": 1}
+	if !maps.Equal(stats.Traps, traps) {
+		t.Errorf("Expected traps %v, got %v", traps, stats.Traps)
+	}
+	if stats.WallTime <= 0 || stats.MIPS <= 0 {
+		t.Errorf("Expected wall time and MIPS, got %v and %f", stats.WallTime,
+			stats.MIPS)
+	}
+}
+
+func TestStats_Disabled(t *testing.T) {
+	sys := NewSystemWithHarts(false, 2)
+	loadProgram(t, sys, spinlockProgram)
+
+	if _, err := sys.Run(100); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	stats := sys.Stats()
+	if stats.Instructions != 200 {
+		t.Errorf("Expected 200 instructions, got %d", stats.Instructions)
+	}
+	if len(stats.Mnemonics) != 0 || stats.Branches != 0 ||
+		len(stats.Devices) != 0 {
+		t.Errorf("Expected no instruction counts, got %+v", stats)
+	}
+}
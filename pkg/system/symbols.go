@@ -0,0 +1,44 @@
+package system
+
+import (
+	"fmt"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+	"github.com/Keisim/go-riscv-emu/pkg/symbols"
+)
+
+// maxBacktrace is the maximum number of frames returned by Backtrace.
+const maxBacktrace = 64
+
+// Symbolizer returns the symbolizer of the system, holding the symbols and
+// line tables of the loaded ELF files.
+func (s *System) Symbolizer() *symbols.Symbolizer {
+	return s.symbols
+}
+
+// hartError annotates an error of a hart with the symbolized PC.
+func (s *System) hartError(hart *cpu.Core, err error) error {
+	return fmt.Errorf("hart %d at %s: %w", hart.GetHartID(),
+		s.symbols.Describe(hart.GetPc()), err)
+}
+
+// ReadWord reads a little-endian word from the bus without triggering
+// watchpoints.
+func (s *System) ReadWord(address uint32) (uint32, error) {
+	var word uint32
+	for i := uint32(0); i < 4; i++ {
+		value, err := s.bus.Fetch(address + i)
+		if err != nil {
+			return 0, err
+		}
+		word |= uint32(value) << (8 * i)
+	}
+	return word, nil
+}
+
+// Backtrace returns a best-effort call stack of the hart: its PC followed by
+// the return addresses found by walking the frame pointer chain.
+func (s *System) Backtrace(hart *cpu.Core) []uint32 {
+	return symbols.Backtrace(hart.GetPc(), hart.GetRegister(1),
+		hart.GetRegister(8), s.ReadWord, maxBacktrace)
+}
@@ -0,0 +1,47 @@
+package system
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/symbols"
+)
+
+func TestRun_SymbolizedError(t *testing.T) {
+	sys := NewSystem(false)
+	loadProgram(t, sys, []uint32{addi(1, 0, 1), 0xFFFFFFFF})
+	sys.Symbolizer().AddSymbol(symbols.Symbol{Name: "start", Address: RAMOffset})
+
+	_, err := sys.Run(0)
+	if err == nil {
+		t.Fatal("Expected error for unsupported instruction, got nil")
+	}
+	if !strings.Contains(err.Error(), "80000004 start+0x4") {
+		t.Errorf("Expected symbolized PC in error, got %v", err)
+	}
+}
+
+func TestBacktrace_FramePointer(t *testing.T) {
+	sys := NewSystem(false)
+	hart := sys.Core()
+	hart.SetPc(RAMOffset + 0x100)
+	hart.SetRegister(1, RAMOffset+0x40)   // ra
+	hart.SetRegister(8, RAMOffset+0x1000) // fp
+	writeWord(t, sys, RAMOffset+0x1000-4, RAMOffset+0x80)
+	writeWord(t, sys, RAMOffset+0x1000-8, 0)
+
+	frames := sys.Backtrace(hart)
+	if len(frames) != 2 || frames[0] != RAMOffset+0x100 ||
+		frames[1] != RAMOffset+0x80 {
+		t.Errorf("Unexpected backtrace %X", frames)
+	}
+}
+
+func writeWord(t *testing.T, sys *System, address, value uint32) {
+	t.Helper()
+	for i := uint32(0); i < 4; i++ {
+		if err := sys.Bus().Write(address+i, byte(value>>(8*i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+}
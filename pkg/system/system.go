@@ -1,10 +1,17 @@
 package system
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Keisim/go-riscv-emu/pkg/cpu"
 	"github.com/Keisim/go-riscv-emu/pkg/devices"
+	"github.com/Keisim/go-riscv-emu/pkg/symbols"
 )
 
 const (
@@ -13,15 +20,91 @@ const (
 	DummyTTYOffset = 0x10000000
 )
 
-// System represents the entire emulation system, including the CPU and memory.
+// runChunk is the number of instructions executed per call into the CPU
+// when the System runs without a step limit.
+const runChunk = 1 << 16
+
+// DefaultQuantum is the number of instructions a hart executes before the
+// round-robin scheduler switches to the next one.
+const DefaultQuantum = 100
+
+// SchedulingMode selects how the harts of a System share the host CPU.
+type SchedulingMode int
+
+const (
+	// ScheduleRoundRobin runs the harts one after another on the calling
+	// goroutine, switching harts every quantum instructions. Runs are
+	// deterministic.
+	ScheduleRoundRobin SchedulingMode = iota
+	// ScheduleParallel runs every hart on its own goroutine. Bus accesses
+	// are serialized and tracers installed on the harts are called
+	// concurrently.
+	ScheduleParallel
+)
+
+// String returns the name of the mode as accepted by ParseSchedulingMode.
+func (m SchedulingMode) String() string {
+	switch m {
+	case ScheduleRoundRobin:
+		return "roundrobin"
+	case ScheduleParallel:
+		return "parallel"
+	default:
+		return fmt.Sprintf("SchedulingMode(%d)", int(m))
+	}
+}
+
+// ParseSchedulingMode returns the SchedulingMode with the given name.
+func ParseSchedulingMode(name string) (SchedulingMode, error) {
+	switch name {
+	case "roundrobin":
+		return ScheduleRoundRobin, nil
+	case "parallel":
+		return ScheduleParallel, nil
+	default:
+		return 0, fmt.Errorf("unknown scheduling mode %q", name)
+	}
+}
+
+// System represents the entire emulation system, including the CPU harts and
+// memory.
 type System struct {
-	core *cpu.Core
-	bus  devices.Bus
+	harts []*cpu.Core
+	bus   *devices.Bus
+	host  *devices.Host // Host resources of the devices, or nil
+
+	mode    SchedulingMode
+	quantum uint64
+	current int    // Hart executing in round-robin mode
+	used    uint64 // Instructions executed by the current hart in its quantum
+
+	inputLog inputInterceptor // Recorder or replayer of an input log, or nil
+	history  *history         // Execution history for reverse execution, or nil
+
+	breakpoints []breakpoint
+	watchpoints []watchpoint
+	nextID      int   // Last breakpoint or watchpoint ID handed out
+	hit         *Stop // Watchpoint hit by the executing hart
+
+	symbols *symbols.Symbolizer
+	stats   runStats
+
+	parallel atomic.Bool   // The harts execute on their own goroutines
+	retired  atomic.Uint64 // Instructions retired while running in parallel
+
+	powerStop  atomic.Pointer[Stop] // Power request made while running in parallel
+	resetState []byte               // Snapshot restored by Reset
 }
 
 // NewSystem initializes and returns a new System with a CPU core and RAM device.
 func NewSystem(dummy_tty bool) *System {
-	bus := devices.Bus{}
+	return NewSystemWithHarts(dummy_tty, 1)
+}
+
+// NewSystemWithHarts initializes and returns a new System with the given
+// number of harts sharing a single bus. Hart IDs are assigned from 0.
+func NewSystemWithHarts(dummy_tty bool, harts int) *System {
+	bus := &devices.Bus{}
 	ramDevice := devices.RAMDevice{}
 	ramDevice.Initialize(RAMOffset, 0x10000000) // 256 MB RAM
 	bus.AddDevice(&ramDevice)
@@ -32,29 +115,250 @@ func NewSystem(dummy_tty bool) *System {
 		bus.AddDevice(&dummyTTYDevice)
 	}
 
+	return newSystem(bus, harts)
+}
+
+// newSystem returns a System with the given number of harts sharing the
+// bus.
+func newSystem(bus *devices.Bus, harts int) *System {
 	system := System{
-		core: cpu.NewCore(&bus),
-		bus:  bus,
+		bus:     bus,
+		mode:    ScheduleRoundRobin,
+		quantum: DefaultQuantum,
+		symbols: symbols.New(),
+	}
+	for i := 0; i < harts; i++ {
+		core := cpu.NewCore(bus)
+		core.SetHartID(uint32(i))
+		system.harts = append(system.harts, core)
 	}
 
 	return &system
 }
 
-// Core returns the CPU core of the system.
+// Core returns the CPU core of the system, i.e. its first hart.
 func (s *System) Core() *cpu.Core {
-	return s.core
+	return s.harts[0]
+}
+
+// Harts returns all CPU harts of the system, ordered by hart ID.
+func (s *System) Harts() []*cpu.Core {
+	return s.harts
 }
 
 // Bus returns the device bus of the system.
 func (s *System) Bus() *devices.Bus {
-	return &s.bus
+	return s.bus
 }
 
-// Step executes a single instruction cycle of the CPU core.
+// Close releases the host resources of the devices, e.g. files and
+// sockets. The system must not run afterwards.
+func (s *System) Close() error {
+	if s.host == nil {
+		return nil
+	}
+	return s.host.Close()
+}
+
+// SetScheduling selects how harts are scheduled by Run. The quantum is the
+// number of instructions after which the round-robin scheduler switches to
+// the next hart; it is ignored in parallel mode.
+func (s *System) SetScheduling(mode SchedulingMode, quantum uint64) {
+	if quantum == 0 {
+		quantum = DefaultQuantum
+	}
+	s.mode = mode
+	s.quantum = quantum
+	s.bus.SetSynchronized(mode == ScheduleParallel)
+}
+
+// Scheduling returns the scheduling mode and quantum of the system.
+func (s *System) Scheduling() (SchedulingMode, uint64) {
+	return s.mode, s.quantum
+}
+
+// Step executes a single instruction cycle of the current CPU hart, switching
+// harts in round-robin order once the hart has used up its quantum.
 func (s *System) Step() {
-	err := cpu.Step(s.core)
+	hart := s.harts[s.current]
+	err := cpu.Step(hart)
 	if err != nil {
-		slog.Error("Failed to execute CPU step:", "error", err)
-		panic(err)
+		slog.Error("Failed to execute CPU step:", "hart", hart.GetHartID(),
+			"pc", s.symbols.Describe(hart.GetPc()), "error", err)
+		panic(s.hartError(hart, err))
+	}
+	s.used++
+	if s.used >= s.quantum {
+		s.nextHart()
+	}
+}
+
+// nextHart switches the round-robin scheduler to the next hart.
+func (s *System) nextHart() {
+	s.current = (s.current + 1) % len(s.harts)
+	s.used = 0
+}
+
+// yield switches to the next hart before the current one has used up its
+// quantum. Where this happens depends on how execution is split into Run
+// calls, so the execution history records it for re-execution.
+func (s *System) yield() {
+	s.nextHart()
+	if s.history != nil {
+		s.history.recordSchedule(s.Position(), s.current, s.used)
+	}
+}
+
+// Run executes the given number of instructions on every hart using the
+// execution engine selected on the harts. A steps value of 0 runs until an
+// error occurs. If a breakpoint or watchpoint stops execution early, Run
+// returns which one it was; calling Run again continues from there. The stop
+// records how many of the steps the first hart ran before it.
+func (s *System) Run(steps uint64) (*Stop, error) {
+	start, instret := time.Now(), s.instret()
+	stop, err := s.run(steps)
+	s.account(start, instret, err)
+	return stop, err
+}
+
+// run executes the steps as described for Run.
+func (s *System) run(steps uint64) (*Stop, error) {
+	if steps == 0 {
+		steps = math.MaxUint64
+	}
+	s.hit = nil
+	if s.mode == ScheduleParallel && len(s.harts) > 1 {
+		if s.inputLog != nil {
+			return nil, fmt.Errorf("record and replay require round-robin scheduling")
+		}
+		if s.history != nil {
+			return nil, fmt.Errorf("reverse execution requires round-robin scheduling")
+		}
+		if len(s.breakpoints) > 0 || len(s.watchpoints) > 0 {
+			return nil, fmt.Errorf("breakpoints and watchpoints require round-robin scheduling")
+		}
+		return s.runParallel(steps)
+	}
+	return s.runRoundRobin(steps)
+}
+
+// runRoundRobin executes the harts one after another on the calling
+// goroutine.
+func (s *System) runRoundRobin(steps uint64) (*Stop, error) {
+	if len(s.harts) == 1 {
+		hart, total := s.harts[0], steps
+		for steps > 0 {
+			budget := s.untilCheckpoint(min(steps, runChunk))
+			executed, err := cpu.Run(hart, budget)
+			steps -= executed
+			s.bus.Poll()
+			if err != nil && !errors.Is(err, cpu.ErrStopped) {
+				return nil, s.hartError(hart, err)
+			}
+			if err := s.checkpoint(); err != nil {
+				return nil, err
+			}
+			if err != nil {
+				if stop := s.stopped(hart); stop != nil {
+					stop.Steps = total - steps
+					return stop, nil
+				}
+			}
+		}
+		return nil, nil
+	}
+
+	remaining := make([]uint64, len(s.harts))
+	for i := range remaining {
+		remaining[i] = steps
+	}
+	active := len(s.harts)
+
+	for active > 0 {
+		hart := s.harts[s.current]
+		budget := min(s.quantum-s.used, remaining[s.current])
+		if budget > 0 {
+			executed, err := cpu.Run(hart, s.untilCheckpoint(budget))
+			remaining[s.current] -= executed
+			s.bus.Poll()
+			s.used += executed
+			if err != nil && !errors.Is(err, cpu.ErrStopped) {
+				return nil, s.hartError(hart, err)
+			}
+			if remaining[s.current] == 0 {
+				active--
+			}
+			if err := s.checkpoint(); err != nil {
+				return nil, err
+			}
+			if err != nil {
+				if stop := s.stopped(hart); stop != nil {
+					if s.used >= s.quantum {
+						s.nextHart()
+					}
+					stop.Steps = steps - remaining[0]
+					return stop, nil
+				}
+			}
+			if executed < budget {
+				// Stopped for a checkpoint or a breakpoint whose condition
+				// is false; the hart keeps its quantum.
+				continue
+			}
+		}
+		if s.used >= s.quantum {
+			s.nextHart()
+		} else {
+			s.yield()
+		}
+	}
+	return nil, nil
+}
+
+// runParallel executes every hart on its own goroutine. The first error or
+// power request stops all harts.
+func (s *System) runParallel(steps uint64) (*Stop, error) {
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	var first uint64 // steps run by the first hart
+	errs := make([]error, len(s.harts))
+	s.retired.Store(s.instret())
+	s.parallel.Store(true)
+	defer s.parallel.Store(false)
+	s.bus.Poll()
+
+	for i, hart := range s.harts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			remaining := steps
+			if i == 0 {
+				defer func() { first = steps - remaining }()
+			}
+			for remaining > 0 && !stop.Load() && s.powerStop.Load() == nil {
+				executed, err := cpu.Run(hart, min(remaining, runChunk))
+				remaining -= executed
+				s.retired.Add(executed)
+				if i == 0 {
+					// Devices are polled by a single hart.
+					s.bus.Poll()
+				}
+				if err != nil {
+					errs[i] = s.hartError(hart, err)
+					stop.Store(true)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	power := s.powerStop.Swap(nil)
+	if power != nil {
+		power.Steps = first
 	}
+	return power, nil
 }
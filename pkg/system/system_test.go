@@ -0,0 +1,243 @@
+package system
+
+import (
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/cpu"
+)
+
+// Instruction encoders for the test programs.
+
+func iType(opcode, func3, rd, rs1 uint32, imm int32) uint32 {
+	return uint32(imm)<<20 | rs1<<15 | func3<<12 | rd<<7 | opcode
+}
+
+func sType(opcode, func3, rs1, rs2 uint32, imm int32) uint32 {
+	u := uint32(imm)
+	return (u>>5&0x7F)<<25 | rs2<<20 | rs1<<15 | func3<<12 |
+		(u&0x1F)<<7 | opcode
+}
+
+func bType(opcode, func3, rs1, rs2 uint32, imm int32) uint32 {
+	u := uint32(imm)
+	return (u>>12&1)<<31 | (u>>5&0x3F)<<25 | rs2<<20 | rs1<<15 |
+		func3<<12 | (u>>1&0xF)<<8 | (u>>11&1)<<7 | opcode
+}
+
+func amo(funct5, rd, rs1, rs2 uint32) uint32 {
+	return funct5<<27 | rs2<<20 | rs1<<15 | 0b010<<12 | rd<<7 | 0b0101111
+}
+
+func addi(rd, rs1 uint32, imm int32) uint32 {
+	return iType(0b0010011, 0b000, rd, rs1, imm)
+}
+
+func bne(rs1, rs2 uint32, imm int32) uint32 {
+	return bType(0b1100011, 0b001, rs1, rs2, imm)
+}
+
+// spinlockProgram increments a byte counter 50 times on every hart, guarding
+// the non-atomic read-modify-write with an LR/SC spinlock:
+//
+//	0x00: LUI       x5, 0x80001         lock word, counter at 4(x5)
+//	0x04: ADDI      x6, x0, 1
+//	0x08: ADDI      x10, x0, 50
+//	0x0C: LR.W      x7, (x5)            acquire
+//	0x10: BNE       x7, x0, acquire
+//	0x14: SC.W      x7, x6, (x5)
+//	0x18: BNE       x7, x0, acquire
+//	0x1C: LBU       x8, 4(x5)
+//	0x20: ADDI      x8, x8, 1
+//	0x24: SB        x8, 4(x5)
+//	0x28: AMOSWAP.W x0, x0, (x5)        release
+//	0x2C: ADDI      x9, x9, 1
+//	0x30: BNE       x9, x10, acquire
+//	0x34: CSRRS     x11, mhartid, x0
+//	0x38: JAL       x0, 0
+var spinlockProgram = []uint32{
+	0x80001<<12 | 5<<7 | 0b0110111,
+	addi(6, 0, 1),
+	addi(10, 0, 50),
+	amo(0b00010, 7, 5, 0),
+	bne(7, 0, -4),
+	amo(0b00011, 7, 5, 6),
+	bne(7, 0, -12),
+	iType(0b0000011, 0b100, 8, 5, 4),
+	addi(8, 8, 1),
+	sType(0b0100011, 0b000, 5, 8, 4),
+	amo(0b00001, 0, 5, 0),
+	addi(9, 9, 1),
+	bne(9, 10, -0x24),
+	iType(0b1110011, 0b010, 11, 0, cpu.CsrMhartid-0x1000),
+	0b1101111,
+}
+
+// loadProgram writes the program to the start of RAM and points every hart
+// at it.
+func loadProgram(t *testing.T, sys *System, program []uint32) {
+	t.Helper()
+	for i, instruction := range program {
+		for j := uint32(0); j < 4; j++ {
+			address := RAMOffset + uint32(4*i) + j
+			err := sys.Bus().Write(address, byte(instruction>>(8*j)))
+			if err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+	}
+	for _, hart := range sys.Harts() {
+		hart.SetPc(RAMOffset)
+	}
+}
+
+// spinlockDone reports whether every hart reached the final loop of
+// spinlockProgram.
+func spinlockDone(sys *System) bool {
+	for _, hart := range sys.Harts() {
+		if hart.GetPc() != RAMOffset+0x38 {
+			return false
+		}
+	}
+	return true
+}
+
+func checkSpinlockResult(t *testing.T, sys *System) {
+	t.Helper()
+	counter, err := sys.Bus().Read(0x80001004)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	expected := byte(50 * len(sys.Harts()))
+	if counter != expected {
+		t.Errorf("Expected counter to be %d, got %d", expected, counter)
+	}
+
+	for i, hart := range sys.Harts() {
+		if hart.GetRegister(11) != uint32(i) {
+			t.Errorf("Expected hart %d to read mhartid %d, got %d", i, i,
+				hart.GetRegister(11))
+		}
+	}
+}
+
+func TestNewSystemWithHarts(t *testing.T) {
+	sys := NewSystemWithHarts(false, 4)
+
+	if len(sys.Harts()) != 4 {
+		t.Fatalf("Expected 4 harts, got %d", len(sys.Harts()))
+	}
+	for i, hart := range sys.Harts() {
+		if hart.GetHartID() != uint32(i) {
+			t.Errorf("Expected hart ID %d, got %d", i, hart.GetHartID())
+		}
+	}
+	if sys.Core() != sys.Harts()[0] {
+		t.Error("Expected Core to return the first hart")
+	}
+}
+
+func TestRun_RoundRobinSpinlock(t *testing.T) {
+	sys := NewSystemWithHarts(false, 4)
+	// A tiny quantum preempts harts inside the critical section.
+	sys.SetScheduling(ScheduleRoundRobin, 3)
+	loadProgram(t, sys, spinlockProgram)
+
+	_, err := sys.Run(20000)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	checkSpinlockResult(t, sys)
+}
+
+func TestRun_RoundRobinDeterministic(t *testing.T) {
+	run := func() [4]uint32 {
+		sys := NewSystemWithHarts(false, 4)
+		sys.SetScheduling(ScheduleRoundRobin, 7)
+		loadProgram(t, sys, spinlockProgram)
+		if _, err := sys.Run(1000); err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		var pcs [4]uint32
+		for i, hart := range sys.Harts() {
+			pcs[i] = hart.GetPc()
+		}
+		return pcs
+	}
+
+	first := run()
+	second := run()
+	if first != second {
+		t.Errorf("Expected identical runs, got PCs %X and %X", first, second)
+	}
+}
+
+func TestRun_ParallelSpinlock(t *testing.T) {
+	for _, engine := range []cpu.Engine{cpu.EngineInterpreter, cpu.EngineBlock} {
+		t.Run(engine.String(), func(t *testing.T) {
+			sys := NewSystemWithHarts(false, 4)
+			sys.SetScheduling(ScheduleParallel, 0)
+			loadProgram(t, sys, spinlockProgram)
+			for _, hart := range sys.Harts() {
+				hart.SetEngine(engine)
+			}
+
+			// Parallel harts spin for as long as the host schedules them,
+			// so no step budget is enough; run until all of them finished.
+			for round := 0; !spinlockDone(sys); round++ {
+				if round == 1000 {
+					t.Fatal("Expected the harts to finish the spinlock loop")
+				}
+				if _, err := sys.Run(20000); err != nil {
+					t.Fatalf("Run failed: %v", err)
+				}
+			}
+
+			checkSpinlockResult(t, sys)
+		})
+	}
+}
+
+func TestRun_ParallelError(t *testing.T) {
+	sys := NewSystemWithHarts(false, 2)
+	sys.SetScheduling(ScheduleParallel, 0)
+	loadProgram(t, sys, []uint32{0xFFFFFFFF})
+
+	_, err := sys.Run(0)
+	if err == nil {
+		t.Fatal("Expected error for unsupported instruction, got nil")
+	}
+}
+
+func TestStep_RoundRobin(t *testing.T) {
+	sys := NewSystemWithHarts(false, 2)
+	sys.SetScheduling(ScheduleRoundRobin, 1)
+	loadProgram(t, sys, []uint32{addi(1, 1, 1), addi(1, 1, 1)})
+
+	sys.Step()
+	sys.Step()
+	sys.Step()
+
+	if pc := sys.Harts()[0].GetPc(); pc != RAMOffset+8 {
+		t.Errorf("Expected hart 0 at %X, got %X", RAMOffset+8, pc)
+	}
+	if pc := sys.Harts()[1].GetPc(); pc != RAMOffset+4 {
+		t.Errorf("Expected hart 1 at %X, got %X", RAMOffset+4, pc)
+	}
+}
+
+func TestParseSchedulingMode(t *testing.T) {
+	for _, mode := range []SchedulingMode{ScheduleRoundRobin, ScheduleParallel} {
+		parsed, err := ParseSchedulingMode(mode.String())
+		if err != nil {
+			t.Fatalf("ParseSchedulingMode(%q) failed: %v", mode, err)
+		}
+		if parsed != mode {
+			t.Errorf("Expected %v, got %v", mode, parsed)
+		}
+	}
+
+	if _, err := ParseSchedulingMode("random"); err == nil {
+		t.Error("Expected error for unknown mode, got nil")
+	}
+}
@@ -0,0 +1,1113 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+func init() {
+	devices.Register("virtio-9p", func(baseAddress, size uint32, params json.RawMessage) (devices.BusDevice, error) {
+		var p struct {
+			transportParams
+			Path     string `json:"path"`      // Host directory to share
+			Tag      string `json:"tag"`       // Mount tag, "hostshare" by default
+			ReadOnly bool   `json:"read-only"` // Reject changes of the guest
+		}
+		if err := devices.DecodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		if p.Path == "" {
+			return nil, fmt.Errorf("virtio-9p needs a path")
+		}
+		if p.Tag == "" {
+			p.Tag = "hostshare"
+		}
+		share, err := newShare(p.Path, p.Tag, p.ReadOnly)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			size = TransportSize
+		}
+		t := NewTransport(share, p.IRQ)
+		t.Initialize(baseAddress, size)
+		return t, nil
+	})
+}
+
+// Feature bits of virtio-9p.
+const p9FeatureMountTag = 0
+
+// Message types of 9P2000.L. Replies have the type of their request plus
+// one.
+const (
+	p9Rlerror   = 7
+	p9Tstatfs   = 8
+	p9Tlopen    = 12
+	p9Tlcreate  = 14
+	p9Tsymlink  = 16
+	p9Trename   = 20
+	p9Treadlink = 22
+	p9Tgetattr  = 24
+	p9Tsetattr  = 26
+	p9Treaddir  = 40
+	p9Tfsync    = 50
+	p9Tlock     = 52
+	p9Tgetlock  = 54
+	p9Tlink     = 70
+	p9Tmkdir    = 72
+	p9Trenameat = 74
+	p9Tunlinkat = 76
+	p9Tversion  = 100
+	p9Tattach   = 104
+	p9Tflush    = 108
+	p9Twalk     = 110
+	p9Tread     = 116
+	p9Twrite    = 118
+	p9Tclunk    = 120
+	p9Tremove   = 122
+)
+
+// Errors returned to the guest, as Linux errno values.
+const (
+	p9ENOENT     = 2
+	p9EBADF      = 9
+	p9EACCES     = 13
+	p9EEXIST     = 17
+	p9ENOTDIR    = 20
+	p9EISDIR     = 21
+	p9EINVAL     = 22
+	p9EROFS      = 30
+	p9ENOTEMPTY  = 39
+	p9EOPNOTSUPP = 95
+)
+
+// Flags of Tlopen and Tlcreate, as on Linux.
+const (
+	p9OpenWriteOnly = 0x1
+	p9OpenReadWrite = 0x2
+	p9OpenCreate    = 0x40
+	p9OpenExclusive = 0x80
+	p9OpenTruncate  = 0x200
+	p9OpenAppend    = 0x400
+)
+
+// Attributes of Tsetattr.
+const (
+	p9SetMode     = 0x1
+	p9SetUID      = 0x2
+	p9SetGID      = 0x4
+	p9SetSize     = 0x8
+	p9SetATime    = 0x10
+	p9SetMTime    = 0x20
+	p9SetATimeSet = 0x80
+	p9SetMTimeSet = 0x100
+)
+
+const (
+	p9Version     = "9P2000.L"
+	p9HeaderSize  = 7         // size[4] type[1] tag[2]
+	p9MaxMessage  = 512 << 10 // Largest msize offered to the guest
+	p9GetattrAll  = 0x3FFF
+	p9V9FSMagic   = 0x01021997
+	p9QidDir      = 0x80
+	p9QidSymlink  = 0x02
+	p9BlockSize   = 4096
+	p9NameMax     = 255
+	p9RemoveDir   = 0x200 // AT_REMOVEDIR of Tunlinkat
+	p9LockSuccess = 0
+	p9LockUnlock  = 2 // F_UNLCK of Tgetlock
+)
+
+// errP9Malformed is returned for messages that end too early.
+var errP9Malformed = errors.New("malformed 9P message")
+
+// p9Reader decodes the fields of a 9P message. After the first error all
+// fields are zero.
+type p9Reader struct {
+	data []byte
+	err  error
+}
+
+func (r *p9Reader) take(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = errP9Malformed
+		return make([]byte, min(n, 8))
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *p9Reader) u8() uint8   { return r.take(1)[0] }
+func (r *p9Reader) u16() uint16 { return binary.LittleEndian.Uint16(r.take(2)) }
+func (r *p9Reader) u32() uint32 { return binary.LittleEndian.Uint32(r.take(4)) }
+func (r *p9Reader) u64() uint64 { return binary.LittleEndian.Uint64(r.take(8)) }
+
+func (r *p9Reader) string() string {
+	return string(r.take(int(r.u16())))
+}
+
+// appendString appends a 9P string, prefixed with its length.
+func appendString(b []byte, s string) []byte {
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// p9Fid is a file of the share referenced by the guest.
+type p9Fid struct {
+	path    string   // Slash-separated path in the share, "." for its root
+	file    *os.File // Open file after Tlopen or Tlcreate
+	flags   int      // Flags the file was opened with
+	entries []fs.DirEntry
+}
+
+// Share is a virtio-9p device sharing a host directory with the guest over
+// 9P2000.L. The guest cannot reach files outside the directory, neither
+// through ".." nor through symbolic links.
+type Share struct {
+	dir      string
+	root     *os.Root // Opened by Open
+	tag      string
+	readOnly bool
+	msize    uint32
+	fids     map[uint32]*p9Fid
+	qids     map[string]uint64 // Stable qid paths of the files seen
+}
+
+// NewShare returns a virtio-9p device sharing the directory dir under the
+// mount tag tag. Close closes the directory.
+func NewShare(dir, tag string, readOnly bool) (*Share, error) {
+	s, err := newShare(dir, tag, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Open(nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newShare returns a share of dir whose directory is not opened yet.
+func newShare(dir, tag string, readOnly bool) (*Share, error) {
+	if len(tag) > 0xFFFF {
+		return nil, fmt.Errorf("mount tag is too long")
+	}
+	return &Share{dir: dir, tag: tag, readOnly: readOnly,
+		msize: p9MaxMessage, fids: map[uint32]*p9Fid{},
+		qids: map[string]uint64{}}, nil
+}
+
+// Open opens the shared directory.
+func (s *Share) Open(host *devices.Host) error {
+	if s.root != nil {
+		return nil
+	}
+	root, err := os.OpenRoot(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to open shared directory: %v", err)
+	}
+	s.root = root
+	return nil
+}
+
+// Close closes the files of the guest and the shared directory.
+func (s *Share) Close() error {
+	s.clunkAll()
+	if s.root == nil {
+		return nil
+	}
+	err := s.root.Close()
+	s.root = nil
+	return err
+}
+
+func (s *Share) DeviceID() uint32 {
+	return DeviceID9P
+}
+
+func (s *Share) Features() uint64 {
+	return 1 << p9FeatureMountTag
+}
+
+func (s *Share) Queues() int {
+	return 1
+}
+
+// ReadConfig reads the configuration space: the length of the mount tag
+// followed by the tag.
+func (s *Share) ReadConfig(offset uint32) byte {
+	if offset < 2 {
+		return byte(len(s.tag) >> (8 * offset))
+	}
+	if int(offset-2) < len(s.tag) {
+		return s.tag[offset-2]
+	}
+	return 0
+}
+
+// WriteConfig ignores writes, as the configuration space is read-only.
+func (s *Share) WriteConfig(offset uint32, value byte) {
+}
+
+// Reset closes all files of the guest.
+func (s *Share) Reset() {
+	s.clunkAll()
+	s.msize = p9MaxMessage
+}
+
+func (s *Share) clunkAll() {
+	for _, f := range s.fids {
+		if f.file != nil {
+			f.file.Close()
+		}
+	}
+	s.fids = map[uint32]*p9Fid{}
+}
+
+// Notify handles the requests of the guest.
+func (s *Share) Notify(t *Transport, queue int) error {
+	q := t.Queue(queue)
+	for {
+		chain, err := q.Pop()
+		if err != nil || chain == nil {
+			return err
+		}
+		request, err := chain.Read()
+		if err != nil {
+			return err
+		}
+		if chain.WritableSize() < p9HeaderSize+4 {
+			return fmt.Errorf("9P request without room for a reply")
+		}
+		reply := s.handle(request, min(chain.WritableSize(), s.msize))
+		if uint32(len(reply)) > chain.WritableSize() {
+			return fmt.Errorf("9P reply of %d bytes does not fit into %d bytes",
+				len(reply), chain.WritableSize())
+		}
+		if err := chain.WriteAt(reply, 0); err != nil {
+			return err
+		}
+		if err := q.Push(chain, uint32(len(reply))); err != nil {
+			return err
+		}
+	}
+}
+
+// handle returns the reply to a request. Replies are limited to max bytes.
+func (s *Share) handle(request []byte, max uint32) []byte {
+	r := &p9Reader{data: request}
+	size := r.u32()
+	kind := r.u8()
+	tag := r.u16()
+	if r.err == nil && size >= p9HeaderSize && int(size) <= len(request) {
+		r.data = request[p9HeaderSize:size]
+	}
+
+	var body []byte
+	var err error
+	if r.err == nil {
+		body, err = s.dispatch(kind, r, max-p9HeaderSize)
+	}
+	if r.err != nil {
+		err = r.err
+	}
+	if err != nil {
+		kind = p9Rlerror - 1
+		body = binary.LittleEndian.AppendUint32(nil, p9Errno(err))
+	}
+
+	reply := binary.LittleEndian.AppendUint32(nil, uint32(p9HeaderSize+len(body)))
+	reply = append(reply, kind+1)
+	reply = binary.LittleEndian.AppendUint16(reply, tag)
+	return append(reply, body...)
+}
+
+// p9Errno returns the Linux errno of an error. Errors of system calls are
+// passed on, which matches on Linux hosts.
+func p9Errno(err error) uint32 {
+	var errno syscall.Errno
+	switch {
+	case errors.Is(err, errP9Malformed):
+		return p9EINVAL
+	case errors.As(err, &errno):
+		return uint32(errno)
+	case errors.Is(err, fs.ErrNotExist):
+		return p9ENOENT
+	case errors.Is(err, fs.ErrExist):
+		return p9EEXIST
+	case errors.Is(err, fs.ErrPermission):
+		return p9EACCES
+	}
+	// Paths escaping the share through symbolic links end up here.
+	return p9EACCES
+}
+
+// dispatch handles a request and returns the body of its reply.
+func (s *Share) dispatch(kind uint8, r *p9Reader, max uint32) ([]byte, error) {
+	switch kind {
+	case p9Tversion:
+		return s.version(r)
+	case p9Tattach:
+		return s.attach(r)
+	case p9Tflush:
+		return nil, nil // Requests complete before the next one starts
+	case p9Twalk:
+		return s.walk(r)
+	case p9Tclunk:
+		return nil, s.clunk(r.u32())
+	case p9Tgetattr:
+		return s.getattr(r)
+	case p9Tstatfs:
+		return s.statfs(r)
+	case p9Tlopen:
+		return s.lopen(r)
+	case p9Tread:
+		return s.read(r, max)
+	case p9Treaddir:
+		return s.readdir(r, max)
+	case p9Treadlink:
+		return s.readlink(r)
+	case p9Tfsync:
+		f, err := s.openFid(r.u32())
+		if err != nil {
+			return nil, err
+		}
+		return nil, f.file.Sync()
+	case p9Tlock:
+		return []byte{p9LockSuccess}, nil
+	case p9Tgetlock:
+		return s.getlock(r)
+	}
+
+	if s.readOnly {
+		switch kind {
+		case p9Tlcreate, p9Tsymlink, p9Trename, p9Tsetattr, p9Twrite,
+			p9Tlink, p9Tmkdir, p9Trenameat, p9Tunlinkat, p9Tremove:
+			return nil, syscall.Errno(p9EROFS)
+		}
+	}
+	switch kind {
+	case p9Tlcreate:
+		return s.lcreate(r)
+	case p9Twrite:
+		return s.write(r)
+	case p9Tsetattr:
+		return nil, s.setattr(r)
+	case p9Tmkdir:
+		return s.mkdir(r)
+	case p9Tsymlink:
+		return s.symlink(r)
+	case p9Tlink:
+		return nil, s.link(r)
+	case p9Trename:
+		return nil, s.rename(r)
+	case p9Trenameat:
+		return nil, s.renameat(r)
+	case p9Tunlinkat:
+		return nil, s.unlinkat(r)
+	case p9Tremove:
+		return nil, s.remove(r)
+	}
+	return nil, syscall.Errno(p9EOPNOTSUPP)
+}
+
+// fid returns the fid with the given number.
+func (s *Share) fid(number uint32) (*p9Fid, error) {
+	f, ok := s.fids[number]
+	if !ok {
+		return nil, syscall.Errno(p9EBADF)
+	}
+	return f, nil
+}
+
+// openFid returns a fid with an open file.
+func (s *Share) openFid(number uint32) (*p9Fid, error) {
+	f, err := s.fid(number)
+	if err == nil && f.file == nil {
+		err = syscall.Errno(p9EBADF)
+	}
+	return f, err
+}
+
+// child returns the path of the entry name of the directory dir. Names
+// must not contain separators, and ".." does not leave the share.
+func child(dir, name string) (string, error) {
+	switch {
+	case name == "" || strings.Contains(name, "/") || name == ".":
+		return "", syscall.Errno(p9EINVAL)
+	case name == "..":
+		return path.Dir(dir), nil
+	}
+	return path.Join(dir, name), nil
+}
+
+// qid returns the qid of the file at path p.
+func (s *Share) qid(p string, info fs.FileInfo) []byte {
+	id, ok := s.qids[p]
+	if !ok {
+		id = uint64(len(s.qids))
+		s.qids[p] = id
+	}
+	var kind byte
+	switch {
+	case info.IsDir():
+		kind = p9QidDir
+	case info.Mode()&fs.ModeSymlink != 0:
+		kind = p9QidSymlink
+	}
+	qid := []byte{kind}
+	qid = binary.LittleEndian.AppendUint32(qid, uint32(info.ModTime().UnixNano()))
+	return binary.LittleEndian.AppendUint64(qid, id)
+}
+
+// statQid returns the qid of the file at path p.
+func (s *Share) statQid(p string) ([]byte, error) {
+	info, err := s.root.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	return s.qid(p, info), nil
+}
+
+func (s *Share) version(r *p9Reader) ([]byte, error) {
+	msize := r.u32()
+	version := r.string()
+	s.clunkAll()
+	s.msize = min(max(msize, 4096), p9MaxMessage)
+	if version != p9Version {
+		version = "unknown"
+	}
+	return appendString(binary.LittleEndian.AppendUint32(nil, s.msize), version), nil
+}
+
+func (s *Share) attach(r *p9Reader) ([]byte, error) {
+	fid := r.u32()
+	r.u32() // afid
+	r.string()
+	r.string() // aname; the share has a single tree
+	if r.err != nil {
+		return nil, r.err
+	}
+	if _, ok := s.fids[fid]; ok {
+		return nil, syscall.Errno(p9EBADF)
+	}
+	qid, err := s.statQid(".")
+	if err != nil {
+		return nil, err
+	}
+	s.fids[fid] = &p9Fid{path: "."}
+	return qid, nil
+}
+
+func (s *Share) walk(r *p9Reader) ([]byte, error) {
+	f, err := s.fid(r.u32())
+	newFid := r.u32()
+	names := make([]string, r.u16())
+	for i := range names {
+		names[i] = r.string()
+	}
+	if r.err != nil || err != nil {
+		return nil, errors.Join(r.err, err)
+	}
+	if _, ok := s.fids[newFid]; ok && s.fids[newFid] != f {
+		return nil, syscall.Errno(p9EBADF)
+	}
+
+	p := f.path
+	var qids [][]byte
+	for _, name := range names {
+		next, err := child(p, name)
+		if err == nil {
+			var qid []byte
+			if qid, err = s.statQid(next); err == nil {
+				p = next
+				qids = append(qids, qid)
+				continue
+			}
+		}
+		if len(qids) == 0 {
+			return nil, err
+		}
+		break
+	}
+	if len(qids) == len(names) {
+		if old := s.fids[newFid]; old != nil && old.file != nil {
+			old.file.Close()
+		}
+		s.fids[newFid] = &p9Fid{path: p}
+	}
+	reply := binary.LittleEndian.AppendUint16(nil, uint16(len(qids)))
+	for _, qid := range qids {
+		reply = append(reply, qid...)
+	}
+	return reply, nil
+}
+
+func (s *Share) clunk(number uint32) error {
+	f, err := s.fid(number)
+	if err != nil {
+		return err
+	}
+	delete(s.fids, number)
+	if f.file != nil {
+		return f.file.Close()
+	}
+	return nil
+}
+
+// linuxMode returns the st_mode of a file on Linux.
+func linuxMode(mode fs.FileMode) uint32 {
+	linux := uint32(mode.Perm())
+	switch mode.Type() {
+	case fs.ModeDir:
+		linux |= 0o040000
+	case fs.ModeSymlink:
+		linux |= 0o120000
+	case fs.ModeNamedPipe:
+		linux |= 0o010000
+	case fs.ModeSocket:
+		linux |= 0o140000
+	case fs.ModeDevice:
+		linux |= 0o060000
+	case fs.ModeDevice | fs.ModeCharDevice:
+		linux |= 0o020000
+	default:
+		linux |= 0o100000
+	}
+	if mode&fs.ModeSetuid != 0 {
+		linux |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		linux |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		linux |= 0o1000
+	}
+	return linux
+}
+
+// getattr returns the attributes of a file. Files are reported as owned
+// by root, with a single link and the modification time as all times.
+func (s *Share) getattr(r *p9Reader) ([]byte, error) {
+	f, err := s.fid(r.u32())
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.root.Lstat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(info.Size())
+	nlink := uint64(1)
+	if info.IsDir() {
+		nlink = 2
+	}
+	mtime := info.ModTime()
+
+	reply := binary.LittleEndian.AppendUint64(nil, p9GetattrAll)
+	reply = append(reply, s.qid(f.path, info)...)
+	reply = binary.LittleEndian.AppendUint32(reply, linuxMode(info.Mode()))
+	reply = binary.LittleEndian.AppendUint32(reply, 0) // uid
+	reply = binary.LittleEndian.AppendUint32(reply, 0) // gid
+	for _, value := range []uint64{nlink, 0, size, p9BlockSize, (size + 511) / 512} {
+		reply = binary.LittleEndian.AppendUint64(reply, value)
+	}
+	for range 4 { // atime, mtime, ctime and btime
+		reply = binary.LittleEndian.AppendUint64(reply, uint64(mtime.Unix()))
+		reply = binary.LittleEndian.AppendUint64(reply, uint64(mtime.Nanosecond()))
+	}
+	reply = binary.LittleEndian.AppendUint64(reply, 0) // gen
+	return binary.LittleEndian.AppendUint64(reply, 0), nil
+}
+
+func (s *Share) setattr(r *p9Reader) error {
+	f, err := s.fid(r.u32())
+	valid := r.u32()
+	mode := r.u32()
+	uid, gid := r.u32(), r.u32()
+	size := r.u64()
+	atime := time.Unix(int64(r.u64()), int64(r.u64()))
+	mtime := time.Unix(int64(r.u64()), int64(r.u64()))
+	if r.err != nil || err != nil {
+		return errors.Join(r.err, err)
+	}
+
+	if valid&p9SetMode != 0 {
+		perm := fs.FileMode(mode & 0o777)
+		if mode&0o4000 != 0 {
+			perm |= fs.ModeSetuid
+		}
+		if mode&0o2000 != 0 {
+			perm |= fs.ModeSetgid
+		}
+		if mode&0o1000 != 0 {
+			perm |= fs.ModeSticky
+		}
+		if err := s.root.Chmod(f.path, perm); err != nil {
+			return err
+		}
+	}
+	if valid&(p9SetUID|p9SetGID) != 0 {
+		owner, group := -1, -1
+		if valid&p9SetUID != 0 {
+			owner = int(uid)
+		}
+		if valid&p9SetGID != 0 {
+			group = int(gid)
+		}
+		if err := s.root.Lchown(f.path, owner, group); err != nil {
+			return err
+		}
+	}
+	if valid&p9SetSize != 0 {
+		file, err := s.root.OpenFile(f.path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		err = file.Truncate(int64(size))
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if valid&(p9SetATime|p9SetMTime) != 0 {
+		now := time.Now()
+		if valid&p9SetATimeSet == 0 {
+			atime = now
+		}
+		if valid&p9SetMTimeSet == 0 {
+			mtime = now
+		}
+		if valid&p9SetATime == 0 || valid&p9SetMTime == 0 {
+			info, err := s.root.Stat(f.path)
+			if err != nil {
+				return err
+			}
+			if valid&p9SetATime == 0 {
+				atime = info.ModTime()
+			}
+			if valid&p9SetMTime == 0 {
+				mtime = info.ModTime()
+			}
+		}
+		return s.root.Chtimes(f.path, atime, mtime)
+	}
+	return nil
+}
+
+func (s *Share) statfs(r *p9Reader) ([]byte, error) {
+	if _, err := s.fid(r.u32()); err != nil {
+		return nil, err
+	}
+	reply := binary.LittleEndian.AppendUint32(nil, p9V9FSMagic)
+	reply = binary.LittleEndian.AppendUint32(reply, p9BlockSize)
+	for range 6 { // blocks, bfree, bavail, files, ffree and fsid
+		reply = binary.LittleEndian.AppendUint64(reply, 0)
+	}
+	return binary.LittleEndian.AppendUint32(reply, p9NameMax), nil
+}
+
+// openFlags returns the flags of os.OpenFile for the Linux open flags of
+// the guest.
+func (s *Share) openFlags(linux uint32) (int, error) {
+	var flags int
+	switch linux & 3 {
+	case p9OpenWriteOnly:
+		flags = os.O_WRONLY
+	case p9OpenReadWrite:
+		flags = os.O_RDWR
+	default:
+		flags = os.O_RDONLY
+	}
+	for _, flag := range []struct {
+		linux uint32
+		flag  int
+	}{
+		{p9OpenCreate, os.O_CREATE},
+		{p9OpenExclusive, os.O_EXCL},
+		{p9OpenTruncate, os.O_TRUNC},
+		{p9OpenAppend, os.O_APPEND},
+	} {
+		if linux&flag.linux != 0 {
+			flags |= flag.flag
+		}
+	}
+	if s.readOnly && flags&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return 0, syscall.Errno(p9EROFS)
+	}
+	return flags, nil
+}
+
+// open opens the file of a fid and returns the reply of Tlopen and
+// Tlcreate.
+func (s *Share) open(f *p9Fid, flags int, perm fs.FileMode) ([]byte, error) {
+	if f.file != nil {
+		return nil, syscall.Errno(p9EBADF)
+	}
+	file, err := s.root.OpenFile(f.path, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f.file, f.flags, f.entries = file, flags, nil
+	return binary.LittleEndian.AppendUint32(s.qid(f.path, info), 0), nil
+}
+
+func (s *Share) lopen(r *p9Reader) ([]byte, error) {
+	f, err := s.fid(r.u32())
+	linux := r.u32()
+	if r.err != nil || err != nil {
+		return nil, errors.Join(r.err, err)
+	}
+	flags, err := s.openFlags(linux)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(f, flags&^(os.O_CREATE|os.O_EXCL), 0)
+}
+
+func (s *Share) lcreate(r *p9Reader) ([]byte, error) {
+	f, err := s.fid(r.u32())
+	name := r.string()
+	linux := r.u32()
+	mode := r.u32()
+	r.u32() // gid
+	if r.err != nil || err != nil {
+		return nil, errors.Join(r.err, err)
+	}
+	p, err := child(f.path, name)
+	if err != nil {
+		return nil, err
+	}
+	flags, err := s.openFlags(linux)
+	if err != nil {
+		return nil, err
+	}
+	created := &p9Fid{path: p}
+	reply, err := s.open(created, flags|os.O_CREATE|os.O_EXCL, fs.FileMode(mode&0o777))
+	if err != nil {
+		return nil, err
+	}
+	*f = *created
+	return reply, nil
+}
+
+func (s *Share) read(r *p9Reader, max uint32) ([]byte, error) {
+	f, err := s.openFid(r.u32())
+	offset := r.u64()
+	count := min(r.u32(), max-4)
+	if r.err != nil || err != nil {
+		return nil, errors.Join(r.err, err)
+	}
+	data := make([]byte, 4+count)
+	n, err := f.file.ReadAt(data[4:], int64(offset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(data, uint32(n))
+	return data[:4+n], nil
+}
+
+func (s *Share) write(r *p9Reader) ([]byte, error) {
+	f, err := s.openFid(r.u32())
+	offset := r.u64()
+	data := r.take(int(r.u32()))
+	if r.err != nil || err != nil {
+		return nil, errors.Join(r.err, err)
+	}
+	var n int
+	if f.flags&os.O_APPEND != 0 {
+		n, err = f.file.Write(data)
+	} else {
+		n, err = f.file.WriteAt(data, int64(offset))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return binary.LittleEndian.AppendUint32(nil, uint32(n)), nil
+}
+
+// readdir returns directory entries from the offset of a previous entry.
+// The entries are read when reading from offset 0, sorted by name and
+// preceded by "." and "..".
+func (s *Share) readdir(r *p9Reader, max uint32) ([]byte, error) {
+	f, err := s.openFid(r.u32())
+	offset := r.u64()
+	count := min(r.u32(), max-4)
+	if r.err != nil || err != nil {
+		return nil, errors.Join(r.err, err)
+	}
+	if offset == 0 {
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			return nil, syscall.Errno(p9ENOTDIR)
+		}
+		entries, err := f.file.ReadDir(-1)
+		if err != nil {
+			return nil, err
+		}
+		slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+			return strings.Compare(a.Name(), b.Name())
+		})
+		f.entries = entries
+	}
+
+	reply := make([]byte, 4)
+	for i := offset; i < uint64(len(f.entries))+2; i++ {
+		name, p := ".", f.path
+		if i == 1 {
+			name, p = "..", path.Dir(f.path)
+		} else if i > 1 {
+			name = f.entries[i-2].Name()
+			p = path.Join(f.path, name)
+		}
+		info, err := s.root.Lstat(p)
+		if err != nil {
+			continue // Removed since the directory was read
+		}
+		qid := s.qid(p, info)
+		if uint32(len(reply)+len(qid)+8+1+2+len(name)) > 4+count {
+			break
+		}
+		reply = append(reply, qid...)
+		reply = binary.LittleEndian.AppendUint64(reply, i+1)
+		reply = append(reply, byte(linuxMode(info.Mode())>>12)) // d_type
+		reply = appendString(reply, name)
+	}
+	binary.LittleEndian.PutUint32(reply, uint32(len(reply)-4))
+	return reply, nil
+}
+
+func (s *Share) readlink(r *p9Reader) ([]byte, error) {
+	f, err := s.fid(r.u32())
+	if err != nil {
+		return nil, err
+	}
+	target, err := s.root.Readlink(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return appendString(nil, target), nil
+}
+
+func (s *Share) getlock(r *p9Reader) ([]byte, error) {
+	if _, err := s.fid(r.u32()); err != nil {
+		return nil, err
+	}
+	r.u8() // type
+	start, length := r.u64(), r.u64()
+	procID := r.u32()
+	clientID := r.string()
+	reply := []byte{p9LockUnlock}
+	reply = binary.LittleEndian.AppendUint64(reply, start)
+	reply = binary.LittleEndian.AppendUint64(reply, length)
+	reply = binary.LittleEndian.AppendUint32(reply, procID)
+	return appendString(reply, clientID), r.err
+}
+
+// childOf decodes a directory fid and a name and returns the path of the
+// entry.
+func (s *Share) childOf(r *p9Reader) (string, error) {
+	dir, err := s.fid(r.u32())
+	name := r.string()
+	if r.err != nil || err != nil {
+		return "", errors.Join(r.err, err)
+	}
+	if name == ".." {
+		return "", syscall.Errno(p9EINVAL)
+	}
+	return child(dir.path, name)
+}
+
+func (s *Share) mkdir(r *p9Reader) ([]byte, error) {
+	p, err := s.childOf(r)
+	mode := r.u32()
+	r.u32() // gid
+	if err != nil {
+		return nil, err
+	}
+	if err := s.root.Mkdir(p, fs.FileMode(mode&0o777)); err != nil {
+		return nil, err
+	}
+	return s.statQid(p)
+}
+
+func (s *Share) symlink(r *p9Reader) ([]byte, error) {
+	p, err := s.childOf(r)
+	target := r.string()
+	r.u32() // gid
+	if err != nil || r.err != nil {
+		return nil, errors.Join(r.err, err)
+	}
+	if err := s.root.Symlink(target, p); err != nil {
+		return nil, err
+	}
+	return s.statQid(p)
+}
+
+func (s *Share) link(r *p9Reader) error {
+	dir, err := s.fid(r.u32())
+	f, fidErr := s.fid(r.u32())
+	name := r.string()
+	if err = errors.Join(r.err, err, fidErr); err != nil {
+		return err
+	}
+	p, err := child(dir.path, name)
+	if err != nil {
+		return err
+	}
+	return s.root.Link(f.path, p)
+}
+
+// move renames a file, keeping the fids referring to it and to the files
+// below it.
+func (s *Share) move(from, to string) error {
+	if from == "." {
+		return syscall.Errno(p9EINVAL)
+	}
+	if err := s.root.Rename(from, to); err != nil {
+		return err
+	}
+	for _, f := range s.fids {
+		if f.path == from {
+			f.path = to
+		} else if rest, ok := strings.CutPrefix(f.path, from+"/"); ok {
+			f.path = path.Join(to, rest)
+		}
+	}
+	return nil
+}
+
+func (s *Share) rename(r *p9Reader) error {
+	f, err := s.fid(r.u32())
+	to, dirErr := s.childOf(r)
+	if err = errors.Join(err, dirErr); err != nil {
+		return err
+	}
+	return s.move(f.path, to)
+}
+
+func (s *Share) renameat(r *p9Reader) error {
+	from, err := s.childOf(r)
+	to, toErr := s.childOf(r)
+	if err = errors.Join(err, toErr); err != nil {
+		return err
+	}
+	return s.move(from, to)
+}
+
+func (s *Share) unlinkat(r *p9Reader) error {
+	p, err := s.childOf(r)
+	flags := r.u32()
+	if err = errors.Join(r.err, err); err != nil {
+		return err
+	}
+	info, err := s.root.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() != (flags&p9RemoveDir != 0) {
+		if info.IsDir() {
+			return syscall.Errno(p9EISDIR)
+		}
+		return syscall.Errno(p9ENOTDIR)
+	}
+	return s.removePath(p)
+}
+
+// removePath removes a file or an empty directory.
+func (s *Share) removePath(p string) error {
+	if p == "." {
+		return syscall.Errno(p9EINVAL)
+	}
+	err := s.root.Remove(p)
+	var errno syscall.Errno
+	if errors.As(err, &errno) && errno == syscall.EEXIST {
+		return syscall.Errno(p9ENOTEMPTY)
+	}
+	return err
+}
+
+func (s *Share) remove(r *p9Reader) error {
+	number := r.u32()
+	f, err := s.fid(number)
+	if err != nil {
+		return err
+	}
+	err = s.removePath(f.path)
+	s.clunk(number)
+	return err
+}
+
+// SaveState writes the fids of the guest to w. Open files are reopened by
+// LoadState, so the shared directory should be unchanged in between.
+func (s *Share) SaveState(w io.Writer) error {
+	numbers := make([]uint32, 0, len(s.fids))
+	for number := range s.fids {
+		numbers = append(numbers, number)
+	}
+	slices.Sort(numbers)
+	if err := binary.Write(w, binary.LittleEndian,
+		[]uint32{s.msize, uint32(len(numbers))}); err != nil {
+		return err
+	}
+	for _, number := range numbers {
+		f := s.fids[number]
+		flags := int32(-1)
+		if f.file != nil {
+			flags = int32(f.flags &^ (os.O_CREATE | os.O_EXCL | os.O_TRUNC))
+		}
+		if err := binary.Write(w, binary.LittleEndian,
+			[]int32{int32(number), flags}); err != nil {
+			return err
+		}
+		if err := writeBytes(w, []byte(f.path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadState restores the fids of the guest and reopens their files.
+func (s *Share) LoadState(r io.Reader) error {
+	var header [2]uint32
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return fmt.Errorf("failed to read virtio-9p state: %v", err)
+	}
+	s.clunkAll()
+	s.msize = header[0]
+	for range header[1] {
+		var fid [2]int32
+		if err := binary.Read(r, binary.LittleEndian, &fid); err != nil {
+			return fmt.Errorf("failed to read virtio-9p fid: %v", err)
+		}
+		p, err := readBytes(r)
+		if err != nil {
+			return fmt.Errorf("failed to read virtio-9p fid: %v", err)
+		}
+		f := &p9Fid{path: string(p)}
+		if fid[1] >= 0 {
+			if _, err := s.open(f, int(fid[1]), 0); err != nil {
+				return fmt.Errorf("failed to reopen %s: %v", f.path, err)
+			}
+		}
+		s.fids[uint32(fid[0])] = f
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// p9Client sends 9P requests through a test driver.
+type p9Client struct {
+	d *testDriver
+}
+
+// call sends a request and returns the type and body of the reply.
+func (c *p9Client) call(kind uint8, body []byte) (uint8, []byte) {
+	c.d.t.Helper()
+	request := binary.LittleEndian.AppendUint32(nil, uint32(p9HeaderSize+len(body)))
+	request = append(request, kind)
+	request = binary.LittleEndian.AppendUint16(request, 1)
+	request = append(request, body...)
+	buffers, written := c.d.request(0, [][]byte{request}, []uint32{512})
+	reply := c.d.read(buffers[0].address, written)
+	if size := binary.LittleEndian.Uint32(reply); size != written {
+		c.d.t.Fatalf("Reply of %d bytes has size %d", written, size)
+	}
+	return reply[4], reply[p9HeaderSize:]
+}
+
+// ok sends a request and fails the test if it is not successful.
+func (c *p9Client) ok(kind uint8, body []byte) []byte {
+	c.d.t.Helper()
+	reply, data := c.call(kind, body)
+	if reply != kind+1 {
+		c.d.t.Fatalf("Request %d failed with %v", kind, data)
+	}
+	return data
+}
+
+// fails sends a request and checks that it fails with the errno.
+func (c *p9Client) fails(kind uint8, body []byte, errno uint32) {
+	c.d.t.Helper()
+	reply, data := c.call(kind, body)
+	if reply != p9Rlerror || binary.LittleEndian.Uint32(data) != errno {
+		c.d.t.Errorf("Expected request %d to fail with %d, got %d %v",
+			kind, errno, reply, data)
+	}
+}
+
+// message builds the body of a request from numbers and strings.
+func message(fields ...any) []byte {
+	var b []byte
+	for _, field := range fields {
+		switch value := field.(type) {
+		case uint8:
+			b = append(b, value)
+		case uint16:
+			b = binary.LittleEndian.AppendUint16(b, value)
+		case uint32:
+			b = binary.LittleEndian.AppendUint32(b, value)
+		case uint64:
+			b = binary.LittleEndian.AppendUint64(b, value)
+		case string:
+			b = appendString(b, value)
+		case []byte:
+			b = binary.LittleEndian.AppendUint32(b, uint32(len(value)))
+			b = append(b, value...)
+		}
+	}
+	return b
+}
+
+// newShareClient shares a directory with a file and a directory and
+// attaches fid 0 to its root.
+func newShareClient(t *testing.T, readOnly bool) (*p9Client, string) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	share, err := NewShare(dir, "hostshare", readOnly)
+	if err != nil {
+		t.Fatalf("NewShare failed: %v", err)
+	}
+	c := &p9Client{newTestDriver(t, share)}
+	reply := c.ok(p9Tversion, message(uint32(8192), p9Version))
+	if !bytes.Equal(reply, message(uint32(8192), p9Version)) {
+		t.Errorf("Unexpected Rversion %v", reply)
+	}
+	c.ok(p9Tattach, message(uint32(0), uint32(0xFFFFFFFF), "root", "", uint32(0)))
+	return c, dir
+}
+
+func TestShare(t *testing.T) {
+	c, dir := newShareClient(t, false)
+	if tag := c.d.read(testTransport+regConfig, 11); !bytes.Equal(tag,
+		append([]byte{9, 0}, "hostshare"...)) {
+		t.Errorf("Unexpected mount tag %q", tag)
+	}
+
+	reply := c.ok(p9Twalk, message(uint32(0), uint32(1), uint16(2), "sub", ".."))
+	if binary.LittleEndian.Uint16(reply) != 2 || reply[2] != p9QidDir {
+		t.Errorf("Unexpected Rwalk %v", reply)
+	}
+	c.ok(p9Twalk, message(uint32(1), uint32(2), uint16(1), "hello.txt"))
+	reply = c.ok(p9Tgetattr, message(uint32(2), uint64(p9GetattrAll)))
+	if mode := binary.LittleEndian.Uint32(reply[21:]); mode != 0o100644 {
+		t.Errorf("Expected mode 100644, got %o", mode)
+	}
+	if size := binary.LittleEndian.Uint64(reply[49:]); size != 5 {
+		t.Errorf("Expected size 5, got %d", size)
+	}
+	c.ok(p9Tlopen, message(uint32(2), uint32(0)))
+	reply = c.ok(p9Tread, message(uint32(2), uint64(1), uint32(100)))
+	if !bytes.Equal(reply, message([]byte("ello"))) {
+		t.Errorf("Unexpected Rread %q", reply)
+	}
+
+	c.ok(p9Tlopen, message(uint32(1), uint32(0)))
+	reply = c.ok(p9Treaddir, message(uint32(1), uint64(0), uint32(4096)))
+	var names []string
+	for data := reply[4:]; len(data) > 0; {
+		r := &p9Reader{data: data[13+8+1:]}
+		names = append(names, r.string())
+		data = r.data
+	}
+	if expected := []string{".", "..", "hello.txt", "sub"}; !slices.Equal(names, expected) {
+		t.Errorf("Expected entries %v, got %v", expected, names)
+	}
+
+	c.ok(p9Twalk, message(uint32(0), uint32(3), uint16(1), "sub"))
+	c.ok(p9Tlcreate, message(uint32(3), "new.txt", uint32(p9OpenReadWrite), uint32(0o600), uint32(0)))
+	reply = c.ok(p9Twrite, message(uint32(3), uint64(0), []byte("data")))
+	if binary.LittleEndian.Uint32(reply) != 4 {
+		t.Errorf("Unexpected Rwrite %v", reply)
+	}
+	c.ok(p9Tclunk, message(uint32(3)))
+	if data, err := os.ReadFile(filepath.Join(dir, "sub", "new.txt")); string(data) != "data" {
+		t.Errorf("Expected the written file, got %q %v", data, err)
+	}
+
+	c.ok(p9Trenameat, message(uint32(0), "hello.txt", uint32(0), "moved.txt"))
+	c.ok(p9Tunlinkat, message(uint32(0), "moved.txt", uint32(0)))
+	c.fails(p9Tunlinkat, message(uint32(0), "sub", uint32(p9RemoveDir)), p9ENOTEMPTY)
+	c.fails(p9Twalk, message(uint32(0), uint32(4), uint16(1), "missing"), p9ENOENT)
+	c.fails(p9Tread, message(uint32(7), uint64(0), uint32(1)), p9EBADF)
+}
+
+func TestShare_Escape(t *testing.T) {
+	c, dir := newShareClient(t, false)
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// ".." stays at the root of the share.
+	c.ok(p9Twalk, message(uint32(0), uint32(1), uint16(2), "..", ".."))
+	reply := c.ok(p9Tgetattr, message(uint32(1), uint64(p9GetattrAll)))
+	root := c.ok(p9Tgetattr, message(uint32(0), uint64(p9GetattrAll)))
+	if !bytes.Equal(reply[8:21], root[8:21]) {
+		t.Error("Expected .. of the root to be the root")
+	}
+	c.fails(p9Twalk, message(uint32(0), uint32(2), uint16(1), "a/b"), p9EINVAL)
+	reply = c.ok(p9Twalk, message(uint32(0), uint32(2), uint16(2), "link", "secret"))
+	if binary.LittleEndian.Uint16(reply) != 1 {
+		t.Errorf("Expected the walk to stop at the link, got %v", reply)
+	}
+	c.ok(p9Twalk, message(uint32(0), uint32(2), uint16(1), "link"))
+	c.fails(p9Tlopen, message(uint32(2), uint32(0)), p9EACCES)
+	c.fails(p9Tmkdir, message(uint32(0), "..", uint32(0o755), uint32(0)), p9EINVAL)
+}
+
+func TestShare_ReadOnly(t *testing.T) {
+	c, dir := newShareClient(t, true)
+	c.ok(p9Twalk, message(uint32(0), uint32(1), uint16(1), "hello.txt"))
+	c.fails(p9Tlopen, message(uint32(1), uint32(p9OpenReadWrite)), p9EROFS)
+	c.fails(p9Tlopen, message(uint32(1), uint32(p9OpenTruncate)), p9EROFS)
+	c.fails(p9Tlcreate, message(uint32(0), "new", uint32(p9OpenWriteOnly), uint32(0o644), uint32(0)), p9EROFS)
+	c.fails(p9Tunlinkat, message(uint32(0), "hello.txt", uint32(0)), p9EROFS)
+	c.ok(p9Tlopen, message(uint32(1), uint32(0)))
+	if _, err := os.Stat(filepath.Join(dir, "hello.txt")); err != nil {
+		t.Errorf("Expected the file to be unchanged: %v", err)
+	}
+}
+
+func TestShare_State(t *testing.T) {
+	c, dir := newShareClient(t, false)
+	c.ok(p9Twalk, message(uint32(0), uint32(1), uint16(1), "hello.txt"))
+	c.ok(p9Tlopen, message(uint32(1), uint32(0)))
+	var state bytes.Buffer
+	if err := c.d.transport.device.SaveState(&state); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+
+	restored, err := NewShare(dir, "hostshare", false)
+	if err != nil {
+		t.Fatalf("NewShare failed: %v", err)
+	}
+	if err := restored.LoadState(&state); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	reply := restored.handle(append([]byte{30, 0, 0, 0, p9Tread, 1, 0},
+		message(uint32(1), uint64(0), uint32(5))...), 512)
+	if !bytes.Equal(reply[p9HeaderSize:], message([]byte("hello"))) {
+		t.Errorf("Expected to read from the reopened file, got %q", reply)
+	}
+}
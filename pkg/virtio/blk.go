@@ -0,0 +1,390 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+func init() {
+	devices.Register("virtio-blk", func(baseAddress, size uint32, params json.RawMessage) (devices.BusDevice, error) {
+		var p struct {
+			transportParams
+			Image    string `json:"image"`     // Path of a raw disk image
+			ReadOnly bool   `json:"read-only"` // Reject writes of the guest
+			COW      bool   `json:"cow"`       // Keep writes in memory
+		}
+		if err := devices.DecodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		if p.Image == "" {
+			return nil, fmt.Errorf("virtio-blk needs an image")
+		}
+		blk := &Block{image: p.Image, readOnly: p.ReadOnly, cow: p.COW}
+		if size == 0 {
+			size = TransportSize
+		}
+		t := NewTransport(blk, p.IRQ)
+		t.Initialize(baseAddress, size)
+		return t, nil
+	})
+}
+
+// SectorSize is the unit of virtio-blk requests.
+const SectorSize = 512
+
+// Feature bits of virtio-blk.
+const (
+	blkFeatureRO    = 5
+	blkFeatureFlush = 9
+)
+
+// Request types and status values of virtio-blk.
+const (
+	blkTypeIn    = 0
+	blkTypeOut   = 1
+	blkTypeFlush = 4
+	blkTypeGetID = 8
+
+	blkStatusOK          = 0
+	blkStatusIOError     = 1
+	blkStatusUnsupported = 2
+)
+
+// blkHeaderSize is the size of the request header: type, reserved and
+// sector.
+const blkHeaderSize = 16
+
+// blkIDSize is the size of the serial number returned for GET_ID.
+const blkIDSize = 20
+
+// Disk is the storage of a virtio-blk device.
+type Disk interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() int64
+	Sync() error
+}
+
+// Block is a virtio-blk device.
+type Block struct {
+	disk     Disk
+	readOnly bool
+	id       string
+
+	image string   // Path of the raw image opened by Open
+	cow   bool     // Keep writes to the image in memory
+	file  *os.File // Image file opened by Open
+}
+
+// NewBlock returns a virtio-blk device backed by a raw image file. A
+// read-only device fails writes of the guest; a copy-on-write device keeps
+// them in memory, leaving the image unchanged. Close closes the image.
+func NewBlock(path string, readOnly, cow bool) (*Block, error) {
+	b := &Block{image: path, readOnly: readOnly, cow: cow}
+	if err := b.Open(nil); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Open opens the image of a device created by a machine configuration or
+// NewBlock. It does nothing for devices with a disk.
+func (b *Block) Open(host *devices.Host) error {
+	if b.disk != nil {
+		return nil
+	}
+	flag := os.O_RDWR
+	if b.readOnly || b.cow {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(b.image, flag, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open disk image: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open disk image: %v", err)
+	}
+	var disk Disk = &fileDisk{f, info.Size()}
+	if b.cow {
+		disk = NewOverlay(disk)
+	}
+	b.disk, b.id, b.file = disk, info.Name(), f
+	return nil
+}
+
+// Close closes the image opened by Open.
+func (b *Block) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	b.disk, b.file = nil, nil
+	return err
+}
+
+// NewBlockDisk returns a virtio-blk device backed by a disk with the given
+// serial number, of which the guest sees the first 20 bytes.
+func NewBlockDisk(disk Disk, readOnly bool, id string) *Block {
+	return &Block{disk: disk, readOnly: readOnly, id: id}
+}
+
+// fileDisk is a disk backed by a raw image file.
+type fileDisk struct {
+	*os.File
+	size int64
+}
+
+func (d *fileDisk) Size() int64 {
+	return d.size
+}
+
+func (b *Block) DeviceID() uint32 {
+	return DeviceIDBlock
+}
+
+func (b *Block) Features() uint64 {
+	features := uint64(1 << blkFeatureFlush)
+	if b.readOnly {
+		features |= 1 << blkFeatureRO
+	}
+	return features
+}
+
+func (b *Block) Queues() int {
+	return 1
+}
+
+// ReadConfig reads the configuration space, of which only the capacity in
+// sectors is implemented.
+func (b *Block) ReadConfig(offset uint32) byte {
+	if offset < 8 {
+		return byte(uint64(b.disk.Size()/SectorSize) >> (8 * offset))
+	}
+	return 0
+}
+
+// WriteConfig ignores writes, as the configuration space is read-only.
+func (b *Block) WriteConfig(offset uint32, value byte) {
+}
+
+func (b *Block) Reset() {
+}
+
+// Notify performs the requests made available by the driver.
+func (b *Block) Notify(t *Transport, queue int) error {
+	q := t.Queue(queue)
+	for {
+		chain, err := q.Pop()
+		if err != nil || chain == nil {
+			return err
+		}
+		written, err := b.request(chain)
+		if err != nil {
+			return err
+		}
+		if err := q.Push(chain, written); err != nil {
+			return err
+		}
+	}
+}
+
+// request performs a request and writes its status, returning the number
+// of bytes written to the chain. Errors of the disk are reported to the
+// driver in the status; malformed requests are errors.
+func (b *Block) request(chain *Chain) (uint32, error) {
+	readable, err := chain.Read()
+	if err != nil {
+		return 0, err
+	}
+	writable := chain.WritableSize()
+	if len(readable) < blkHeaderSize || writable < 1 {
+		return 0, fmt.Errorf("virtio-blk request without header or status")
+	}
+	kind := binary.LittleEndian.Uint32(readable)
+	sector := binary.LittleEndian.Uint64(readable[8:])
+	data := readable[blkHeaderSize:]
+	// The status byte is the last writable byte; data precedes it.
+	size := writable - 1
+	// inDisk reports whether length bytes from the sector lie on the disk,
+	// without overflowing for sectors of any number.
+	inDisk := func(length uint64) bool {
+		disk := uint64(b.disk.Size())
+		return sector <= disk/SectorSize && sector*SectorSize+length <= disk
+	}
+	offset := int64(sector * SectorSize)
+
+	status := byte(blkStatusOK)
+	var written uint32
+	switch kind {
+	case blkTypeIn:
+		if !inDisk(uint64(size)) {
+			status = blkStatusIOError
+			break
+		}
+		buffer := make([]byte, size)
+		if _, err := b.disk.ReadAt(buffer, offset); err != nil {
+			status = blkStatusIOError
+		} else if err := chain.WriteAt(buffer, 0); err != nil {
+			return 0, err
+		} else {
+			written = size
+		}
+	case blkTypeOut:
+		if b.readOnly || !inDisk(uint64(len(data))) {
+			status = blkStatusIOError
+		} else if _, err := b.disk.WriteAt(data, offset); err != nil {
+			status = blkStatusIOError
+		}
+	case blkTypeFlush:
+		if err := b.disk.Sync(); err != nil {
+			status = blkStatusIOError
+		}
+	case blkTypeGetID:
+		id := make([]byte, min(size, blkIDSize))
+		copy(id, b.id)
+		if err := chain.WriteAt(id, 0); err != nil {
+			return 0, err
+		}
+		written = uint32(len(id))
+	default:
+		status = blkStatusUnsupported
+	}
+	if err := chain.WriteAt([]byte{status}, size); err != nil {
+		return 0, err
+	}
+	return written + 1, nil
+}
+
+// SaveState writes the sectors written to a copy-on-write overlay to w.
+// Writes to an image file are not part of snapshots.
+func (b *Block) SaveState(w io.Writer) error {
+	overlay, ok := b.disk.(*Overlay)
+	if !ok {
+		return nil
+	}
+	return overlay.SaveState(w)
+}
+
+// LoadState restores the sectors of a copy-on-write overlay.
+func (b *Block) LoadState(r io.Reader) error {
+	overlay, ok := b.disk.(*Overlay)
+	if !ok {
+		return nil
+	}
+	return overlay.LoadState(r)
+}
+
+// Overlay is a copy-on-write disk keeping the sectors written to it in
+// memory, in front of a disk it only reads.
+type Overlay struct {
+	base    Disk
+	sectors map[int64][]byte // By sector number
+}
+
+// NewOverlay returns an overlay on top of a disk.
+func NewOverlay(base Disk) *Overlay {
+	return &Overlay{base: base, sectors: map[int64][]byte{}}
+}
+
+func (o *Overlay) Size() int64 {
+	return o.base.Size()
+}
+
+// Sync does nothing, as the written sectors are not persisted.
+func (o *Overlay) Sync() error {
+	return nil
+}
+
+// ReadAt reads from the written sectors or else the base disk.
+func (o *Overlay) ReadAt(p []byte, offset int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		sector, start := (offset+int64(n))/SectorSize, (offset+int64(n))%SectorSize
+		data, err := o.sector(sector)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[start:])
+	}
+	return n, nil
+}
+
+// WriteAt writes into copies of the sectors.
+func (o *Overlay) WriteAt(p []byte, offset int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		sector, start := (offset+int64(n))/SectorSize, (offset+int64(n))%SectorSize
+		data, err := o.sector(sector)
+		if err != nil {
+			return n, err
+		}
+		data = append([]byte(nil), data...)
+		n += copy(data[start:], p[n:])
+		o.sectors[sector] = data
+	}
+	return n, nil
+}
+
+// sector returns the contents of a sector.
+func (o *Overlay) sector(sector int64) ([]byte, error) {
+	if data, ok := o.sectors[sector]; ok {
+		return data, nil
+	}
+	data := make([]byte, SectorSize)
+	n, err := o.base.ReadAt(data, sector*SectorSize)
+	if err == io.EOF && n > 0 {
+		// The image ends in a partial sector.
+		err = nil
+	}
+	return data, err
+}
+
+// SaveState writes the written sectors to w.
+func (o *Overlay) SaveState(w io.Writer) error {
+	sectors := make([]int64, 0, len(o.sectors))
+	for sector := range o.sectors {
+		sectors = append(sectors, sector)
+	}
+	sort.Slice(sectors, func(i, j int) bool { return sectors[i] < sectors[j] })
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(sectors))); err != nil {
+		return err
+	}
+	for _, sector := range sectors {
+		if err := binary.Write(w, binary.LittleEndian, sector); err != nil {
+			return err
+		}
+		if _, err := w.Write(o.sectors[sector]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadState restores the written sectors saved by SaveState.
+func (o *Overlay) LoadState(r io.Reader) error {
+	var count uint64
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return fmt.Errorf("failed to read overlay state: %v", err)
+	}
+	o.sectors = map[int64][]byte{}
+	for range count {
+		var sector int64
+		if err := binary.Read(r, binary.LittleEndian, &sector); err != nil {
+			return fmt.Errorf("failed to read overlay state: %v", err)
+		}
+		data := make([]byte, SectorSize)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("failed to read overlay state: %v", err)
+		}
+		o.sectors[sector] = data
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/system"
+)
+
+// blkHeader returns the header of a virtio-blk request.
+func blkHeader(kind uint32, sector uint64) []byte {
+	header := binary.LittleEndian.AppendUint32(nil, kind)
+	header = binary.LittleEndian.AppendUint32(header, 0)
+	return binary.LittleEndian.AppendUint64(header, sector)
+}
+
+// testImage writes a disk image of 4 sectors, each filled with its number.
+func testImage(t *testing.T) string {
+	t.Helper()
+	image := make([]byte, 4*SectorSize)
+	for i := range image {
+		image[i] = byte(i / SectorSize)
+	}
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, image, 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return path
+}
+
+// blkRead reads a sector through the driver, returning its contents and
+// the request status.
+func blkRead(d *testDriver, sector uint64) ([]byte, byte) {
+	d.t.Helper()
+	buffers, written := d.request(0, [][]byte{blkHeader(blkTypeIn, sector)},
+		[]uint32{SectorSize, 1})
+	status := d.read(buffers[1].address, 1)[0]
+	if status == blkStatusOK && written != SectorSize+1 {
+		d.t.Errorf("Expected %d bytes written, got %d", SectorSize+1, written)
+	}
+	return d.read(buffers[0].address, SectorSize), status
+}
+
+// blkWrite writes a sector through the driver and returns the status.
+func blkWrite(d *testDriver, sector uint64, data []byte) byte {
+	d.t.Helper()
+	buffers, _ := d.request(0, [][]byte{blkHeader(blkTypeOut, sector), data},
+		[]uint32{1})
+	return d.read(buffers[0].address, 1)[0]
+}
+
+func TestBlock(t *testing.T) {
+	path := testImage(t)
+	blk, err := NewBlock(path, false, false)
+	if err != nil {
+		t.Fatalf("NewBlock failed: %v", err)
+	}
+	d := newTestDriver(t, blk)
+
+	capacity := binary.LittleEndian.Uint64(d.read(testTransport+regConfig, 8))
+	if capacity != 4 {
+		t.Errorf("Expected a capacity of 4 sectors, got %d", capacity)
+	}
+
+	data, status := blkRead(d, 2)
+	if status != blkStatusOK || !bytes.Equal(data, bytes.Repeat([]byte{2}, SectorSize)) {
+		t.Errorf("Unexpected contents of sector 2 with status %d", status)
+	}
+	if _, status := blkRead(d, 4); status != blkStatusIOError {
+		t.Errorf("Expected an I/O error past the end, got status %d", status)
+	}
+	// The byte offset of this sector wraps around to 0.
+	if _, status := blkRead(d, 1<<55); status != blkStatusIOError {
+		t.Errorf("Expected an I/O error for a huge sector, got status %d", status)
+	}
+
+	written := bytes.Repeat([]byte{0xAA}, SectorSize)
+	if status := blkWrite(d, 1, written); status != blkStatusOK {
+		t.Errorf("Write failed with status %d", status)
+	}
+	image, _ := os.ReadFile(path)
+	if !bytes.Equal(image[SectorSize:2*SectorSize], written) {
+		t.Error("Expected the write in the image")
+	}
+
+	buffers, _ := d.request(0, [][]byte{blkHeader(blkTypeGetID, 0)},
+		[]uint32{blkIDSize, 1})
+	if id := d.read(buffers[0].address, 8); string(id) != "disk.img" {
+		t.Errorf("Unexpected ID %q", id)
+	}
+	buffers, _ = d.request(0, [][]byte{blkHeader(99, 0)}, []uint32{1})
+	if status := d.read(buffers[0].address, 1)[0]; status != blkStatusUnsupported {
+		t.Errorf("Expected an unsupported request, got status %d", status)
+	}
+}
+
+func TestBlock_ReadOnly(t *testing.T) {
+	blk, err := NewBlock(testImage(t), true, false)
+	if err != nil {
+		t.Fatalf("NewBlock failed: %v", err)
+	}
+	d := newTestDriver(t, blk)
+	if d.transport.Features()&(1<<blkFeatureRO) == 0 {
+		t.Error("Expected VIRTIO_BLK_F_RO")
+	}
+	if status := blkWrite(d, 0, make([]byte, SectorSize)); status != blkStatusIOError {
+		t.Errorf("Expected an I/O error, got status %d", status)
+	}
+}
+
+func TestBlock_COW(t *testing.T) {
+	path := testImage(t)
+	blk, err := NewBlock(path, false, true)
+	if err != nil {
+		t.Fatalf("NewBlock failed: %v", err)
+	}
+	d := newTestDriver(t, blk)
+
+	written := bytes.Repeat([]byte{0xAA}, SectorSize)
+	if status := blkWrite(d, 3, written); status != blkStatusOK {
+		t.Errorf("Write failed with status %d", status)
+	}
+	if data, _ := blkRead(d, 3); !bytes.Equal(data, written) {
+		t.Error("Expected to read back the write")
+	}
+	image, _ := os.ReadFile(path)
+	if image[3*SectorSize] != 3 {
+		t.Error("Expected the image unchanged")
+	}
+
+	var state bytes.Buffer
+	if err := d.transport.SaveState(&state); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	restoredBlk, _ := NewBlock(path, false, true)
+	restored := NewTransport(restoredBlk, 0)
+	restored.Initialize(testTransport, TransportSize)
+	if err := restored.LoadState(&state); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	data := make([]byte, SectorSize)
+	restoredBlk.disk.ReadAt(data, 3*SectorSize)
+	if !bytes.Equal(data, written) || !restored.DriverOK() {
+		t.Error("Expected the overlay and transport restored")
+	}
+}
+
+func TestBlock_Machine(t *testing.T) {
+	config, err := system.ParseMachineConfig(strings.NewReader(`{
+		"devices": [
+			{"type": "ram", "base": "0x80000000", "size": "1M"},
+			{"type": "plic", "base": "0x0c000000"},
+			{"type": "virtio-blk", "base": "0x10001000",
+			 "params": {"irq": 1, "image": "` + testImage(t) + `", "cow": true}}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("ParseMachineConfig failed: %v", err)
+	}
+	sys, err := system.NewMachine(config)
+	if err != nil {
+		t.Fatalf("NewMachine failed: %v", err)
+	}
+	transport := sys.Bus().Devices()[2].(*Transport)
+	if transport.bus != sys.Bus() || transport.line == nil {
+		t.Error("Expected the transport connected to the bus and PLIC")
+	}
+	node := sys.DeviceTree("").Lookup("/soc/virtio_mmio@10001000")
+	if interrupts, _ := node.U32("interrupts"); len(interrupts) != 1 ||
+		interrupts[0] != 1 {
+		t.Errorf("Expected interrupt 1 in the device tree, got %v", interrupts)
+	}
+}
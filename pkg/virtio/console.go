@@ -0,0 +1,504 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+func init() {
+	devices.Register("virtio-console", func(baseAddress, size uint32, params json.RawMessage) (devices.BusDevice, error) {
+		var p struct {
+			transportParams
+			Ports []struct {
+				Name   string `json:"name"`
+				Stdio  bool   `json:"stdio"`  // Bind to standard input and output
+				Socket string `json:"socket"` // Path of a Unix socket to listen on
+			} `json:"ports"`
+		}
+		if err := devices.DecodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		console := NewConsole()
+		if len(p.Ports) == 0 {
+			console.AddPort("", os.Stdin, os.Stdout)
+		}
+		for i, port := range p.Ports {
+			switch {
+			case port.Stdio && port.Socket != "":
+				return nil, fmt.Errorf("port %d is bound to both stdio and a socket", i)
+			case port.Stdio:
+				console.AddPort(port.Name, os.Stdin, os.Stdout)
+			case port.Socket != "":
+				console.AddSocketPort(port.Name, port.Socket)
+			default:
+				console.AddPort(port.Name, nil, nil)
+			}
+		}
+		if size == 0 {
+			size = TransportSize
+		}
+		t := NewTransport(console, p.IRQ)
+		t.Initialize(baseAddress, size)
+		return t, nil
+	})
+}
+
+// Feature bits of virtio-console.
+const (
+	consoleFeatureMultiport  = 1
+	consoleFeatureEmergWrite = 2
+)
+
+// Events of control messages of virtio-console.
+const (
+	consoleDeviceReady  = 0
+	consoleDeviceAdd    = 1
+	consolePortReady    = 3
+	consoleConsolePort  = 4
+	consolePortOpen     = 6
+	consolePortName     = 7
+	consoleControlSize  = 8
+	consoleControlRx    = 2 // Queue of control messages to the driver
+	consoleControlTx    = 3 // Queue of control messages from the driver
+	consoleEmergWrite   = 8 // Offset of emerg_wr in the configuration space
+	consoleMaxPortsSize = 4 // Offset of max_nr_ports in the configuration space
+)
+
+// Console is a virtio-console device with multiport support. Port 0 is the
+// console; other ports are named serial ports. Each port is bound to a
+// host reader and writer, e.g. standard input and output or a Unix socket.
+// The host side of the ports is only connected by Open.
+type Console struct {
+	ports []*consolePort
+
+	mu      sync.Mutex // Guards the host side of the ports and control
+	control [][]byte   // Control messages to the driver not delivered yet
+	opened  bool       // Open was called and Close was not
+	closers []io.Closer
+}
+
+// consolePort is a port of a Console.
+type consolePort struct {
+	name   string
+	reader io.Reader // Host input, read from Open on
+	socket string    // Path of the Unix socket the port listens on
+	output io.Writer // Nil while nothing is connected
+	input  []byte    // Received from the host, not delivered yet
+	open   bool      // Host side is connected
+	ready  bool      // Driver has set up the port
+}
+
+// NewConsole returns a console without ports.
+func NewConsole() *Console {
+	return &Console{}
+}
+
+// AddPort adds a port writing the output of the guest to w and receiving
+// what is read from r in the background once the console is opened. Both
+// may be nil.
+func (c *Console) AddPort(name string, r io.Reader, w io.Writer) {
+	c.ports = append(c.ports, &consolePort{name: name, reader: r, output: w,
+		open: r != nil || w != nil})
+}
+
+// AddSocketPort adds a port bound to a Unix socket listening at path once
+// the console is opened. One connection at a time is accepted; the port is
+// open while it lasts.
+func (c *Console) AddSocketPort(name, path string) {
+	c.ports = append(c.ports, &consolePort{name: name, socket: path})
+}
+
+// Open starts reading the input of the ports and listening on their
+// sockets.
+func (c *Console) Open(host *devices.Host) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opened {
+		return nil
+	}
+	for i, port := range c.ports {
+		if port.socket == "" {
+			if port.reader != nil {
+				go c.receive(port, port.reader)
+			}
+			continue
+		}
+		listener, err := net.Listen("unix", port.socket)
+		if err != nil {
+			for _, closer := range c.closers {
+				closer.Close()
+			}
+			c.closers = nil
+			return fmt.Errorf("failed to listen for console port %q: %v",
+				port.name, err)
+		}
+		c.closers = append(c.closers, listener)
+		go c.accept(i, listener)
+	}
+	c.opened = true
+	return nil
+}
+
+// Close stops listening on the sockets of the ports and closes their
+// connections. Input read from other readers afterwards is dropped.
+func (c *Console) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	for _, closer := range c.closers {
+		if err := closer.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	c.closers = nil
+	c.opened = false
+	return errors.Join(errs...)
+}
+
+// accept connects the port to one connection of the listener after the
+// other until the listener is closed.
+func (c *Console) accept(index int, listener net.Listener) {
+	port := c.ports[index]
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Warn("Console socket closed", "path", port.socket,
+					"error", err)
+			}
+			return
+		}
+		c.mu.Lock()
+		if !c.opened {
+			c.mu.Unlock()
+			conn.Close()
+			return
+		}
+		c.closers = append(c.closers, conn)
+		c.mu.Unlock()
+		c.setOutput(index, conn)
+		c.receive(port, conn)
+		conn.Close()
+		c.mu.Lock()
+		c.closers = slices.DeleteFunc(c.closers, func(closer io.Closer) bool {
+			return closer == conn
+		})
+		c.mu.Unlock()
+		c.setOutput(index, nil)
+	}
+}
+
+// setOutput connects or disconnects the host side of a port and tells the
+// driver.
+func (c *Console) setOutput(index int, w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	port := c.ports[index]
+	port.output = w
+	port.open = w != nil
+	if port.ready {
+		c.queueControl(uint32(index), consolePortOpen, boolValue(port.open), nil)
+	}
+}
+
+// receive queues what is read from r as input of a port until r fails or
+// the console is closed.
+func (c *Console) receive(port *consolePort, r io.Reader) {
+	buffer := make([]byte, 4096)
+	for {
+		n, err := r.Read(buffer)
+		c.mu.Lock()
+		opened := c.opened
+		if opened {
+			port.input = append(port.input, buffer[:n]...)
+		}
+		c.mu.Unlock()
+		if !opened {
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Warn("Failed to read console input", "port", port.name,
+					"error", err)
+			}
+			return
+		}
+	}
+}
+
+// queueControl queues a control message to the driver. The caller holds
+// the lock.
+func (c *Console) queueControl(id uint32, event, value uint16, data []byte) {
+	message := binary.LittleEndian.AppendUint32(nil, id)
+	message = binary.LittleEndian.AppendUint16(message, event)
+	message = binary.LittleEndian.AppendUint16(message, value)
+	c.control = append(c.control, append(message, data...))
+}
+
+func boolValue(b bool) uint16 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (c *Console) DeviceID() uint32 {
+	return DeviceIDConsole
+}
+
+func (c *Console) Features() uint64 {
+	return 1<<consoleFeatureMultiport | 1<<consoleFeatureEmergWrite
+}
+
+// Queues returns the number of queues: receive and transmit of port 0,
+// those of the control messages, then those of the other ports.
+func (c *Console) Queues() int {
+	return 2 * (len(c.ports) + 1)
+}
+
+// queues returns the receive and transmit queues of a port.
+func queues(port int) (rx, tx int) {
+	if port == 0 {
+		return 0, 1
+	}
+	return 2 * (port + 1), 2*(port+1) + 1
+}
+
+// ReadConfig reads the configuration space: cols and rows, which are 0,
+// max_nr_ports and emerg_wr.
+func (c *Console) ReadConfig(offset uint32) byte {
+	if offset >= consoleMaxPortsSize && offset < consoleMaxPortsSize+4 {
+		return byte(uint32(len(c.ports)) >> (8 * (offset - consoleMaxPortsSize)))
+	}
+	return 0
+}
+
+// WriteConfig writes emerg_wr, whose first byte is written to port 0.
+func (c *Console) WriteConfig(offset uint32, value byte) {
+	if offset == consoleEmergWrite {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if output := c.ports[0].output; output != nil {
+			output.Write([]byte{value})
+		}
+	}
+}
+
+// Reset drops the control messages to the driver and forgets which ports
+// it has set up.
+func (c *Console) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.control = nil
+	for _, port := range c.ports {
+		port.ready = false
+	}
+}
+
+// Notify transmits the output of the guest, handles its control messages
+// and delivers pending input into new receive buffers.
+func (c *Console) Notify(t *Transport, queue int) error {
+	if queue == consoleControlTx {
+		if err := c.handleControl(t); err != nil {
+			return err
+		}
+	} else if queue%2 == 1 {
+		port := 0
+		if queue > 1 {
+			port = queue/2 - 1
+		}
+		if err := c.transmit(t, port); err != nil {
+			return err
+		}
+	}
+	return c.Poll(t)
+}
+
+// transmit writes the buffers in the transmit queue of a port to its
+// output. Output is dropped while nothing is connected to the port.
+func (c *Console) transmit(t *Transport, port int) error {
+	_, tx := queues(port)
+	q := t.Queue(tx)
+	for {
+		chain, err := q.Pop()
+		if err != nil || chain == nil {
+			return err
+		}
+		data, err := chain.Read()
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		output := c.ports[port].output
+		c.mu.Unlock()
+		if output != nil {
+			if _, err := output.Write(data); err != nil {
+				slog.Warn("Failed to write console output", "port",
+					c.ports[port].name, "error", err)
+			}
+		}
+		if err := q.Push(chain, 0); err != nil {
+			return err
+		}
+	}
+}
+
+// handleControl handles the control messages of the driver.
+func (c *Console) handleControl(t *Transport) error {
+	q := t.Queue(consoleControlTx)
+	for {
+		chain, err := q.Pop()
+		if err != nil || chain == nil {
+			return err
+		}
+		message, err := chain.Read()
+		if err != nil {
+			return err
+		}
+		if len(message) < consoleControlSize {
+			return fmt.Errorf("virtio-console control message of %d bytes",
+				len(message))
+		}
+		id := binary.LittleEndian.Uint32(message)
+		event := binary.LittleEndian.Uint16(message[4:])
+		value := binary.LittleEndian.Uint16(message[6:])
+
+		c.mu.Lock()
+		switch {
+		case event == consoleDeviceReady && value == 1:
+			for i := range c.ports {
+				c.queueControl(uint32(i), consoleDeviceAdd, 0, nil)
+			}
+		case event == consolePortReady && value == 1 && id < uint32(len(c.ports)):
+			port := c.ports[id]
+			port.ready = true
+			if id == 0 {
+				c.queueControl(id, consoleConsolePort, 1, nil)
+			}
+			if port.name != "" {
+				c.queueControl(id, consolePortName, 0, []byte(port.name))
+			}
+			if port.open {
+				c.queueControl(id, consolePortOpen, 1, nil)
+			}
+		}
+		c.mu.Unlock()
+		if err := q.Push(chain, 0); err != nil {
+			return err
+		}
+	}
+}
+
+// Poll delivers pending control messages and input into the receive
+// buffers made available by the driver.
+func (c *Console) Poll(t *Transport) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.Features()&(1<<consoleFeatureMultiport) != 0 &&
+		t.Queue(consoleControlRx).Ready() {
+		q := t.Queue(consoleControlRx)
+		for len(c.control) > 0 {
+			chain, err := q.Pop()
+			if err != nil || chain == nil {
+				return err
+			}
+			message := c.control[0]
+			if uint32(len(message)) > chain.WritableSize() {
+				message = message[:chain.WritableSize()]
+			}
+			if err := chain.WriteAt(message, 0); err != nil {
+				return err
+			}
+			if err := q.Push(chain, uint32(len(message))); err != nil {
+				return err
+			}
+			c.control = c.control[1:]
+		}
+	}
+
+	for i, port := range c.ports {
+		rx, _ := queues(i)
+		if rx >= len(t.queues) || !t.Queue(rx).Ready() {
+			continue
+		}
+		q := t.Queue(rx)
+		for len(port.input) > 0 {
+			chain, err := q.Pop()
+			if err != nil || chain == nil {
+				return err
+			}
+			n := min(uint32(len(port.input)), chain.WritableSize())
+			if err := chain.WriteAt(port.input[:n], 0); err != nil {
+				return err
+			}
+			if err := q.Push(chain, n); err != nil {
+				return err
+			}
+			port.input = port.input[n:]
+		}
+	}
+	return nil
+}
+
+// SaveState writes the control messages and input not delivered yet and
+// which ports the driver has set up.
+func (c *Console) SaveState(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(c.control))); err != nil {
+		return err
+	}
+	for _, message := range c.control {
+		if err := writeBytes(w, message); err != nil {
+			return err
+		}
+	}
+	for _, port := range c.ports {
+		if err := binary.Write(w, binary.LittleEndian, port.ready); err != nil {
+			return err
+		}
+		if err := writeBytes(w, port.input); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadState restores the state saved by SaveState.
+func (c *Console) LoadState(r io.Reader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return fmt.Errorf("failed to read console state: %v", err)
+	}
+	c.control = nil
+	for range count {
+		message, err := readBytes(r)
+		if err != nil {
+			return fmt.Errorf("failed to read console state: %v", err)
+		}
+		c.control = append(c.control, message)
+	}
+	for _, port := range c.ports {
+		if err := binary.Read(r, binary.LittleEndian, &port.ready); err != nil {
+			return fmt.Errorf("failed to read console state: %v", err)
+		}
+		input, err := readBytes(r)
+		if err != nil {
+			return fmt.Errorf("failed to read console state: %v", err)
+		}
+		port.input = input
+	}
+	return nil
+}
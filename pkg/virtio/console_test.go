@@ -0,0 +1,166 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// control returns a control message of virtio-console.
+func control(id uint32, event, value uint16) []byte {
+	message := binary.LittleEndian.AppendUint32(nil, id)
+	message = binary.LittleEndian.AppendUint16(message, event)
+	return binary.LittleEndian.AppendUint16(message, value)
+}
+
+// receiveControl returns the next control message delivered to a buffer
+// of the control receive queue.
+func receiveControl(d *testDriver, buffer testBuffer) []byte {
+	d.t.Helper()
+	written, ok := d.used(consoleControlRx)
+	if !ok {
+		d.t.Fatalf("Expected a control message")
+	}
+	return d.read(buffer.address, written)
+}
+
+// pollUntil polls the transport until the queue has a used chain and
+// returns the number of bytes written to it.
+func pollUntil(d *testDriver, queue int) uint32 {
+	d.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		d.transport.Poll()
+		if written, ok := d.used(queue); ok {
+			return written
+		}
+		time.Sleep(time.Millisecond)
+	}
+	d.t.Fatalf("Timed out waiting for queue %d", queue)
+	return 0
+}
+
+func TestConsole(t *testing.T) {
+	console := NewConsole()
+	var output, serial bytes.Buffer
+	console.AddPort("", strings.NewReader("ls\n"), &output)
+	console.AddPort("org.test.0", nil, &serial)
+	if err := console.Open(nil); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer console.Close()
+	d := newTestDriver(t, console)
+
+	if ports := d.readRegister(regConfig + consoleMaxPortsSize); ports != 2 {
+		t.Errorf("Expected 2 ports, got %d", ports)
+	}
+
+	var buffers []testBuffer
+	for range 6 {
+		buffers = append(buffers, d.submit(consoleControlRx, nil, []uint32{64})...)
+	}
+	d.request(consoleControlTx, [][]byte{control(0, consoleDeviceReady, 1)}, nil)
+	for i := range uint32(2) {
+		expected := control(i, consoleDeviceAdd, 0)
+		if message := receiveControl(d, buffers[i]); !bytes.Equal(message, expected) {
+			t.Errorf("Expected DEVICE_ADD of port %d, got %v", i, message)
+		}
+	}
+
+	d.request(consoleControlTx, [][]byte{control(0, consolePortReady, 1)}, nil)
+	d.request(consoleControlTx, [][]byte{control(1, consolePortReady, 1)}, nil)
+	expected := [][]byte{
+		control(0, consoleConsolePort, 1),
+		control(0, consolePortOpen, 1),
+		append(control(1, consolePortName, 0), "org.test.0"...),
+		control(1, consolePortOpen, 1),
+	}
+	for i, message := range expected {
+		if actual := receiveControl(d, buffers[2+i]); !bytes.Equal(actual, message) {
+			t.Errorf("Expected control message %v, got %v", message, actual)
+		}
+	}
+
+	d.request(1, [][]byte{[]byte("hello")}, nil)
+	d.request(5, [][]byte{[]byte("serial")}, nil)
+	if output.String() != "hello" || serial.String() != "serial" {
+		t.Errorf("Unexpected output %q and %q", output.String(), serial.String())
+	}
+
+	input := d.submit(0, nil, []uint32{16})
+	if written := pollUntil(d, 0); string(d.read(input[0].address, written)) != "ls\n" {
+		t.Errorf("Expected input %q", "ls\n")
+	}
+}
+
+func TestConsole_Socket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.sock")
+	console := NewConsole()
+	console.AddPort("", nil, nil)
+	console.AddSocketPort("org.test.socket", path)
+	if err := console.Open(nil); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer console.Close()
+	d := newTestDriver(t, console)
+	for range 4 {
+		d.submit(consoleControlRx, nil, []uint32{64})
+	}
+	d.request(consoleControlTx, [][]byte{control(0, consoleDeviceReady, 1)}, nil)
+	d.request(consoleControlTx, [][]byte{control(1, consolePortReady, 1)}, nil)
+	for range 3 {
+		// DEVICE_ADD of both ports and PORT_NAME
+		d.used(consoleControlRx)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+
+	// The port opens once the connection is accepted.
+	if written := pollUntil(d, consoleControlRx); written != consoleControlSize {
+		t.Errorf("Expected PORT_OPEN, got %d bytes", written)
+	}
+	input := d.submit(4, nil, []uint32{16})
+	if written := pollUntil(d, 4); string(d.read(input[0].address, written)) != "ping" {
+		t.Errorf("Expected input %q", "ping")
+	}
+
+	d.request(5, [][]byte{[]byte("pong")}, nil)
+	reply := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(reply); err != nil || string(reply) != "pong" {
+		t.Errorf("Expected reply %q, got %q (%v)", "pong", reply, err)
+	}
+}
+
+func TestConsole_OpenClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.sock")
+	first, second := NewConsole(), NewConsole()
+	first.AddSocketPort("", path)
+	second.AddSocketPort("", path)
+	if _, err := net.Dial("unix", path); err == nil {
+		t.Fatal("Expected no socket before Open")
+	}
+
+	if err := first.Open(nil); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := second.Open(nil); err == nil {
+		t.Fatal("Expected the socket to be in use")
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := second.Open(nil); err != nil {
+		t.Fatalf("Expected the socket released by Close, got %v", err)
+	}
+	second.Close()
+}
@@ -0,0 +1,355 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+func init() {
+	devices.Register("virtio-input", func(baseAddress, size uint32, params json.RawMessage) (devices.BusDevice, error) {
+		var p struct {
+			transportParams
+			Kind string `json:"kind"` // keyboard or tablet
+		}
+		if err := devices.DecodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		var input *Input
+		switch p.Kind {
+		case "keyboard":
+			input = NewKeyboard()
+		case "tablet":
+			input = NewTablet()
+		default:
+			return nil, fmt.Errorf("unknown virtio-input kind %q", p.Kind)
+		}
+		if size == 0 {
+			size = TransportSize
+		}
+		t := NewTransport(input, p.IRQ)
+		t.Initialize(baseAddress, size)
+		return t, nil
+	})
+}
+
+// Selectors of the configuration space of virtio-input.
+const (
+	inputConfigName    = 0x01
+	inputConfigSerial  = 0x02
+	inputConfigDevIDs  = 0x03
+	inputConfigEvBits  = 0x11
+	inputConfigAbsInfo = 0x12
+	inputConfigData    = 8 // Offset of the selected data
+)
+
+// Event types and codes of Linux evdev.
+const (
+	inputEvSyn    = 0x00
+	inputEvKey    = 0x01
+	inputEvRel    = 0x02
+	inputEvAbs    = 0x03
+	inputRelWheel = 0x08
+	inputAbsX     = 0x00
+	inputAbsY     = 0x01
+	inputBtnLeft  = 0x110
+	inputBtnRight = 0x111
+	inputBtnMid   = 0x112
+)
+
+const (
+	// InputAbsMax is the largest coordinate of a tablet.
+	InputAbsMax = 0x7FFF
+	// maxInputEvents bounds the events waiting for buffers of the driver.
+	maxInputEvents = 4096
+)
+
+// Pointer buttons of Input.PointerEvent, as in the RFB protocol.
+const (
+	ButtonLeft      = 1 << 0
+	ButtonMiddle    = 1 << 1
+	ButtonRight     = 1 << 2
+	ButtonWheelUp   = 1 << 3
+	ButtonWheelDown = 1 << 4
+)
+
+// Input is a virtio-input device, either a keyboard or a tablet, an
+// absolute pointer with three buttons and a wheel. Events from the host
+// are delivered to the guest when the bus is polled.
+type Input struct {
+	tablet bool
+
+	selected, subselected byte
+
+	mu      sync.Mutex // Guards the events and buttons
+	events  []byte     // Events not delivered yet, 8 bytes each
+	buttons uint8      // Pointer buttons held down
+}
+
+// NewKeyboard returns a virtio-input keyboard.
+func NewKeyboard() *Input {
+	return &Input{}
+}
+
+// NewTablet returns a virtio-input tablet.
+func NewTablet() *Input {
+	return &Input{tablet: true}
+}
+
+// IsTablet reports whether the device is a tablet rather than a keyboard.
+func (in *Input) IsTablet() bool {
+	return in.tablet
+}
+
+// event queues an evdev event.
+func (in *Input) event(kind, code uint16, value int32) {
+	if len(in.events) >= 8*maxInputEvents {
+		return
+	}
+	in.events = binary.LittleEndian.AppendUint16(in.events, kind)
+	in.events = binary.LittleEndian.AppendUint16(in.events, code)
+	in.events = binary.LittleEndian.AppendUint32(in.events, uint32(value))
+}
+
+// KeyEvent presses or releases the key with a Linux key code, e.g. 30 for
+// KEY_A. Tablets ignore it.
+func (in *Input) KeyEvent(code uint16, pressed bool) {
+	if in.tablet {
+		return
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	value := int32(0)
+	if pressed {
+		value = 1
+	}
+	in.event(inputEvKey, code, value)
+	in.event(inputEvSyn, 0, 0)
+}
+
+// PointerEvent moves the pointer to (x, y) of a screen of width by height
+// pixels with the given buttons held down. Keyboards ignore it.
+func (in *Input) PointerEvent(x, y, width, height int, buttons uint8) {
+	if !in.tablet {
+		return
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.event(inputEvAbs, inputAbsX, int32(scale(x, width)))
+	in.event(inputEvAbs, inputAbsY, int32(scale(y, height)))
+	for _, button := range []struct {
+		mask uint8
+		code uint16
+	}{{ButtonLeft, inputBtnLeft}, {ButtonMiddle, inputBtnMid}, {ButtonRight, inputBtnRight}} {
+		if (buttons^in.buttons)&button.mask != 0 {
+			value := int32(0)
+			if buttons&button.mask != 0 {
+				value = 1
+			}
+			in.event(inputEvKey, button.code, value)
+		}
+	}
+	pressed := buttons &^ in.buttons
+	if pressed&ButtonWheelUp != 0 {
+		in.event(inputEvRel, inputRelWheel, 1)
+	}
+	if pressed&ButtonWheelDown != 0 {
+		in.event(inputEvRel, inputRelWheel, -1)
+	}
+	in.buttons = buttons
+	in.event(inputEvSyn, 0, 0)
+}
+
+// scale maps a coordinate of a screen of the given size to the axis of a
+// tablet.
+func scale(position, size int) int {
+	if size <= 1 || position <= 0 {
+		return 0
+	}
+	return min(position, size-1) * InputAbsMax / (size - 1)
+}
+
+func (in *Input) DeviceID() uint32 {
+	return DeviceIDInput
+}
+
+func (in *Input) Features() uint64 {
+	return 0
+}
+
+// Queues returns the event queue and the status queue.
+func (in *Input) Queues() int {
+	return 2
+}
+
+// bitmap returns a bitmap with the given bits set.
+func bitmap(bits ...uint16) []byte {
+	var b []byte
+	for _, bit := range bits {
+		for int(bit/8) >= len(b) {
+			b = append(b, 0)
+		}
+		b[bit/8] |= 1 << (bit % 8)
+	}
+	return b
+}
+
+// config returns the data selected in the configuration space.
+func (in *Input) config() []byte {
+	switch in.selected {
+	case inputConfigName:
+		if in.tablet {
+			return []byte("go-riscv-emu tablet")
+		}
+		return []byte("go-riscv-emu keyboard")
+	case inputConfigSerial:
+		return []byte("0")
+	case inputConfigDevIDs:
+		ids := binary.LittleEndian.AppendUint16(nil, 0x06) // BUS_VIRTUAL
+		ids = binary.LittleEndian.AppendUint16(ids, 0)
+		product := uint16(1)
+		if in.tablet {
+			product = 2
+		}
+		ids = binary.LittleEndian.AppendUint16(ids, product)
+		return binary.LittleEndian.AppendUint16(ids, 1)
+	case inputConfigEvBits:
+		switch {
+		case in.subselected == inputEvKey && in.tablet:
+			return bitmap(inputBtnLeft, inputBtnRight, inputBtnMid)
+		case in.subselected == inputEvKey:
+			keys := make([]uint16, 0, 255)
+			for key := range uint16(255) {
+				keys = append(keys, key+1)
+			}
+			return bitmap(keys...)
+		case in.subselected == inputEvRel && in.tablet:
+			return bitmap(inputRelWheel)
+		case in.subselected == inputEvAbs && in.tablet:
+			return bitmap(inputAbsX, inputAbsY)
+		}
+	case inputConfigAbsInfo:
+		if in.tablet && (in.subselected == inputAbsX || in.subselected == inputAbsY) {
+			info := binary.LittleEndian.AppendUint32(nil, 0)
+			info = binary.LittleEndian.AppendUint32(info, InputAbsMax)
+			return append(info, make([]byte, 12)...) // fuzz, flat and res
+		}
+	}
+	return nil
+}
+
+// ReadConfig reads the configuration space: select, subsel, the size of
+// the selected data and the data.
+func (in *Input) ReadConfig(offset uint32) byte {
+	data := in.config()
+	switch {
+	case offset == 0:
+		return in.selected
+	case offset == 1:
+		return in.subselected
+	case offset == 2:
+		return byte(len(data))
+	case offset >= inputConfigData && int(offset-inputConfigData) < len(data):
+		return data[offset-inputConfigData]
+	}
+	return 0
+}
+
+// WriteConfig writes select and subsel.
+func (in *Input) WriteConfig(offset uint32, value byte) {
+	switch offset {
+	case 0:
+		in.selected = value
+	case 1:
+		in.subselected = value
+	}
+}
+
+// Reset drops the events not delivered yet.
+func (in *Input) Reset() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.selected, in.subselected = 0, 0
+	in.events = nil
+}
+
+// Notify discards status updates of the driver, e.g. keyboard LEDs, and
+// delivers events into new buffers.
+func (in *Input) Notify(t *Transport, queue int) error {
+	if queue == 1 {
+		q := t.Queue(1)
+		for {
+			chain, err := q.Pop()
+			if err != nil {
+				return err
+			}
+			if chain == nil {
+				break
+			}
+			if err := q.Push(chain, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return in.Poll(t)
+}
+
+// Poll delivers the queued events, one per buffer.
+func (in *Input) Poll(t *Transport) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	q := t.Queue(0)
+	if !q.Ready() {
+		return nil
+	}
+	for len(in.events) > 0 {
+		chain, err := q.Pop()
+		if err != nil || chain == nil {
+			return err
+		}
+		written := uint32(0)
+		if chain.WritableSize() >= 8 {
+			if err := chain.WriteAt(in.events[:8], 0); err != nil {
+				return err
+			}
+			written = 8
+		}
+		if err := q.Push(chain, written); err != nil {
+			return err
+		}
+		in.events = in.events[8:]
+	}
+	return nil
+}
+
+// SaveState writes the selected configuration, the events not delivered
+// yet and the buttons held down to w.
+func (in *Input) SaveState(w io.Writer) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if _, err := w.Write([]byte{in.selected, in.subselected, in.buttons}); err != nil {
+		return err
+	}
+	return writeBytes(w, in.events)
+}
+
+// LoadState restores the state saved by SaveState.
+func (in *Input) LoadState(r io.Reader) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	var state [3]byte
+	if _, err := io.ReadFull(r, state[:]); err != nil {
+		return fmt.Errorf("failed to read virtio-input state: %v", err)
+	}
+	events, err := readBytes(r)
+	if err != nil {
+		return fmt.Errorf("failed to read virtio-input state: %v", err)
+	}
+	in.selected, in.subselected, in.buttons = state[0], state[1], state[2]
+	in.events = events
+	return nil
+}
@@ -0,0 +1,96 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// inputEvents returns the events delivered into the given buffers.
+func inputEvents(d *testDriver, buffers []testBuffer) [][3]int32 {
+	d.t.Helper()
+	var events [][3]int32
+	for _, buffer := range buffers {
+		if written, ok := d.used(0); !ok || written != 8 {
+			break
+		}
+		event := d.read(buffer.address, 8)
+		events = append(events, [3]int32{
+			int32(binary.LittleEndian.Uint16(event)),
+			int32(binary.LittleEndian.Uint16(event[2:])),
+			int32(binary.LittleEndian.Uint32(event[4:])),
+		})
+	}
+	return events
+}
+
+func TestInput_Keyboard(t *testing.T) {
+	keyboard := NewKeyboard()
+	d := newTestDriver(t, keyboard)
+
+	d.write(testTransport+regConfig, []byte{inputConfigName})
+	size := d.read(testTransport+regConfig+2, 1)[0]
+	if name := d.read(testTransport+regConfig+inputConfigData, uint32(size)); string(name) != "go-riscv-emu keyboard" {
+		t.Errorf("Unexpected name %q", name)
+	}
+	d.write(testTransport+regConfig, []byte{inputConfigEvBits, inputEvAbs})
+	if size := d.read(testTransport+regConfig+2, 1)[0]; size != 0 {
+		t.Errorf("Expected no absolute axes, got %d bytes", size)
+	}
+
+	var buffers []testBuffer
+	for range 4 {
+		buffers = append(buffers, d.submit(0, nil, []uint32{8})...)
+	}
+	keyboard.KeyEvent(30, true)
+	keyboard.KeyEvent(30, false)
+	d.transport.Poll()
+	expected := [][3]int32{
+		{inputEvKey, 30, 1}, {inputEvSyn, 0, 0},
+		{inputEvKey, 30, 0}, {inputEvSyn, 0, 0},
+	}
+	if events := inputEvents(d, buffers); !slices.Equal(events, expected) {
+		t.Errorf("Expected events %v, got %v", expected, events)
+	}
+}
+
+func TestInput_Tablet(t *testing.T) {
+	tablet := NewTablet()
+	d := newTestDriver(t, tablet)
+
+	d.write(testTransport+regConfig, []byte{inputConfigAbsInfo, inputAbsY})
+	info := d.read(testTransport+regConfig+inputConfigData, 8)
+	if binary.LittleEndian.Uint32(info[4:]) != InputAbsMax {
+		t.Errorf("Unexpected axis %v", info)
+	}
+
+	tablet.PointerEvent(639, 240, 640, 480, ButtonLeft|ButtonWheelUp)
+	var state bytes.Buffer
+	if err := tablet.SaveState(&state); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	restored := NewTablet()
+	if err := restored.LoadState(&state); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if !bytes.Equal(restored.events, tablet.events) || restored.buttons != tablet.buttons {
+		t.Error("Expected the restored events")
+	}
+
+	var buffers []testBuffer
+	for range 5 {
+		buffers = append(buffers, d.submit(0, nil, []uint32{8})...)
+	}
+	d.transport.Poll()
+	expected := [][3]int32{
+		{inputEvAbs, inputAbsX, InputAbsMax},
+		{inputEvAbs, inputAbsY, 240 * InputAbsMax / 479},
+		{inputEvKey, inputBtnLeft, 1},
+		{inputEvRel, inputRelWheel, 1},
+		{inputEvSyn, 0, 0},
+	}
+	if events := inputEvents(d, buffers); !slices.Equal(events, expected) {
+		t.Errorf("Expected events %v, got %v", expected, events)
+	}
+}
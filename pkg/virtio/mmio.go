@@ -0,0 +1,509 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+// TransportSize is the default size of the register space of a transport.
+const TransportSize = 0x200
+
+// Registers of the virtio-mmio transport.
+const (
+	regMagic             = 0x000
+	regVersion           = 0x004
+	regDeviceID          = 0x008
+	regVendorID          = 0x00C
+	regDeviceFeatures    = 0x010
+	regDeviceFeaturesSel = 0x014
+	regDriverFeatures    = 0x020
+	regDriverFeaturesSel = 0x024
+	regQueueSel          = 0x030
+	regQueueNumMax       = 0x034
+	regQueueNum          = 0x038
+	regQueueReady        = 0x044
+	regQueueNotify       = 0x050
+	regInterruptStatus   = 0x060
+	regInterruptACK      = 0x064
+	regStatus            = 0x070
+	regQueueDescLow      = 0x080
+	regQueueDescHigh     = 0x084
+	regQueueDriverLow    = 0x090
+	regQueueDriverHigh   = 0x094
+	regQueueDeviceLow    = 0x0A0
+	regQueueDeviceHigh   = 0x0A4
+	regConfigGeneration  = 0x0FC
+	regConfig            = 0x100
+)
+
+const (
+	magic    = 0x74726976 // "virt"
+	version  = 2
+	vendorID = 0x4D49534B // "KSIM"
+)
+
+// Bits of the device status.
+const (
+	statusAcknowledge = 1
+	statusDriver      = 2
+	statusDriverOK    = 4
+	statusFeaturesOK  = 8
+	statusNeedsReset  = 0x40
+	statusFailed      = 0x80
+)
+
+// Bits of the interrupt status.
+const (
+	interruptUsedBuffer   = 1
+	interruptConfigChange = 2
+)
+
+// transportParams are the parameters of the transport shared by all device
+// types in machine configurations.
+type transportParams struct {
+	IRQ uint32 `json:"irq"` // Interrupt source at the PLIC, 0 for none
+}
+
+// Transport is a virtio-mmio transport, the bus device through which the
+// driver talks to a virtio device. Its registers are 32 bits wide and
+// written registers take effect with their last byte.
+type Transport struct {
+	baseAddress uint32
+	size        uint32
+	irq         uint32
+	line        devices.IRQLine
+	bus         *devices.Bus
+	device      Device
+	queues      []*Queue
+
+	status            uint32
+	deviceFeaturesSel uint32
+	driverFeaturesSel uint32
+	driverFeatures    uint64
+	queueSel          uint32
+	interruptStatus   uint32
+	configGeneration  uint32
+	write             uint32 // Register being written byte by byte
+}
+
+// NewTransport returns a transport for a device, raising the given
+// interrupt source, 0 for none.
+func NewTransport(device Device, irq uint32) *Transport {
+	t := &Transport{device: device, irq: irq}
+	for i := range device.Queues() {
+		t.queues = append(t.queues, &Queue{transport: t, index: i})
+	}
+	return t
+}
+
+// Initialize sets up the transport at the given base address.
+func (t *Transport) Initialize(baseAddress, size uint32) {
+	t.baseAddress = baseAddress
+	t.size = size
+}
+
+func (t *Transport) BaseAddress() uint32 {
+	return t.baseAddress
+}
+
+func (t *Transport) Size() uint32 {
+	return t.size
+}
+
+// Device returns the virtio device behind the transport.
+func (t *Transport) Device() Device {
+	return t.device
+}
+
+// IRQ returns the interrupt source of the transport.
+func (t *Transport) IRQ() uint32 {
+	return t.irq
+}
+
+// ConnectIRQ connects the transport to its interrupt line.
+func (t *Transport) ConnectIRQ(line devices.IRQLine) {
+	t.line = line
+	t.updateLine()
+}
+
+// ConnectBus connects the transport to the bus that the queues are
+// accessed through.
+func (t *Transport) ConnectBus(bus *devices.Bus) {
+	t.bus = bus
+}
+
+// Open opens the host resources of a HostDevice behind the transport.
+func (t *Transport) Open(host *devices.Host) error {
+	if device, ok := t.device.(HostDevice); ok {
+		return device.Open(host)
+	}
+	return nil
+}
+
+// Close closes the host resources of a HostDevice behind the transport.
+func (t *Transport) Close() error {
+	if device, ok := t.device.(HostDevice); ok {
+		return device.Close()
+	}
+	return nil
+}
+
+// Queue returns a virtqueue of the device.
+func (t *Transport) Queue(index int) *Queue {
+	return t.queues[index]
+}
+
+// Features returns the feature bits negotiated with the driver, or 0 while
+// negotiation is not complete.
+func (t *Transport) Features() uint64 {
+	if t.status&statusFeaturesOK == 0 {
+		return 0
+	}
+	return t.driverFeatures
+}
+
+// DriverOK reports whether the driver has set up the device.
+func (t *Transport) DriverOK() bool {
+	return t.status&statusDriverOK != 0 && t.status&statusNeedsReset == 0
+}
+
+// ConfigChanged tells the driver that the configuration space changed.
+func (t *Transport) ConfigChanged() {
+	t.configGeneration++
+	if t.DriverOK() {
+		t.interrupt(interruptConfigChange)
+	}
+}
+
+// deviceFeatures returns all feature bits offered to the driver.
+func (t *Transport) deviceFeatures() uint64 {
+	return t.device.Features() | 1<<FeatureVersion1
+}
+
+// interrupt sets bits of the interrupt status.
+func (t *Transport) interrupt(bits uint32) {
+	t.interruptStatus |= bits
+	t.updateLine()
+}
+
+// updateLine sets the interrupt line to whether an interrupt is pending.
+func (t *Transport) updateLine() {
+	if t.line != nil {
+		t.line.SetLevel(t.interruptStatus != 0)
+	}
+}
+
+// fail marks the device as needing a reset after an error of the driver,
+// e.g. a malformed descriptor chain.
+func (t *Transport) fail(err error) {
+	slog.Warn("virtio device needs reset", "device", t.device.DeviceID(),
+		"address", fmt.Sprintf("%X", t.baseAddress), "error", err)
+	t.status |= statusNeedsReset
+	t.interrupt(interruptConfigChange)
+}
+
+// reset returns the transport and its device to their initial state.
+func (t *Transport) reset() {
+	t.status = 0
+	t.deviceFeaturesSel, t.driverFeaturesSel = 0, 0
+	t.driverFeatures = 0
+	t.queueSel = 0
+	t.interruptStatus = 0
+	for _, q := range t.queues {
+		q.reset()
+	}
+	t.device.Reset()
+	t.updateLine()
+}
+
+// selected returns the queue selected by QueueSel, or nil.
+func (t *Transport) selected() *Queue {
+	if t.queueSel < uint32(len(t.queues)) {
+		return t.queues[t.queueSel]
+	}
+	return nil
+}
+
+// Read reads a byte of a transport register or of the configuration space.
+func (t *Transport) Read(address uint32) (byte, error) {
+	if address < t.baseAddress || address-t.baseAddress >= t.size {
+		return 0, fmt.Errorf(
+			"attempted to read from invalid virtio-mmio address %X", address)
+	}
+	offset := address - t.baseAddress
+	if offset >= regConfig {
+		return t.device.ReadConfig(offset - regConfig), nil
+	}
+	return byte(t.register(offset&^3) >> (8 * (offset & 3))), nil
+}
+
+// register returns the value of a transport register.
+func (t *Transport) register(offset uint32) uint32 {
+	q := t.selected()
+	switch offset {
+	case regMagic:
+		return magic
+	case regVersion:
+		return version
+	case regDeviceID:
+		return t.device.DeviceID()
+	case regVendorID:
+		return vendorID
+	case regDeviceFeatures:
+		if t.deviceFeaturesSel < 2 {
+			return uint32(t.deviceFeatures() >> (32 * t.deviceFeaturesSel))
+		}
+	case regQueueNumMax:
+		if q != nil {
+			return MaxQueueSize
+		}
+	case regQueueNum:
+		if q != nil {
+			return q.size
+		}
+	case regQueueReady:
+		if q != nil && q.ready {
+			return 1
+		}
+	case regInterruptStatus:
+		return t.interruptStatus
+	case regStatus:
+		return t.status
+	case regQueueDescLow, regQueueDescHigh:
+		if q != nil {
+			return uint32(q.desc >> (8 * (offset - regQueueDescLow)))
+		}
+	case regQueueDriverLow, regQueueDriverHigh:
+		if q != nil {
+			return uint32(q.driver >> (8 * (offset - regQueueDriverLow)))
+		}
+	case regQueueDeviceLow, regQueueDeviceHigh:
+		if q != nil {
+			return uint32(q.device >> (8 * (offset - regQueueDeviceLow)))
+		}
+	case regConfigGeneration:
+		return t.configGeneration
+	}
+	return 0
+}
+
+// Write writes a byte of a transport register or of the configuration
+// space. Errors of the driver put the device into the needs reset state
+// rather than failing the access.
+func (t *Transport) Write(address uint32, value byte) error {
+	if address < t.baseAddress || address-t.baseAddress >= t.size {
+		return fmt.Errorf(
+			"attempted to write %X to invalid virtio-mmio address %X",
+			value, address)
+	}
+	offset := address - t.baseAddress
+	if offset >= regConfig {
+		t.device.WriteConfig(offset-regConfig, value)
+		return nil
+	}
+	shift := 8 * (offset & 3)
+	t.write = t.write&^(0xFF<<shift) | uint32(value)<<shift
+	if offset&3 == 3 {
+		if err := t.setRegister(offset&^3, t.write); err != nil {
+			t.fail(err)
+		}
+	}
+	return nil
+}
+
+// setRegister writes a transport register.
+func (t *Transport) setRegister(offset, value uint32) error {
+	q := t.selected()
+	switch offset {
+	case regDeviceFeaturesSel:
+		t.deviceFeaturesSel = value
+	case regDriverFeatures:
+		if t.driverFeaturesSel < 2 {
+			shift := 32 * t.driverFeaturesSel
+			t.driverFeatures = t.driverFeatures&^(0xFFFFFFFF<<shift) |
+				uint64(value)<<shift
+		}
+	case regDriverFeaturesSel:
+		t.driverFeaturesSel = value
+	case regQueueSel:
+		t.queueSel = value
+	case regQueueNotify:
+		if value >= uint32(len(t.queues)) {
+			return fmt.Errorf("notification of missing queue %d", value)
+		}
+		if t.DriverOK() && t.queues[value].ready {
+			return t.device.Notify(t, int(value))
+		}
+	case regInterruptACK:
+		t.interruptStatus &^= value
+		t.updateLine()
+	case regStatus:
+		t.setStatus(value)
+	}
+
+	if q == nil || q.ready && offset != regQueueReady {
+		// The queue registers are read-only while the queue is ready.
+		return nil
+	}
+	switch offset {
+	case regQueueNum:
+		q.size = value
+	case regQueueReady:
+		if value&1 == 0 {
+			q.ready = false
+			return nil
+		}
+		if q.size == 0 || q.size > MaxQueueSize || q.size&(q.size-1) != 0 {
+			return fmt.Errorf("invalid size %d of queue %d", q.size, q.index)
+		}
+		q.ready = true
+	case regQueueDescLow, regQueueDescHigh:
+		q.desc = setHalf(q.desc, offset-regQueueDescLow, value)
+	case regQueueDriverLow, regQueueDriverHigh:
+		q.driver = setHalf(q.driver, offset-regQueueDriverLow, value)
+	case regQueueDeviceLow, regQueueDeviceHigh:
+		q.device = setHalf(q.device, offset-regQueueDeviceLow, value)
+	}
+	return nil
+}
+
+// setHalf sets the lower (offset 0) or upper (offset 4) half of a 64-bit
+// address.
+func setHalf(address uint64, offset, value uint32) uint64 {
+	shift := 8 * offset
+	return address&^(0xFFFFFFFF<<shift) | uint64(value)<<shift
+}
+
+// setStatus writes the device status. Writing 0 resets the device, and
+// FEATURES_OK is only accepted for features the device offered, including
+// VIRTIO_F_VERSION_1.
+func (t *Transport) setStatus(value uint32) {
+	if value == 0 {
+		t.reset()
+		return
+	}
+	if value&statusFeaturesOK != 0 && t.status&statusFeaturesOK == 0 {
+		if t.driverFeatures&^t.deviceFeatures() != 0 ||
+			t.driverFeatures&(1<<FeatureVersion1) == 0 {
+			value &^= statusFeaturesOK
+		}
+	}
+	t.status = value | t.status&statusNeedsReset
+}
+
+// Poll lets a device with work from the host perform it.
+func (t *Transport) Poll() {
+	device, ok := t.device.(PolledDevice)
+	if !ok || !t.DriverOK() {
+		return
+	}
+	if err := device.Poll(t); err != nil {
+		t.fail(err)
+	}
+}
+
+// AsyncInput reports whether the device receives work from the host, which
+// it delivers to the guest when polled.
+func (t *Transport) AsyncInput() bool {
+	_, ok := t.device.(PolledDevice)
+	return ok
+}
+
+// readMemory reads guest memory through the bus.
+func (t *Transport) readMemory(address, size uint32) ([]byte, error) {
+	if t.bus == nil {
+		return nil, fmt.Errorf("virtio device is not connected to a bus")
+	}
+	data := make([]byte, size)
+	for i := range data {
+		value, err := t.bus.ReadLocked(address + uint32(i))
+		if err != nil {
+			return nil, err
+		}
+		data[i] = value
+	}
+	return data, nil
+}
+
+// writeMemory writes guest memory through the bus.
+func (t *Transport) writeMemory(address uint32, data []byte) error {
+	if t.bus == nil {
+		return fmt.Errorf("virtio device is not connected to a bus")
+	}
+	for i, value := range data {
+		if err := t.bus.WriteLocked(address+uint32(i), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddToDeviceTree adds the node of the transport.
+func (t *Transport) AddToDeviceTree(tree *devices.DeviceTree) {
+	node := tree.AddDevice(t, "virtio_mmio", "virtio,mmio")
+	tree.AddInterrupt(node, t.irq)
+}
+
+// transportState holds the registers of a transport in a snapshot.
+type transportState struct {
+	Status, DeviceFeaturesSel, DriverFeaturesSel uint32
+	DriverFeatures                               uint64
+	QueueSel, InterruptStatus, ConfigGeneration  uint32
+	Write                                        uint32
+}
+
+// queueState holds the state of a queue in a snapshot.
+type queueState struct {
+	Size                 uint32
+	Ready                bool
+	Desc, Driver, Device uint64
+	LastAvail, Used      uint16
+}
+
+// SaveState writes the registers and queues of the transport followed by
+// the state of the device to w.
+func (t *Transport) SaveState(w io.Writer) error {
+	state := transportState{t.status, t.deviceFeaturesSel,
+		t.driverFeaturesSel, t.driverFeatures, t.queueSel,
+		t.interruptStatus, t.configGeneration, t.write}
+	if err := binary.Write(w, binary.LittleEndian, state); err != nil {
+		return err
+	}
+	for _, q := range t.queues {
+		state := queueState{q.size, q.ready, q.desc, q.driver, q.device,
+			q.lastAvail, q.used}
+		if err := binary.Write(w, binary.LittleEndian, state); err != nil {
+			return err
+		}
+	}
+	return t.device.SaveState(w)
+}
+
+// LoadState restores the state saved by SaveState.
+func (t *Transport) LoadState(r io.Reader) error {
+	var state transportState
+	if err := binary.Read(r, binary.LittleEndian, &state); err != nil {
+		return fmt.Errorf("failed to read virtio-mmio state: %v", err)
+	}
+	t.status, t.deviceFeaturesSel, t.driverFeaturesSel = state.Status,
+		state.DeviceFeaturesSel, state.DriverFeaturesSel
+	t.driverFeatures, t.queueSel = state.DriverFeatures, state.QueueSel
+	t.interruptStatus, t.configGeneration = state.InterruptStatus,
+		state.ConfigGeneration
+	t.write = state.Write
+	for _, q := range t.queues {
+		var state queueState
+		if err := binary.Read(r, binary.LittleEndian, &state); err != nil {
+			return fmt.Errorf("failed to read virtqueue state: %v", err)
+		}
+		q.size, q.ready, q.desc, q.driver, q.device = state.Size,
+			state.Ready, state.Desc, state.Driver, state.Device
+		q.lastAvail, q.used = state.LastAvail, state.Used
+	}
+	t.updateLine()
+	return t.device.LoadState(r)
+}
@@ -0,0 +1,285 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+func init() {
+	devices.Register("virtio-net", func(baseAddress, size uint32, params json.RawMessage) (devices.BusDevice, error) {
+		var p struct {
+			transportParams
+			MAC     string `json:"mac"`
+			Backend string `json:"backend"` // none, loopback or unixgram
+			Link    string `json:"link"`    // Name of the loopback link
+			Socket  string `json:"socket"`  // Path to bind the datagram socket to
+			Peer    string `json:"peer"`    // Path of the peer datagram socket
+			Pcap    string `json:"pcap"`    // Path of a pcap file of all frames
+		}
+		if err := devices.DecodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		mac := DefaultMAC
+		if p.MAC != "" {
+			var err error
+			if mac, err = net.ParseMAC(p.MAC); err != nil || len(mac) != 6 {
+				return nil, fmt.Errorf("invalid MAC address %q", p.MAC)
+			}
+		}
+
+		switch p.Backend {
+		case "", "none":
+			if p.Pcap == "" {
+				return nil, fmt.Errorf("virtio-net needs a backend or a pcap file")
+			}
+		case "loopback":
+		case "unixgram":
+			if p.Socket == "" || p.Peer == "" {
+				return nil, fmt.Errorf("unixgram backend needs a socket and a peer")
+			}
+		default:
+			return nil, fmt.Errorf("unknown network backend %q", p.Backend)
+		}
+
+		if size == 0 {
+			size = TransportSize
+		}
+		n := &Net{mac: mac, kind: p.Backend, link: p.Link, socket: p.Socket,
+			peer: p.Peer, pcap: p.Pcap}
+		t := NewTransport(n, p.IRQ)
+		t.Initialize(baseAddress, size)
+		return t, nil
+	})
+}
+
+// DefaultMAC is the MAC address of virtio-net devices without one.
+var DefaultMAC = net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+
+// Feature bits of virtio-net.
+const (
+	netFeatureMAC    = 5
+	netFeatureStatus = 16
+)
+
+const (
+	netRx         = 0
+	netTx         = 1
+	netHeaderSize = 12 // struct virtio_net_hdr including num_buffers
+	netLinkUp     = 1
+)
+
+// NetBackend carries the Ethernet frames of a virtio-net device.
+type NetBackend interface {
+	// Send sends a frame transmitted by the guest.
+	Send(frame []byte) error
+	// Receive returns the next frame for the guest, or nil if there is
+	// none. It must not block.
+	Receive() ([]byte, error)
+}
+
+// Net is a virtio-net device, an Ethernet adapter whose frames are
+// carried by a backend.
+type Net struct {
+	backend NetBackend
+	mac     net.HardwareAddr
+	pending []byte // Frame received from the backend but not delivered
+
+	// Backend of a machine configuration, created by Open.
+	kind, link, socket, peer, pcap string
+	opened                         bool // The backend was created by Open
+	closers                        []io.Closer
+}
+
+// NewNet returns a virtio-net device with the given backend and MAC
+// address.
+func NewNet(backend NetBackend, mac net.HardwareAddr) *Net {
+	return &Net{backend: backend, mac: mac}
+}
+
+// Open creates the backend of a device from a machine configuration: it
+// takes an end of the loopback link of the machine or binds the datagram
+// socket, and creates the pcap file. It does nothing for devices with a
+// backend.
+func (n *Net) Open(host *devices.Host) error {
+	if n.backend != nil {
+		return nil
+	}
+	var backend NetBackend
+	switch n.kind {
+	case "loopback":
+		end, err := LoopbackLink(host, n.link)
+		if err != nil {
+			return err
+		}
+		backend = end
+	case "unixgram":
+		u, err := NewUnixgramBackend(n.socket, n.peer)
+		if err != nil {
+			return err
+		}
+		backend = u
+		n.closers = append(n.closers, u)
+	}
+	if n.pcap != "" {
+		f, err := os.Create(n.pcap)
+		if err != nil {
+			n.Close()
+			return fmt.Errorf("failed to create pcap file: %v", err)
+		}
+		n.closers = append(n.closers, f)
+		if backend, err = NewPcapBackend(backend, f); err != nil {
+			n.Close()
+			return err
+		}
+	}
+	n.backend, n.opened = backend, true
+	return nil
+}
+
+// Close closes the socket and the pcap file created by Open.
+func (n *Net) Close() error {
+	var errs []error
+	for _, closer := range n.closers {
+		errs = append(errs, closer.Close())
+	}
+	n.closers = nil
+	if n.opened {
+		n.backend, n.opened = nil, false
+	}
+	return errors.Join(errs...)
+}
+
+func (n *Net) DeviceID() uint32 {
+	return DeviceIDNet
+}
+
+func (n *Net) Features() uint64 {
+	return 1<<netFeatureMAC | 1<<netFeatureStatus
+}
+
+func (n *Net) Queues() int {
+	return 2
+}
+
+// ReadConfig reads the configuration space: the MAC address and the link
+// status, which is always up.
+func (n *Net) ReadConfig(offset uint32) byte {
+	switch {
+	case offset < 6:
+		return n.mac[offset]
+	case offset == 6:
+		return netLinkUp
+	}
+	return 0
+}
+
+// WriteConfig ignores writes, as the configuration space is read-only.
+func (n *Net) WriteConfig(offset uint32, value byte) {
+}
+
+// Reset drops a frame not delivered yet.
+func (n *Net) Reset() {
+	n.pending = nil
+}
+
+// Notify sends the frames transmitted by the guest and delivers received
+// ones into new receive buffers.
+func (n *Net) Notify(t *Transport, queue int) error {
+	if queue == netTx {
+		q := t.Queue(netTx)
+		for {
+			chain, err := q.Pop()
+			if err != nil {
+				return err
+			}
+			if chain == nil {
+				break
+			}
+			data, err := chain.Read()
+			if err != nil {
+				return err
+			}
+			if len(data) < netHeaderSize {
+				return fmt.Errorf("virtio-net packet of %d bytes without header",
+					len(data))
+			}
+			if err := n.backend.Send(data[netHeaderSize:]); err != nil {
+				slog.Warn("Failed to send network frame", "error", err)
+			}
+			if err := q.Push(chain, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return n.Poll(t)
+}
+
+// Poll delivers the frames received by the backend into the receive
+// buffers made available by the guest. Frames larger than a buffer are
+// dropped.
+func (n *Net) Poll(t *Transport) error {
+	q := t.Queue(netRx)
+	if !q.Ready() {
+		return nil
+	}
+	for {
+		if n.pending == nil {
+			frame, err := n.backend.Receive()
+			if err != nil {
+				slog.Warn("Failed to receive network frame", "error", err)
+				return nil
+			}
+			if frame == nil {
+				return nil
+			}
+			n.pending = frame
+		}
+		chain, err := q.Pop()
+		if err != nil || chain == nil {
+			return err
+		}
+		packet := make([]byte, netHeaderSize, netHeaderSize+len(n.pending))
+		binary.LittleEndian.PutUint16(packet[10:], 1) // num_buffers
+		packet = append(packet, n.pending...)
+		n.pending = nil
+		written := uint32(0)
+		if uint32(len(packet)) <= chain.WritableSize() {
+			if err := chain.WriteAt(packet, 0); err != nil {
+				return err
+			}
+			written = uint32(len(packet))
+		} else {
+			slog.Warn("Dropped network frame larger than the receive buffer",
+				"size", len(packet)-netHeaderSize)
+		}
+		if err := q.Push(chain, written); err != nil {
+			return err
+		}
+	}
+}
+
+// SaveState writes a frame not delivered yet to w.
+func (n *Net) SaveState(w io.Writer) error {
+	return writeBytes(w, n.pending)
+}
+
+// LoadState restores a frame not delivered yet.
+func (n *Net) LoadState(r io.Reader) error {
+	pending, err := readBytes(r)
+	if err != nil {
+		return fmt.Errorf("failed to read virtio-net state: %v", err)
+	}
+	n.pending = nil
+	if len(pending) > 0 {
+		n.pending = pending
+	}
+	return nil
+}
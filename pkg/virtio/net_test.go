@@ -0,0 +1,151 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+// netFrame is an Ethernet frame for the tests.
+var netFrame = append(bytes.Repeat([]byte{0xFF}, 6),
+	0x52, 0x54, 0x00, 0x12, 0x34, 0x56, 0x08, 0x06, 'h', 'i')
+
+// netTransmit sends a frame with a virtio-net header through the driver.
+func netTransmit(d *testDriver, frame []byte) {
+	d.t.Helper()
+	d.request(netTx, [][]byte{make([]byte, netHeaderSize), frame}, nil)
+}
+
+func TestNet_Loopback(t *testing.T) {
+	a, b := NewLoopbackPair()
+	device := NewNet(a, DefaultMAC)
+	first := newTestDriver(t, device)
+	second := newTestDriver(t, NewNet(b, DefaultMAC))
+
+	if mac := first.read(testTransport+regConfig, 7); !bytes.Equal(mac,
+		append(DefaultMAC[:6:6], netLinkUp)) {
+		t.Errorf("Unexpected configuration %v", mac)
+	}
+
+	netTransmit(first, netFrame)
+	buffers := second.submit(netRx, nil, []uint32{1526})
+	written := pollUntil(second, netRx)
+	if written != netHeaderSize+uint32(len(netFrame)) {
+		t.Fatalf("Expected a frame with header, got %d bytes", written)
+	}
+	packet := second.read(buffers[0].address, written)
+	if binary.LittleEndian.Uint16(packet[10:]) != 1 {
+		t.Errorf("Expected num_buffers 1, got header %v", packet[:netHeaderSize])
+	}
+	if !bytes.Equal(packet[netHeaderSize:], netFrame) {
+		t.Errorf("Expected frame %v, got %v", netFrame, packet[netHeaderSize:])
+	}
+
+	// Frames wait for receive buffers and are part of snapshots.
+	netTransmit(second, netFrame)
+	first.transport.Poll()
+	var state bytes.Buffer
+	if err := device.SaveState(&state); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	var restored Net
+	if err := restored.LoadState(&state); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if !bytes.Equal(restored.pending, netFrame) {
+		t.Errorf("Expected the pending frame in the snapshot, got %v", restored.pending)
+	}
+	buffers = first.submit(netRx, nil, []uint32{1526})
+	written = pollUntil(first, netRx)
+	if packet := first.read(buffers[0].address, written); !bytes.Equal(packet[netHeaderSize:], netFrame) {
+		t.Errorf("Expected the waiting frame, got %v", packet)
+	}
+}
+
+func TestLoopbackLink(t *testing.T) {
+	host := devices.NewHost()
+	a, err := LoopbackLink(host, "test")
+	if err != nil {
+		t.Fatalf("LoopbackLink failed: %v", err)
+	}
+	b, err := LoopbackLink(host, "test")
+	if err != nil {
+		t.Fatalf("LoopbackLink failed: %v", err)
+	}
+	if _, err := LoopbackLink(host, "test"); err == nil {
+		t.Error("Expected an error for a third end")
+	}
+	if _, err := LoopbackLink(devices.NewHost(), "test"); err != nil {
+		t.Errorf("Expected links scoped to their machine, got %v", err)
+	}
+	b.Send(netFrame)
+	if frame, _ := a.Receive(); !bytes.Equal(frame, netFrame) {
+		t.Errorf("Expected the frame on the other end, got %v", frame)
+	}
+}
+
+func TestUnixgramBackend(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "a.sock")
+	second := filepath.Join(dir, "b.sock")
+	a, err := NewUnixgramBackend(first, second)
+	if err != nil {
+		t.Fatalf("NewUnixgramBackend failed: %v", err)
+	}
+	defer a.Close()
+	b, err := NewUnixgramBackend(second, first)
+	if err != nil {
+		t.Fatalf("NewUnixgramBackend failed: %v", err)
+	}
+	defer b.Close()
+
+	if err := a.Send(netFrame); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if frame, _ := b.Receive(); frame != nil {
+			if !bytes.Equal(frame, netFrame) {
+				t.Errorf("Expected frame %v, got %v", netFrame, frame)
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for the frame")
+}
+
+func TestPcapBackend(t *testing.T) {
+	var capture bytes.Buffer
+	a, b := NewLoopbackPair()
+	p, err := NewPcapBackend(a, &capture)
+	if err != nil {
+		t.Fatalf("NewPcapBackend failed: %v", err)
+	}
+	p.now = func() time.Time { return time.Unix(100, 5000) }
+	p.Send(netFrame)
+	b.Send(netFrame[:6])
+	if frame, _ := p.Receive(); len(frame) != 6 {
+		t.Errorf("Expected the received frame, got %v", frame)
+	}
+
+	data := capture.Bytes()
+	if len(data) != 24+16+len(netFrame)+16+6 {
+		t.Fatalf("Unexpected capture of %d bytes", len(data))
+	}
+	if binary.LittleEndian.Uint32(data) != 0xA1B2C3D4 ||
+		binary.LittleEndian.Uint32(data[20:]) != 1 {
+		t.Errorf("Unexpected pcap header %v", data[:24])
+	}
+	record := data[24:]
+	if binary.LittleEndian.Uint32(record) != 100 ||
+		binary.LittleEndian.Uint32(record[4:]) != 5 ||
+		binary.LittleEndian.Uint32(record[8:]) != uint32(len(netFrame)) ||
+		!bytes.Equal(record[16:16+len(netFrame)], netFrame) {
+		t.Errorf("Unexpected record %v", record[:16+len(netFrame)])
+	}
+}
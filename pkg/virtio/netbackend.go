@@ -0,0 +1,213 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+// maxQueuedFrames bounds the frames a backend holds for the guest. Further
+// frames are dropped, as a full receive ring of a real adapter would.
+const maxQueuedFrames = 1024
+
+// frameQueue is a queue of frames filled by the host and drained by the
+// device.
+type frameQueue struct {
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+// push appends a copy of a frame, dropping it if the queue is full.
+func (q *frameQueue) push(frame []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.frames) < maxQueuedFrames {
+		q.frames = append(q.frames, append([]byte(nil), frame...))
+	}
+}
+
+// pop removes the first frame, or returns nil if there is none.
+func (q *frameQueue) pop() []byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.frames) == 0 {
+		return nil
+	}
+	frame := q.frames[0]
+	q.frames = q.frames[1:]
+	return frame
+}
+
+// LoopbackBackend is one end of a virtual cable. Frames sent on one end are
+// received on the other.
+type LoopbackBackend struct {
+	queue frameQueue
+	peer  *LoopbackBackend
+}
+
+// NewLoopbackPair returns the two ends of a virtual cable, e.g. to connect
+// the virtio-net devices of two Systems in one process.
+func NewLoopbackPair() (*LoopbackBackend, *LoopbackBackend) {
+	a, b := &LoopbackBackend{}, &LoopbackBackend{}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (l *LoopbackBackend) Send(frame []byte) error {
+	l.peer.queue.push(frame)
+	return nil
+}
+
+func (l *LoopbackBackend) Receive() ([]byte, error) {
+	return l.queue.pop(), nil
+}
+
+// loopbackLink is a named virtual cable of a machine.
+type loopbackLink struct {
+	mu   sync.Mutex
+	ends []*LoopbackBackend // Ends not taken yet
+}
+
+// LoopbackLink returns an end of the virtual cable with the given name
+// among the devices of a machine. The first call for a name returns one end
+// and the second one the other end, so two devices of the machine with the
+// same link are connected.
+func LoopbackLink(host *devices.Host, name string) (*LoopbackBackend, error) {
+	if host == nil {
+		return nil, fmt.Errorf("loopback link %q needs a machine", name)
+	}
+	link := host.Shared("loopback:"+name, func() any {
+		a, b := NewLoopbackPair()
+		return &loopbackLink{ends: []*LoopbackBackend{a, b}}
+	}).(*loopbackLink)
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if len(link.ends) == 0 {
+		return nil, fmt.Errorf("loopback link %q already has two ends", name)
+	}
+	end := link.ends[0]
+	link.ends = link.ends[1:]
+	return end, nil
+}
+
+// UnixgramBackend exchanges frames as datagrams of a Unix socket, one frame
+// per datagram.
+type UnixgramBackend struct {
+	conn  *net.UnixConn
+	local string
+	peer  *net.UnixAddr
+	queue frameQueue
+}
+
+// NewUnixgramBackend binds a Unix datagram socket to the path local and
+// sends frames to the socket at the path peer. Received frames are queued
+// by a goroutine.
+func NewUnixgramBackend(local, peer string) (*UnixgramBackend, error) {
+	if local == "" || peer == "" {
+		return nil, fmt.Errorf("unixgram backend needs a socket and a peer")
+	}
+	os.Remove(local)
+	conn, err := net.ListenUnixgram("unixgram",
+		&net.UnixAddr{Name: local, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind network socket: %v", err)
+	}
+	u := &UnixgramBackend{conn: conn, local: local,
+		peer: &net.UnixAddr{Name: peer, Net: "unixgram"}}
+	go u.receive()
+	return u, nil
+}
+
+// receive queues the datagrams of the socket until it is closed.
+func (u *UnixgramBackend) receive() {
+	buffer := make([]byte, 65536)
+	for {
+		n, _, err := u.conn.ReadFromUnix(buffer)
+		if err != nil {
+			return
+		}
+		u.queue.push(buffer[:n])
+	}
+}
+
+func (u *UnixgramBackend) Send(frame []byte) error {
+	_, err := u.conn.WriteToUnix(frame, u.peer)
+	return err
+}
+
+func (u *UnixgramBackend) Receive() ([]byte, error) {
+	return u.queue.pop(), nil
+}
+
+// Close closes the socket and removes it.
+func (u *UnixgramBackend) Close() error {
+	err := u.conn.Close()
+	os.Remove(u.local)
+	return err
+}
+
+// PcapBackend writes every frame in both directions to a pcap capture file,
+// e.g. for Wireshark, and passes them on to another backend.
+type PcapBackend struct {
+	backend NetBackend
+	mu      sync.Mutex
+	w       io.Writer
+	now     func() time.Time
+}
+
+// NewPcapBackend writes the pcap header to w and returns a backend capturing
+// the frames of backend. Without a backend, sent frames are only captured
+// and no frames are received.
+func NewPcapBackend(backend NetBackend, w io.Writer) (*PcapBackend, error) {
+	var header [24]byte
+	binary.LittleEndian.PutUint32(header[0:], 0xA1B2C3D4)
+	binary.LittleEndian.PutUint16(header[4:], 2) // Version 2.4
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535) // Snapshot length
+	binary.LittleEndian.PutUint32(header[20:], 1)     // LINKTYPE_ETHERNET
+	if _, err := w.Write(header[:]); err != nil {
+		return nil, fmt.Errorf("failed to write pcap header: %v", err)
+	}
+	return &PcapBackend{backend: backend, w: w, now: time.Now}, nil
+}
+
+// capture writes a frame record.
+func (p *PcapBackend) capture(frame []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	var header [16]byte
+	binary.LittleEndian.PutUint32(header[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(header[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(frame)))
+	if _, err := p.w.Write(append(header[:], frame...)); err != nil {
+		slog.Warn("Failed to write pcap record", "error", err)
+	}
+}
+
+func (p *PcapBackend) Send(frame []byte) error {
+	p.capture(frame)
+	if p.backend == nil {
+		return nil
+	}
+	return p.backend.Send(frame)
+}
+
+func (p *PcapBackend) Receive() ([]byte, error) {
+	if p.backend == nil {
+		return nil, nil
+	}
+	frame, err := p.backend.Receive()
+	if frame != nil {
+		p.capture(frame)
+	}
+	return frame, err
+}
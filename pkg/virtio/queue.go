@@ -0,0 +1,228 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Flags of virtqueue descriptors.
+const (
+	descriptorNext  = 1
+	descriptorWrite = 2
+)
+
+// descriptorSize is the size of a descriptor in the descriptor table.
+const descriptorSize = 16
+
+// MaxChainSize limits the total length of the buffers of a descriptor
+// chain, so that a driver cannot make the device allocate host memory of
+// any size.
+const MaxChainSize = 1 << 24
+
+// Queue is a split virtqueue. The driver makes descriptor chains available
+// in the driver area and the device returns them in the device area.
+type Queue struct {
+	transport *Transport
+	index     int
+
+	size   uint32 // Number of descriptors set by the driver
+	ready  bool
+	desc   uint64 // Address of the descriptor table
+	driver uint64 // Address of the driver area (available ring)
+	device uint64 // Address of the device area (used ring)
+
+	lastAvail uint16 // Index of the next available entry to pop
+	used      uint16 // Index of the next used entry to push
+}
+
+// Index returns the index of the queue in its device.
+func (q *Queue) Index() int {
+	return q.index
+}
+
+// Ready reports whether the driver has set up the queue.
+func (q *Queue) Ready() bool {
+	return q.ready
+}
+
+// reset returns the queue to its state before the driver set it up.
+func (q *Queue) reset() {
+	*q = Queue{transport: q.transport, index: q.index}
+}
+
+// address checks that a guest address of the queue lies in the 32-bit
+// address space.
+func address(value uint64) (uint32, error) {
+	if value>>32 != 0 {
+		return 0, fmt.Errorf("address %X beyond the 32-bit address space", value)
+	}
+	return uint32(value), nil
+}
+
+// readUint16 reads a little-endian 16-bit value at an offset of a queue
+// area.
+func (q *Queue) readUint16(area uint64, offset uint32) (uint16, error) {
+	base, err := address(area)
+	if err != nil {
+		return 0, err
+	}
+	data, err := q.transport.readMemory(base+offset, 2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(data), nil
+}
+
+// Pop returns the next descriptor chain made available by the driver, or
+// nil if there is none.
+func (q *Queue) Pop() (*Chain, error) {
+	if !q.ready {
+		return nil, fmt.Errorf("queue %d is not ready", q.index)
+	}
+	available, err := q.readUint16(q.driver, 2)
+	if err != nil {
+		return nil, err
+	}
+	if available == q.lastAvail {
+		return nil, nil
+	}
+	head, err := q.readUint16(q.driver, 4+2*(uint32(q.lastAvail)%q.size))
+	if err != nil {
+		return nil, err
+	}
+	q.lastAvail++
+
+	chain := &Chain{queue: q, head: head}
+	var total uint64
+	index := head
+	for range q.size {
+		if uint32(index) >= q.size {
+			return nil, fmt.Errorf("descriptor %d out of range of queue %d",
+				index, q.index)
+		}
+		base, err := address(q.desc)
+		if err != nil {
+			return nil, err
+		}
+		data, err := q.transport.readMemory(base+descriptorSize*uint32(index),
+			descriptorSize)
+		if err != nil {
+			return nil, err
+		}
+		bufferAddress, err := address(binary.LittleEndian.Uint64(data))
+		if err != nil {
+			return nil, err
+		}
+		b := buffer{address: bufferAddress,
+			length: binary.LittleEndian.Uint32(data[8:])}
+		total += uint64(b.length)
+		if total > MaxChainSize {
+			return nil, fmt.Errorf("descriptor chain of queue %d exceeds %d bytes",
+				q.index, MaxChainSize)
+		}
+		flags := binary.LittleEndian.Uint16(data[12:])
+		if flags&descriptorWrite != 0 {
+			chain.writable = append(chain.writable, b)
+			chain.writableSize += b.length
+		} else if len(chain.writable) > 0 {
+			return nil, fmt.Errorf("readable descriptor %d after writable ones",
+				index)
+		} else {
+			chain.readable = append(chain.readable, b)
+			chain.readableSize += b.length
+		}
+		if flags&descriptorNext == 0 {
+			return chain, nil
+		}
+		index = binary.LittleEndian.Uint16(data[14:])
+	}
+	return nil, fmt.Errorf("descriptor chain of queue %d has a loop", q.index)
+}
+
+// Push returns a descriptor chain to the driver, with the number of bytes
+// written into its writable buffers, and interrupts the driver.
+func (q *Queue) Push(chain *Chain, written uint32) error {
+	base, err := address(q.device)
+	if err != nil {
+		return err
+	}
+	element := binary.LittleEndian.AppendUint32(nil, uint32(chain.head))
+	element = binary.LittleEndian.AppendUint32(element, written)
+	err = q.transport.writeMemory(base+4+8*(uint32(q.used)%q.size), element)
+	if err != nil {
+		return err
+	}
+	q.used++
+	err = q.transport.writeMemory(base+2,
+		binary.LittleEndian.AppendUint16(nil, q.used))
+	if err != nil {
+		return err
+	}
+	q.transport.interrupt(interruptUsedBuffer)
+	return nil
+}
+
+// buffer is a buffer of a descriptor chain in guest memory.
+type buffer struct {
+	address uint32
+	length  uint32
+}
+
+// Chain is a descriptor chain popped from a queue: buffers the device
+// reads followed by buffers it writes, of at most MaxChainSize bytes.
+type Chain struct {
+	queue    *Queue
+	head     uint16
+	readable []buffer
+	writable []buffer
+
+	readableSize, writableSize uint32
+}
+
+// ReadableSize returns the total size of the readable buffers.
+func (c *Chain) ReadableSize() uint32 {
+	return c.readableSize
+}
+
+// WritableSize returns the total size of the writable buffers.
+func (c *Chain) WritableSize() uint32 {
+	return c.writableSize
+}
+
+// Read returns the contents of the readable buffers.
+func (c *Chain) Read() ([]byte, error) {
+	var data []byte
+	for _, b := range c.readable {
+		contents, err := c.queue.transport.readMemory(b.address, b.length)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, contents...)
+	}
+	return data, nil
+}
+
+// WriteAt writes data into the writable buffers, at an offset into them
+// as if they were one. Data beyond the end of the buffers is an error.
+func (c *Chain) WriteAt(data []byte, offset uint32) error {
+	if uint64(offset)+uint64(len(data)) > uint64(c.WritableSize()) {
+		return fmt.Errorf("%d bytes at %d exceed writable buffers of %d bytes",
+			len(data), offset, c.WritableSize())
+	}
+	for _, b := range c.writable {
+		if len(data) == 0 {
+			break
+		}
+		if offset >= b.length {
+			offset -= b.length
+			continue
+		}
+		n := min(uint32(len(data)), b.length-offset)
+		err := c.queue.transport.writeMemory(b.address+offset, data[:n])
+		if err != nil {
+			return err
+		}
+		data, offset = data[n:], 0
+	}
+	return nil
+}
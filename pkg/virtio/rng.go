@@ -0,0 +1,128 @@
+package virtio
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+func init() {
+	devices.Register("virtio-rng", func(baseAddress, size uint32, params json.RawMessage) (devices.BusDevice, error) {
+		var p struct {
+			transportParams
+			Seed *uint64 `json:"seed"` // Seed of a deterministic source
+		}
+		if err := devices.DecodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		rng := NewRNG()
+		if p.Seed != nil {
+			rng = NewSeededRNG(*p.Seed)
+		}
+		if size == 0 {
+			size = TransportSize
+		}
+		t := NewTransport(rng, p.IRQ)
+		t.Initialize(baseAddress, size)
+		return t, nil
+	})
+}
+
+// RNG is a virtio-rng device, an entropy source for the guest.
+type RNG struct {
+	source io.Reader
+	seeded *mathrand.ChaCha8 // Deterministic source, or nil
+}
+
+// NewRNG returns a virtio-rng device reading from crypto/rand.
+func NewRNG() *RNG {
+	return &RNG{source: rand.Reader}
+}
+
+// NewSeededRNG returns a virtio-rng device with a deterministic source, so
+// that runs with the same seed see the same random numbers. Its state is
+// part of snapshots.
+func NewSeededRNG(seed uint64) *RNG {
+	var key [32]byte
+	binary.LittleEndian.PutUint64(key[:], seed)
+	seeded := mathrand.NewChaCha8(key)
+	return &RNG{source: seeded, seeded: seeded}
+}
+
+func (r *RNG) DeviceID() uint32 {
+	return DeviceIDRNG
+}
+
+func (r *RNG) Features() uint64 {
+	return 0
+}
+
+func (r *RNG) Queues() int {
+	return 1
+}
+
+// ReadConfig returns 0, as virtio-rng has no configuration space.
+func (r *RNG) ReadConfig(offset uint32) byte {
+	return 0
+}
+
+func (r *RNG) WriteConfig(offset uint32, value byte) {
+}
+
+func (r *RNG) Reset() {
+}
+
+// rngMaxFill is the number of random bytes returned in a chain at most.
+const rngMaxFill = 1 << 16
+
+// Notify fills the buffers made available by the driver with random
+// bytes.
+func (r *RNG) Notify(t *Transport, queue int) error {
+	q := t.Queue(queue)
+	for {
+		chain, err := q.Pop()
+		if err != nil || chain == nil {
+			return err
+		}
+		// The device may fill fewer bytes than the buffers hold.
+		data := make([]byte, min(chain.WritableSize(), rngMaxFill))
+		if _, err := io.ReadFull(r.source, data); err != nil {
+			return fmt.Errorf("failed to read random bytes: %v", err)
+		}
+		if err := chain.WriteAt(data, 0); err != nil {
+			return err
+		}
+		if err := q.Push(chain, uint32(len(data))); err != nil {
+			return err
+		}
+	}
+}
+
+// SaveState writes the state of a deterministic source to w.
+func (r *RNG) SaveState(w io.Writer) error {
+	if r.seeded == nil {
+		return nil
+	}
+	state, err := r.seeded.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return writeBytes(w, state)
+}
+
+// LoadState restores the state of a deterministic source.
+func (r *RNG) LoadState(reader io.Reader) error {
+	if r.seeded == nil {
+		return nil
+	}
+	state, err := readBytes(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read RNG state: %v", err)
+	}
+	return r.seeded.UnmarshalBinary(state)
+}
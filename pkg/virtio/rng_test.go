@@ -0,0 +1,43 @@
+package virtio
+
+import (
+	"bytes"
+	"testing"
+)
+
+// rngRead reads 16 random bytes through the driver.
+func rngRead(d *testDriver) []byte {
+	d.t.Helper()
+	buffers, written := d.request(0, nil, []uint32{16})
+	if written != 16 {
+		d.t.Errorf("Expected 16 bytes, got %d", written)
+	}
+	return d.read(buffers[0].address, 16)
+}
+
+func TestRNG(t *testing.T) {
+	d := newTestDriver(t, NewRNG())
+	if bytes.Equal(rngRead(d), make([]byte, 16)) {
+		t.Error("Expected random bytes")
+	}
+}
+
+func TestRNG_Seeded(t *testing.T) {
+	first := newTestDriver(t, NewSeededRNG(42))
+	second := newTestDriver(t, NewSeededRNG(42))
+	if !bytes.Equal(rngRead(first), rngRead(second)) {
+		t.Error("Expected the same bytes with the same seed")
+	}
+
+	var state bytes.Buffer
+	if err := first.transport.SaveState(&state); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	expected := rngRead(first)
+	if err := second.transport.LoadState(&state); err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if actual := rngRead(second); !bytes.Equal(actual, expected) {
+		t.Error("Expected the restored source to continue the sequence")
+	}
+}
@@ -0,0 +1,91 @@
+// Package virtio implements virtio devices behind the virtio-mmio transport
+// (version 2) with split virtqueues. Importing it registers the device
+// types with the devices package, e.g. "virtio-blk".
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+// Device IDs of the virtio device types.
+const (
+	DeviceIDNet     = 1
+	DeviceIDBlock   = 2
+	DeviceIDConsole = 3
+	DeviceIDRNG     = 4
+	DeviceID9P      = 9
+	DeviceIDInput   = 18
+)
+
+// Feature bits independent of the device type.
+const (
+	FeatureVersion1 = 32 // Compliance with virtio 1.0 and later
+)
+
+// MaxQueueSize is the largest number of descriptors in a virtqueue.
+const MaxQueueSize = 256
+
+// Device is the device type specific part of a virtio device. Its methods
+// are called with the lock of the bus held, so they may access guest
+// memory through the queues.
+type Device interface {
+	// DeviceID returns the virtio device ID, e.g. DeviceIDBlock.
+	DeviceID() uint32
+	// Features returns the device type specific feature bits offered to
+	// the driver.
+	Features() uint64
+	// Queues returns the number of virtqueues.
+	Queues() int
+	// ReadConfig and WriteConfig access a byte of the configuration space.
+	ReadConfig(offset uint32) byte
+	WriteConfig(offset uint32, value byte)
+	// Notify is called when the driver made buffers available in a queue.
+	Notify(t *Transport, queue int) error
+	// Reset returns the device to its initial state.
+	Reset()
+	// SaveState and LoadState save and restore the state of the device for
+	// snapshots.
+	SaveState(w io.Writer) error
+	LoadState(r io.Reader) error
+}
+
+// PolledDevice is a Device with work arriving from the host, performed
+// when the bus is polled.
+type PolledDevice interface {
+	Device
+	Poll(t *Transport) error
+}
+
+// HostDevice is a Device using host resources, e.g. files or sockets,
+// which its transport opens and closes as a devices.HostDevice. Until Open,
+// the device only holds its parameters.
+type HostDevice interface {
+	Device
+	Open(host *devices.Host) error
+	Close() error
+}
+
+// writeBytes writes a byte slice preceded by its length for snapshots.
+func writeBytes(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readBytes reads a byte slice written by writeBytes. The slice grows as
+// it is read, so that a corrupt length fails at the end of the input.
+func readBytes(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	var data bytes.Buffer
+	_, err := io.CopyN(&data, r, int64(size))
+	return data.Bytes(), err
+}
@@ -0,0 +1,301 @@
+package virtio
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/Keisim/go-riscv-emu/pkg/devices"
+)
+
+const (
+	testRAM       = 0x80000000
+	testTransport = 0x10001000
+	testQueueSize = 8
+)
+
+// testDriver plays the virtio driver of a device in tests.
+type testDriver struct {
+	t         *testing.T
+	bus       *devices.Bus
+	transport *Transport
+	free      uint32 // Next unused RAM address
+	queues    []*testQueue
+}
+
+// testQueue is the driver side of a virtqueue.
+type testQueue struct {
+	desc, avail, used uint32
+	nextDesc          uint16
+	availIdx, usedIdx uint16
+}
+
+// newTestDriver sets up a device on a bus with RAM, negotiating all the
+// features it offers.
+func newTestDriver(t *testing.T, device Device) *testDriver {
+	t.Helper()
+	ram := &devices.RAMDevice{}
+	ram.Initialize(testRAM, 0x10000)
+	transport := NewTransport(device, 0)
+	transport.Initialize(testTransport, TransportSize)
+	bus := &devices.Bus{}
+	bus.AddDevice(ram)
+	bus.AddDevice(transport)
+	transport.ConnectBus(bus)
+
+	d := &testDriver{t: t, bus: bus, transport: transport, free: testRAM}
+	if d.readRegister(regMagic) != magic || d.readRegister(regVersion) != 2 ||
+		d.readRegister(regDeviceID) != device.DeviceID() {
+		t.Fatalf("Unexpected identification of the device")
+	}
+	d.writeRegister(regStatus, statusAcknowledge|statusDriver)
+	for i := range uint32(2) {
+		d.writeRegister(regDeviceFeaturesSel, i)
+		features := d.readRegister(regDeviceFeatures)
+		d.writeRegister(regDriverFeaturesSel, i)
+		d.writeRegister(regDriverFeatures, features)
+	}
+	d.writeRegister(regStatus, statusAcknowledge|statusDriver|statusFeaturesOK)
+	if d.readRegister(regStatus)&statusFeaturesOK == 0 {
+		t.Fatalf("Features not accepted")
+	}
+
+	for i := range device.Queues() {
+		q := &testQueue{
+			desc:  d.alloc(descriptorSize * testQueueSize),
+			avail: d.alloc(6 + 2*testQueueSize),
+			used:  d.alloc(6 + 8*testQueueSize),
+		}
+		d.queues = append(d.queues, q)
+		d.writeRegister(regQueueSel, uint32(i))
+		if d.readRegister(regQueueNumMax) != MaxQueueSize {
+			t.Fatalf("Unexpected maximum size of queue %d", i)
+		}
+		d.writeRegister(regQueueNum, testQueueSize)
+		d.writeRegister(regQueueDescLow, q.desc)
+		d.writeRegister(regQueueDriverLow, q.avail)
+		d.writeRegister(regQueueDeviceLow, q.used)
+		d.writeRegister(regQueueReady, 1)
+	}
+	d.writeRegister(regStatus, statusAcknowledge|statusDriver|
+		statusFeaturesOK|statusDriverOK)
+	return d
+}
+
+// alloc allocates 16-byte aligned RAM.
+func (d *testDriver) alloc(size uint32) uint32 {
+	address := d.free
+	d.free += (size + 15) &^ 15
+	return address
+}
+
+func (d *testDriver) readRegister(offset uint32) uint32 {
+	d.t.Helper()
+	return binary.LittleEndian.Uint32(d.read(testTransport+offset, 4))
+}
+
+func (d *testDriver) writeRegister(offset, value uint32) {
+	d.t.Helper()
+	d.write(testTransport+offset, binary.LittleEndian.AppendUint32(nil, value))
+}
+
+func (d *testDriver) read(address, size uint32) []byte {
+	d.t.Helper()
+	data := make([]byte, size)
+	for i := range data {
+		value, err := d.bus.Read(address + uint32(i))
+		if err != nil {
+			d.t.Fatalf("Read failed: %v", err)
+		}
+		data[i] = value
+	}
+	return data
+}
+
+func (d *testDriver) write(address uint32, data []byte) {
+	d.t.Helper()
+	for i, value := range data {
+		if err := d.bus.Write(address+uint32(i), value); err != nil {
+			d.t.Fatalf("Write failed: %v", err)
+		}
+	}
+}
+
+// testBuffer is a buffer of a chain submitted by the test driver.
+type testBuffer struct {
+	address uint32
+	size    uint32
+}
+
+// submit makes a chain of readable buffers with the given contents and
+// writable buffers of the given sizes available, without notifying the
+// device. It returns the writable buffers.
+func (d *testDriver) submit(queue int, readable [][]byte, writable []uint32) []testBuffer {
+	d.t.Helper()
+	q := d.queues[queue]
+	var buffers []testBuffer
+	head := q.nextDesc
+	count := len(readable) + len(writable)
+	for i := range count {
+		var b testBuffer
+		var flags uint16
+		if i < len(readable) {
+			b = testBuffer{d.alloc(uint32(len(readable[i]))), uint32(len(readable[i]))}
+			d.write(b.address, readable[i])
+		} else {
+			b = testBuffer{d.alloc(writable[i-len(readable)]), writable[i-len(readable)]}
+			flags |= descriptorWrite
+			buffers = append(buffers, b)
+		}
+		index := q.nextDesc
+		q.nextDesc = (q.nextDesc + 1) % testQueueSize
+		if i < count-1 {
+			flags |= descriptorNext
+		}
+		descriptor := binary.LittleEndian.AppendUint64(nil, uint64(b.address))
+		descriptor = binary.LittleEndian.AppendUint32(descriptor, b.size)
+		descriptor = binary.LittleEndian.AppendUint16(descriptor, flags)
+		descriptor = binary.LittleEndian.AppendUint16(descriptor, q.nextDesc)
+		d.write(q.desc+descriptorSize*uint32(index), descriptor)
+	}
+	d.write(q.avail+4+2*uint32(q.availIdx%testQueueSize),
+		binary.LittleEndian.AppendUint16(nil, head))
+	q.availIdx++
+	d.write(q.avail+2, binary.LittleEndian.AppendUint16(nil, q.availIdx))
+	return buffers
+}
+
+// request submits a chain, notifies the device and returns the writable
+// buffers and the number of bytes written to them.
+func (d *testDriver) request(queue int, readable [][]byte, writable []uint32) ([]testBuffer, uint32) {
+	d.t.Helper()
+	buffers := d.submit(queue, readable, writable)
+	d.writeRegister(regQueueNotify, uint32(queue))
+	written, ok := d.used(queue)
+	if !ok {
+		d.t.Fatalf("Request on queue %d not completed", queue)
+	}
+	return buffers, written
+}
+
+// used returns the number of bytes written to the next used chain of a
+// queue, if there is one.
+func (d *testDriver) used(queue int) (uint32, bool) {
+	d.t.Helper()
+	q := d.queues[queue]
+	index := binary.LittleEndian.Uint16(d.read(q.used+2, 2))
+	if index == q.usedIdx {
+		return 0, false
+	}
+	element := d.read(q.used+4+8*uint32(q.usedIdx%testQueueSize), 8)
+	q.usedIdx++
+	return binary.LittleEndian.Uint32(element[4:]), true
+}
+
+// nullDevice is a device with a single queue returning every chain
+// unchanged.
+type nullDevice struct {
+	resets int
+}
+
+func (n *nullDevice) DeviceID() uint32                      { return 0x42 }
+func (n *nullDevice) Features() uint64                      { return 1 }
+func (n *nullDevice) Queues() int                           { return 1 }
+func (n *nullDevice) ReadConfig(offset uint32) byte         { return byte(offset) }
+func (n *nullDevice) WriteConfig(offset uint32, value byte) {}
+func (n *nullDevice) Reset()                                { n.resets++ }
+func (n *nullDevice) SaveState(w io.Writer) error           { return nil }
+func (n *nullDevice) LoadState(r io.Reader) error           { return nil }
+
+func (n *nullDevice) Notify(t *Transport, queue int) error {
+	for {
+		chain, err := t.Queue(queue).Pop()
+		if err != nil || chain == nil {
+			return err
+		}
+		if err := t.Queue(queue).Push(chain, 0); err != nil {
+			return err
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	device := &nullDevice{}
+	d := newTestDriver(t, device)
+
+	if features := d.transport.Features(); features != 1|1<<FeatureVersion1 {
+		t.Errorf("Unexpected negotiated features %X", features)
+	}
+	if value, _ := d.bus.Read(testTransport + regConfig + 5); value != 5 {
+		t.Errorf("Expected config byte 5, got %d", value)
+	}
+
+	d.request(0, [][]byte{{1, 2}}, []uint32{4})
+	if status := d.readRegister(regInterruptStatus); status != interruptUsedBuffer {
+		t.Errorf("Expected a used buffer interrupt, got %X", status)
+	}
+	d.writeRegister(regInterruptACK, interruptUsedBuffer)
+	if status := d.readRegister(regInterruptStatus); status != 0 {
+		t.Errorf("Expected the interrupt acknowledged, got %X", status)
+	}
+
+	// Queue registers are read-only while the queue is ready.
+	d.writeRegister(regQueueNum, 4)
+	if size := d.readRegister(regQueueNum); size != testQueueSize {
+		t.Errorf("Expected queue size %d, got %d", testQueueSize, size)
+	}
+
+	d.writeRegister(regStatus, 0)
+	if d.readRegister(regStatus) != 0 || d.readRegister(regQueueReady) != 0 ||
+		device.resets != 1 {
+		t.Errorf("Expected the device reset")
+	}
+}
+
+func TestTransport_Errors(t *testing.T) {
+	d := newTestDriver(t, &nullDevice{})
+	d.writeRegister(regStatus, 0)
+
+	// Drivers without VIRTIO_F_VERSION_1 are rejected.
+	d.writeRegister(regStatus, statusAcknowledge|statusDriver)
+	d.writeRegister(regDriverFeatures, 1)
+	d.writeRegister(regStatus, statusAcknowledge|statusDriver|statusFeaturesOK)
+	if d.readRegister(regStatus)&statusFeaturesOK != 0 {
+		t.Error("Expected features without VIRTIO_F_VERSION_1 rejected")
+	}
+
+	d.writeRegister(regQueueNum, 3)
+	d.writeRegister(regQueueReady, 1)
+	if d.readRegister(regStatus)&statusNeedsReset == 0 ||
+		d.readRegister(regInterruptStatus)&interruptConfigChange == 0 {
+		t.Error("Expected an invalid queue size to need a reset")
+	}
+}
+
+func TestQueue_ChainTooLarge(t *testing.T) {
+	d := newTestDriver(t, &nullDevice{})
+	q := d.queues[0]
+	d.submit(0, [][]byte{{1}}, []uint32{1})
+	// The writable descriptor claims the whole address space.
+	d.write(q.desc+descriptorSize+8, binary.LittleEndian.AppendUint32(nil, 0xFFFFFFFF))
+	d.writeRegister(regQueueNotify, 0)
+
+	if _, ok := d.used(0); ok {
+		t.Error("Expected the oversized chain not to be used")
+	}
+	if d.readRegister(regStatus)&statusNeedsReset == 0 {
+		t.Error("Expected an oversized chain to need a reset")
+	}
+}
+
+func TestTransport_AsyncInput(t *testing.T) {
+	if NewTransport(NewSeededRNG(1), 0).AsyncInput() {
+		t.Error("Expected an RNG not to deliver host input on its own")
+	}
+	if !NewTransport(NewConsole(), 0).AsyncInput() {
+		t.Error("Expected a console to deliver host input on its own")
+	}
+	if !NewTransport(NewKeyboard(), 0).AsyncInput() {
+		t.Error("Expected a keyboard to deliver host input on its own")
+	}
+}
@@ -0,0 +1,60 @@
+package vnc
+
+// keysymCodes maps the X11 keysyms sent by VNC clients to Linux key codes.
+// Shifted characters map to the key they are typed with, as clients send
+// the shift key separately.
+var keysymCodes = map[uint32]uint16{
+	' ': 57, '\'': 40, '"': 40, ',': 51, '<': 51, '-': 12, '_': 12,
+	'.': 52, '>': 52, '/': 53, '?': 53, ';': 39, ':': 39, '=': 13, '+': 13,
+	'[': 26, '{': 26, '\\': 43, '|': 43, ']': 27, '}': 27, '`': 41, '~': 41,
+	'!': 2, '@': 3, '#': 4, '$': 5, '%': 6, '^': 7, '&': 8, '*': 9, '(': 10,
+	')': 11,
+
+	0xFF08: 14,  // BackSpace
+	0xFF09: 15,  // Tab
+	0xFF0D: 28,  // Return
+	0xFF1B: 1,   // Escape
+	0xFF50: 102, // Home
+	0xFF51: 105, // Left
+	0xFF52: 103, // Up
+	0xFF53: 106, // Right
+	0xFF54: 108, // Down
+	0xFF55: 104, // Page Up
+	0xFF56: 109, // Page Down
+	0xFF57: 107, // End
+	0xFF63: 110, // Insert
+	0xFF8D: 96,  // Keypad Enter
+	0xFFE1: 42,  // Left Shift
+	0xFFE2: 54,  // Right Shift
+	0xFFE3: 29,  // Left Control
+	0xFFE4: 97,  // Right Control
+	0xFFE5: 58,  // Caps Lock
+	0xFFE7: 125, // Left Meta
+	0xFFE8: 126, // Right Meta
+	0xFFE9: 56,  // Left Alt
+	0xFFEA: 100, // Right Alt
+	0xFFEB: 125, // Left Super
+	0xFFEC: 126, // Right Super
+	0xFFFF: 111, // Delete
+}
+
+func init() {
+	for i, code := range []uint16{30, 48, 46, 32, 18, 33, 34, 35, 23, 36, 37,
+		38, 50, 49, 24, 25, 16, 19, 31, 20, 22, 47, 17, 45, 21, 44} {
+		keysymCodes['a'+uint32(i)] = code
+		keysymCodes['A'+uint32(i)] = code
+	}
+	for i := range uint32(9) {
+		keysymCodes['1'+i] = uint16(2 + i)
+	}
+	keysymCodes['0'] = 11
+	for i, code := range []uint16{59, 60, 61, 62, 63, 64, 65, 66, 67, 68, 87, 88} {
+		keysymCodes[0xFFBE+uint32(i)] = code // F1 to F12
+	}
+}
+
+// KeyCode returns the Linux key code of an X11 keysym.
+func KeyCode(keysym uint32) (uint16, bool) {
+	code, ok := keysymCodes[keysym]
+	return code, ok
+}
@@ -0,0 +1,387 @@
+// Package vnc implements an RFB (VNC) server exporting the frames of a
+// framebuffer and forwarding the keyboard and pointer events of clients,
+// e.g. to virtio-input devices.
+package vnc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// Keyboard receives the key events of clients as Linux key codes.
+type Keyboard interface {
+	KeyEvent(code uint16, pressed bool)
+}
+
+// Pointer receives the pointer events of clients: the position on a
+// screen of width by height pixels and the buttons held down, bit 0 for
+// the left one, 1 for the middle one, 2 for the right one and 3 and 4 for
+// the wheel.
+type Pointer interface {
+	PointerEvent(x, y, width, height int, buttons uint8)
+}
+
+// Client messages of RFB.
+const (
+	msgSetPixelFormat           = 0
+	msgSetEncodings             = 2
+	msgFramebufferUpdateRequest = 3
+	msgKeyEvent                 = 4
+	msgPointerEvent             = 5
+	msgClientCutText            = 6
+)
+
+// maxCutText bounds the clipboard text accepted from clients.
+const maxCutText = 1 << 20
+
+// pixelFormat is an RFB pixel format. Only true colour is supported.
+type pixelFormat struct {
+	BitsPerPixel, Depth             uint8
+	BigEndian, TrueColour           uint8
+	RedMax, GreenMax, BlueMax       uint16
+	RedShift, GreenShift, BlueShift uint8
+	_                               [3]byte
+}
+
+// defaultFormat is the format offered by the server: 32 bits per pixel,
+// 0x00RRGGBB in little endian.
+var defaultFormat = pixelFormat{32, 24, 0, 1, 255, 255, 255, 16, 8, 0, [3]byte{}}
+
+// validate checks that the server can encode pixels in the format.
+func (f *pixelFormat) validate() error {
+	switch {
+	case f.TrueColour == 0:
+		return fmt.Errorf("colour maps are not supported")
+	case f.BitsPerPixel != 8 && f.BitsPerPixel != 16 && f.BitsPerPixel != 32:
+		return fmt.Errorf("unsupported pixel size of %d bits", f.BitsPerPixel)
+	}
+	return nil
+}
+
+// appendPixel appends an 8-bit RGB colour in the format.
+func (f *pixelFormat) appendPixel(b []byte, r, g, bl uint8) []byte {
+	value := (uint32(r)*uint32(f.RedMax)+127)/255<<f.RedShift |
+		(uint32(g)*uint32(f.GreenMax)+127)/255<<f.GreenShift |
+		(uint32(bl)*uint32(f.BlueMax)+127)/255<<f.BlueShift
+	var order binary.AppendByteOrder = binary.LittleEndian
+	if f.BigEndian != 0 {
+		order = binary.BigEndian
+	}
+	switch f.BitsPerPixel {
+	case 8:
+		return append(b, byte(value))
+	case 16:
+		return order.AppendUint16(b, uint16(value))
+	}
+	return order.AppendUint32(b, value)
+}
+
+// Server is an RFB server. Clients share the screen and see every frame
+// set with SetFrame.
+type Server struct {
+	name     string
+	keyboard Keyboard
+	pointer  Pointer
+
+	mu      sync.Mutex
+	changed *sync.Cond // Signals new frames, requests and closed clients
+	frame   *image.NRGBA
+}
+
+// NewServer returns a server named name showing frame until the next one is
+// set. Events of clients go to keyboard and pointer, which may be nil.
+func NewServer(name string, frame *image.NRGBA, keyboard Keyboard, pointer Pointer) *Server {
+	s := &Server{name: name, keyboard: keyboard, pointer: pointer, frame: frame}
+	s.changed = sync.NewCond(&s.mu)
+	return s
+}
+
+// SetFrame shows a new frame of the size of the first one. The image must
+// not be modified afterwards.
+func (s *Server) SetFrame(frame *image.NRGBA) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frame = frame
+	s.changed.Broadcast()
+}
+
+// Serve accepts connections and serves each of them in a goroutine until
+// the listener is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(conn); err != nil && !errors.Is(err, io.EOF) {
+				slog.Warn("VNC client failed", "address", conn.RemoteAddr(), "error", err)
+			}
+		}()
+	}
+}
+
+// client is the state of a connection shared by its reader and writer.
+type client struct {
+	format      pixelFormat
+	requested   bool // A framebuffer update was requested
+	incremental bool // Only changes are requested
+	area        image.Rectangle
+	closed      bool
+}
+
+// ServeConn serves a single connection until the client disconnects.
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if err := s.handshake(r, conn); err != nil {
+		return err
+	}
+
+	c := &client{format: defaultFormat}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.update(conn, c)
+	}()
+	err := s.receive(r, c)
+	s.mu.Lock()
+	c.closed = true
+	s.changed.Broadcast()
+	s.mu.Unlock()
+	conn.Close()
+	<-done
+	return err
+}
+
+// handshake performs the protocol version and security handshake without
+// authentication, which is why the emulator listens on localhost only, and
+// the initialization messages.
+func (s *Server) handshake(r io.Reader, w io.Writer) error {
+	if _, err := io.WriteString(w, "RFB 003.008\n"); err != nil {
+		return err
+	}
+	var version [12]byte
+	if _, err := io.ReadFull(r, version[:]); err != nil {
+		return err
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(version[:]), "RFB %03d.%03d\n", &major, &minor); err != nil || major != 3 {
+		return fmt.Errorf("unsupported protocol version %q", version)
+	}
+
+	if minor < 7 {
+		// Version 3.3 lets the server choose the security type.
+		if err := binary.Write(w, binary.BigEndian, uint32(1)); err != nil {
+			return err
+		}
+	} else {
+		if _, err := w.Write([]byte{1, 1}); err != nil { // Only None
+			return err
+		}
+		var security [1]byte
+		if _, err := io.ReadFull(r, security[:]); err != nil {
+			return err
+		}
+		if security[0] != 1 {
+			return fmt.Errorf("unsupported security type %d", security[0])
+		}
+		if minor >= 8 {
+			if err := binary.Write(w, binary.BigEndian, uint32(0)); err != nil {
+				return err
+			}
+		}
+	}
+
+	var shared [1]byte
+	if _, err := io.ReadFull(r, shared[:]); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	bounds := s.frame.Bounds()
+	s.mu.Unlock()
+	init := binary.BigEndian.AppendUint16(nil, uint16(bounds.Dx()))
+	init = binary.BigEndian.AppendUint16(init, uint16(bounds.Dy()))
+	init, _ = binary.Append(init, binary.BigEndian, defaultFormat)
+	init = binary.BigEndian.AppendUint32(init, uint32(len(s.name)))
+	_, err := w.Write(append(init, s.name...))
+	return err
+}
+
+// receive handles the messages of a client until it disconnects.
+func (s *Server) receive(r io.Reader, c *client) error {
+	for {
+		var kind [1]byte
+		if _, err := io.ReadFull(r, kind[:]); err != nil {
+			return err
+		}
+		switch kind[0] {
+		case msgSetPixelFormat:
+			var message struct {
+				_      [3]byte
+				Format pixelFormat
+			}
+			if err := binary.Read(r, binary.BigEndian, &message); err != nil {
+				return err
+			}
+			if err := message.Format.validate(); err != nil {
+				return err
+			}
+			s.mu.Lock()
+			c.format = message.Format
+			s.mu.Unlock()
+		case msgSetEncodings:
+			// Raw encoding is always supported and the only one used.
+			var message struct {
+				_     byte
+				Count uint16
+			}
+			if err := binary.Read(r, binary.BigEndian, &message); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(io.Discard, r, 4*int64(message.Count)); err != nil {
+				return err
+			}
+		case msgFramebufferUpdateRequest:
+			var message struct {
+				Incremental         uint8
+				X, Y, Width, Height uint16
+			}
+			if err := binary.Read(r, binary.BigEndian, &message); err != nil {
+				return err
+			}
+			s.mu.Lock()
+			c.requested = true
+			c.incremental = message.Incremental != 0
+			c.area = image.Rect(int(message.X), int(message.Y),
+				int(message.X)+int(message.Width), int(message.Y)+int(message.Height))
+			s.changed.Broadcast()
+			s.mu.Unlock()
+		case msgKeyEvent:
+			var message struct {
+				Down   uint8
+				_      [2]byte
+				Keysym uint32
+			}
+			if err := binary.Read(r, binary.BigEndian, &message); err != nil {
+				return err
+			}
+			if code, ok := KeyCode(message.Keysym); ok && s.keyboard != nil {
+				s.keyboard.KeyEvent(code, message.Down != 0)
+			}
+		case msgPointerEvent:
+			var message struct {
+				Buttons uint8
+				X, Y    uint16
+			}
+			if err := binary.Read(r, binary.BigEndian, &message); err != nil {
+				return err
+			}
+			if s.pointer != nil {
+				s.mu.Lock()
+				bounds := s.frame.Bounds()
+				s.mu.Unlock()
+				s.pointer.PointerEvent(int(message.X), int(message.Y),
+					bounds.Dx(), bounds.Dy(), message.Buttons)
+			}
+		case msgClientCutText:
+			var message struct {
+				_      [3]byte
+				Length uint32
+			}
+			if err := binary.Read(r, binary.BigEndian, &message); err != nil {
+				return err
+			}
+			if message.Length > maxCutText {
+				return fmt.Errorf("clipboard text of %d bytes", message.Length)
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(message.Length)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown message type %d", kind[0])
+		}
+	}
+}
+
+// update sends framebuffer updates when requested. Incremental requests
+// wait for a frame differing from the last one sent and get the bounding
+// box of the changes.
+func (s *Server) update(w io.Writer, c *client) error {
+	var sent *image.NRGBA
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for !c.closed && (!c.requested || c.incremental && s.frame == sent) {
+			s.changed.Wait()
+		}
+		if c.closed {
+			return nil
+		}
+		frame, format, area := s.frame, c.format, c.area.Intersect(s.frame.Bounds())
+		if c.incremental {
+			area = changes(sent, frame).Intersect(area)
+		}
+		sent = frame
+		if c.incremental && area.Empty() {
+			continue // Keep waiting for a visible change
+		}
+		c.requested = false
+		s.mu.Unlock()
+		err := writeUpdate(w, frame, area, &format)
+		s.mu.Lock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// changes returns the bounding box of the pixels differing between two
+// frames of the same size.
+func changes(old, new *image.NRGBA) image.Rectangle {
+	if old == nil || old.Bounds() != new.Bounds() {
+		return new.Bounds()
+	}
+	var box image.Rectangle
+	bounds := new.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		oldRow := old.Pix[old.PixOffset(bounds.Min.X, y):old.PixOffset(bounds.Max.X, y)]
+		newRow := new.Pix[new.PixOffset(bounds.Min.X, y):new.PixOffset(bounds.Max.X, y)]
+		for x := 0; x < len(newRow); x += 4 {
+			if [4]byte(oldRow[x:]) != [4]byte(newRow[x:]) {
+				box = box.Union(image.Rect(bounds.Min.X+x/4, y, bounds.Min.X+x/4+1, y+1))
+			}
+		}
+	}
+	return box
+}
+
+// writeUpdate sends a FramebufferUpdate message with an area of a frame in
+// raw encoding, or without rectangles for an empty area.
+func writeUpdate(w io.Writer, frame *image.NRGBA, area image.Rectangle, format *pixelFormat) error {
+	message := []byte{0, 0}
+	if area.Empty() {
+		message = binary.BigEndian.AppendUint16(message, 0)
+		_, err := w.Write(message)
+		return err
+	}
+	message = binary.BigEndian.AppendUint16(message, 1)
+	for _, value := range []int{area.Min.X, area.Min.Y, area.Dx(), area.Dy()} {
+		message = binary.BigEndian.AppendUint16(message, uint16(value))
+	}
+	message = binary.BigEndian.AppendUint32(message, 0) // Raw encoding
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			pixel := frame.Pix[frame.PixOffset(x, y):]
+			message = format.appendPixel(message, pixel[0], pixel[1], pixel[2])
+		}
+	}
+	_, err := w.Write(message)
+	return err
+}
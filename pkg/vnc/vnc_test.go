@@ -0,0 +1,160 @@
+package vnc
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// recorder records the input events of clients.
+type recorder struct {
+	mu     sync.Mutex
+	keys   []uint16
+	points [][5]int
+}
+
+func (r *recorder) KeyEvent(code uint16, pressed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if pressed {
+		r.keys = append(r.keys, code)
+	}
+}
+
+func (r *recorder) PointerEvent(x, y, width, height int, buttons uint8) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.points = append(r.points, [5]int{x, y, width, height, int(buttons)})
+}
+
+// testClient is the client side of a connection to a server.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (c *testClient) read(size int) []byte {
+	c.t.Helper()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.conn, data); err != nil {
+		c.t.Fatalf("Read failed: %v", err)
+	}
+	return data
+}
+
+func (c *testClient) write(data ...byte) {
+	c.t.Helper()
+	if _, err := c.conn.Write(data); err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+}
+
+// connect performs the handshake of RFB 3.8 and returns the name of the
+// server.
+func connect(t *testing.T, s *Server) *testClient {
+	server, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- s.ServeConn(server) }()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	c := &testClient{t, conn}
+	if version := c.read(12); string(version) != "RFB 003.008\n" {
+		t.Fatalf("Unexpected version %q", version)
+	}
+	c.write([]byte("RFB 003.008\n")...)
+	if security := c.read(2); security[0] != 1 || security[1] != 1 {
+		t.Fatalf("Unexpected security types %v", security)
+	}
+	c.write(1)
+	if result := c.read(4); binary.BigEndian.Uint32(result) != 0 {
+		t.Fatalf("Unexpected security result %v", result)
+	}
+	c.write(1) // Shared
+	init := c.read(24)
+	if width, height := binary.BigEndian.Uint16(init), binary.BigEndian.Uint16(init[2:]); width != 4 || height != 2 {
+		t.Errorf("Unexpected size %dx%d", width, height)
+	}
+	if name := c.read(int(binary.BigEndian.Uint32(init[20:]))); string(name) != "test" {
+		t.Errorf("Unexpected name %q", name)
+	}
+	return c
+}
+
+// readUpdate reads a FramebufferUpdate with a rectangle of pixels of size
+// bytes each.
+func (c *testClient) readUpdate(size int) (image.Rectangle, []byte) {
+	c.t.Helper()
+	header := c.read(4)
+	if header[0] != 0 || binary.BigEndian.Uint16(header[2:]) != 1 {
+		c.t.Fatalf("Unexpected update header %v", header)
+	}
+	rect := c.read(12)
+	x, y := int(binary.BigEndian.Uint16(rect)), int(binary.BigEndian.Uint16(rect[2:]))
+	w, h := int(binary.BigEndian.Uint16(rect[4:])), int(binary.BigEndian.Uint16(rect[6:]))
+	return image.Rect(x, y, x+w, y+h), c.read(w * h * size)
+}
+
+func TestServer(t *testing.T) {
+	frame := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	frame.SetNRGBA(1, 0, color.NRGBA{0x12, 0x34, 0x56, 0xFF})
+	input := &recorder{}
+	s := NewServer("test", frame, input, input)
+	c := connect(t, s)
+
+	c.write(msgFramebufferUpdateRequest, 0, 0, 0, 0, 0, 0, 4, 0, 2)
+	rect, pixels := c.readUpdate(4)
+	if rect != frame.Bounds() {
+		t.Errorf("Expected the whole frame, got %v", rect)
+	}
+	if pixel := binary.LittleEndian.Uint32(pixels[4:]); pixel != 0x123456 {
+		t.Errorf("Expected pixel 0x123456, got %X", pixel)
+	}
+
+	// 16 bits per pixel, RGB565 in big endian.
+	c.write(msgSetPixelFormat, 0, 0, 0, 16, 16, 1, 1, 0, 31, 0, 63, 0, 31, 11, 5, 0, 0, 0, 0)
+	c.write(msgFramebufferUpdateRequest, 1, 0, 0, 0, 0, 0, 4, 0, 2)
+	next := image.NewNRGBA(frame.Bounds())
+	copy(next.Pix, frame.Pix)
+	next.SetNRGBA(3, 1, color.NRGBA{0xFF, 0, 0, 0xFF})
+	s.SetFrame(next)
+	rect, pixels = c.readUpdate(2)
+	if rect != image.Rect(3, 1, 4, 2) {
+		t.Errorf("Expected only the changed pixel, got %v", rect)
+	}
+	if pixel := binary.BigEndian.Uint16(pixels); pixel != 0xF800 {
+		t.Errorf("Expected red pixel F800, got %X", pixel)
+	}
+
+	c.write(msgKeyEvent, 1, 0, 0, 0, 0, 0, 'A')
+	c.write(msgKeyEvent, 1, 0, 0, 0, 0, 0xFF, 0x0D)
+	c.write(msgPointerEvent, 1, 0, 3, 0, 1)
+	c.write(msgFramebufferUpdateRequest, 0, 0, 0, 0, 0, 0, 1, 0, 1)
+	c.readUpdate(2) // Ensures that the events were handled
+	input.mu.Lock()
+	defer input.mu.Unlock()
+	if len(input.keys) != 2 || input.keys[0] != 30 || input.keys[1] != 28 {
+		t.Errorf("Expected KEY_A and KEY_ENTER, got %v", input.keys)
+	}
+	if len(input.points) != 1 || input.points[0] != [5]int{3, 1, 4, 2, 1} {
+		t.Errorf("Unexpected pointer events %v", input.points)
+	}
+}
+
+func TestServer_Version33(t *testing.T) {
+	s := NewServer("test", image.NewNRGBA(image.Rect(0, 0, 4, 2)), nil, nil)
+	server, conn := net.Pipe()
+	defer conn.Close()
+	go s.ServeConn(server)
+	c := &testClient{t, conn}
+	c.read(12)
+	c.write([]byte("RFB 003.003\n")...)
+	if security := c.read(4); binary.BigEndian.Uint32(security) != 1 {
+		t.Errorf("Expected security type None, got %v", security)
+	}
+}